@@ -20,6 +20,14 @@ func main() {
 	r := chi.NewRouter()
 
 	r.Post("/api/snapshots", api.PostSnapshotHandler)
+	r.Post("/api/snapshots/upload-url", api.PostSnapshotUploadURLHandler) // signed upload URL for <relay_id>/<timestamp>.jpg
+	r.Post("/api/snapshots/batch", api.PostSnapshotBatchHandler)          // device token, register many uploaded snapshots with per-item results
+
+	r.Options("/api/clips/uploads", api.ClipUploadOptionsHandler)  // tus capabilities
+	r.Post("/api/clips/uploads", api.PostClipUploadHandler)        // device token, start a resumable upload
+	r.Head("/api/clips/uploads/{id}", api.HeadClipUploadHandler)   // device token, current Upload-Offset
+	r.Patch("/api/clips/uploads/{id}", api.PatchClipUploadHandler) // device token, append at Upload-Offset
+	r.Post("/api/clips", api.PostClipHandler)                      // device token, register a finished upload as a clip
 
 	r.Post("/api/egg-detections/run", api.PostEggDetectionsRunHandler)
 	r.Post("/api/internal/snapshot-created", api.PostSnapshotCreatedHandler)
@@ -30,9 +38,32 @@ func main() {
 		r.Post("/status", api.PostRelayStatusHandler)    // POST /api/relay/status
 		r.Get("/status/read", api.GetRelayStatusHandler) // GET /api/relay/status/read?relay_id=xxx
 		r.Get("/snapshots", api.GetRelaySnapshotsHandler) // GET /api/relay/snapshots?relay_id=xxx (placeholder)
+		r.Get("/clips", api.GetRelayClipsHandler)         // GET /api/relay/clips?relay_id=xxx (user JWT, clips with stream URLs)
+		r.Get("/cameras", api.GetRelayCamerasHandler)       // GET /api/relay/cameras?relay_id=xxx (user JWT)
+		r.Post("/cameras", api.PostRelayCameraHandler)      // POST /api/relay/cameras (user JWT, create or update)
+		r.Delete("/cameras", api.DeleteRelayCameraHandler)  // DELETE /api/relay/cameras?relay_id=xxx&camera_id=yyy (user JWT)
 		r.Post("/request_pairing_code", api.RequestRelayPairingCodeHandler)
 		r.Post("/claim", api.ClaimRelayHandler) // POST /api/relay/claim
-		// r.Get("/pairing", api.GetRelayPairingStatusHandler) // GET /api/relay/pairing?code=xxxx - Activate if needed
+		r.Post("/token", api.PostRelayTokenHandler)               // POST /api/relay/token (pairing secret -> device token)
+		r.Post("/token/rotate", api.PostRelayTokenRotateHandler)  // POST /api/relay/token/rotate (device token)
+		r.Post("/token/revoke", api.PostRelayTokenRevokeHandler)  // POST /api/relay/token/revoke (user JWT)
+		r.Get("/pairing", api.GetRelayPairingStatusHandler) // GET /api/relay/pairing?code=xxxx (polled by `relay pair`)
+		r.Post("/commands", api.PostRelayCommandHandler)              // POST /api/relay/commands (user JWT, queue a command)
+		r.Get("/commands", api.GetRelayCommandsHandler)               // GET /api/relay/commands?relay_id=xxx (user JWT, recent commands and results)
+		r.Get("/commands/poll", api.GetRelayCommandsPollHandler)      // GET /api/relay/commands/poll?wait=25 (device token, long-poll)
+		r.Post("/commands/ack", api.PostRelayCommandAckHandler)       // POST /api/relay/commands/ack (device token)
+		r.Post("/commands/result", api.PostRelayCommandResultHandler) // POST /api/relay/commands/result (device token)
+		r.Get("/update", api.GetRelayUpdateHandler)                     // GET /api/relay/update?version=&os=&arch= (device token, signed release offer)
+		r.Post("/releases", api.PostRelayReleaseHandler)                // POST /api/relay/releases (release admin token, publish a signed manifest)
+		r.Get("/releases", api.GetRelayReleasesHandler)                 // GET /api/relay/releases (release admin token)
+		r.Post("/releases/rollout", api.PostRelayReleaseRolloutHandler) // POST /api/relay/releases/rollout (release admin token, staged rollout)
+		r.Post("/discovered_cameras", api.PostDiscoveredCamerasHandler) // POST /api/relay/discovered_cameras (device token, ONVIF discovery report)
+		r.Get("/discovered_cameras", api.GetDiscoveredCamerasHandler)   // GET /api/relay/discovered_cameras?relay_id=xxx (user JWT, camera pick list)
+		r.Post("/doctor", api.PostRelayDoctorHandler)                   // POST /api/relay/doctor (device token, self-check report)
+		r.Get("/doctor", api.GetRelayDoctorHandler)                     // GET /api/relay/doctor?relay_id=xxx (user JWT, latest self-check report)
+		r.Post("/logs", api.PostRelayLogsHandler)                       // POST /api/relay/logs?from=&to=&lines=&reason= (device token, gzipped log bundle)
+		r.Get("/logs", api.GetRelayLogsHandler)                         // GET /api/relay/logs?relay_id=xxx&since=1h (support token, bundles with download URLs)
+		r.Post("/logs/request", api.PostRelayLogsRequestHandler)        // POST /api/relay/logs/request (support token, queue upload_logs)
 	})
 
 	r.Route("/api/onboarding", func(apiRouter chi.Router) {
@@ -44,6 +75,7 @@ func main() {
 	r.Route("/api/coop", func(coopRouter chi.Router) {
 		// coopRouter.Use(AuthMiddleware) // Example: if you add a JWT middleware for this group
 		coopRouter.Get("/info", api.GetCoopInfoHandler) // GET /api/coop/info
+		coopRouter.Post("/location", api.PostCoopLocationHandler) // POST /api/coop/location (user JWT, for sunrise/sunset schedules)
 	})
 
 	log.Println("🚀 Coop backend listening on :8080")
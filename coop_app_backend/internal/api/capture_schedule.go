@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+	_ "time/tzdata" // validate time zones even where the host has no zoneinfo
+)
+
+// Capture schedules
+//
+// A schedule replaces the single interval string. It is stored as jsonb in
+// relays.schedule (legacy camera and default for all cameras) and
+// relay_cameras.schedule (per-camera override):
+//
+//	{
+//	  "timezone": "America/Chicago",        // optional, defaults to the coop's
+//	  "default_interval": "10m",            // outside every window; omit to not capture
+//	  "windows": [
+//	    {"days": ["mon", "tue"], "start": "sunrise+1h", "end": "sunset", "interval": "30s"},
+//	    {"start": "05:30", "end": "11:00", "interval": "15s"}
+//	  ]
+//	}
+//
+// The first window covering the current time wins. start and end are "HH:MM"
+// or sunrise/sunset with an optional offset such as "sunset-30m"; an end at
+// or before start runs past midnight. days defaults to every day and refers
+// to the day the window starts. Sun times need the coop's location
+// (coops.latitude, coops.longitude, coops.timezone), which GET
+// /api/relay/config merges into every schedule it returns.
+
+// CaptureSchedule says when and how often a relay captures.
+type CaptureSchedule struct {
+	Timezone        string           `json:"timezone,omitempty"`
+	Latitude        *float64         `json:"latitude,omitempty"`
+	Longitude       *float64         `json:"longitude,omitempty"`
+	DefaultInterval *string          `json:"default_interval,omitempty"`
+	Windows         []ScheduleWindow `json:"windows"`
+}
+
+// ScheduleWindow is one active period of a schedule.
+type ScheduleWindow struct {
+	Days     []string `json:"days,omitempty"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Interval string   `json:"interval"`
+}
+
+// CoopLocation is where a coop is, for sunrise/sunset schedules.
+type CoopLocation struct {
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Timezone  *string  `json:"timezone"`
+}
+
+const maxScheduleWindows = 16
+
+var (
+	scheduleTimePattern = regexp.MustCompile(`^(?:([01]\d|2[0-3]):[0-5]\d|(?:sunrise|sunset)(?:[+-]\d+[mh])?)$`)
+	scheduleDays        = map[string]bool{"mon": true, "tue": true, "wed": true, "thu": true, "fri": true, "sat": true, "sun": true}
+)
+
+func (s *CaptureSchedule) validate() error {
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q", s.Timezone)
+		}
+	}
+	if s.DefaultInterval != nil && !cameraIntervalPattern.MatchString(*s.DefaultInterval) {
+		return errors.New("default_interval must look like 30s, 10m or 1h")
+	}
+	if len(s.Windows) > maxScheduleWindows {
+		return fmt.Errorf("a schedule can have at most %d windows", maxScheduleWindows)
+	}
+	for i, win := range s.Windows {
+		if !scheduleTimePattern.MatchString(win.Start) || !scheduleTimePattern.MatchString(win.End) {
+			return fmt.Errorf("window %d: start and end must be HH:MM, sunrise or sunset with an optional offset like +1h", i+1)
+		}
+		if !cameraIntervalPattern.MatchString(win.Interval) {
+			return fmt.Errorf("window %d: interval must look like 30s, 10m or 1h", i+1)
+		}
+		for _, day := range win.Days {
+			if !scheduleDays[day] {
+				return fmt.Errorf("window %d: unknown day %q (use mon..sun)", i+1, day)
+			}
+		}
+	}
+	// Location comes from the coop; a client can't set it per schedule.
+	s.Latitude, s.Longitude = nil, nil
+	return nil
+}
+
+// withLocation returns a copy of the schedule with the coop's location and,
+// unless the schedule names its own, the coop's time zone.
+func (s *CaptureSchedule) withLocation(loc *CoopLocation) *CaptureSchedule {
+	if s == nil {
+		return nil
+	}
+	out := *s
+	if loc == nil {
+		return &out
+	}
+	out.Latitude, out.Longitude = loc.Latitude, loc.Longitude
+	if out.Timezone == "" && loc.Timezone != nil {
+		out.Timezone = *loc.Timezone
+	}
+	return &out
+}
+
+// fetchCoopLocation loads a coop's location fields.
+func fetchCoopLocation(supabaseURL, serviceKey, coopID string) (*CoopLocation, error) {
+	req, err := http.NewRequest("GET", supabaseURL+"/rest/v1/coops?id=eq."+url.QueryEscape(coopID)+"&select=latitude,longitude,timezone", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("coop lookup failed: %s: %s", resp.Status, string(b))
+	}
+	var coops []CoopLocation
+	if err := json.NewDecoder(resp.Body).Decode(&coops); err != nil {
+		return nil, err
+	}
+	if len(coops) == 0 {
+		return nil, errors.New("coop not found")
+	}
+	return &coops[0], nil
+}
@@ -0,0 +1,298 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Resumable clip uploads
+//
+// Clips are too big to send in one request over a barn's Wi-Fi, so relays
+// upload them with the tus.io core protocol (1.0.0) plus its creation
+// extension:
+//
+//	POST  /api/clips/uploads        Upload-Length: <n>  -> 201, Location: /api/clips/uploads/<id>
+//	HEAD  /api/clips/uploads/<id>                       -> Upload-Offset, Upload-Length
+//	PATCH /api/clips/uploads/<id>   Upload-Offset: <o>, Content-Type: application/offset+octet-stream
+//
+// A PATCH keeps whatever bytes arrived before the connection dropped, so the
+// relay asks for the offset with HEAD and carries on from there. Uploads are
+// staged under CLIP_UPLOAD_DIR (default <tmp>/coop-clip-uploads) until POST
+// /api/clips moves them into storage; that directory must be shared by every
+// backend instance. Unfinished uploads are removed after clipUploadTTL.
+
+const (
+	tusVersion = "1.0.0"
+	// maxClipBytes caps a single clip upload.
+	maxClipBytes  = 50 << 20
+	clipUploadTTL = 24 * time.Hour
+)
+
+var clipUploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// clipUploadLocks serialises PATCHes and registration of one upload.
+var clipUploadLocks sync.Map
+
+var errClipUploadNotFound = errors.New("clip upload not found")
+
+// clipUpload is the sidecar record of a staged upload.
+type clipUpload struct {
+	ID        string    `json:"id"`
+	RelayID   string    `json:"relay_id"`
+	Length    int64     `json:"length"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func clipUploadDir() string {
+	if dir := os.Getenv("CLIP_UPLOAD_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "coop-clip-uploads")
+}
+
+func (u *clipUpload) dataPath() string {
+	return filepath.Join(clipUploadDir(), u.ID+".bin")
+}
+
+func (u *clipUpload) metaPath() string {
+	return filepath.Join(clipUploadDir(), u.ID+".json")
+}
+
+// offset is how many bytes of the upload have arrived.
+func (u *clipUpload) offset() (int64, error) {
+	fi, err := os.Stat(u.dataPath())
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (u *clipUpload) remove() {
+	os.Remove(u.dataPath())
+	os.Remove(u.metaPath())
+}
+
+// lockClipUpload takes the upload's lock and returns its unlock function.
+func lockClipUpload(id string) func() {
+	v, _ := clipUploadLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// loadClipUpload returns the relay's staged upload id, or
+// errClipUploadNotFound if it doesn't exist, expired or belongs to another
+// relay.
+func loadClipUpload(id, relayID string) (*clipUpload, error) {
+	if !clipUploadIDPattern.MatchString(id) {
+		return nil, errClipUploadNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(clipUploadDir(), id+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errClipUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u clipUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	if u.RelayID != relayID || time.Since(u.CreatedAt) > clipUploadTTL {
+		return nil, errClipUploadNotFound
+	}
+	return &u, nil
+}
+
+// pruneClipUploads deletes staged uploads older than clipUploadTTL.
+func pruneClipUploads() {
+	entries, err := os.ReadDir(clipUploadDir())
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-clipUploadTTL)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(clipUploadDir(), e.Name()))
+		}
+	}
+}
+
+// authenticateClipUpload checks the relay token and the Tus-Resumable header
+// shared by every upload request. It writes the error response itself.
+func authenticateClipUpload(w http.ResponseWriter, r *http.Request) (*relayAuthRecord, bool) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithError(w, http.StatusPreconditionFailed, "Tus-Resumable 1.0.0 is required")
+		return nil, false
+	}
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return nil, false
+	}
+	relay, err := authenticateRelay(r, supabaseURL, serviceKey)
+	if err != nil {
+		respondRelayAuthError(w, err)
+		return nil, false
+	}
+	return relay, true
+}
+
+// OPTIONS /api/clips/uploads
+func ClipUploadOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation")
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(maxClipBytes))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/clips/uploads (device token)
+func PostClipUploadHandler(w http.ResponseWriter, r *http.Request) {
+	relay, ok := authenticateClipUpload(w, r)
+	if !ok {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Upload-Length is required")
+		return
+	}
+	if length > maxClipBytes {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("clips are limited to %d bytes", maxClipBytes))
+		return
+	}
+
+	if err := os.MkdirAll(clipUploadDir(), 0o700); err != nil {
+		log.Printf("Error creating clip upload directory: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create upload")
+		return
+	}
+	pruneClipUploads()
+	id, err := newRandomID(16)
+	if err != nil {
+		log.Printf("Error generating clip upload id: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create upload")
+		return
+	}
+	u := &clipUpload{ID: id, RelayID: relay.ID, Length: length, CreatedAt: time.Now().UTC()}
+	meta, _ := json.Marshal(u)
+	if err := os.WriteFile(u.dataPath(), nil, 0o600); err != nil {
+		log.Printf("Error creating clip upload %s: %v", id, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create upload")
+		return
+	}
+	if err := os.WriteFile(u.metaPath(), meta, 0o600); err != nil {
+		log.Printf("Error creating clip upload %s: %v", id, err)
+		u.remove()
+		respondWithError(w, http.StatusInternalServerError, "Failed to create upload")
+		return
+	}
+	log.Printf("Relay %s started clip upload %s (%d bytes)", relay.ID, id, length)
+	w.Header().Set("Location", "/api/clips/uploads/"+id)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HEAD /api/clips/uploads/{id} (device token)
+func HeadClipUploadHandler(w http.ResponseWriter, r *http.Request) {
+	relay, ok := authenticateClipUpload(w, r)
+	if !ok {
+		return
+	}
+	u, err := loadClipUpload(chi.URLParam(r, "id"), relay.ID)
+	if err != nil {
+		respondClipUploadError(w, err)
+		return
+	}
+	offset, err := u.offset()
+	if err != nil {
+		respondClipUploadError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// PATCH /api/clips/uploads/{id} (device token)
+func PatchClipUploadHandler(w http.ResponseWriter, r *http.Request) {
+	relay, ok := authenticateClipUpload(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		respondWithError(w, http.StatusBadRequest, "Upload-Offset is required")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	unlock := lockClipUpload(id)
+	defer unlock()
+	u, err := loadClipUpload(id, relay.ID)
+	if err != nil {
+		respondClipUploadError(w, err)
+		return
+	}
+	current, err := u.offset()
+	if err != nil {
+		respondClipUploadError(w, err)
+		return
+	}
+	if offset != current {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(current, 10))
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("Upload-Offset is %d", current))
+		return
+	}
+
+	f, err := os.OpenFile(u.dataPath(), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		respondClipUploadError(w, err)
+		return
+	}
+	// Anything past Upload-Length is ignored; what did arrive is kept even
+	// if the connection drops part way.
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, u.Length-current))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if copyErr != nil {
+		log.Printf("Clip upload %s interrupted at %d bytes: %v", id, current+n, copyErr)
+		respondWithError(w, http.StatusBadRequest, "Upload interrupted")
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(current+n, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondClipUploadError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errClipUploadNotFound) || errors.Is(err, os.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Upload not found")
+		return
+	}
+	log.Printf("Clip upload error: %v", err)
+	respondWithError(w, http.StatusInternalServerError, "Upload storage error")
+}
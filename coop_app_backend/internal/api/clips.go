@@ -0,0 +1,459 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clips
+//
+// A relay can record short MP4 clips as well as stills. When and how long is
+// set per camera in relay_cameras.clip, and for the legacy single camera in
+// relays.clip (jsonb null, null means no clips):
+//
+//	{"seconds": 15, "on_change": true, "every": "1h", "cooldown": "5m"}
+//
+// on_change records after a capture that passed change detection, at most
+// once per cooldown (default 5m); every records on a fixed interval; the
+// record_clip command records one on demand.
+//
+// The relay uploads the file with the resumable protocol in clip_uploads.go
+// and registers it with POST /api/clips, which moves it to the private clips
+// storage bucket at <relay_id>/[<camera_id>/]<timestamp>.mp4 and records a
+// row in clips:
+//
+//	id uuid primary key default gen_random_uuid(),
+//	coop_id uuid not null references coops(id) on delete cascade,
+//	relay_id uuid not null references relays(id) on delete cascade,
+//	camera_id uuid references relay_cameras(id) on delete set null,
+//	storage_path text not null,
+//	captured_at timestamptz not null,
+//	duration_seconds double precision,
+//	size_bytes bigint not null,
+//	sha256 text not null,
+//	width int, height int,
+//	trigger text,                       -- change, schedule or command
+//	created_at timestamptz not null default now()
+//
+//	create unique index clips_relay_sha256 on clips (relay_id, sha256);
+
+// ClipSettings says when a camera records clips.
+type ClipSettings struct {
+	Seconds  int    `json:"seconds"`
+	OnChange bool   `json:"on_change,omitempty"`
+	Every    string `json:"every,omitempty"`
+	Cooldown string `json:"cooldown,omitempty"`
+}
+
+const (
+	maxClipSeconds = 60
+	// clipURLExpiry is how long a streaming URL from GET /api/relay/clips lasts.
+	clipURLExpiry = time.Hour
+)
+
+var clipTriggers = map[string]bool{"change": true, "schedule": true, "command": true}
+
+func (c *ClipSettings) validate() error {
+	if c.Seconds < 1 || c.Seconds > maxClipSeconds {
+		return fmt.Errorf("clip seconds must be between 1 and %d", maxClipSeconds)
+	}
+	if c.Every != "" && !cameraIntervalPattern.MatchString(c.Every) {
+		return errors.New("clip every must look like 30s, 10m or 1h")
+	}
+	if c.Cooldown != "" && !cameraIntervalPattern.MatchString(c.Cooldown) {
+		return errors.New("clip cooldown must look like 30s, 10m or 1h")
+	}
+	return nil
+}
+
+// ClipRequest is the body of POST /api/clips.
+type ClipRequest struct {
+	UploadID        string     `json:"upload_id"`
+	CameraID        string     `json:"camera_id,omitempty"`
+	CapturedAt      *time.Time `json:"captured_at"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	Width           int        `json:"width,omitempty"`
+	Height          int        `json:"height,omitempty"`
+	Trigger         string     `json:"trigger,omitempty"`
+	snapshotDigest
+}
+
+// Clip is one row of clips as the app sees it.
+type Clip struct {
+	ID              string   `json:"id"`
+	RelayID         string   `json:"relay_id"`
+	CameraID        *string  `json:"camera_id"`
+	StoragePath     string   `json:"storage_path"`
+	CapturedAt      string   `json:"captured_at"`
+	DurationSeconds *float64 `json:"duration_seconds"`
+	SizeBytes       int64    `json:"size_bytes"`
+	Width           *int     `json:"width"`
+	Height          *int     `json:"height"`
+	Trigger         *string  `json:"trigger"`
+	StreamURL       string   `json:"stream_url,omitempty"`
+}
+
+const clipColumns = "id,relay_id,camera_id,storage_path,captured_at,duration_seconds,size_bytes,width,height,trigger"
+
+var errDuplicateClip = errors.New("duplicate clip")
+
+// clipRequest sends a PostgREST request against clips and decodes the
+// returned rows.
+func clipRequest(method, supabaseURL, serviceKey, query string, payload interface{}) ([]Clip, error) {
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, supabaseURL+"/rest/v1/clips?"+query, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=representation")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return nil, errDuplicateClip
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("clips %s failed: %s: %s", method, resp.Status, string(b))
+	}
+	var clips []Clip
+	if err := json.NewDecoder(resp.Body).Decode(&clips); err != nil {
+		return nil, err
+	}
+	return clips, nil
+}
+
+// POST /api/clips (device token)
+// Registers a finished resumable upload as a clip.
+func PostClipHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+
+	var req ClipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	req.SHA256 = strings.ToLower(req.SHA256)
+	if req.UploadID == "" || !sha256Pattern.MatchString(req.SHA256) {
+		respondWithError(w, http.StatusBadRequest, "upload_id and sha256 (64 hex characters) are required")
+		return
+	}
+	if req.Trigger != "" && !clipTriggers[req.Trigger] {
+		respondWithError(w, http.StatusBadRequest, "trigger must be change, schedule or command")
+		return
+	}
+	if req.DurationSeconds < 0 || req.DurationSeconds > 2*maxClipSeconds {
+		respondWithError(w, http.StatusBadRequest, "duration_seconds is out of range")
+		return
+	}
+
+	relay, err := authenticateRelay(r, supabaseURL, serviceKey)
+	if err != nil {
+		respondRelayAuthError(w, err)
+		return
+	}
+	if relay.CoopID == nil || *relay.CoopID == "" {
+		respondWithError(w, http.StatusBadRequest, "Relay is not attached to a coop")
+		return
+	}
+	if req.CameraID != "" {
+		if _, err := fetchRelayCamera(supabaseURL, serviceKey, relay.ID, req.CameraID); err != nil {
+			if errors.Is(err, errCameraNotFound) {
+				respondWithError(w, http.StatusForbidden, "camera_id does not belong to this relay")
+				return
+			}
+			log.Printf("Camera lookup error: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to look up camera")
+			return
+		}
+	}
+
+	unlock := lockClipUpload(req.UploadID)
+	defer unlock()
+	upload, err := loadClipUpload(req.UploadID, relay.ID)
+	if err != nil {
+		respondClipUploadError(w, err)
+		return
+	}
+	if offset, err := upload.offset(); err != nil || offset != upload.Length {
+		respondWithError(w, http.StatusConflict, "Upload is not complete")
+		return
+	}
+	if err := verifyClipUpload(upload, req.snapshotDigest); err != nil {
+		// The relay starts the upload over.
+		log.Printf("Rejecting clip from relay %s: %v", relay.ID, err)
+		upload.remove()
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	if existing, err := findClipByDigest(supabaseURL, serviceKey, relay.ID, req.SHA256); err != nil {
+		log.Printf("Duplicate lookup error: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to check for duplicates")
+		return
+	} else if existing != nil {
+		upload.remove()
+		respondDuplicateClip(w, existing)
+		return
+	}
+
+	capturedAt := time.Now()
+	if req.CapturedAt != nil && req.CapturedAt.Before(capturedAt) {
+		capturedAt = *req.CapturedAt
+	}
+	storagePath := fmt.Sprintf("%s/%s.mp4", relay.ID, capturedAt.UTC().Format(snapshotTimestampLayout))
+	if req.CameraID != "" {
+		storagePath = fmt.Sprintf("%s/%s/%s.mp4", relay.ID, req.CameraID, capturedAt.UTC().Format(snapshotTimestampLayout))
+	}
+	if err := storeClipObject(supabaseURL, serviceKey, storagePath, upload); err != nil {
+		log.Printf("Error storing clip %s: %v", storagePath, err)
+		respondWithError(w, http.StatusBadGateway, "Failed to store clip")
+		return
+	}
+
+	payload := map[string]interface{}{
+		"coop_id":      *relay.CoopID,
+		"relay_id":     relay.ID,
+		"storage_path": storagePath,
+		"captured_at":  capturedAt.UTC().Format(time.RFC3339),
+		"size_bytes":   upload.Length,
+		"sha256":       req.SHA256,
+	}
+	if req.CameraID != "" {
+		payload["camera_id"] = req.CameraID
+	}
+	if req.DurationSeconds > 0 {
+		payload["duration_seconds"] = req.DurationSeconds
+	}
+	if req.Width > 0 && req.Height > 0 {
+		payload["width"] = req.Width
+		payload["height"] = req.Height
+	}
+	if req.Trigger != "" {
+		payload["trigger"] = req.Trigger
+	}
+	clips, err := clipRequest("POST", supabaseURL, serviceKey, "select="+clipColumns, payload)
+	if errors.Is(err, errDuplicateClip) {
+		// Lost a race with a concurrent resubmission.
+		if existing, _ := findClipByDigest(supabaseURL, serviceKey, relay.ID, req.SHA256); existing != nil {
+			upload.remove()
+			respondDuplicateClip(w, existing)
+			return
+		}
+	}
+	if err != nil || len(clips) == 0 {
+		log.Printf("Clip insert error: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to record clip")
+		return
+	}
+	upload.remove()
+	log.Printf("Relay %s registered clip %s (%d bytes)", relay.ID, clips[0].ID, upload.Length)
+	respondWithJSON(w, http.StatusCreated, map[string]interface{}{
+		"clip_id":      clips[0].ID,
+		"storage_path": storagePath,
+	})
+}
+
+// verifyClipUpload checks the staged file against the relay's digest and
+// that it looks like an MP4 (an ftyp box first).
+func verifyClipUpload(u *clipUpload, want snapshotDigest) error {
+	f, err := os.Open(u.dataPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(io.TeeReader(f, h), head); err != nil || string(head[4:]) != "ftyp" {
+		return errors.New("upload is not an MP4 file")
+	}
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("reading upload: %w", err)
+	}
+	size := n + int64(len(head))
+	if want.Size != 0 && size != want.Size {
+		return fmt.Errorf("checksum mismatch: upload is %d bytes, relay sent %d", size, want.Size)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want.SHA256 {
+		return fmt.Errorf("checksum mismatch: upload sha256 is %s, relay sent %s", got, want.SHA256)
+	}
+	return nil
+}
+
+// storeClipObject copies a finished upload into the clips bucket.
+func storeClipObject(supabaseURL, serviceKey, path string, u *clipUpload) error {
+	f, err := os.Open(u.dataPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/storage/v1/object/clips/%s", supabaseURL, path), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = u.Length
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	req.Header.Set("Content-Type", "video/mp4")
+	// A retry after a lost response stores the same path again.
+	req.Header.Set("x-upsert", "true")
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("storage upload failed: %s: %s", resp.Status, string(b))
+	}
+	return nil
+}
+
+// findClipByDigest returns the relay's clip with this SHA-256, or nil.
+func findClipByDigest(supabaseURL, serviceKey, relayID, sha string) (*Clip, error) {
+	query := fmt.Sprintf("relay_id=eq.%s&sha256=eq.%s&select=%s&limit=1", url.QueryEscape(relayID), url.QueryEscape(sha), clipColumns)
+	clips, err := clipRequest("GET", supabaseURL, serviceKey, query, nil)
+	if err != nil || len(clips) == 0 {
+		return nil, err
+	}
+	return &clips[0], nil
+}
+
+// respondDuplicateClip answers a resubmission with 409 and the clip already
+// on record, so the relay can treat it as delivered.
+func respondDuplicateClip(w http.ResponseWriter, existing *Clip) {
+	log.Printf("Rejecting duplicate of clip %s", existing.ID)
+	respondWithJSON(w, http.StatusConflict, map[string]interface{}{
+		"error":        "duplicate clip",
+		"clip_id":      existing.ID,
+		"storage_path": existing.StoragePath,
+	})
+}
+
+// signClipURLs asks Supabase Storage for streaming URLs for paths in the
+// clips bucket, keyed by path.
+func signClipURLs(supabaseURL, serviceKey string, paths []string) (map[string]string, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"expiresIn": int(clipURLExpiry / time.Second),
+		"paths":     paths,
+	})
+	req, err := http.NewRequest("POST", supabaseURL+"/storage/v1/object/sign/clips", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("sign clips failed: %s: %s", resp.Status, string(b))
+	}
+	var signed []struct {
+		Path      string  `json:"path"`
+		SignedURL *string `json:"signedURL"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		return nil, err
+	}
+	urls := make(map[string]string, len(signed))
+	for _, s := range signed {
+		if s.SignedURL != nil {
+			urls[s.Path] = supabaseURL + "/storage/v1" + *s.SignedURL
+		}
+	}
+	return urls, nil
+}
+
+// GET /api/relay/clips?relay_id=<relay_id>[&camera_id=<camera_id>][&limit=20] (user JWT)
+// Lists the relay's clips, newest first, each with a signed stream_url.
+func GetRelayClipsHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+
+	relayID := r.URL.Query().Get("relay_id")
+	if relayID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing relay_id")
+		return
+	}
+	limit := 20
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = min(l, 100)
+	}
+	if !authorizeRelayForUser(w, r, supabaseURL, serviceKey, relayID) {
+		return
+	}
+
+	query := fmt.Sprintf("relay_id=eq.%s&select=%s&order=captured_at.desc&limit=%d", url.QueryEscape(relayID), clipColumns, limit)
+	if cameraID := r.URL.Query().Get("camera_id"); cameraID != "" {
+		query += "&camera_id=eq." + url.QueryEscape(cameraID)
+	}
+	clips, err := clipRequest("GET", supabaseURL, serviceKey, query, nil)
+	if err != nil {
+		log.Printf("Error listing clips for relay %s: %v", relayID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to list clips")
+		return
+	}
+	if clips == nil {
+		clips = []Clip{}
+	}
+	if len(clips) > 0 {
+		paths := make([]string, len(clips))
+		for i, c := range clips {
+			paths[i] = c.StoragePath
+		}
+		urls, err := signClipURLs(supabaseURL, serviceKey, paths)
+		if err != nil {
+			log.Printf("Error signing clip URLs for relay %s: %v", relayID, err)
+			respondWithError(w, http.StatusBadGateway, "Failed to sign clip URLs")
+			return
+		}
+		for i := range clips {
+			clips[i].StreamURL = urls[clips[i].StoragePath]
+		}
+	}
+	respondWithJSON(w, http.StatusOK, clips)
+}
@@ -13,10 +13,11 @@ import (
 
 // CoopInfoResponse defines the structure for the /api/coop/info endpoint
 type CoopInfoResponse struct {
-	CoopID     string       `json:"coop_id"`
-	Name       string       `json:"name"`
-	InviteCode *string      `json:"invite_code,omitempty"` // Made pointer to handle potential absence from schema
-	Members    []CoopMember `json:"members"`
+	CoopID       string       `json:"coop_id"`
+	Name         string       `json:"name"`
+	InviteCode   *string      `json:"invite_code,omitempty"` // Made pointer to handle potential absence from schema
+	Members      []CoopMember `json:"members"`
+	CoopLocation              // for sunrise/sunset capture schedules; null until set
 }
 
 // CoopMember defines the structure for a member in the CoopInfoResponse
@@ -35,6 +36,7 @@ type SupabaseCoopDetails struct {
 	ID         string  `json:"id"`
 	Name       string  `json:"name"`
 	InviteCode *string `json:"invite_code,omitempty"` // Attempt to select, handle if null/missing
+	CoopLocation
 }
 
 // SupabaseCoopMemberWithUser is used to decode the response from coop_members joined with users
@@ -141,7 +143,7 @@ func GetCoopInfoHandler(w http.ResponseWriter, r *http.Request) {
 	coopID := userCoopMemberships[0].CoopID
 
 	// 3. Fetch coop details from the coops table
-	coopDetailsURL := fmt.Sprintf("%s/rest/v1/coops?id=eq.%s&select=name,invite_code&limit=1", supabaseURL, coopID)
+	coopDetailsURL := fmt.Sprintf("%s/rest/v1/coops?id=eq.%s&select=name,invite_code,latitude,longitude,timezone&limit=1", supabaseURL, coopID)
 	req, _ = http.NewRequest("GET", coopDetailsURL, nil)
 	req.Header.Set("apikey", supabaseServiceKey)
 	req.Header.Set("Authorization", "Bearer "+supabaseServiceKey)
@@ -207,10 +209,11 @@ func GetCoopInfoHandler(w http.ResponseWriter, r *http.Request) {
 
 	// 5. Construct and return response
 	response := CoopInfoResponse{
-		CoopID:     coopID,
-		Name:       coopDetail.Name,
-		InviteCode: coopDetail.InviteCode,
-		Members:    members,
+		CoopID:       coopID,
+		Name:         coopDetail.Name,
+		InviteCode:   coopDetail.InviteCode,
+		Members:      members,
+		CoopLocation: coopDetail.CoopLocation,
 	}
 
 	respondWithJSON(w, http.StatusOK, response)
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// SetCoopLocationRequest is the body of POST /api/coop/location.
+type SetCoopLocationRequest struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Timezone  string  `json:"timezone"`
+}
+
+// POST /api/coop/location (user JWT)
+// Sets where the user's coop is, for sunrise/sunset capture schedules.
+func PostCoopLocationHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	jwtSecret := os.Getenv("SUPABASE_JWT_SECRET")
+	if supabaseURL == "" || serviceKey == "" || jwtSecret == "" {
+		log.Println("Error: Missing Supabase environment variables for coop location")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+
+	userID, err := userIDFromRequest(r, jwtSecret)
+	if err != nil {
+		log.Printf("Coop location: %v", err)
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired token")
+		return
+	}
+
+	var req SetCoopLocationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Latitude < -90 || req.Latitude > 90 || req.Longitude < -180 || req.Longitude > 180 {
+		respondWithError(w, http.StatusBadRequest, "latitude must be -90..90 and longitude -180..180")
+		return
+	}
+	if _, err := time.LoadLocation(req.Timezone); err != nil || req.Timezone == "" {
+		respondWithError(w, http.StatusBadRequest, "timezone must be an IANA name like America/Chicago")
+		return
+	}
+
+	coopID, err := coopIDForUser(supabaseURL, serviceKey, userID)
+	if err != nil {
+		log.Printf("Error fetching coop membership for user %s: %v", userID, err)
+		respondWithError(w, http.StatusForbidden, "User is not part of any coop")
+		return
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"latitude":  req.Latitude,
+		"longitude": req.Longitude,
+		"timezone":  req.Timezone,
+	})
+	patchReq, err := http.NewRequest("PATCH", supabaseURL+"/rest/v1/coops?id=eq."+url.QueryEscape(coopID), bytes.NewReader(body))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	patchReq.Header.Set("apikey", serviceKey)
+	patchReq.Header.Set("Authorization", "Bearer "+serviceKey)
+	patchReq.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(patchReq)
+	if err != nil {
+		log.Printf("Error updating location for coop %s: %v", coopID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to communicate with database")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		log.Printf("Supabase error updating location for coop %s: %s: %s", coopID, resp.Status, string(b))
+		respondWithError(w, http.StatusInternalServerError, "Failed to save coop location")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"coop_id":   coopID,
+		"latitude":  req.Latitude,
+		"longitude": req.Longitude,
+		"timezone":  req.Timezone,
+	})
+}
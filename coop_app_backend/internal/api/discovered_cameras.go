@@ -0,0 +1,204 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Discovered cameras
+//
+// The relay finds ONVIF cameras on its network and reports them with their
+// media profiles, so the app can offer a pick list instead of asking for an
+// RTSP URL. The latest report replaces the previous one in
+// relays.discovered_cameras (jsonb) with relays.discovered_at (timestamptz).
+// Picking a camera is an ordinary POST /api/relay/cameras with the chosen
+// profile's stream_uri (plus credentials) as source_url.
+
+// DiscoveredCamera is an ONVIF device the relay found.
+type DiscoveredCamera struct {
+	Endpoint     string              `json:"endpoint"`
+	Address      string              `json:"address"`
+	DeviceURL    string              `json:"device_url"`
+	Name         string              `json:"name,omitempty"`
+	Hardware     string              `json:"hardware,omitempty"`
+	Manufacturer string              `json:"manufacturer,omitempty"`
+	Model        string              `json:"model,omitempty"`
+	Firmware     string              `json:"firmware,omitempty"`
+	AuthRequired bool                `json:"auth_required,omitempty"`
+	Error        string              `json:"error,omitempty"`
+	Profiles     []DiscoveredProfile `json:"profiles"`
+}
+
+// DiscoveredProfile is one of a camera's media profiles.
+type DiscoveredProfile struct {
+	Token       string `json:"token"`
+	Name        string `json:"name"`
+	Encoding    string `json:"encoding,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	StreamURI   string `json:"stream_uri,omitempty"`
+	SnapshotURI string `json:"snapshot_uri,omitempty"`
+}
+
+const (
+	maxDiscoveredCameras  = 64
+	maxDiscoveredProfiles = 16
+)
+
+// sanitize bounds a report and strips any credentials a camera put in its
+// URIs, so they never reach the app.
+func (c *DiscoveredCamera) sanitize() {
+	for _, s := range []*string{&c.Endpoint, &c.Address, &c.Name, &c.Hardware, &c.Manufacturer, &c.Model, &c.Firmware, &c.Error} {
+		*s = truncateText(*s, maxTelemetryText)
+	}
+	c.DeviceURL = stripURLCredentials(c.DeviceURL)
+	if len(c.Profiles) > maxDiscoveredProfiles {
+		c.Profiles = c.Profiles[:maxDiscoveredProfiles]
+	}
+	if c.Profiles == nil {
+		c.Profiles = []DiscoveredProfile{}
+	}
+	for i := range c.Profiles {
+		p := &c.Profiles[i]
+		p.Token, p.Name, p.Encoding = truncateText(p.Token, maxTelemetryText), truncateText(p.Name, maxTelemetryText), truncateText(p.Encoding, 32)
+		p.StreamURI, p.SnapshotURI = stripURLCredentials(p.StreamURI), stripURLCredentials(p.SnapshotURI)
+	}
+}
+
+func stripURLCredentials(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	return truncateText(u.String(), 2048)
+}
+
+// POST /api/relay/discovered_cameras (relay device token)
+// Body: { cameras: [...] }. Replaces the relay's discovered camera list.
+func PostDiscoveredCamerasHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+	relay, err := authenticateRelay(r, supabaseURL, serviceKey)
+	if err != nil {
+		respondRelayAuthError(w, err)
+		return
+	}
+
+	var req struct {
+		Cameras []DiscoveredCamera `json:"cameras"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 512<<10)).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(req.Cameras) > maxDiscoveredCameras {
+		req.Cameras = req.Cameras[:maxDiscoveredCameras]
+	}
+	if req.Cameras == nil {
+		req.Cameras = []DiscoveredCamera{}
+	}
+	for i := range req.Cameras {
+		req.Cameras[i].sanitize()
+	}
+
+	discoveredAt := time.Now().UTC()
+	body, _ := json.Marshal(map[string]interface{}{
+		"discovered_cameras": req.Cameras,
+		"discovered_at":      discoveredAt.Format(time.RFC3339Nano),
+	})
+	patchReq, err := http.NewRequest("PATCH", supabaseURL+"/rest/v1/relays?id=eq."+url.QueryEscape(relay.ID), bytes.NewReader(body))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	patchReq.Header.Set("apikey", serviceKey)
+	patchReq.Header.Set("Authorization", "Bearer "+serviceKey)
+	patchReq.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(patchReq)
+	if err != nil {
+		log.Printf("Error saving discovered cameras for relay %s: %v", relay.ID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to communicate with database")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		log.Printf("Supabase error saving discovered cameras for relay %s: %s: %s", relay.ID, resp.Status, string(b))
+		respondWithError(w, http.StatusInternalServerError, "Failed to save discovered cameras")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"relay_id":      relay.ID,
+		"discovered_at": discoveredAt,
+		"cameras":       len(req.Cameras),
+	})
+}
+
+// GET /api/relay/discovered_cameras?relay_id=<relay_id> (user JWT)
+// Returns the relay's latest discovery report. Queue a discover_cameras
+// command to refresh it.
+func GetDiscoveredCamerasHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+	relayID := r.URL.Query().Get("relay_id")
+	if relayID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing relay_id")
+		return
+	}
+	if !authorizeRelayForUser(w, r, supabaseURL, serviceKey, relayID) {
+		return
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/rest/v1/relays?id=eq.%s&select=discovered_cameras,discovered_at", supabaseURL, url.QueryEscape(relayID)), nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error fetching discovered cameras for relay %s: %v", relayID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to communicate with database")
+		return
+	}
+	defer resp.Body.Close()
+	var rows []struct {
+		DiscoveredCameras []DiscoveredCamera `json:"discovered_cameras"`
+		DiscoveredAt      *time.Time         `json:"discovered_at"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&rows) != nil || len(rows) == 0 {
+		log.Printf("Error fetching discovered cameras for relay %s: %s", relayID, resp.Status)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch discovered cameras")
+		return
+	}
+	cams := rows[0].DiscoveredCameras
+	if cams == nil {
+		cams = []DiscoveredCamera{}
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"relay_id":      relayID,
+		"discovered_at": rows[0].DiscoveredAt,
+		"cameras":       cams,
+	})
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Image processing
+//
+// Relays crop, downscale and re-encode frames before upload. The settings
+// live on each relay_cameras row, and on the relays row for the legacy
+// single camera:
+//
+//	crop jsonb null,          -- {"x","y","width","height"} as fractions of the frame
+//	max_dimension int null,   -- longest side in pixels after cropping
+//	jpeg_quality int null,    -- 1-100
+//	burst_frames int null,    -- frames to grab per capture, 2-10; the sharpest is kept
+//	burst_seconds int null,   -- how long a burst may take, 1-15 (relay default 4)
+//	privacy_mask jsonb null   -- see PrivacyMask
+//
+// Null means "leave it alone": no crop, full resolution, the relay's default
+// quality, a single frame per capture, nothing masked.
+
+// CropRect is a region of interest given as fractions of the frame, so it
+// still fits after a camera's resolution changes.
+type CropRect struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// PrivacyMask is a set of polygons the relay blacks out or blurs before a
+// frame leaves the LAN, e.g. a neighbour's yard. Points are [x, y] fractions
+// of the full camera frame, before any crop. Version identifies the mask's
+// contents; the backend sets it and relays report it with each snapshot.
+//
+//	{"version":"3f2a9c1e07b4","mode":"black","regions":[[[0,0],[0.3,0],[0.3,0.4]]]}
+type PrivacyMask struct {
+	Version string         `json:"version"`
+	Mode    string         `json:"mode"`
+	Regions [][][2]float64 `json:"regions"`
+}
+
+// ImageProcessing is embedded in camera and relay config payloads.
+type ImageProcessing struct {
+	Crop         *CropRect    `json:"crop"`
+	MaxDimension *int         `json:"max_dimension"`
+	JPEGQuality  *int         `json:"jpeg_quality"`
+	BurstFrames  *int         `json:"burst_frames"`
+	BurstSeconds *int         `json:"burst_seconds"`
+	PrivacyMask  *PrivacyMask `json:"privacy_mask"`
+}
+
+const (
+	minMaxDimension = 64
+	maxMaxDimension = 8192
+	maxBurstFrames  = 10
+	maxBurstSeconds = 15
+
+	maxMaskRegions = 16
+	maxMaskPoints  = 32
+)
+
+const imageProcessingColumns = "crop,max_dimension,jpeg_quality,burst_frames,burst_seconds,privacy_mask"
+
+func (c CropRect) validate() error {
+	if c.X < 0 || c.Y < 0 || c.Width <= 0 || c.Height <= 0 || c.X+c.Width > 1 || c.Y+c.Height > 1 {
+		return errors.New("crop must be x, y, width, height fractions inside the frame")
+	}
+	return nil
+}
+
+// fullFrame reports whether the crop covers the whole frame, which clears it.
+func (c CropRect) fullFrame() bool {
+	return c.X == 0 && c.Y == 0 && c.Width == 1 && c.Height == 1
+}
+
+func (m PrivacyMask) validate() error {
+	if m.Mode != "" && m.Mode != "black" && m.Mode != "blur" {
+		return errors.New(`privacy_mask.mode must be "black" or "blur"`)
+	}
+	if len(m.Regions) > maxMaskRegions {
+		return fmt.Errorf("privacy_mask has more than %d regions", maxMaskRegions)
+	}
+	for i, region := range m.Regions {
+		if len(region) < 3 || len(region) > maxMaskPoints {
+			return fmt.Errorf("privacy_mask region %d must have 3 to %d points", i+1, maxMaskPoints)
+		}
+		var area float64
+		for j, pt := range region {
+			if pt[0] < 0 || pt[0] > 1 || pt[1] < 0 || pt[1] > 1 {
+				return fmt.Errorf("privacy_mask region %d has a point outside the frame (use 0-1 fractions)", i+1)
+			}
+			next := region[(j+1)%len(region)]
+			area += pt[0]*next[1] - next[0]*pt[1]
+		}
+		if math.Abs(area) < 1e-6 {
+			return fmt.Errorf("privacy_mask region %d has no area", i+1)
+		}
+	}
+	return nil
+}
+
+// withVersion returns the mask with mode defaulted and Version set to a
+// digest of its contents, so the same mask always has the same version.
+func (m PrivacyMask) withVersion() PrivacyMask {
+	if m.Mode == "" {
+		m.Mode = "black"
+	}
+	m.Version = ""
+	canonical, _ := json.Marshal(m)
+	sum := sha256.Sum256(canonical)
+	m.Version = hex.EncodeToString(sum[:6])
+	return m
+}
+
+func (p ImageProcessing) validate() error {
+	if p.Crop != nil {
+		if err := p.Crop.validate(); err != nil {
+			return err
+		}
+	}
+	if p.MaxDimension != nil && *p.MaxDimension != 0 && (*p.MaxDimension < minMaxDimension || *p.MaxDimension > maxMaxDimension) {
+		return fmt.Errorf("max_dimension must be between %d and %d", minMaxDimension, maxMaxDimension)
+	}
+	if p.JPEGQuality != nil && *p.JPEGQuality != 0 && (*p.JPEGQuality < 1 || *p.JPEGQuality > 100) {
+		return errors.New("jpeg_quality must be between 1 and 100")
+	}
+	if p.BurstFrames != nil && *p.BurstFrames != 0 && (*p.BurstFrames < 1 || *p.BurstFrames > maxBurstFrames) {
+		return fmt.Errorf("burst_frames must be between 1 and %d", maxBurstFrames)
+	}
+	if p.BurstSeconds != nil && *p.BurstSeconds != 0 && (*p.BurstSeconds < 1 || *p.BurstSeconds > maxBurstSeconds) {
+		return fmt.Errorf("burst_seconds must be between 1 and %d", maxBurstSeconds)
+	}
+	if p.PrivacyMask != nil {
+		if err := p.PrivacyMask.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addToPayload copies the settings present in a request into a PostgREST
+// payload. A full-frame crop, 0 for any of the numbers, or a privacy mask
+// with no regions resets the setting to null.
+func (p ImageProcessing) addToPayload(payload map[string]interface{}) {
+	if p.PrivacyMask != nil {
+		if len(p.PrivacyMask.Regions) == 0 {
+			payload["privacy_mask"] = nil
+		} else {
+			payload["privacy_mask"] = p.PrivacyMask.withVersion()
+		}
+	}
+	if p.Crop != nil {
+		if p.Crop.fullFrame() {
+			payload["crop"] = nil
+		} else {
+			payload["crop"] = p.Crop
+		}
+	}
+	if p.MaxDimension != nil {
+		if *p.MaxDimension == 0 {
+			payload["max_dimension"] = nil
+		} else {
+			payload["max_dimension"] = *p.MaxDimension
+		}
+	}
+	if p.JPEGQuality != nil {
+		if *p.JPEGQuality == 0 {
+			payload["jpeg_quality"] = nil
+		} else {
+			payload["jpeg_quality"] = *p.JPEGQuality
+		}
+	}
+	for column, v := range map[string]*int{"burst_frames": p.BurstFrames, "burst_seconds": p.BurstSeconds} {
+		if v == nil {
+			continue
+		}
+		if *v == 0 {
+			payload[column] = nil
+		} else {
+			payload[column] = *v
+		}
+	}
+}
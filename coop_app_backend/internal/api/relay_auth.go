@@ -0,0 +1,429 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Relay device tokens
+//
+// A relay authenticates with "Authorization: Bearer <relay_id>.<token_id>.<sig>",
+// where sig is base64url(HMAC-SHA256(RELAY_TOKEN_SECRET, "<relay_id>.<token_id>")).
+// token_id is stored in relays.device_token_id; the token is only valid while
+// it matches, so clearing or replacing that column revokes the token. Nothing
+// that grants access is stored in the database, and a leaked token only
+// speaks for its own relay.
+//
+// The relay collects its token once after being claimed by presenting the
+// pairing_secret it received from POST /api/relay/request_pairing_code.
+
+var errRelayUnauthorized = errors.New("relay not authorized")
+
+// relayAuthRecord holds the relay columns used for device authentication.
+type relayAuthRecord struct {
+	ID                string  `json:"id"`
+	Status            string  `json:"status"`
+	CoopID            *string `json:"coop_id"`
+	DeviceTokenID     *string `json:"device_token_id"`
+	PairingSecretHash *string `json:"pairing_secret_hash"`
+}
+
+// newRandomID returns n random bytes, hex encoded.
+func newRandomID(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashPairingSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func relayTokenSignature(secret, relayID, tokenID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(relayID + "." + tokenID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// relayTokenFor builds the device token for a relay's current token_id.
+func relayTokenFor(secret, relayID, tokenID string) string {
+	return relayID + "." + tokenID + "." + relayTokenSignature(secret, relayID, tokenID)
+}
+
+// parseRelayToken checks a token's signature and returns its relay and token IDs.
+func parseRelayToken(secret, token string) (relayID, tokenID string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return "", "", errRelayUnauthorized
+	}
+	want := relayTokenSignature(secret, parts[0], parts[1])
+	if subtle.ConstantTimeCompare([]byte(want), []byte(parts[2])) != 1 {
+		return "", "", errRelayUnauthorized
+	}
+	return parts[0], parts[1], nil
+}
+
+// fetchRelayAuthRecord loads the auth columns of a relay row.
+func fetchRelayAuthRecord(supabaseURL, serviceKey, relayID string) (*relayAuthRecord, error) {
+	relayURL := fmt.Sprintf("%s/rest/v1/relays?id=eq.%s&select=id,status,coop_id,device_token_id,pairing_secret_hash", supabaseURL, url.QueryEscape(relayID))
+	req, err := http.NewRequest("GET", relayURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("relay lookup failed: %s", resp.Status)
+	}
+	var relays []relayAuthRecord
+	if err := json.NewDecoder(resp.Body).Decode(&relays); err != nil {
+		return nil, err
+	}
+	if len(relays) != 1 {
+		return nil, errRelayUnauthorized
+	}
+	return &relays[0], nil
+}
+
+// authenticateRelay verifies the request's device token against the relay
+// row and returns the relay. Errors other than errRelayUnauthorized are
+// server-side failures.
+func authenticateRelay(r *http.Request, supabaseURL, serviceKey string) (*relayAuthRecord, error) {
+	secret := os.Getenv("RELAY_TOKEN_SECRET")
+	if secret == "" {
+		return nil, errors.New("missing RELAY_TOKEN_SECRET env var")
+	}
+	authHeader := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	if authHeader == "" || token == authHeader {
+		return nil, errRelayUnauthorized
+	}
+	relayID, tokenID, err := parseRelayToken(secret, token)
+	if err != nil {
+		return nil, err
+	}
+	relay, err := fetchRelayAuthRecord(supabaseURL, serviceKey, relayID)
+	if err != nil {
+		return nil, err
+	}
+	if relay.Status != "claimed" || relay.DeviceTokenID == nil ||
+		subtle.ConstantTimeCompare([]byte(*relay.DeviceTokenID), []byte(tokenID)) != 1 {
+		return nil, errRelayUnauthorized
+	}
+	return relay, nil
+}
+
+// respondRelayAuthError maps an authenticateRelay error to a response.
+func respondRelayAuthError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errRelayUnauthorized) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or revoked relay token")
+		return
+	}
+	log.Printf("Relay authentication error: %v", err)
+	respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+}
+
+// patchRelay applies a PATCH to relays matching filter and returns how many rows changed.
+func patchRelay(supabaseURL, serviceKey, filter string, payload map[string]interface{}) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("PATCH", supabaseURL+"/rest/v1/relays?"+filter, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=representation")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("relay update failed: %s: %s", resp.Status, string(b))
+	}
+	var rows []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+// RelayTokenRequest is the body of POST /api/relay/token.
+type RelayTokenRequest struct {
+	RelayID       string `json:"relay_id"`
+	PairingSecret string `json:"pairing_secret"`
+}
+
+// RelayTokenResponse carries a relay's device token.
+type RelayTokenResponse struct {
+	RelayID     string `json:"relay_id"`
+	Status      string `json:"status"`
+	DeviceToken string `json:"device_token,omitempty"`
+}
+
+// POST /api/relay/token
+// The relay exchanges its pairing secret for a device token once it has been
+// claimed. Until then it gets {"status": "pending"}. The secret is single-use.
+func PostRelayTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req RelayTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.RelayID == "" || req.PairingSecret == "" {
+		respondWithError(w, http.StatusBadRequest, "relay_id and pairing_secret are required")
+		return
+	}
+
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	tokenSecret := os.Getenv("RELAY_TOKEN_SECRET")
+	if supabaseURL == "" || serviceKey == "" || tokenSecret == "" {
+		log.Println("Error: Missing SUPABASE_URL, SUPABASE_SERVICE_KEY or RELAY_TOKEN_SECRET env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+
+	relay, err := fetchRelayAuthRecord(supabaseURL, serviceKey, req.RelayID)
+	if errors.Is(err, errRelayUnauthorized) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid relay or pairing secret")
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching relay %s for token exchange: %v", req.RelayID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to communicate with database")
+		return
+	}
+	if relay.PairingSecretHash == nil ||
+		subtle.ConstantTimeCompare([]byte(*relay.PairingSecretHash), []byte(hashPairingSecret(req.PairingSecret))) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "Invalid relay or pairing secret")
+		return
+	}
+	if relay.Status != "claimed" || relay.DeviceTokenID == nil {
+		respondWithJSON(w, http.StatusOK, RelayTokenResponse{RelayID: relay.ID, Status: "pending"})
+		return
+	}
+
+	// Burn the pairing secret so the token can only be collected once.
+	filter := fmt.Sprintf("id=eq.%s&pairing_secret_hash=eq.%s", relay.ID, *relay.PairingSecretHash)
+	n, err := patchRelay(supabaseURL, serviceKey, filter, map[string]interface{}{"pairing_secret_hash": nil})
+	if err != nil {
+		log.Printf("Error clearing pairing secret for relay %s: %v", relay.ID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to issue relay token")
+		return
+	}
+	if n == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Invalid relay or pairing secret")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, RelayTokenResponse{
+		RelayID:     relay.ID,
+		Status:      relay.Status,
+		DeviceToken: relayTokenFor(tokenSecret, relay.ID, *relay.DeviceTokenID),
+	})
+}
+
+// POST /api/relay/token/rotate
+// Authenticated with the relay's current device token; returns a new one and
+// invalidates the old.
+func PostRelayTokenRotateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	tokenSecret := os.Getenv("RELAY_TOKEN_SECRET")
+	if supabaseURL == "" || serviceKey == "" || tokenSecret == "" {
+		log.Println("Error: Missing SUPABASE_URL, SUPABASE_SERVICE_KEY or RELAY_TOKEN_SECRET env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+
+	relay, err := authenticateRelay(r, supabaseURL, serviceKey)
+	if err != nil {
+		respondRelayAuthError(w, err)
+		return
+	}
+
+	newTokenID, err := newRandomID(16)
+	if err != nil {
+		log.Printf("Error generating token id: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	// Only swap if the token we authenticated with is still current, so two
+	// concurrent rotations can't both succeed.
+	filter := fmt.Sprintf("id=eq.%s&device_token_id=eq.%s", relay.ID, *relay.DeviceTokenID)
+	n, err := patchRelay(supabaseURL, serviceKey, filter, map[string]interface{}{"device_token_id": newTokenID})
+	if err != nil {
+		log.Printf("Error rotating token for relay %s: %v", relay.ID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to rotate relay token")
+		return
+	}
+	if n == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or revoked relay token")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, RelayTokenResponse{
+		RelayID:     relay.ID,
+		Status:      relay.Status,
+		DeviceToken: relayTokenFor(tokenSecret, relay.ID, newTokenID),
+	})
+}
+
+// RevokeRelayTokenRequest is the body of POST /api/relay/token/revoke.
+type RevokeRelayTokenRequest struct {
+	RelayID string `json:"relay_id"`
+}
+
+// POST /api/relay/token/revoke
+// Called from the app by a member of the relay's coop. The relay stops being
+// able to talk to the backend until it is paired again.
+func PostRelayTokenRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	jwtSecret := os.Getenv("SUPABASE_JWT_SECRET")
+	if supabaseURL == "" || serviceKey == "" || jwtSecret == "" {
+		log.Println("Error: Missing Supabase environment variables for relay token revoke")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+
+	userID, err := userIDFromRequest(r, jwtSecret)
+	if err != nil {
+		log.Printf("Relay token revoke: %v", err)
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired token")
+		return
+	}
+
+	var req RevokeRelayTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RelayID == "" {
+		respondWithError(w, http.StatusBadRequest, "relay_id is required")
+		return
+	}
+
+	coopID, err := coopIDForUser(supabaseURL, serviceKey, userID)
+	if err != nil {
+		log.Printf("Error fetching coop membership for user %s: %v", userID, err)
+		respondWithError(w, http.StatusForbidden, "User is not part of any coop")
+		return
+	}
+
+	filter := fmt.Sprintf("id=eq.%s&coop_id=eq.%s", url.QueryEscape(req.RelayID), url.QueryEscape(coopID))
+	n, err := patchRelay(supabaseURL, serviceKey, filter, map[string]interface{}{
+		"device_token_id":     nil,
+		"pairing_secret_hash": nil,
+	})
+	if err != nil {
+		log.Printf("Error revoking token for relay %s: %v", req.RelayID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke relay token")
+		return
+	}
+	if n == 0 {
+		respondWithError(w, http.StatusNotFound, "Relay not found in your coop")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"relay_id": req.RelayID, "status": "revoked"})
+}
+
+// userIDFromRequest validates the Supabase JWT in the Authorization header
+// and returns its subject.
+func userIDFromRequest(r *http.Request, jwtSecret string) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+	if authHeader == "" || tokenString == authHeader {
+		return "", errors.New("missing bearer token")
+	}
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(jwtSecret), nil
+	})
+	if err != nil || !token.Valid {
+		return "", fmt.Errorf("invalid JWT: %v", err)
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", errors.New("invalid JWT claims")
+	}
+	userID, ok := claims["sub"].(string)
+	if !ok || userID == "" {
+		return "", errors.New("'sub' claim missing")
+	}
+	return userID, nil
+}
+
+// coopIDForUser returns the coop the user belongs to.
+func coopIDForUser(supabaseURL, serviceKey, userID string) (string, error) {
+	memberURL := fmt.Sprintf("%s/rest/v1/coop_members?user_id=eq.%s&select=coop_id&limit=1", supabaseURL, url.QueryEscape(userID))
+	req, err := http.NewRequest("GET", memberURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("coop membership lookup failed: %s", resp.Status)
+	}
+	var members []CoopMemberRecord
+	if err := json.NewDecoder(resp.Body).Decode(&members); err != nil {
+		return "", err
+	}
+	if len(members) == 0 || members[0].CoopID == "" {
+		return "", errors.New("no coop membership")
+	}
+	return members[0].CoopID, nil
+}
@@ -0,0 +1,373 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Relay cameras
+//
+// A relay can front several cameras. Each is a row in relay_cameras:
+//
+//	id uuid primary key default gen_random_uuid(),
+//	relay_id uuid not null references relays(id) on delete cascade,
+//	label text not null,
+//	source_url text not null,
+//	interval text,
+//	enabled boolean not null default true,
+//	created_at timestamptz not null default now(),
+//	crop jsonb, max_dimension int, jpeg_quality int,  -- see ImageProcessing
+//	burst_frames int, burst_seconds int,              -- see ImageProcessing
+//	privacy_mask jsonb,                               -- see ImageProcessing
+//	schedule jsonb,                                   -- see CaptureSchedule; null uses the relay's
+//	clip jsonb                                        -- see ClipSettings; null records no clips
+//
+// and snapshots.camera_id uuid null references relay_cameras(id) on delete set null.
+// A relay with no camera rows keeps using relays.rtsp_url and relays.interval.
+
+// RelayCamera is one camera under a relay.
+type RelayCamera struct {
+	ID        string           `json:"id"`
+	RelayID   string           `json:"relay_id"`
+	Label     string           `json:"label"`
+	SourceURL string           `json:"source_url"`
+	Interval  *string          `json:"interval"`
+	Enabled   bool             `json:"enabled"`
+	CreatedAt string           `json:"created_at,omitempty"`
+	Schedule  *CaptureSchedule `json:"schedule"`
+	Clip      *ClipSettings    `json:"clip"`
+	ImageProcessing
+}
+
+// UpsertRelayCameraRequest is the body of POST /api/relay/cameras. Without
+// camera_id a new camera is created; with it the camera is updated.
+type UpsertRelayCameraRequest struct {
+	RelayID   string           `json:"relay_id"`
+	CameraID  string           `json:"camera_id,omitempty"`
+	Label     string           `json:"label"`
+	SourceURL string           `json:"source_url"`
+	Interval  *string          `json:"interval"`
+	Enabled   *bool            `json:"enabled"`
+	Schedule  *CaptureSchedule `json:"schedule"`
+	// ClearSchedule removes the camera's own schedule so it follows the relay's.
+	ClearSchedule bool          `json:"clear_schedule,omitempty"`
+	Clip          *ClipSettings `json:"clip"`
+	// ClearClip stops the camera recording clips.
+	ClearClip bool `json:"clear_clip,omitempty"`
+	ImageProcessing
+}
+
+const relayCameraColumns = "id,relay_id,label,source_url,interval,enabled,created_at,schedule,clip," + imageProcessingColumns
+
+// cameraIntervalPattern matches the "30s" / "10m" / "1h" strings relays accept.
+var cameraIntervalPattern = regexp.MustCompile(`^\d+[smh]$`)
+
+// validateSourceURL checks a camera source: an rtsp:// stream, or an http(s)://
+// snapshot (one JPEG per request) or MJPEG URL. The relay tells the two HTTP
+// kinds apart by the response's Content-Type. Credentials, if any, go in the
+// URL and are used for Basic or Digest auth. push:// marks a camera that
+// uploads its images to the relay's FTP or HTTP ingest server instead of
+// being polled.
+func validateSourceURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || strings.ContainsAny(raw, " \t\r\n") {
+		return errors.New("source_url is not a valid URL")
+	}
+	switch u.Scheme {
+	case "rtsp", "rtsps", "http", "https":
+	case "push":
+		return nil
+	default:
+		return errors.New("source_url must be an rtsp://, http://, https:// or push:// URL")
+	}
+	if u.Hostname() == "" {
+		return errors.New("source_url must include a host")
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return errors.New("source_url has an invalid port")
+		}
+	}
+	if u.User != nil && u.User.Username() == "" {
+		return errors.New("source_url has a password but no username")
+	}
+	if u.Fragment != "" {
+		return errors.New("source_url must not have a #fragment")
+	}
+	return nil
+}
+
+var errCameraNotFound = errors.New("camera not found")
+
+// cameraRequest sends a PostgREST request against relay_cameras and decodes
+// the returned rows.
+func cameraRequest(method, supabaseURL, serviceKey, query string, payload interface{}) ([]RelayCamera, error) {
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, supabaseURL+"/rest/v1/relay_cameras?"+query, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=representation")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("relay_cameras %s failed: %s: %s", method, resp.Status, string(b))
+	}
+	var cameras []RelayCamera
+	if err := json.NewDecoder(resp.Body).Decode(&cameras); err != nil {
+		return nil, err
+	}
+	return cameras, nil
+}
+
+// fetchRelayCameras lists a relay's cameras, oldest first.
+func fetchRelayCameras(supabaseURL, serviceKey, relayID string, enabledOnly bool) ([]RelayCamera, error) {
+	query := fmt.Sprintf("relay_id=eq.%s&select=%s&order=created_at.asc", url.QueryEscape(relayID), relayCameraColumns)
+	if enabledOnly {
+		query += "&enabled=eq.true"
+	}
+	return cameraRequest("GET", supabaseURL, serviceKey, query, nil)
+}
+
+// fetchRelayCamera loads one camera of a relay, or errCameraNotFound if the
+// camera does not exist or belongs to another relay.
+func fetchRelayCamera(supabaseURL, serviceKey, relayID, cameraID string) (*RelayCamera, error) {
+	query := fmt.Sprintf("id=eq.%s&relay_id=eq.%s&select=%s", url.QueryEscape(cameraID), url.QueryEscape(relayID), relayCameraColumns)
+	cameras, err := cameraRequest("GET", supabaseURL, serviceKey, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(cameras) == 0 {
+		return nil, errCameraNotFound
+	}
+	return &cameras[0], nil
+}
+
+// authorizeRelayForUser checks that the request's user JWT belongs to the
+// coop the relay is claimed by. It writes the error response itself.
+func authorizeRelayForUser(w http.ResponseWriter, r *http.Request, supabaseURL, serviceKey, relayID string) bool {
+	jwtSecret := os.Getenv("SUPABASE_JWT_SECRET")
+	if jwtSecret == "" {
+		log.Println("Error: Missing SUPABASE_JWT_SECRET")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return false
+	}
+	userID, err := userIDFromRequest(r, jwtSecret)
+	if err != nil {
+		log.Printf("Relay cameras: %v", err)
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired token")
+		return false
+	}
+	coopID, err := coopIDForUser(supabaseURL, serviceKey, userID)
+	if err != nil {
+		log.Printf("Error fetching coop membership for user %s: %v", userID, err)
+		respondWithError(w, http.StatusForbidden, "User is not part of any coop")
+		return false
+	}
+	relay, err := fetchRelayAuthRecord(supabaseURL, serviceKey, relayID)
+	if errors.Is(err, errRelayUnauthorized) || (err == nil && (relay.CoopID == nil || *relay.CoopID != coopID)) {
+		respondWithError(w, http.StatusNotFound, "Relay not found in your coop")
+		return false
+	}
+	if err != nil {
+		log.Printf("Error fetching relay %s: %v", relayID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to communicate with database")
+		return false
+	}
+	return true
+}
+
+// GET /api/relay/cameras?relay_id=<relay_id> (user JWT)
+func GetRelayCamerasHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+
+	relayID := r.URL.Query().Get("relay_id")
+	if relayID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing relay_id")
+		return
+	}
+	if !authorizeRelayForUser(w, r, supabaseURL, serviceKey, relayID) {
+		return
+	}
+
+	cameras, err := fetchRelayCameras(supabaseURL, serviceKey, relayID, false)
+	if err != nil {
+		log.Printf("Error listing cameras for relay %s: %v", relayID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to list cameras")
+		return
+	}
+	if cameras == nil {
+		cameras = []RelayCamera{}
+	}
+	respondWithJSON(w, http.StatusOK, cameras)
+}
+
+// POST /api/relay/cameras (user JWT)
+func PostRelayCameraHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+
+	var req UpsertRelayCameraRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.RelayID == "" {
+		respondWithError(w, http.StatusBadRequest, "relay_id is required")
+		return
+	}
+	if req.CameraID == "" && (strings.TrimSpace(req.Label) == "" || req.SourceURL == "") {
+		respondWithError(w, http.StatusBadRequest, "label and source_url are required for a new camera")
+		return
+	}
+	if req.SourceURL != "" {
+		if err := validateSourceURL(req.SourceURL); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if req.Interval != nil && !cameraIntervalPattern.MatchString(*req.Interval) {
+		respondWithError(w, http.StatusBadRequest, "interval must look like 30s, 10m or 1h")
+		return
+	}
+	if err := req.ImageProcessing.validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Schedule != nil {
+		if err := req.Schedule.validate(); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if req.Clip != nil {
+		if err := req.Clip.validate(); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if !authorizeRelayForUser(w, r, supabaseURL, serviceKey, req.RelayID) {
+		return
+	}
+
+	payload := map[string]interface{}{}
+	if req.Label != "" {
+		payload["label"] = strings.TrimSpace(req.Label)
+	}
+	if req.SourceURL != "" {
+		payload["source_url"] = req.SourceURL
+	}
+	if req.Interval != nil {
+		payload["interval"] = *req.Interval
+	}
+	if req.Enabled != nil {
+		payload["enabled"] = *req.Enabled
+	}
+	req.ImageProcessing.addToPayload(payload)
+	switch {
+	case req.ClearSchedule:
+		payload["schedule"] = nil
+	case req.Schedule != nil:
+		payload["schedule"] = req.Schedule
+	}
+	switch {
+	case req.ClearClip:
+		payload["clip"] = nil
+	case req.Clip != nil:
+		payload["clip"] = req.Clip
+	}
+
+	var cameras []RelayCamera
+	var err error
+	status := http.StatusOK
+	if req.CameraID == "" {
+		payload["relay_id"] = req.RelayID
+		cameras, err = cameraRequest("POST", supabaseURL, serviceKey, "select="+relayCameraColumns, payload)
+		status = http.StatusCreated
+	} else {
+		query := fmt.Sprintf("id=eq.%s&relay_id=eq.%s&select=%s", url.QueryEscape(req.CameraID), url.QueryEscape(req.RelayID), relayCameraColumns)
+		cameras, err = cameraRequest("PATCH", supabaseURL, serviceKey, query, payload)
+	}
+	if err != nil {
+		log.Printf("Error saving camera for relay %s: %v", req.RelayID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to save camera")
+		return
+	}
+	if len(cameras) == 0 {
+		respondWithError(w, http.StatusNotFound, "Camera not found")
+		return
+	}
+	respondWithJSON(w, status, cameras[0])
+}
+
+// DELETE /api/relay/cameras?relay_id=<relay_id>&camera_id=<camera_id> (user JWT)
+// Snapshots keep their images; their camera_id is cleared by the foreign key.
+func DeleteRelayCameraHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+
+	relayID := r.URL.Query().Get("relay_id")
+	cameraID := r.URL.Query().Get("camera_id")
+	if relayID == "" || cameraID == "" {
+		respondWithError(w, http.StatusBadRequest, "relay_id and camera_id are required")
+		return
+	}
+	if !authorizeRelayForUser(w, r, supabaseURL, serviceKey, relayID) {
+		return
+	}
+
+	query := fmt.Sprintf("id=eq.%s&relay_id=eq.%s", url.QueryEscape(cameraID), url.QueryEscape(relayID))
+	cameras, err := cameraRequest("DELETE", supabaseURL, serviceKey, query, nil)
+	if err != nil {
+		log.Printf("Error deleting camera %s: %v", cameraID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete camera")
+		return
+	}
+	if len(cameras) == 0 {
+		respondWithError(w, http.StatusNotFound, "Camera not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,570 @@
+package api
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Relay commands
+//
+// The app queues commands for a relay; the relay long-polls for them,
+// acknowledges each one before running it and reports the result. Rows live
+// in relay_commands:
+//
+//	id uuid primary key default gen_random_uuid(),
+//	relay_id uuid not null references relays(id) on delete cascade,
+//	command text not null,
+//	args jsonb,
+//	status text not null default 'pending',  -- pending, acked, succeeded, failed
+//	result jsonb,
+//	error text,
+//	created_by uuid,
+//	created_at timestamptz not null default now(),
+//	expires_at timestamptz not null,
+//	acked_at timestamptz,
+//	completed_at timestamptz
+//
+// A command the relay hasn't acknowledged by expires_at is never delivered
+// and reads back as "expired". Acknowledging only succeeds once, so a command
+// delivered twice (a lost poll response) still runs once.
+//
+// Args of sealedCommands carry camera credentials. They are stored
+// encrypted, opened only in the relay's own poll response, cleared once the
+// relay acknowledges the command or it expires, and never listed to users.
+
+// RelayCommand is one queued command.
+type RelayCommand struct {
+	ID          string          `json:"id"`
+	RelayID     string          `json:"relay_id"`
+	Command     string          `json:"command"`
+	Args        json.RawMessage `json:"args,omitempty"`
+	Status      string          `json:"status"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Error       *string         `json:"error,omitempty"`
+	CreatedAt   string          `json:"created_at,omitempty"`
+	ExpiresAt   time.Time       `json:"expires_at"`
+	AckedAt     *string         `json:"acked_at,omitempty"`
+	CompletedAt *string         `json:"completed_at,omitempty"`
+}
+
+// EnqueueRelayCommandRequest is the body of POST /api/relay/commands.
+type EnqueueRelayCommandRequest struct {
+	RelayID string          `json:"relay_id"`
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+// RelayCommandResultRequest is the body of POST /api/relay/commands/result.
+type RelayCommandResultRequest struct {
+	CommandID string          `json:"command_id"`
+	Status    string          `json:"status"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+const (
+	commandStatusPending   = "pending"
+	commandStatusAcked     = "acked"
+	commandStatusSucceeded = "succeeded"
+	commandStatusFailed    = "failed"
+	commandStatusExpired   = "expired" // derived, never stored
+
+	relayCommandColumns = "id,relay_id,command,args,status,result,error,created_at,expires_at,acked_at,completed_at"
+	// relayCommandListColumns leaves args out of what users see.
+	relayCommandListColumns = "id,relay_id,command,status,result,error,created_at,expires_at,acked_at,completed_at"
+
+	// commandTTL is how long a queued command waits for the relay. "Take a
+	// picture now" is pointless an hour later.
+	commandTTL = 10 * time.Minute
+
+	defaultCommandPollWait = 25 * time.Second
+	maxCommandPollWait     = 30 * time.Second
+	// A waiting poll re-reads the table every step, starting at
+	// minCommandPollStep and doubling up to maxCommandPollStep, so each
+	// connected relay costs well under one query a second. Commands queued
+	// through this instance wake the poll at once.
+	minCommandPollStep = 2 * time.Second
+	maxCommandPollStep = 10 * time.Second
+
+	maxCommandArgsBytes   = 4 << 10
+	maxCommandResultBytes = 256 << 10
+)
+
+// commandWakers holds, per relay, a channel that is closed when a command is
+// queued for it, waking its long polls on this instance.
+var commandWakers = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: make(map[string]chan struct{})}
+
+func commandWaker(relayID string) <-chan struct{} {
+	commandWakers.Lock()
+	defer commandWakers.Unlock()
+	ch, ok := commandWakers.m[relayID]
+	if !ok {
+		ch = make(chan struct{})
+		commandWakers.m[relayID] = ch
+	}
+	return ch
+}
+
+func wakeCommandPolls(relayID string) {
+	commandWakers.Lock()
+	defer commandWakers.Unlock()
+	if ch, ok := commandWakers.m[relayID]; ok {
+		close(ch)
+		delete(commandWakers.m, relayID)
+	}
+}
+
+// relayCommandNames are the commands a relay understands.
+var relayCommandNames = map[string]bool{
+	"capture_now":   true,
+	"reload_config": true,
+	// runs the relay's self-checks; the report is the result and is also
+	// stored for GET /api/relay/doctor.
+	"run_diagnostics": true,
+	// args { since } is optional (a duration, default 1h, at most 24h); the
+	// relay uploads that much of its log to POST /api/relay/logs.
+	"upload_logs": true,
+	"restart":     true,
+	// args may carry the cameras' ONVIF username and password.
+	"discover_cameras": true,
+	// args { camera_id, seconds } are optional; the camera's clip length
+	// (or 15s) is used when seconds is omitted.
+	"record_clip": true,
+}
+
+// sealedCommands are the commands whose args are stored encrypted.
+var sealedCommands = map[string]bool{
+	"discover_cameras": true,
+}
+
+var errCommandNotPending = errors.New("command is not awaiting this step")
+
+// commandArgsCipher is AES-256-GCM under a key derived from the relay token
+// secret, so no separate key has to be configured.
+func commandArgsCipher(secret string) (cipher.AEAD, error) {
+	if secret == "" {
+		return nil, errors.New("missing RELAY_TOKEN_SECRET env var")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("relay command args"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealCommandArgs encrypts args for storage as { "sealed": <base64> }. The
+// relay ID is bound in, so the row can't be moved to another relay.
+func sealCommandArgs(secret, relayID string, args json.RawMessage) (json.RawMessage, error) {
+	aead, err := commandArgsCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, args, []byte(relayID))
+	return json.Marshal(map[string]string{"sealed": base64.StdEncoding.EncodeToString(sealed)})
+}
+
+// openCommandArgs reverses sealCommandArgs.
+func openCommandArgs(secret, relayID string, stored json.RawMessage) (json.RawMessage, error) {
+	var wrapper struct {
+		Sealed []byte `json:"sealed"`
+	}
+	if err := json.Unmarshal(stored, &wrapper); err != nil || wrapper.Sealed == nil {
+		return nil, errors.New("args are not sealed")
+	}
+	aead, err := commandArgsCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapper.Sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed args are truncated")
+	}
+	nonce, ciphertext := wrapper.Sealed[:aead.NonceSize()], wrapper.Sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(relayID))
+}
+
+// clearCommandArgs drops a finished or acknowledged command's credentials.
+func clearCommandArgs(supabaseURL, serviceKey string, cmd *RelayCommand) *RelayCommand {
+	if !sealedCommands[cmd.Command] || len(cmd.Args) == 0 {
+		return cmd
+	}
+	query := fmt.Sprintf("id=eq.%s&select=%s", url.QueryEscape(cmd.ID), relayCommandColumns)
+	cleared, err := commandRequest("PATCH", supabaseURL, serviceKey, query, map[string]interface{}{"args": nil})
+	if err != nil || len(cleared) == 0 {
+		log.Printf("Error clearing credentials of command %s: %v", cmd.ID, err)
+		return cmd
+	}
+	return &cleared[0]
+}
+
+// clearExpiredCommandArgs drops the credentials of the relay's commands that
+// expired without being acknowledged.
+func clearExpiredCommandArgs(supabaseURL, serviceKey, relayID string) {
+	names := make([]string, 0, len(sealedCommands))
+	for name := range sealedCommands {
+		names = append(names, name)
+	}
+	query := fmt.Sprintf("relay_id=eq.%s&command=in.(%s)&status=eq.%s&expires_at=lte.%s&args=not.is.null&select=id",
+		url.QueryEscape(relayID), strings.Join(names, ","), commandStatusPending, url.QueryEscape(time.Now().UTC().Format(time.RFC3339)))
+	if _, err := commandRequest("PATCH", supabaseURL, serviceKey, query, map[string]interface{}{"args": nil}); err != nil {
+		log.Printf("Error clearing credentials of expired commands for relay %s: %v", relayID, err)
+	}
+}
+
+// commandRequest sends a PostgREST request against relay_commands and decodes
+// the returned rows.
+func commandRequest(method, supabaseURL, serviceKey, query string, payload interface{}) ([]RelayCommand, error) {
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, supabaseURL+"/rest/v1/relay_commands?"+query, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=representation")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("relay_commands %s failed: %s: %s", method, resp.Status, string(b))
+	}
+	var commands []RelayCommand
+	if err := json.NewDecoder(resp.Body).Decode(&commands); err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+// advanceCommand moves one of the relay's commands from status from to the
+// fields in payload, or returns errCommandNotPending if it isn't in status
+// from (already acknowledged, finished, expired or not this relay's).
+func advanceCommand(supabaseURL, serviceKey, relayID, commandID, from string, payload map[string]interface{}) (*RelayCommand, error) {
+	query := fmt.Sprintf("id=eq.%s&relay_id=eq.%s&status=eq.%s&select=%s",
+		url.QueryEscape(commandID), url.QueryEscape(relayID), from, relayCommandColumns)
+	if from == commandStatusPending {
+		query += "&expires_at=gt." + url.QueryEscape(time.Now().UTC().Format(time.RFC3339))
+	}
+	commands, err := commandRequest("PATCH", supabaseURL, serviceKey, query, payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(commands) == 0 {
+		return nil, errCommandNotPending
+	}
+	return &commands[0], nil
+}
+
+// effectiveStatus reports pending commands past their expiry as expired.
+func (c *RelayCommand) effectiveStatus(now time.Time) {
+	if c.Status == commandStatusPending && !c.ExpiresAt.After(now) {
+		c.Status = commandStatusExpired
+	}
+}
+
+// POST /api/relay/commands (user JWT)
+func PostRelayCommandHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+
+	var req EnqueueRelayCommandRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCommandArgsBytes+1024)).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.RelayID == "" || !relayCommandNames[req.Command] {
+		respondWithError(w, http.StatusBadRequest, "relay_id and a command of capture_now, reload_config, run_diagnostics, upload_logs, restart, discover_cameras or record_clip are required")
+		return
+	}
+	if len(req.Args) > maxCommandArgsBytes {
+		respondWithError(w, http.StatusBadRequest, "args too large")
+		return
+	}
+	if !authorizeRelayForUser(w, r, supabaseURL, serviceKey, req.RelayID) {
+		return
+	}
+
+	payload := map[string]interface{}{
+		"relay_id":   req.RelayID,
+		"command":    req.Command,
+		"status":     commandStatusPending,
+		"expires_at": time.Now().Add(commandTTL).UTC().Format(time.RFC3339),
+	}
+	if len(req.Args) > 0 && string(req.Args) != "null" {
+		payload["args"] = req.Args
+		if sealedCommands[req.Command] {
+			sealed, err := sealCommandArgs(os.Getenv("RELAY_TOKEN_SECRET"), req.RelayID, req.Args)
+			if err != nil {
+				log.Printf("Error sealing %s args: %v", req.Command, err)
+				respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+				return
+			}
+			payload["args"] = sealed
+		}
+	}
+	// authorizeRelayForUser already checked the token.
+	if userID, err := userIDFromRequest(r, os.Getenv("SUPABASE_JWT_SECRET")); err == nil {
+		payload["created_by"] = userID
+	}
+	commands, err := commandRequest("POST", supabaseURL, serviceKey, "select="+relayCommandColumns, payload)
+	if err != nil || len(commands) == 0 {
+		log.Printf("Error queueing %s for relay %s: %v", req.Command, req.RelayID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to queue command")
+		return
+	}
+	wakeCommandPolls(req.RelayID)
+	commands[0].Args = nil
+	respondWithJSON(w, http.StatusCreated, commands[0])
+}
+
+// GET /api/relay/commands?relay_id=<relay_id>[&command_id=<id>] (user JWT)
+// Lists the relay's most recent commands, newest first, so the app can show
+// results.
+func GetRelayCommandsHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+
+	relayID := r.URL.Query().Get("relay_id")
+	if relayID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing relay_id")
+		return
+	}
+	if !authorizeRelayForUser(w, r, supabaseURL, serviceKey, relayID) {
+		return
+	}
+
+	clearExpiredCommandArgs(supabaseURL, serviceKey, relayID)
+	query := fmt.Sprintf("relay_id=eq.%s&select=%s&order=created_at.desc&limit=50", url.QueryEscape(relayID), relayCommandListColumns)
+	if commandID := r.URL.Query().Get("command_id"); commandID != "" {
+		query += "&id=eq." + url.QueryEscape(commandID)
+	}
+	commands, err := commandRequest("GET", supabaseURL, serviceKey, query, nil)
+	if err != nil {
+		log.Printf("Error listing commands for relay %s: %v", relayID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to list commands")
+		return
+	}
+	now := time.Now()
+	for i := range commands {
+		commands[i].effectiveStatus(now)
+	}
+	if commands == nil {
+		commands = []RelayCommand{}
+	}
+	respondWithJSON(w, http.StatusOK, commands)
+}
+
+// GET /api/relay/commands/poll?wait=<seconds> (relay device token)
+// Long-polls for pending commands: returns as soon as there are any, or an
+// empty list after wait seconds (default 25, at most 30).
+func GetRelayCommandsPollHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+	relay, err := authenticateRelay(r, supabaseURL, serviceKey)
+	if err != nil {
+		respondRelayAuthError(w, err)
+		return
+	}
+
+	wait := defaultCommandPollWait
+	if s := r.URL.Query().Get("wait"); s != "" {
+		secs, err := strconv.Atoi(s)
+		if err != nil || secs < 0 {
+			respondWithError(w, http.StatusBadRequest, "wait must be a number of seconds")
+			return
+		}
+		wait = min(time.Duration(secs)*time.Second, maxCommandPollWait)
+	}
+
+	clearExpiredCommandArgs(supabaseURL, serviceKey, relay.ID)
+	deadline := time.Now().Add(wait)
+	step := minCommandPollStep
+	for {
+		// Take the waker before querying so a command queued in between
+		// still wakes this poll.
+		woken := commandWaker(relay.ID)
+		query := fmt.Sprintf("relay_id=eq.%s&status=eq.%s&expires_at=gt.%s&select=%s&order=created_at.asc&limit=20",
+			url.QueryEscape(relay.ID), commandStatusPending, url.QueryEscape(time.Now().UTC().Format(time.RFC3339)), relayCommandColumns)
+		commands, err := commandRequest("GET", supabaseURL, serviceKey, query, nil)
+		if err != nil {
+			log.Printf("Error polling commands for relay %s: %v", relay.ID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to poll commands")
+			return
+		}
+		if len(commands) > 0 || !time.Now().Before(deadline) {
+			if commands == nil {
+				commands = []RelayCommand{}
+			}
+			for i := range commands {
+				if !sealedCommands[commands[i].Command] || len(commands[i].Args) == 0 {
+					continue
+				}
+				args, err := openCommandArgs(os.Getenv("RELAY_TOKEN_SECRET"), relay.ID, commands[i].Args)
+				if err != nil {
+					log.Printf("Error opening args of command %s: %v", commands[i].ID, err)
+				}
+				commands[i].Args = args
+			}
+			respondWithJSON(w, http.StatusOK, commands)
+			return
+		}
+		timer := time.NewTimer(min(step, time.Until(deadline)))
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return
+		case <-woken:
+			timer.Stop()
+		case <-timer.C:
+			step = min(step*2, maxCommandPollStep)
+		}
+	}
+}
+
+// POST /api/relay/commands/ack (relay device token)
+// Body: { command_id }. The relay must acknowledge a command before running
+// it; 409 means it was already acknowledged or has expired and must not run.
+func PostRelayCommandAckHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+	relay, err := authenticateRelay(r, supabaseURL, serviceKey)
+	if err != nil {
+		respondRelayAuthError(w, err)
+		return
+	}
+
+	var req struct {
+		CommandID string `json:"command_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CommandID == "" {
+		respondWithError(w, http.StatusBadRequest, "command_id is required")
+		return
+	}
+
+	cmd, err := advanceCommand(supabaseURL, serviceKey, relay.ID, req.CommandID, commandStatusPending, map[string]interface{}{
+		"status":   commandStatusAcked,
+		"acked_at": time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if errors.Is(err, errCommandNotPending) {
+		respondWithError(w, http.StatusConflict, "Command already acknowledged or expired")
+		return
+	}
+	if err != nil {
+		log.Printf("Error acknowledging command %s: %v", req.CommandID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to acknowledge command")
+		return
+	}
+	// The relay got the args with the poll; it doesn't need them again.
+	cmd = clearCommandArgs(supabaseURL, serviceKey, cmd)
+	respondWithJSON(w, http.StatusOK, cmd)
+}
+
+// POST /api/relay/commands/result (relay device token)
+// Reports how an acknowledged command went.
+func PostRelayCommandResultHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+	relay, err := authenticateRelay(r, supabaseURL, serviceKey)
+	if err != nil {
+		respondRelayAuthError(w, err)
+		return
+	}
+
+	var req RelayCommandResultRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCommandResultBytes+4096)).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.CommandID == "" || (req.Status != commandStatusSucceeded && req.Status != commandStatusFailed) {
+		respondWithError(w, http.StatusBadRequest, "command_id and a status of succeeded or failed are required")
+		return
+	}
+	if len(req.Result) > maxCommandResultBytes {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "result too large")
+		return
+	}
+
+	payload := map[string]interface{}{
+		"status":       req.Status,
+		"completed_at": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if len(req.Result) > 0 && string(req.Result) != "null" {
+		payload["result"] = req.Result
+	}
+	if req.Error != "" {
+		payload["error"] = truncateText(req.Error, maxTelemetryText)
+	}
+	cmd, err := advanceCommand(supabaseURL, serviceKey, relay.ID, req.CommandID, commandStatusAcked, payload)
+	if errors.Is(err, errCommandNotPending) {
+		respondWithError(w, http.StatusConflict, "Command is not awaiting a result")
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving result for command %s: %v", req.CommandID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to save command result")
+		return
+	}
+	cmd = clearCommandArgs(supabaseURL, serviceKey, cmd)
+	respondWithJSON(w, http.StatusOK, cmd)
+}
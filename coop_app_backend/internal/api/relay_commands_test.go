@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func pollCommands(t *testing.T, wait string) []RelayCommand {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/relay/commands/poll?wait="+wait, nil)
+	req.Header.Set("Authorization", "Bearer "+relayTokenFor("token-secret", testRelayID, "token-1"))
+	rec := httptest.NewRecorder()
+	GetRelayCommandsPollHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/relay/commands/poll = %d %s", rec.Code, rec.Body.String())
+	}
+	var commands []RelayCommand
+	if err := json.Unmarshal(rec.Body.Bytes(), &commands); err != nil {
+		t.Fatal(err)
+	}
+	return commands
+}
+
+func TestCommandPollBacksOff(t *testing.T) {
+	store := newFakeRelayStore(t)
+
+	start := time.Now()
+	if commands := pollCommands(t, "5"); len(commands) != 0 {
+		t.Fatalf("poll returned %d commands", len(commands))
+	}
+	if elapsed := time.Since(start); elapsed < 5*time.Second {
+		t.Errorf("poll returned after %v, want the full 5s wait", elapsed)
+	}
+	// Queries at 0s, 2s and the 5s deadline.
+	if store.commandPolls > 3 {
+		t.Errorf("%d queries during a 5s poll, want at most 3", store.commandPolls)
+	}
+}
+
+func TestCommandPollWakes(t *testing.T) {
+	store := newFakeRelayStore(t)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		store.mu.Lock()
+		store.commands = []map[string]interface{}{{"id": "cmd-1", "relay_id": testRelayID, "command": "capture_now", "status": commandStatusPending}}
+		store.mu.Unlock()
+		wakeCommandPolls(testRelayID)
+	}()
+	start := time.Now()
+	commands := pollCommands(t, "30")
+	if len(commands) != 1 || commands[0].ID != "cmd-1" {
+		t.Fatalf("poll returned %+v", commands)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("queued command took %v to reach the poll", elapsed)
+	}
+}
+
+func TestDiscoverCamerasCredentials(t *testing.T) {
+	store := newFakeRelayStore(t)
+	t.Setenv("SUPABASE_JWT_SECRET", "jwt-secret")
+	userToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user-1"}).SignedString([]byte("jwt-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := httptest.NewRequest(http.MethodPost, "/api/relay/commands", strings.NewReader(`{
+		"relay_id": "`+testRelayID+`",
+		"command": "discover_cameras",
+		"args": {"username": "admin", "password": "hunter2"}
+	}`))
+	post.Header.Set("Authorization", "Bearer "+userToken)
+	rec := httptest.NewRecorder()
+	PostRelayCommandHandler(rec, post)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /api/relay/commands = %d %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "hunter2") {
+		t.Errorf("POST response carries the password: %s", rec.Body.String())
+	}
+	store.mu.Lock()
+	stored, _ := json.Marshal(store.commands[0]["args"])
+	store.mu.Unlock()
+	if strings.Contains(string(stored), "hunter2") || strings.Contains(string(stored), "admin") {
+		t.Fatalf("credentials stored in plain text: %s", stored)
+	}
+
+	list := func() string {
+		get := httptest.NewRequest(http.MethodGet, "/api/relay/commands?relay_id="+testRelayID, nil)
+		get.Header.Set("Authorization", "Bearer "+userToken)
+		rec := httptest.NewRecorder()
+		GetRelayCommandsHandler(rec, get)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /api/relay/commands = %d %s", rec.Code, rec.Body.String())
+		}
+		return rec.Body.String()
+	}
+	if body := list(); strings.Contains(body, `"args"`) {
+		t.Errorf("command list carries args: %s", body)
+	}
+
+	commands := pollCommands(t, "0")
+	var args struct{ Username, Password string }
+	if len(commands) != 1 || json.Unmarshal(commands[0].Args, &args) != nil || args.Username != "admin" || args.Password != "hunter2" {
+		t.Fatalf("poll returned %+v, want the opened credentials", commands)
+	}
+
+	ack := httptest.NewRequest(http.MethodPost, "/api/relay/commands/ack", strings.NewReader(`{"command_id":"cmd-1"}`))
+	ack.Header.Set("Authorization", "Bearer "+relayTokenFor("token-secret", testRelayID, "token-1"))
+	rec = httptest.NewRecorder()
+	PostRelayCommandAckHandler(rec, ack)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /api/relay/commands/ack = %d %s", rec.Code, rec.Body.String())
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.commands[0]["args"] != nil {
+		t.Errorf("args kept after the ack: %v", store.commands[0]["args"])
+	}
+	// Listing and polling also clear what expired unacknowledged.
+	sweeps := 0
+	for _, q := range store.commandPatches {
+		if strings.Contains(q, "expires_at=lte.") && strings.Contains(q, "args=not.is.null") {
+			sweeps++
+		}
+	}
+	if sweeps != 2 {
+		t.Errorf("%d expired-args sweeps in %q, want 2", sweeps, store.commandPatches)
+	}
+}
+
+func TestSealedCommandArgsBoundToRelay(t *testing.T) {
+	args := json.RawMessage(`{"password":"hunter2"}`)
+	sealed, err := sealCommandArgs("secret", testRelayID, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := openCommandArgs("secret", testRelayID, sealed); err != nil || string(opened) != string(args) {
+		t.Fatalf("open = %s, %v", opened, err)
+	}
+	if _, err := openCommandArgs("secret", "22222222-2222-2222-2222-222222222222", sealed); err == nil {
+		t.Error("another relay opened the args")
+	}
+	if _, err := openCommandArgs("other-secret", testRelayID, sealed); err == nil {
+		t.Error("args opened under another secret")
+	}
+	if _, err := openCommandArgs("secret", testRelayID, args); err == nil {
+		t.Error("plain args opened as sealed")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 )
 
@@ -18,18 +19,20 @@ type SupabaseRelayRecord struct {
 	Interval   *string `json:"interval"`
 	RTSPUrl    *string `json:"rtsp_url"`
 	PairingCode *string `json:"pairing_code,omitempty"` // Only needed if querying by it, but good for full model
+	Schedule    *CaptureSchedule `json:"schedule"`
+	Clip        *ClipSettings    `json:"clip"` // legacy single-camera clip recording
+	ImageProcessing // legacy single-camera crop/resize/quality/burst
 }
 
 // RelayConfigResponseByPairingCode defines the JSON response structure when querying by pairing_code.
+// The caller is unauthenticated, so it only learns whether the relay has been
+// claimed; the config itself needs the device token.
 type RelayConfigResponseByPairingCode struct {
-	RelayID  string  `json:"relay_id"`
-	Status   string  `json:"status"`
-	CoopID   *string `json:"coop_id,omitempty"`
-	Interval *string `json:"interval,omitempty"`
-	RTSPUrl  *string `json:"rtsp_url,omitempty"`
+	RelayID string `json:"relay_id"`
+	Status  string `json:"status"`
 }
 
-// GET /api/relay/config?relay_id=<uuid> OR /api/relay/config?pairing_code=<string>
+// GET /api/relay/config (relay device token) OR /api/relay/config?pairing_code=<string>
 func GetRelayConfigHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
@@ -49,9 +52,24 @@ func GetRelayConfigHandler(w http.ResponseWriter, r *http.Request) {
 
 	client := &http.Client{}
 
+	// Relays identify themselves with their device token; relay_id in the
+	// query is optional but must match the token when given.
+	if r.Header.Get("Authorization") != "" || relayID != "" {
+		relay, err := authenticateRelay(r, supabaseURL, serviceKey)
+		if err != nil {
+			respondRelayAuthError(w, err)
+			return
+		}
+		if relayID != "" && relayID != relay.ID {
+			respondWithError(w, http.StatusForbidden, "relay_id does not match relay token")
+			return
+		}
+		relayID = relay.ID
+	}
+
 	if relayID != "" {
 		// Logic for handling request by relay_id (existing behavior)
-		relayURL := supabaseURL + "/rest/v1/relays?id=eq." + relayID + "&select=id,status,coop_id,interval,rtsp_url"
+		relayURL := supabaseURL + "/rest/v1/relays?id=eq." + url.QueryEscape(relayID) + "&select=id,status,coop_id,interval,rtsp_url,schedule,clip," + imageProcessingColumns
 		req, err := http.NewRequest("GET", relayURL, nil)
 		if err != nil {
 			log.Printf("Error creating request for relay_id %s: %v", relayID, err)
@@ -81,25 +99,65 @@ func GetRelayConfigHandler(w http.ResponseWriter, r *http.Request) {
 			if len(relays) > 0 {
 				row := relays[0]
 				if row.Status == "claimed" && row.CoopID != nil && *row.CoopID != "" {
+					// A relay with no camera rows uses the legacy single-camera
+					// fields; an error here must not look like "no cameras".
+					cameras, err := fetchRelayCameras(supabaseURL, serviceKey, relayID, true)
+					if err != nil {
+						log.Printf("Error fetching cameras for relay_id %s: %v", relayID, err)
+						respondWithError(w, http.StatusInternalServerError, "Failed to load relay cameras.")
+						return
+					}
+					if cameras == nil {
+						cameras = []RelayCamera{}
+					}
+					// Cameras without their own schedule follow the relay's.
+					// Sun-based windows need the coop's location; without it
+					// the relay just never matches them.
+					var location *CoopLocation
+					if row.Schedule != nil || camerasHaveSchedule(cameras) {
+						location, err = fetchCoopLocation(supabaseURL, serviceKey, *row.CoopID)
+						if err != nil {
+							log.Printf("Error fetching location for coop %s: %v", *row.CoopID, err)
+						}
+					}
+					for i := range cameras {
+						if cameras[i].Schedule == nil {
+							cameras[i].Schedule = row.Schedule
+						}
+						cameras[i].Schedule = cameras[i].Schedule.withLocation(location)
+					}
 					// If interval or rtsp_url are null in DB, they will be null in JSON
 					respondWithJSON(w, http.StatusOK, map[string]interface{}{
-						"interval": row.Interval,
-						"rtsp_url": row.RTSPUrl,
+						"interval":      row.Interval,
+						"rtsp_url":      row.RTSPUrl,
+						"schedule":      row.Schedule.withLocation(location),
+						"crop":          row.Crop,
+						"max_dimension": row.MaxDimension,
+						"jpeg_quality":  row.JPEGQuality,
+						"burst_frames":  row.BurstFrames,
+						"burst_seconds": row.BurstSeconds,
+						"privacy_mask":  row.PrivacyMask,
+						"clip":          row.Clip,
+						"cameras":       cameras,
 					})
 					return
 				}
 			}
 		}
-		// Fallback default for relay_id not found, not claimed, or other Supabase errors for this path
-		respondWithJSON(w, http.StatusOK, map[string]interface{}{
-			"interval": "30s",
-			"rtsp_url": nil,
-		})
+		// A default config would let the relay capture without its privacy
+		// mask, so anything short of a claimed relay's own config is an error.
+		if relayResp.StatusCode != http.StatusOK {
+			bodyBytes, _ := io.ReadAll(relayResp.Body)
+			log.Printf("Supabase error fetching relay by relay_id %s. Status: %s, Body: %s", relayID, relayResp.Status, string(bodyBytes))
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to retrieve relay details. Supabase status: %s", relayResp.Status))
+			return
+		}
+		respondWithError(w, http.StatusServiceUnavailable, "Relay is not claimed by a coop yet.")
 		return
 
 	} else if pairingCode != "" {
 		// Logic for handling request by pairing_code (new behavior)
-		relayURL := supabaseURL + "/rest/v1/relays?pairing_code=eq." + pairingCode + "&select=id,status,coop_id,interval,rtsp_url"
+		relayURL := supabaseURL + "/rest/v1/relays?pairing_code=eq." + url.QueryEscape(pairingCode) + "&select=id,status"
 		req, err := http.NewRequest("GET", relayURL, nil)
 		if err != nil {
 			log.Printf("Error creating request for pairing_code %s: %v", pairingCode, err)
@@ -132,24 +190,10 @@ func GetRelayConfigHandler(w http.ResponseWriter, r *http.Request) {
 			}
 
 			relay := relays[0]
-			response := RelayConfigResponseByPairingCode{
+			respondWithJSON(w, http.StatusOK, RelayConfigResponseByPairingCode{
 				RelayID: relay.ID,
 				Status:  relay.Status,
-			}
-
-			if relay.Status == "claimed" {
-				response.CoopID = relay.CoopID // Will be null if DB coop_id is null
-				response.RTSPUrl = relay.RTSPUrl // Will be null if DB rtsp_url is null
-				
-				// Default interval to "10m" if null in DB for a claimed relay by pairing code
-				if relay.Interval != nil {
-					response.Interval = relay.Interval
-				} else {
-					defaultInterval := "10m"
-					response.Interval = &defaultInterval
-				}
-			}
-			respondWithJSON(w, http.StatusOK, response)
+			})
 			return
 		} else if relayResp.StatusCode == http.StatusNotFound { // Should be caught by len(relays) == 0 if Supabase returns 200 with empty array
 			respondWithError(w, http.StatusNotFound, "No relay found with the provided pairing code.")
@@ -167,3 +211,12 @@ func GetRelayConfigHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+
+func camerasHaveSchedule(cameras []RelayCamera) bool {
+	for _, c := range cameras {
+		if c.Schedule != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -21,6 +22,14 @@ func PostRelayConfigHandler(w http.ResponseWriter, r *http.Request) {
 		RelayID  string `json:"relay_id"`
 		Interval string `json:"interval"`
 		RTSPUrl  string `json:"rtsp_url"`
+		// Schedule, when set, takes over from interval; ClearSchedule
+		// goes back to the plain interval.
+		Schedule      *CaptureSchedule `json:"schedule"`
+		ClearSchedule bool             `json:"clear_schedule,omitempty"`
+		// Clip sets the legacy camera's clip recording; ClearClip stops it.
+		Clip      *ClipSettings `json:"clip"`
+		ClearClip bool          `json:"clear_clip,omitempty"`
+		ImageProcessing
 	}
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -37,6 +46,30 @@ func PostRelayConfigHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "relay_id and interval are required", http.StatusBadRequest)
 		return
 	}
+	if req.RTSPUrl != "" {
+		// Despite the field name this is any camera source the relay
+		// understands, RTSP or an HTTP snapshot / MJPEG URL.
+		if err := validateSourceURL(req.RTSPUrl); err != nil {
+			http.Error(w, strings.Replace(err.Error(), "source_url", "rtsp_url", 1), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := req.ImageProcessing.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Schedule != nil {
+		if err := req.Schedule.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Clip != nil {
+		if err := req.Clip.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	supabaseURL := os.Getenv("SUPABASE_URL")
 	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
@@ -83,6 +116,19 @@ func PostRelayConfigHandler(w http.ResponseWriter, r *http.Request) {
 		"interval": req.Interval,
 		"rtsp_url": req.RTSPUrl,
 	}
+	req.ImageProcessing.addToPayload(payload)
+	switch {
+	case req.ClearSchedule:
+		payload["schedule"] = nil
+	case req.Schedule != nil:
+		payload["schedule"] = req.Schedule
+	}
+	switch {
+	case req.ClearClip:
+		payload["clip"] = nil
+	case req.Clip != nil:
+		payload["clip"] = req.Clip
+	}
 	jsonBody, _ := json.Marshal(payload)
 	updateReq, err := http.NewRequest("PATCH", updateURL, ioutil.NopCloser(bytes.NewReader(jsonBody)))
 	if err != nil {
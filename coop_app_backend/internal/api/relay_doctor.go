@@ -0,0 +1,182 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Relay doctor reports
+//
+// `relay doctor`, or the run_diagnostics command, runs the relay's self-checks (DNS,
+// TLS, backend reachability, credentials, config, cameras, a test capture,
+// clock skew, disk space) and uploads a pass/fail report. The latest report
+// replaces the previous one in relays.doctor_report (jsonb) with
+// relays.doctor_at (timestamptz), so support can see it when a user says
+// their relay isn't uploading.
+
+// DoctorCheck is one line of a doctor report.
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // pass, warn, fail or skip
+	Detail string `json:"detail,omitempty"`
+	Millis int64  `json:"ms,omitempty"`
+}
+
+// DoctorReport is the relay's self-check result.
+type DoctorReport struct {
+	Version string        `json:"version"`
+	OS      string        `json:"os"`
+	Arch    string        `json:"arch"`
+	RanAt   *time.Time    `json:"ran_at,omitempty"`
+	OK      bool          `json:"ok"`
+	Checks  []DoctorCheck `json:"checks"`
+}
+
+const maxDoctorChecks = 64
+
+var doctorStatuses = map[string]bool{"pass": true, "warn": true, "fail": true, "skip": true}
+
+// sanitize bounds a report and recomputes OK from its checks.
+func (d *DoctorReport) sanitize() error {
+	if len(d.Checks) > maxDoctorChecks {
+		return errors.New("too many checks in report")
+	}
+	d.Version = truncateText(d.Version, 64)
+	d.OS = truncateText(d.OS, 64)
+	d.Arch = truncateText(d.Arch, 64)
+	if d.Checks == nil {
+		d.Checks = []DoctorCheck{}
+	}
+	d.OK = true
+	for i := range d.Checks {
+		c := &d.Checks[i]
+		if !doctorStatuses[c.Status] {
+			return fmt.Errorf("check %d: status must be pass, warn, fail or skip", i+1)
+		}
+		c.Name = truncateText(c.Name, 200)
+		c.Detail = truncateText(c.Detail, maxTelemetryText)
+		if c.Status == "fail" {
+			d.OK = false
+		}
+	}
+	return nil
+}
+
+// POST /api/relay/doctor (relay device token)
+// Body: a DoctorReport. Replaces the relay's latest report.
+func PostRelayDoctorHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+	relay, err := authenticateRelay(r, supabaseURL, serviceKey)
+	if err != nil {
+		respondRelayAuthError(w, err)
+		return
+	}
+
+	var report DoctorReport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 128<<10)).Decode(&report); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if err := report.sanitize(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	reportedAt := time.Now().UTC()
+	body, _ := json.Marshal(map[string]interface{}{
+		"doctor_report": report,
+		"doctor_at":     reportedAt.Format(time.RFC3339Nano),
+	})
+	patchReq, err := http.NewRequest("PATCH", supabaseURL+"/rest/v1/relays?id=eq."+url.QueryEscape(relay.ID), bytes.NewReader(body))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	patchReq.Header.Set("apikey", serviceKey)
+	patchReq.Header.Set("Authorization", "Bearer "+serviceKey)
+	patchReq.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(patchReq)
+	if err != nil {
+		log.Printf("Error saving doctor report for relay %s: %v", relay.ID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to communicate with database")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		log.Printf("Supabase error saving doctor report for relay %s: %s: %s", relay.ID, resp.Status, string(b))
+		respondWithError(w, http.StatusInternalServerError, "Failed to save doctor report")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"relay_id":    relay.ID,
+		"reported_at": reportedAt,
+		"ok":          report.OK,
+	})
+}
+
+// GET /api/relay/doctor?relay_id=<relay_id> (user JWT)
+// Returns the relay's latest doctor report, or null if it never sent one.
+// Queue a run_diagnostics command to run the checks again.
+func GetRelayDoctorHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+	relayID := r.URL.Query().Get("relay_id")
+	if relayID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing relay_id")
+		return
+	}
+	if !authorizeRelayForUser(w, r, supabaseURL, serviceKey, relayID) {
+		return
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/rest/v1/relays?id=eq.%s&select=doctor_report,doctor_at", supabaseURL, url.QueryEscape(relayID)), nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error fetching doctor report for relay %s: %v", relayID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to communicate with database")
+		return
+	}
+	defer resp.Body.Close()
+	var rows []struct {
+		DoctorReport *DoctorReport `json:"doctor_report"`
+		DoctorAt     *time.Time    `json:"doctor_at"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&rows) != nil || len(rows) == 0 {
+		log.Printf("Error fetching doctor report for relay %s: %s", relayID, resp.Status)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch doctor report")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"relay_id":    relayID,
+		"reported_at": rows[0].DoctorAt,
+		"report":      rows[0].DoctorReport,
+	})
+}
@@ -0,0 +1,407 @@
+package api
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Relay log bundles
+//
+// The relay keeps a rotating log file and uploads gzipped excerpts of it when
+// the upload_logs command asks or when errors come in a burst. Bundles are
+// stored in the private "relay-logs" bucket at
+// <relay_id>/<to>-<reason>.log.gz and listed in relay_log_bundles:
+//
+//	id uuid primary key default gen_random_uuid(),
+//	relay_id uuid not null references relays(id) on delete cascade,
+//	storage_path text not null,
+//	reason text not null,  -- command or errors
+//	from_time timestamptz not null,
+//	to_time timestamptz not null,
+//	lines int not null,
+//	size_bytes bigint not null,
+//	created_at timestamptz not null default now()
+//
+// Each relay keeps its newest maxLogBundlesPerRelay bundles, none older than
+// logBundleRetention. Support reads them with RELAY_SUPPORT_TOKEN rather than
+// a user JWT, since they help with relays that aren't theirs.
+
+// LogBundle is one uploaded log excerpt.
+type LogBundle struct {
+	ID          string    `json:"id"`
+	RelayID     string    `json:"relay_id"`
+	StoragePath string    `json:"storage_path"`
+	Reason      string    `json:"reason"`
+	FromTime    time.Time `json:"from_time"`
+	ToTime      time.Time `json:"to_time"`
+	Lines       int       `json:"lines"`
+	SizeBytes   int64     `json:"size_bytes"`
+	CreatedAt   time.Time `json:"created_at"`
+	DownloadURL string    `json:"download_url,omitempty"`
+}
+
+// ShipLogsRequest is the body of POST /api/relay/logs/request.
+type ShipLogsRequest struct {
+	RelayID string `json:"relay_id"`
+	Since   string `json:"since,omitempty"`
+}
+
+const (
+	logBundleColumns = "id,relay_id,storage_path,reason,from_time,to_time,lines,size_bytes,created_at"
+
+	maxLogBundleBytes     = 8 << 20
+	maxLogBundlesPerRelay = 50
+	logBundleRetention    = 14 * 24 * time.Hour
+	logURLExpiry          = time.Hour
+
+	defaultLogSince = time.Hour
+	// maxShipSince matches what the relay will read back from its log.
+	maxShipSince = 24 * time.Hour
+)
+
+var logBundleReasons = map[string]bool{"command": true, "errors": true}
+
+// supportAuthorized checks the Bearer token against RELAY_SUPPORT_TOKEN.
+func supportAuthorized(r *http.Request) bool {
+	supportToken := os.Getenv("RELAY_SUPPORT_TOKEN")
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return supportToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(supportToken)) == 1
+}
+
+// logBundleRequest sends a PostgREST request against relay_log_bundles and
+// decodes the returned rows.
+func logBundleRequest(method, supabaseURL, serviceKey, query string, payload interface{}) ([]LogBundle, error) {
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, supabaseURL+"/rest/v1/relay_log_bundles?"+query, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=representation")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("relay_log_bundles %s failed: %s: %s", method, resp.Status, string(b))
+	}
+	var bundles []LogBundle
+	if err := json.NewDecoder(resp.Body).Decode(&bundles); err != nil {
+		return nil, err
+	}
+	return bundles, nil
+}
+
+// POST /api/relay/logs?from=<rfc3339>&to=<rfc3339>&lines=<n>&reason=command|errors (relay device token)
+// Body: the gzipped log excerpt (Content-Type application/gzip).
+func PostRelayLogsHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+	relay, err := authenticateRelay(r, supabaseURL, serviceKey)
+	if err != nil {
+		respondRelayAuthError(w, err)
+		return
+	}
+
+	q := r.URL.Query()
+	reason := q.Get("reason")
+	if !logBundleReasons[reason] {
+		respondWithError(w, http.StatusBadRequest, "reason must be command or errors")
+		return
+	}
+	from, errFrom := time.Parse(time.RFC3339, q.Get("from"))
+	to, errTo := time.Parse(time.RFC3339, q.Get("to"))
+	if errFrom != nil || errTo != nil || to.Before(from) {
+		respondWithError(w, http.StatusBadRequest, "from and to must be RFC 3339 times, from first")
+		return
+	}
+	lines, err := strconv.Atoi(q.Get("lines"))
+	if err != nil || lines < 0 {
+		respondWithError(w, http.StatusBadRequest, "lines must be a count")
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxLogBundleBytes))
+	if err != nil {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Log bundle too large")
+		return
+	}
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		respondWithError(w, http.StatusBadRequest, "Body must be gzip")
+		return
+	}
+
+	path := fmt.Sprintf("%s/%s-%s.log.gz", relay.ID, to.UTC().Format("20060102T150405Z"), reason)
+	if err := uploadLogObject(supabaseURL, serviceKey, path, data); err != nil {
+		log.Printf("Error storing log bundle for relay %s: %v", relay.ID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to store log bundle")
+		return
+	}
+	bundles, err := logBundleRequest("POST", supabaseURL, serviceKey, "select="+logBundleColumns, map[string]interface{}{
+		"relay_id":     relay.ID,
+		"storage_path": path,
+		"reason":       reason,
+		"from_time":    from.UTC().Format(time.RFC3339),
+		"to_time":      to.UTC().Format(time.RFC3339),
+		"lines":        lines,
+		"size_bytes":   len(data),
+	})
+	if err != nil || len(bundles) == 0 {
+		log.Printf("Error recording log bundle for relay %s: %v", relay.ID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to record log bundle")
+		return
+	}
+	pruneLogBundles(supabaseURL, serviceKey, relay.ID)
+	respondWithJSON(w, http.StatusCreated, bundles[0])
+}
+
+func uploadLogObject(supabaseURL, serviceKey, path string, data []byte) error {
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/storage/v1/object/relay-logs/%s", supabaseURL, path), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	req.Header.Set("Content-Type", "application/gzip")
+	// Two bundles ending in the same second (a retry) share a path.
+	req.Header.Set("x-upsert", "true")
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("storage upload failed: %s: %s", resp.Status, string(b))
+	}
+	return nil
+}
+
+// pruneLogBundles deletes the relay's bundles past the newest
+// maxLogBundlesPerRelay or older than logBundleRetention, objects first.
+// Failures are logged and left for the next upload.
+func pruneLogBundles(supabaseURL, serviceKey, relayID string) {
+	bundles, err := logBundleRequest("GET", supabaseURL, serviceKey, fmt.Sprintf("relay_id=eq.%s&select=%s&order=created_at.desc", url.QueryEscape(relayID), logBundleColumns), nil)
+	if err != nil {
+		log.Printf("Error listing log bundles for relay %s: %v", relayID, err)
+		return
+	}
+	cutoff := time.Now().Add(-logBundleRetention)
+	var ids, paths []string
+	for i, b := range bundles {
+		if i >= maxLogBundlesPerRelay || b.CreatedAt.Before(cutoff) {
+			ids = append(ids, b.ID)
+			paths = append(paths, b.StoragePath)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	if err := deleteLogObjects(supabaseURL, serviceKey, paths); err != nil {
+		log.Printf("Error deleting old log bundles for relay %s: %v", relayID, err)
+		return
+	}
+	if _, err := logBundleRequest("DELETE", supabaseURL, serviceKey, "id=in.("+strings.Join(ids, ",")+")", nil); err != nil {
+		log.Printf("Error deleting old log bundle rows for relay %s: %v", relayID, err)
+	}
+}
+
+func deleteLogObjects(supabaseURL, serviceKey string, paths []string) error {
+	body, _ := json.Marshal(map[string]interface{}{"prefixes": paths})
+	req, err := http.NewRequest("DELETE", supabaseURL+"/storage/v1/object/relay-logs", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("storage delete failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// signLogURLs returns signed download URLs for bundles, keyed by storage path.
+func signLogURLs(supabaseURL, serviceKey string, paths []string) (map[string]string, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"expiresIn": int(logURLExpiry / time.Second),
+		"paths":     paths,
+	})
+	req, err := http.NewRequest("POST", supabaseURL+"/storage/v1/object/sign/relay-logs", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("sign relay logs failed: %s: %s", resp.Status, string(b))
+	}
+	var signed []struct {
+		Path      string  `json:"path"`
+		SignedURL *string `json:"signedURL"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		return nil, err
+	}
+	urls := make(map[string]string, len(signed))
+	for _, s := range signed {
+		if s.SignedURL != nil {
+			urls[s.Path] = supabaseURL + "/storage/v1" + *s.SignedURL
+		}
+	}
+	return urls, nil
+}
+
+// GET /api/relay/logs?relay_id=<relay_id>[&since=1h] (support token)
+// Lists the relay's bundles that cover any of the last since (at most
+// logBundleRetention), oldest first, each with a signed download_url.
+func GetRelayLogsHandler(w http.ResponseWriter, r *http.Request) {
+	if !supportAuthorized(r) {
+		respondWithError(w, http.StatusUnauthorized, "Support token required")
+		return
+	}
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+	relayID := r.URL.Query().Get("relay_id")
+	if relayID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing relay_id")
+		return
+	}
+	since := defaultLogSince
+	if s := r.URL.Query().Get("since"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			respondWithError(w, http.StatusBadRequest, "since must be a duration such as 1h")
+			return
+		}
+		since = min(d, logBundleRetention)
+	}
+
+	after := time.Now().Add(-since).UTC().Format(time.RFC3339)
+	query := fmt.Sprintf("relay_id=eq.%s&to_time=gte.%s&select=%s&order=from_time.asc", url.QueryEscape(relayID), url.QueryEscape(after), logBundleColumns)
+	bundles, err := logBundleRequest("GET", supabaseURL, serviceKey, query, nil)
+	if err != nil {
+		log.Printf("Error listing log bundles for relay %s: %v", relayID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch log bundles")
+		return
+	}
+	if len(bundles) > 0 {
+		paths := make([]string, len(bundles))
+		for i, b := range bundles {
+			paths[i] = b.StoragePath
+		}
+		urls, err := signLogURLs(supabaseURL, serviceKey, paths)
+		if err != nil {
+			log.Printf("Error signing log bundle URLs for relay %s: %v", relayID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to sign log bundle URLs")
+			return
+		}
+		for i := range bundles {
+			bundles[i].DownloadURL = urls[bundles[i].StoragePath]
+		}
+	} else {
+		bundles = []LogBundle{}
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"relay_id": relayID,
+		"since":    after,
+		"bundles":  bundles,
+	})
+}
+
+// POST /api/relay/logs/request (support token)
+// Body: {"relay_id": "...", "since": "1h"}. Queues an upload_logs command; the
+// bundle shows up in GET /api/relay/logs once the relay has run it.
+func PostRelayLogsRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if !supportAuthorized(r) {
+		respondWithError(w, http.StatusUnauthorized, "Support token required")
+		return
+	}
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+
+	var req ShipLogsRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.RelayID == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing relay_id")
+		return
+	}
+	since := defaultLogSince
+	if req.Since != "" {
+		d, err := time.ParseDuration(req.Since)
+		if err != nil || d <= 0 || d > maxShipSince {
+			respondWithError(w, http.StatusBadRequest, "since must be a duration up to 24h")
+			return
+		}
+		since = d
+	}
+
+	commands, err := commandRequest("POST", supabaseURL, serviceKey, "select="+relayCommandColumns, map[string]interface{}{
+		"relay_id":   req.RelayID,
+		"command":    "upload_logs",
+		"args":       map[string]string{"since": since.String()},
+		"status":     commandStatusPending,
+		"expires_at": time.Now().Add(commandTTL).UTC().Format(time.RFC3339),
+	})
+	if err != nil || len(commands) == 0 {
+		log.Printf("Error queueing upload_logs for relay %s: %v", req.RelayID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to queue command")
+		return
+	}
+	wakeCommandPolls(req.RelayID)
+	respondWithJSON(w, http.StatusCreated, commands[0])
+}
@@ -3,11 +3,13 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -16,6 +18,9 @@ import (
 )
 
 // GET /api/relay/pairing?code=<pairing_code>
+// Polled by a relay (e.g. `relay pair`) while it waits for its code to be
+// claimed in the app. Once claimed, the relay collects its device token from
+// POST /api/relay/token.
 func GetRelayPairingStatusHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -25,7 +30,7 @@ func GetRelayPairingStatusHandler(w http.ResponseWriter, r *http.Request) {
 	// Get pairing_code from query
 	code := r.URL.Query().Get("code")
 	if code == "" {
-		http.Error(w, `{"error": "Missing pairing code"}\n`, http.StatusBadRequest)
+		respondWithError(w, http.StatusBadRequest, "Missing pairing code")
 		return
 	}
 
@@ -33,28 +38,33 @@ func GetRelayPairingStatusHandler(w http.ResponseWriter, r *http.Request) {
 	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
 	if supabaseURL == "" || serviceKey == "" {
 		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
-		http.Error(w, `{"error": "Server config error"}\n`, http.StatusInternalServerError)
+		respondWithError(w, http.StatusInternalServerError, "Server config error")
 		return
 	}
 
 	// Query relay by pairing_code
-	relayURL := supabaseURL + "/rest/v1/relays?pairing_code=eq." + code
+	relayURL := supabaseURL + "/rest/v1/relays?select=id,status,paired_at&pairing_code=eq." + url.QueryEscape(code)
 	req, err := http.NewRequest("GET", relayURL, nil)
 	if err != nil {
 		log.Printf("Relay pairing lookup error: %v", err)
-		http.Error(w, `{"error": "Internal error"}\n`, http.StatusInternalServerError)
+		respondWithError(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
 	req.Header.Set("apikey", serviceKey)
 	req.Header.Set("Authorization", "Bearer "+serviceKey)
 	client := &http.Client{}
 	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != 200 {
-		log.Printf("Relay pairing lookup error: %v, status: %v", err, resp.StatusCode)
-		http.Error(w, `{"error": "Internal error"}\n`, http.StatusInternalServerError)
+	if err != nil {
+		log.Printf("Relay pairing lookup error: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Relay pairing lookup error, status: %s", resp.Status)
+		respondWithError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
 
 	var relays []struct {
 		ID       string  `json:"id"`
@@ -63,29 +73,25 @@ func GetRelayPairingStatusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&relays); err != nil {
 		log.Printf("Relay pairing decode error: %v", err)
-		http.Error(w, `{"error": "Internal error"}\n`, http.StatusInternalServerError)
+		respondWithError(w, http.StatusInternalServerError, "Internal error")
 		return
 	}
 	if len(relays) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"error": "Pairing code not found"}\n`))
+		respondWithError(w, http.StatusNotFound, "Pairing code not found")
 		return
 	}
 	relay := relays[0]
 	if relay.Status != "claimed" {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"status": "pending"}\n`))
+		respondWithJSON(w, http.StatusOK, map[string]string{"status": "pending"})
 		return
 	}
 
 	respObj := map[string]interface{}{
-		"status":   "claimed",
-		"relay_id": relay.ID,
+		"status":    "claimed",
+		"relay_id":  relay.ID,
 		"paired_at": relay.PairedAt,
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(respObj)
+	respondWithJSON(w, http.StatusOK, respObj)
 }
 
 // RelayRecord defines the structure for a relay record from Supabase.
@@ -106,10 +112,13 @@ type RequestRelayPairingCodeRequest struct {
 }
 
 // RequestRelayPairingCodeResponse defines the specific fields for the response of this endpoint.
+// PairingSecret is only ever returned here; the relay keeps it and trades it
+// for a device token at POST /api/relay/token once the relay is claimed.
 type RequestRelayPairingCodeResponse struct {
-	RelayID     string `json:"relay_id"`
-	PairingCode string `json:"pairing_code"`
-	Status      string `json:"status"`
+	RelayID       string `json:"relay_id"`
+	PairingCode   string `json:"pairing_code"`
+	Status        string `json:"status"`
+	PairingSecret string `json:"pairing_secret"`
 }
 
 // POST /api/relay/request_pairing_code
@@ -137,6 +146,35 @@ func RequestRelayPairingCodeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A relay that already holds a device token must present it to re-pair,
+	// otherwise anyone who knows a relay_id could unpair it.
+	if reqBody.RelayID != nil && *reqBody.RelayID != "" {
+		existing, err := fetchRelayAuthRecord(supabaseURL, supabaseServiceKey, *reqBody.RelayID)
+		if err != nil && !errors.Is(err, errRelayUnauthorized) {
+			log.Printf("Error fetching relay %s before re-pairing: %v", *reqBody.RelayID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to communicate with database")
+			return
+		}
+		if existing != nil && existing.DeviceTokenID != nil {
+			authed, err := authenticateRelay(r, supabaseURL, supabaseServiceKey)
+			if err != nil {
+				respondRelayAuthError(w, err)
+				return
+			}
+			if authed.ID != existing.ID {
+				respondWithError(w, http.StatusForbidden, "Token does not belong to this relay")
+				return
+			}
+		}
+	}
+
+	pairingSecret, err := newRandomID(32)
+	if err != nil {
+		log.Printf("Error generating pairing secret: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
 	localRand := rand.New(rand.NewSource(time.Now().UnixNano()))
 	client := &http.Client{}
 	maxRetries := 5
@@ -149,9 +187,11 @@ func RequestRelayPairingCodeHandler(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Processing pairing code request for existing relay_id: %s", *reqBody.RelayID)
 
 			updatePayload := map[string]interface{}{
-				"pairing_code": pairingCode,
-				"status":       "pending",
-				"coop_id":      nil, // Explicitly reset coop_id
+				"pairing_code":        pairingCode,
+				"status":              "pending",
+				"coop_id":             nil, // Explicitly reset coop_id
+				"device_token_id":     nil, // Re-pairing revokes the old device token
+				"pairing_secret_hash": hashPairingSecret(pairingSecret),
 			}
 			jsonPayload, _ := json.Marshal(updatePayload)
 
@@ -185,9 +225,10 @@ func RequestRelayPairingCodeHandler(w http.ResponseWriter, r *http.Request) {
 				}
 				updatedRelay := updatedRelays[0]
 				responsePayload := RequestRelayPairingCodeResponse{
-					RelayID:     updatedRelay.ID,
-					PairingCode: updatedRelay.PairingCode,
-					Status:      updatedRelay.Status,
+					RelayID:       updatedRelay.ID,
+					PairingCode:   updatedRelay.PairingCode,
+					Status:        updatedRelay.Status,
+					PairingSecret: pairingSecret,
 				}
 				respondWithJSON(w, http.StatusOK, responsePayload)
 				return
@@ -206,8 +247,9 @@ func RequestRelayPairingCodeHandler(w http.ResponseWriter, r *http.Request) {
 			log.Println("Processing pairing code request for a new relay.")
 
 			insertPayload := map[string]string{
-				"pairing_code": pairingCode,
-				"status":       "pending",
+				"pairing_code":        pairingCode,
+				"status":              "pending",
+				"pairing_secret_hash": hashPairingSecret(pairingSecret),
 			}
 			jsonPayload, err := json.Marshal(insertPayload)
 			if err != nil {
@@ -245,9 +287,10 @@ func RequestRelayPairingCodeHandler(w http.ResponseWriter, r *http.Request) {
 				}
 				createdRelay := createdRelays[0]
 				responsePayload := RequestRelayPairingCodeResponse{
-					RelayID:     createdRelay.ID,
-					PairingCode: createdRelay.PairingCode,
-					Status:      createdRelay.Status,
+					RelayID:       createdRelay.ID,
+					PairingCode:   createdRelay.PairingCode,
+					Status:        createdRelay.Status,
+					PairingSecret: pairingSecret,
 				}
 				respondWithJSON(w, http.StatusCreated, responsePayload)
 				return
@@ -397,11 +440,19 @@ func ClaimRelayHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	userCoopID := coopMembers[0].CoopID
 
-	// 4. Find and update the relay
+	// 4. Find and update the relay, minting a fresh device token id. The relay
+	// collects the matching token itself via POST /api/relay/token.
+	deviceTokenID, err := newRandomID(16)
+	if err != nil {
+		log.Printf("Error generating device token id: %v\n", err)
+		respondWithError(w, http.StatusInternalServerError, "Internal server error during claim preparation")
+		return
+	}
 	patchPayload := map[string]interface{}{
-		"status":    "claimed",
-		"coop_id":   userCoopID,
-		"paired_at": "now()", // Supabase will interpret this as the current timestamp
+		"status":          "claimed",
+		"coop_id":         userCoopID,
+		"paired_at":       "now()", // Supabase will interpret this as the current timestamp
+		"device_token_id": deviceTokenID,
 	}
 	jsonPatchPayload, err := json.Marshal(patchPayload)
 	if err != nil {
@@ -20,6 +20,11 @@ func PostRelayStatusHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		RelayID string  `json:"relay_id"`
 		SeenAt *string `json:"seen_at,omitempty"`
+		// SkippedCaptures counts frames the relay dropped as unchanged
+		// since its previous heartbeat.
+		SkippedCaptures *int64 `json:"skipped_captures,omitempty"`
+		// Optional telemetry, stored as the relay's latest status record.
+		RelayTelemetry
 	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -32,8 +37,8 @@ func PostRelayStatusHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid JSON body", http.StatusBadRequest)
 		return
 	}
-	if req.RelayID == "" {
-		http.Error(w, "relay_id is required", http.StatusBadRequest)
+	if err := req.RelayTelemetry.sanitize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -45,34 +50,17 @@ func PostRelayStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate relay exists
-	relayURL := supabaseURL + "/rest/v1/relays?id=eq." + req.RelayID
-	relayReq, err := http.NewRequest("GET", relayURL, nil)
+	// Authenticate the relay by its device token
+	relay, err := authenticateRelay(r, supabaseURL, serviceKey)
 	if err != nil {
-		log.Printf("Relay lookup error: %v", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
-	}
-	relayReq.Header.Set("apikey", serviceKey)
-	relayReq.Header.Set("Authorization", "Bearer "+serviceKey)
-	client := &http.Client{Timeout: 5 * time.Second}
-	relayResp, err := client.Do(relayReq)
-	if err != nil || relayResp.StatusCode != 200 {
-		log.Printf("Relay lookup failed: %v, status: %v", err, relayResp.StatusCode)
-		http.Error(w, "relay not found", http.StatusBadRequest)
-		return
-	}
-	var relays []struct{ ID string `json:"id"` }
-	if err := json.NewDecoder(relayResp.Body).Decode(&relays); err != nil {
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		relayResp.Body.Close()
+		respondRelayAuthError(w, err)
 		return
 	}
-	relayResp.Body.Close()
-	if len(relays) == 0 {
-		http.Error(w, "relay not found", http.StatusBadRequest)
+	if req.RelayID != "" && req.RelayID != relay.ID {
+		http.Error(w, "relay_id does not match relay token", http.StatusForbidden)
 		return
 	}
+	req.RelayID = relay.ID
 
 	// Determine last_seen_at
 	var seenAt string
@@ -87,6 +75,13 @@ func PostRelayStatusHandler(w http.ResponseWriter, r *http.Request) {
 	payload := map[string]interface{}{
 		"last_seen_at": seenAt,
 	}
+	if req.SkippedCaptures != nil {
+		payload["skipped_captures"] = *req.SkippedCaptures
+	}
+	if !req.RelayTelemetry.empty() {
+		payload["telemetry"] = req.RelayTelemetry
+		payload["telemetry_at"] = seenAt
+	}
 	jsonBody, _ := json.Marshal(payload)
 	updateReq, err := http.NewRequest("PATCH", updateURL, io.NopCloser(bytes.NewReader(jsonBody)))
 	if err != nil {
@@ -97,10 +92,16 @@ func PostRelayStatusHandler(w http.ResponseWriter, r *http.Request) {
 	updateReq.Header.Set("apikey", serviceKey)
 	updateReq.Header.Set("Authorization", "Bearer "+serviceKey)
 	updateReq.Header.Set("Content-Type", "application/json")
-	client = &http.Client{Timeout: 5 * time.Second}
+	client := &http.Client{Timeout: 5 * time.Second}
 	updateResp, err := client.Do(updateReq)
-	if err != nil || (updateResp.StatusCode != 200 && updateResp.StatusCode != 204) {
-		log.Printf("Relay update failed: %v, status: %v", err, updateResp.StatusCode)
+	if err != nil {
+		log.Printf("Relay update failed: %v", err)
+		http.Error(w, "could not update relay", http.StatusInternalServerError)
+		return
+	}
+	if updateResp.StatusCode != 200 && updateResp.StatusCode != 204 {
+		updateResp.Body.Close()
+		log.Printf("Relay update failed, status: %v", updateResp.StatusCode)
 		http.Error(w, "could not update relay", http.StatusInternalServerError)
 		return
 	}
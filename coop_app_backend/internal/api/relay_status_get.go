@@ -50,6 +50,11 @@ func GetRelayStatusHandler(w http.ResponseWriter, r *http.Request) {
 		ID         string  `json:"id"`
 		PairedAt   *string `json:"paired_at"`
 		LastSeenAt *string `json:"last_seen_at"`
+		// Frames skipped as unchanged in the relay's latest heartbeat window.
+		SkippedCaptures *int64 `json:"skipped_captures"`
+		// Latest heartbeat telemetry, if the relay sends any.
+		Telemetry   *RelayTelemetry `json:"telemetry"`
+		TelemetryAt *string         `json:"telemetry_at"`
 	}
 	if err := json.NewDecoder(relayResp.Body).Decode(&relays); err != nil {
 		http.Error(w, `{"error": "Internal error"}\n`, http.StatusInternalServerError)
@@ -100,6 +105,10 @@ func GetRelayStatusHandler(w http.ResponseWriter, r *http.Request) {
 		"last_seen_at":   relay.LastSeenAt,
 		"interval":       "1m", // can be hardcoded or pulled from config
 		"latest_snapshot": latestSnapshot,
+		"skipped_captures": relay.SkippedCaptures,
+		"telemetry":        relay.Telemetry,
+		"telemetry_at":     relay.TelemetryAt,
+		"health":           relay.Telemetry.health(),
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"errors"
+	"time"
+)
+
+// Relay telemetry
+//
+// Each heartbeat may carry a telemetry report, stored as the relay's latest
+// status record:
+//
+//	relays.telemetry jsonb null,
+//	relays.telemetry_at timestamptz null
+//
+// GET /api/relay/status/read returns it with a one-word health summary.
+
+// RelayTelemetry is what a relay reports about itself in POST /api/relay/status.
+type RelayTelemetry struct {
+	Version          string            `json:"version,omitempty"`
+	OS               string            `json:"os,omitempty"`
+	Arch             string            `json:"arch,omitempty"`
+	UptimeSeconds    *int64            `json:"uptime_seconds,omitempty"`
+	DiskFreeBytes    *int64            `json:"disk_free_bytes,omitempty"`
+	QueueFrames      *int64            `json:"queue_frames,omitempty"`
+	QueueBytes       *int64            `json:"queue_bytes,omitempty"`
+	LastCaptureError string            `json:"last_capture_error,omitempty"`
+	Cameras          []CameraTelemetry `json:"cameras,omitempty"`
+}
+
+// CameraTelemetry is one camera's reachability and stream stats.
+type CameraTelemetry struct {
+	CameraID      string     `json:"camera_id,omitempty"`
+	Name          string     `json:"name,omitempty"`
+	Reachable     bool       `json:"reachable"`
+	LastCaptureAt *time.Time `json:"last_capture_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	Captures      int64      `json:"captures"`
+	Failures      int64      `json:"failures"`
+	Skipped       int64      `json:"skipped"`
+	Width         int        `json:"width,omitempty"`
+	Height        int        `json:"height,omitempty"`
+	CaptureMillis int64      `json:"capture_ms,omitempty"`
+}
+
+const (
+	maxTelemetryCameras = 32
+	// maxTelemetryText caps free-text fields so a chatty error can't bloat
+	// the relays row.
+	maxTelemetryText = 500
+)
+
+// Health values returned by GET /api/relay/status/read.
+const (
+	relayHealthUnknown           = "unknown"
+	relayHealthOK                = "ok"
+	relayHealthCameraUnreachable = "camera_unreachable"
+	relayHealthNoCameras         = "no_cameras"
+)
+
+func (t *RelayTelemetry) sanitize() error {
+	if len(t.Cameras) > maxTelemetryCameras {
+		return errors.New("too many cameras in telemetry")
+	}
+	t.Version = truncateText(t.Version, 64)
+	t.OS = truncateText(t.OS, 64)
+	t.Arch = truncateText(t.Arch, 64)
+	t.LastCaptureError = truncateText(t.LastCaptureError, maxTelemetryText)
+	for i := range t.Cameras {
+		c := &t.Cameras[i]
+		c.Name = truncateText(c.Name, 200)
+		c.LastError = truncateText(c.LastError, maxTelemetryText)
+	}
+	return nil
+}
+
+func (t *RelayTelemetry) empty() bool {
+	return t.Version == "" && t.OS == "" && t.UptimeSeconds == nil && t.QueueFrames == nil && len(t.Cameras) == 0 && t.LastCaptureError == ""
+}
+
+// health tells "relay alive but a camera is down" apart from "all fine".
+func (t *RelayTelemetry) health() string {
+	switch {
+	case t == nil:
+		return relayHealthUnknown
+	case len(t.Cameras) == 0:
+		return relayHealthNoCameras
+	}
+	for _, c := range t.Cameras {
+		if !c.Reachable {
+			return relayHealthCameraUnreachable
+		}
+	}
+	return relayHealthOK
+}
+
+func truncateText(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	// Cut on a rune boundary.
+	for n > 0 && s[n]&0xC0 == 0x80 {
+		n--
+	}
+	return s[:n]
+}
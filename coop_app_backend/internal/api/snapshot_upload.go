@@ -0,0 +1,244 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxSnapshotBytes caps what a relay may register as a snapshot.
+	maxSnapshotBytes = 10 << 20
+	// snapshotTimestampLayout names objects <relay_id>/[<camera_id>/]<timestamp>.jpg.
+	snapshotTimestampLayout = "2006-01-02-15-04-05"
+)
+
+// snapshotKeyPattern matches the object keys relays are allowed to register.
+// The camera segment is present for snapshots of a relay_cameras row. Keys
+// handed out before snapshotObjectName have no milliseconds or suffix.
+var snapshotKeyPattern = regexp.MustCompile(`^([0-9a-fA-F-]{36})/(?:([0-9a-fA-F-]{36})/)?\d{4}-\d{2}-\d{2}-\d{2}-\d{2}-\d{2}(?:\.\d{3}-[0-9a-f]{8})?\.jpg$`)
+
+// snapshotObjectName names the object for a frame captured at t: the
+// timestamp to the millisecond plus a random suffix, so bursts, cameras on
+// the legacy path, and a push next to a scheduled capture never share a key.
+func snapshotObjectName(t time.Time) (string, error) {
+	suffix, err := newRandomID(4)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(snapshotTimestampLayout+".000") + "-" + suffix + ".jpg", nil
+}
+
+// SnapshotUploadURLRequest is the optional body of POST /api/snapshots/upload-url.
+type SnapshotUploadURLRequest struct {
+	CameraID   string     `json:"camera_id,omitempty"`
+	CapturedAt *time.Time `json:"captured_at,omitempty"`
+}
+
+// SnapshotUploadURLResponse tells the relay where to PUT the JPEG.
+type SnapshotUploadURLResponse struct {
+	ObjectKey string `json:"object_key"`
+	UploadURL string `json:"upload_url"`
+}
+
+// POST /api/snapshots/upload-url
+// Hands an authenticated relay a short-lived signed URL for
+// snapshots/<relay_id>/[<camera_id>/]<timestamp>.jpg. The relay PUTs the JPEG there and
+// then registers it with POST /api/snapshots.
+func PostSnapshotUploadURLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+
+	relay, err := authenticateRelay(r, supabaseURL, serviceKey)
+	if err != nil {
+		respondRelayAuthError(w, err)
+		return
+	}
+	if relay.CoopID == nil || *relay.CoopID == "" {
+		respondWithError(w, http.StatusBadRequest, "Relay is not attached to a coop")
+		return
+	}
+
+	var req SnapshotUploadURLRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			respondWithError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+	capturedAt := time.Now()
+	// Relays queue frames while offline, so honour their capture time, but
+	// not one from the future.
+	if req.CapturedAt != nil && req.CapturedAt.Before(capturedAt) {
+		capturedAt = *req.CapturedAt
+	}
+	name, err := snapshotObjectName(capturedAt)
+	if err != nil {
+		log.Printf("Error naming snapshot object: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create upload URL")
+		return
+	}
+	objectKey := relay.ID + "/" + name
+	if req.CameraID != "" {
+		if _, err := fetchRelayCamera(supabaseURL, serviceKey, relay.ID, req.CameraID); err != nil {
+			if errors.Is(err, errCameraNotFound) {
+				respondWithError(w, http.StatusForbidden, "camera_id does not belong to this relay")
+				return
+			}
+			log.Printf("Camera lookup error: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to look up camera")
+			return
+		}
+		// Cameras capture independently, so each gets its own folder.
+		objectKey = relay.ID + "/" + req.CameraID + "/" + name
+	}
+
+	uploadURL, err := createSignedUploadURL(supabaseURL, serviceKey, objectKey)
+	if err != nil {
+		log.Printf("Error creating signed upload URL for %s: %v", objectKey, err)
+		respondWithError(w, http.StatusBadGateway, "Failed to create upload URL")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, SnapshotUploadURLResponse{ObjectKey: objectKey, UploadURL: uploadURL})
+}
+
+// createSignedUploadURL asks Supabase Storage for a one-off upload URL for
+// objectKey in the snapshots bucket.
+func createSignedUploadURL(supabaseURL, serviceKey, objectKey string) (string, error) {
+	signURL := fmt.Sprintf("%s/storage/v1/object/upload/sign/snapshots/%s", supabaseURL, objectKey)
+	req, err := http.NewRequest("POST", signURL, bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	req.Header.Set("Content-Type", "application/json")
+	// No x-upsert: every attempt gets a fresh key, so an existing object
+	// means a collision and the upload should fail rather than replace it.
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("sign upload failed: %s: %s", resp.Status, string(b))
+	}
+	var signed struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		return "", err
+	}
+	if signed.URL == "" {
+		return "", errors.New("sign upload response has no url")
+	}
+	if strings.HasPrefix(signed.URL, "http://") || strings.HasPrefix(signed.URL, "https://") {
+		return signed.URL, nil
+	}
+	return supabaseURL + "/storage/v1" + signed.URL, nil
+}
+
+// verifySnapshotObject checks that key names a JPEG the relay uploaded into
+// its own folder (and its camera's, if cameraID is set): the path shape, the
+// owner, and the stored object's size, content type and magic bytes. With a
+// digest from the relay it reads the whole object and checks its size and
+// SHA-256 too, so a truncated or corrupted upload is caught.
+func verifySnapshotObject(supabaseURL, serviceKey, relayID, cameraID, key string, want snapshotDigest) (int64, error) {
+	m := snapshotKeyPattern.FindStringSubmatch(key)
+	if m == nil {
+		return 0, fmt.Errorf("image_filename %q is not of the form <relay_id>/[<camera_id>/]<timestamp>.jpg", key)
+	}
+	if !strings.EqualFold(m[1], relayID) {
+		return 0, fmt.Errorf("image_filename %q does not belong to relay %s", key, relayID)
+	}
+	if !strings.EqualFold(m[2], cameraID) {
+		return 0, fmt.Errorf("image_filename %q does not match camera_id %q", key, cameraID)
+	}
+
+	objectURL := fmt.Sprintf("%s/storage/v1/object/authenticated/snapshots/%s", supabaseURL, key)
+	req, err := http.NewRequest("GET", objectURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	if want.SHA256 == "" {
+		req.Header.Set("Range", "bytes=0-2")
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusNotFound, http.StatusBadRequest:
+		// Storage reports a missing object as 400 or 404 depending on version.
+		return 0, fmt.Errorf("image_filename %q has not been uploaded", key)
+	default:
+		return 0, fmt.Errorf("storage lookup failed: %s", resp.Status)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "image/jpeg") {
+		return 0, fmt.Errorf("object content type is %q, want image/jpeg", ct)
+	}
+	size := resp.ContentLength
+	if cr := resp.Header.Get("Content-Range"); cr != "" {
+		// "bytes 0-2/<total>"
+		if i := strings.LastIndex(cr, "/"); i >= 0 {
+			if total, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				size = total
+			}
+		}
+	}
+	if size > maxSnapshotBytes {
+		return 0, fmt.Errorf("object size %d is outside 1..%d bytes", size, maxSnapshotBytes)
+	}
+	h := sha256.New()
+	body := io.TeeReader(io.LimitReader(resp.Body, maxSnapshotBytes+1), h)
+	magic := make([]byte, 3)
+	if _, err := io.ReadFull(body, magic); err != nil || !bytes.Equal(magic, []byte{0xFF, 0xD8, 0xFF}) {
+		return 0, errors.New("object is not a JPEG")
+	}
+	if want.SHA256 != "" {
+		n, err := io.Copy(io.Discard, body)
+		if err != nil {
+			return 0, fmt.Errorf("reading object: %w", err)
+		}
+		size = n + int64(len(magic))
+		if want.Size != 0 && size != want.Size {
+			return 0, fmt.Errorf("checksum mismatch: object is %d bytes, relay sent %d", size, want.Size)
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != want.SHA256 {
+			return 0, fmt.Errorf("checksum mismatch: object sha256 is %s, relay sent %s", got, want.SHA256)
+		}
+	}
+	if size <= 0 || size > maxSnapshotBytes {
+		return 0, fmt.Errorf("object size %d is outside 1..%d bytes", size, maxSnapshotBytes)
+	}
+	return size, nil
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotObjectName(t *testing.T) {
+	at := time.Date(2026, 10, 16, 18, 45, 11, 0, time.UTC)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		name, err := snapshotObjectName(at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[name] {
+			t.Fatalf("%s handed out twice for the same capture time", name)
+		}
+		seen[name] = true
+		if key := testRelayID + "/" + name; !snapshotKeyPattern.MatchString(key) {
+			t.Fatalf("snapshotKeyPattern rejects %s", key)
+		}
+	}
+}
+
+func TestSnapshotKeyPattern(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{testRelayID + "/2026-10-16-18-45-11.jpg", true},
+		{testRelayID + "/" + testRelayID + "/2026-10-16-18-45-11.123-0a1b2c3d.jpg", true},
+		{testRelayID + "/2026-10-16-18-45-11.123.jpg", false},
+		{testRelayID + "/2026-10-16-18-45-11.123-0a1b2c3d.png", false},
+		{testRelayID + "/../2026-10-16-18-45-11.jpg", false},
+	}
+	for _, tt := range tests {
+		if got := snapshotKeyPattern.MatchString(tt.key); got != tt.want {
+			t.Errorf("snapshotKeyPattern.MatchString(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
@@ -3,17 +3,64 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 )
 
 type SnapshotRequest struct {
 	RelayID       string `json:"relay_id"`
+	CameraID      string `json:"camera_id,omitempty"`
 	ImageFilename string `json:"image_filename"`
+	// CaptureID is the relay's own ID for the frame, the same on every
+	// attempt to register it, so a replayed frame can be told from a new
+	// one that happens to be identical (a dark coop at night gives the same
+	// JPEG for hours). It is stored as snapshots.capture_id (text null),
+	// and a unique index rejects a relay registering it twice:
+	//
+	//	create unique index snapshots_relay_capture on snapshots (relay_id, capture_id);
+	CaptureID string `json:"capture_id,omitempty"`
+	// SHA256 (hex) and Size are the relay's digest of the JPEG it captured.
+	// When sent, the stored object must match them.
+	snapshotDigest
+	// Quality is how the relay scored the frame when it picked it from a
+	// burst. It is stored as snapshots.capture_quality (jsonb, nullable).
+	Quality *CaptureQuality `json:"quality,omitempty"`
+	// PrivacyMaskVersion is the version of the privacy mask the relay
+	// applied, so a frame can be traced to the mask that was in force. It
+	// is stored as snapshots.privacy_mask_version (text, nullable).
+	PrivacyMaskVersion string `json:"privacy_mask_version,omitempty"`
+	// CapturedAt is when the relay took the frame, which can be long before
+	// it is registered if the relay was offline. It is stored as
+	// snapshots.captured_at (timestamptz, nullable).
+	CapturedAt *time.Time `json:"captured_at,omitempty"`
+}
+
+// snapshotDigest is stored as snapshots.sha256 (text null) and
+// snapshots.size_bytes (bigint null).
+type snapshotDigest struct {
+	SHA256 string `json:"sha256,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+var (
+	sha256Pattern    = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	captureIDPattern = regexp.MustCompile(`^[0-9A-Za-z_-]{8,64}$`)
+)
+
+// CaptureQuality is the relay's sharpness and exposure score for a frame.
+type CaptureQuality struct {
+	Sharpness   float64 `json:"sharpness"`
+	Exposure    float64 `json:"exposure"`
+	Score       float64 `json:"score"`
+	BurstFrames int     `json:"burst_frames"`
 }
 
 type SnapshotResponse struct {
@@ -21,10 +68,29 @@ type SnapshotResponse struct {
 	ImageURL   string `json:"image_url"`
 }
 
-type relayRecord struct {
-	ID      string  `json:"id"`
-	CoopID  *string `json:"coop_id"`
-	Status  string  `json:"status"`
+// normalize checks the request's own fields and lowercases its digest. A
+// capture time in the future is dropped.
+func (req *SnapshotRequest) normalize() error {
+	if req.ImageFilename == "" {
+		return errors.New("image_filename is required")
+	}
+	req.SHA256 = strings.ToLower(req.SHA256)
+	if req.SHA256 != "" && !sha256Pattern.MatchString(req.SHA256) {
+		return errors.New("sha256 must be 64 hex characters")
+	}
+	if req.CaptureID != "" && !captureIDPattern.MatchString(req.CaptureID) {
+		return errors.New("capture_id must be 8 to 64 letters, digits, '-' or '_'")
+	}
+	if req.Size < 0 || req.Size > maxSnapshotBytes {
+		return errors.New("size is out of range")
+	}
+	if len(req.PrivacyMaskVersion) > 64 {
+		return errors.New("privacy_mask_version is too long")
+	}
+	if req.CapturedAt != nil && req.CapturedAt.After(time.Now()) {
+		req.CapturedAt = nil
+	}
+	return nil
 }
 
 type snapshotInsertResponse struct {
@@ -43,8 +109,8 @@ func PostSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid JSON body", http.StatusBadRequest)
 		return
 	}
-	if req.RelayID == "" || req.ImageFilename == "" {
-		http.Error(w, "relay_id and image_filename are required", http.StatusBadRequest)
+	if err := req.normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -58,27 +124,71 @@ func PostSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 1. Validate relay
-	relay, err := getRelay(supabaseURL, serviceKey, req.RelayID)
+	// 1. Authenticate the relay by its device token
+	relay, err := authenticateRelay(r, supabaseURL, serviceKey)
 	if err != nil {
-		log.Printf("Relay validation error: %v", err)
-		http.Error(w, "relay not found or invalid", http.StatusBadRequest)
+		respondRelayAuthError(w, err)
 		return
 	}
+	if req.RelayID != "" && req.RelayID != relay.ID {
+		http.Error(w, "relay_id does not match relay token", http.StatusForbidden)
+		return
+	}
+	req.RelayID = relay.ID
 	if relay.Status != "claimed" || relay.CoopID == nil || *relay.CoopID == "" {
 		http.Error(w, "relay unclaimed or missing coop_id", http.StatusBadRequest)
 		return
 	}
 
-	// 2. Insert snapshot
-	snapshotID, err := insertSnapshot(supabaseURL, serviceKey, *relay.CoopID, req.RelayID, req.ImageFilename)
+	// 2. Check the camera and the uploaded object before recording it
+	if req.CameraID != "" {
+		if _, err := fetchRelayCamera(supabaseURL, serviceKey, relay.ID, req.CameraID); err != nil {
+			if errors.Is(err, errCameraNotFound) {
+				http.Error(w, "camera_id does not belong to this relay", http.StatusForbidden)
+				return
+			}
+			log.Printf("Camera lookup error: %v", err)
+			http.Error(w, "could not look up camera", http.StatusInternalServerError)
+			return
+		}
+	}
+	size, err := verifySnapshotObject(supabaseURL, serviceKey, relay.ID, req.CameraID, req.ImageFilename, req.snapshotDigest)
+	if err != nil {
+		log.Printf("Rejecting snapshot from relay %s: %v", relay.ID, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	req.Size = size
+	log.Printf("Verified snapshot object %s (%d bytes)", req.ImageFilename, size)
+	if req.CaptureID != "" {
+		existing, err := findSnapshotByCaptureID(supabaseURL, serviceKey, relay.ID, req.CaptureID)
+		if err != nil {
+			log.Printf("Duplicate lookup error: %v", err)
+			http.Error(w, "could not check for duplicates", http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			respondDuplicateSnapshot(w, supabaseURL, serviceKey, existing, req.ImageFilename)
+			return
+		}
+	}
+
+	// 3. Insert snapshot
+	snapshotID, err := insertSnapshot(supabaseURL, serviceKey, *relay.CoopID, req)
+	if errors.Is(err, errDuplicateSnapshot) {
+		// Lost a race with a concurrent resubmission.
+		if existing, _ := findSnapshotByCaptureID(supabaseURL, serviceKey, relay.ID, req.CaptureID); existing != nil {
+			respondDuplicateSnapshot(w, supabaseURL, serviceKey, existing, req.ImageFilename)
+			return
+		}
+	}
 	if err != nil {
 		log.Printf("Snapshot insert error: %v", err)
 		http.Error(w, "could not insert snapshot", http.StatusInternalServerError)
 		return
 	}
 
-	// 3. Respond with snapshot_id and image_url
+	// 4. Respond with snapshot_id and image_url
 	imageURL := fmt.Sprintf("%s/storage/v1/object/public/snapshots/%s", supabaseURL, req.ImageFilename)
 	resp := SnapshotResponse{
 		SnapshotID: snapshotID,
@@ -88,42 +198,44 @@ func PostSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-func getRelay(supabaseURL, serviceKey, relayID string) (*relayRecord, error) {
-	url := fmt.Sprintf("%s/rest/v1/relays?id=eq.%s", supabaseURL, relayID)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+var errDuplicateSnapshot = errors.New("duplicate snapshot")
+
+// snapshotRow is the snapshots row for snap, without the columns it leaves
+// unset.
+func snapshotRow(coopID string, snap SnapshotRequest) map[string]interface{} {
+	row := map[string]interface{}{
+		"coop_id":    coopID,
+		"relay_id":   snap.RelayID,
+		"image_path": snap.ImageFilename,
+		// created_at will default to now() in DB
 	}
-	req.Header.Set("apikey", serviceKey)
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", serviceKey))
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	if snap.CameraID != "" {
+		row["camera_id"] = snap.CameraID
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("relay lookup failed: %s", resp.Status)
+	if snap.Quality != nil {
+		row["capture_quality"] = snap.Quality
 	}
-	var relays []relayRecord
-	if err := json.NewDecoder(resp.Body).Decode(&relays); err != nil {
-		return nil, err
+	if snap.PrivacyMaskVersion != "" {
+		row["privacy_mask_version"] = snap.PrivacyMaskVersion
+	}
+	if snap.CaptureID != "" {
+		row["capture_id"] = snap.CaptureID
+	}
+	if snap.SHA256 != "" {
+		row["sha256"] = snap.SHA256
+	}
+	if snap.Size > 0 {
+		row["size_bytes"] = snap.Size
 	}
-	if len(relays) != 1 {
-		return nil, fmt.Errorf("relay not found")
+	if snap.CapturedAt != nil {
+		row["captured_at"] = snap.CapturedAt.UTC().Format(time.RFC3339)
 	}
-	return &relays[0], nil
+	return row
 }
 
-func insertSnapshot(supabaseURL, serviceKey, coopID, relayID, imagePath string) (string, error) {
+func insertSnapshot(supabaseURL, serviceKey, coopID string, snap SnapshotRequest) (string, error) {
 	url := fmt.Sprintf("%s/rest/v1/snapshots", supabaseURL)
-	payload := map[string]interface{}{
-		"coop_id":    coopID,
-		"relay_id":   relayID,
-		"image_path": imagePath,
-		// created_at will default to now() in DB
-	}
-	body, _ := json.Marshal(payload)
+	body, _ := json.Marshal(snapshotRow(coopID, snap))
 	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
 	if err != nil {
 		return "", err
@@ -138,6 +250,9 @@ func insertSnapshot(supabaseURL, serviceKey, coopID, relayID, imagePath string)
 		return "", err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return "", errDuplicateSnapshot
+	}
 	if resp.StatusCode != 201 {
 		b, _ := ioutil.ReadAll(resp.Body)
 		return "", fmt.Errorf("insert failed: %s: %s", resp.Status, string(b))
@@ -151,3 +266,80 @@ func insertSnapshot(supabaseURL, serviceKey, coopID, relayID, imagePath string)
 	}
 	return inserted[0].ID, nil
 }
+
+type existingSnapshot struct {
+	ID        string `json:"id"`
+	ImagePath string `json:"image_path"`
+	CaptureID string `json:"capture_id,omitempty"`
+}
+
+// findSnapshotByCaptureID returns the relay's snapshot with this capture ID,
+// or nil.
+func findSnapshotByCaptureID(supabaseURL, serviceKey, relayID, captureID string) (*existingSnapshot, error) {
+	q := fmt.Sprintf("%s/rest/v1/snapshots?relay_id=eq.%s&capture_id=eq.%s&select=id,image_path&limit=1", supabaseURL, url.QueryEscape(relayID), url.QueryEscape(captureID))
+	req, err := http.NewRequest("GET", q, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("snapshot lookup failed: %s", resp.Status)
+	}
+	var rows []existingSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return &rows[0], nil
+}
+
+// respondDuplicateSnapshot answers a resubmission with 409 and the snapshot
+// already on record, so the relay can treat it as delivered. A copy uploaded
+// under a new key is deleted from storage.
+func respondDuplicateSnapshot(w http.ResponseWriter, supabaseURL, serviceKey string, existing *existingSnapshot, key string) {
+	discardDuplicateObject(supabaseURL, serviceKey, existing, key)
+	respondWithJSON(w, http.StatusConflict, map[string]interface{}{
+		"error":       "duplicate snapshot",
+		"snapshot_id": existing.ID,
+		"image_url":   fmt.Sprintf("%s/storage/v1/object/public/snapshots/%s", supabaseURL, existing.ImagePath),
+	})
+}
+
+// discardDuplicateObject deletes a resubmitted frame's object when it was
+// uploaded under a different key from the snapshot already on record.
+func discardDuplicateObject(supabaseURL, serviceKey string, existing *existingSnapshot, key string) {
+	log.Printf("Rejecting duplicate of snapshot %s (%s)", existing.ID, key)
+	if key != existing.ImagePath {
+		if err := deleteSnapshotObject(supabaseURL, serviceKey, key); err != nil {
+			log.Printf("Error deleting duplicate object %s: %v", key, err)
+		}
+	}
+}
+
+func deleteSnapshotObject(supabaseURL, serviceKey, key string) error {
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/storage/v1/object/snapshots/%s", supabaseURL, key), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("storage delete failed: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Batch snapshot registration
+//
+// A relay coming back from an outage has a queue of frames to register. It
+// uploads them as usual and then registers up to maxSnapshotBatch at once
+// with POST /api/snapshots/batch: the relay is authenticated once, the rows
+// go in with one insert, and each item gets its own result so the relay
+// retries only the ones that failed. Items are checked exactly as
+// POST /api/snapshots checks a single snapshot.
+
+// SnapshotBatchRequest is the body of POST /api/snapshots/batch.
+type SnapshotBatchRequest struct {
+	RelayID   string            `json:"relay_id,omitempty"`
+	Snapshots []SnapshotRequest `json:"snapshots"`
+}
+
+// SnapshotBatchResult is the outcome for one item, in request order.
+type SnapshotBatchResult struct {
+	Index      int    `json:"index"`
+	Status     string `json:"status"`
+	SnapshotID string `json:"snapshot_id,omitempty"`
+	ImageURL   string `json:"image_url,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+const (
+	// Item statuses. created and duplicate count as delivered; rejected
+	// means the stored object is unusable and must be uploaded again;
+	// invalid items won't succeed as sent; failed items can be retried.
+	batchStatusCreated   = "created"
+	batchStatusDuplicate = "duplicate"
+	batchStatusRejected  = "rejected"
+	batchStatusInvalid   = "invalid"
+	batchStatusFailed    = "failed"
+
+	maxSnapshotBatch = 100
+	// snapshotBatchVerifiers is how many stored objects are checked at once.
+	snapshotBatchVerifiers = 4
+)
+
+// POST /api/snapshots/batch (device token)
+// Body: {"snapshots": [<POST /api/snapshots body>, ...]}. Responds 200 with
+// one result per item.
+func PostSnapshotBatchHandler(w http.ResponseWriter, r *http.Request) {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	serviceKey := os.Getenv("SUPABASE_SERVICE_KEY")
+	if supabaseURL == "" || serviceKey == "" {
+		log.Printf("Missing SUPABASE_URL or SUPABASE_SERVICE_KEY env vars")
+		respondWithError(w, http.StatusInternalServerError, "Server configuration error")
+		return
+	}
+	relay, err := authenticateRelay(r, supabaseURL, serviceKey)
+	if err != nil {
+		respondRelayAuthError(w, err)
+		return
+	}
+
+	var req SnapshotBatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSnapshotBatch<<11)).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(req.Snapshots) == 0 || len(req.Snapshots) > maxSnapshotBatch {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("snapshots must hold 1 to %d items", maxSnapshotBatch))
+		return
+	}
+	if req.RelayID != "" && req.RelayID != relay.ID {
+		respondWithError(w, http.StatusForbidden, "relay_id does not match relay token")
+		return
+	}
+	if relay.Status != "claimed" || relay.CoopID == nil || *relay.CoopID == "" {
+		respondWithError(w, http.StatusBadRequest, "relay unclaimed or missing coop_id")
+		return
+	}
+
+	items := req.Snapshots
+	results := make([]SnapshotBatchResult, len(items))
+	// records are the snapshots items were registered as, new or earlier.
+	records := make([]*existingSnapshot, len(items))
+	pending := make([]int, 0, len(items))
+	needCameras := false
+	for i := range items {
+		results[i].Index = i
+		item := &items[i]
+		if err := item.normalize(); err != nil {
+			results[i].Status, results[i].Error = batchStatusInvalid, err.Error()
+			continue
+		}
+		if item.RelayID != "" && item.RelayID != relay.ID {
+			results[i].Status, results[i].Error = batchStatusInvalid, "relay_id does not match relay token"
+			continue
+		}
+		item.RelayID = relay.ID
+		needCameras = needCameras || item.CameraID != ""
+		pending = append(pending, i)
+	}
+
+	// 1. Check cameras against the relay's, fetched once
+	if needCameras {
+		cameras, err := fetchRelayCameras(supabaseURL, serviceKey, relay.ID, false)
+		owned := make(map[string]bool, len(cameras))
+		for _, c := range cameras {
+			owned[c.ID] = true
+		}
+		pending = filterBatch(pending, func(i int) bool {
+			switch {
+			case items[i].CameraID == "" || owned[items[i].CameraID]:
+				return true
+			case err != nil:
+				results[i].Status, results[i].Error = batchStatusFailed, "could not look up camera"
+			default:
+				results[i].Status, results[i].Error = batchStatusInvalid, "camera_id does not belong to this relay"
+			}
+			return false
+		})
+		if err != nil {
+			log.Printf("Camera lookup error: %v", err)
+		}
+	}
+
+	// 2. Check the uploaded objects
+	verifyErrs := make([]error, len(items))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, snapshotBatchVerifiers)
+	for _, i := range pending {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			size, err := verifySnapshotObject(supabaseURL, serviceKey, relay.ID, items[i].CameraID, items[i].ImageFilename, items[i].snapshotDigest)
+			items[i].Size, verifyErrs[i] = size, err
+		}(i)
+	}
+	wg.Wait()
+	pending = filterBatch(pending, func(i int) bool {
+		if verifyErrs[i] != nil {
+			log.Printf("Rejecting snapshot from relay %s: %v", relay.ID, verifyErrs[i])
+			results[i].Status, results[i].Error = batchStatusRejected, verifyErrs[i].Error()
+			return false
+		}
+		return true
+	})
+
+	// 3. Settle frames registered before, or repeated within the batch
+	var captureIDs []string
+	firstWithID := map[string]int{}
+	repeats := map[int]int{}
+	for _, i := range pending {
+		id := items[i].CaptureID
+		if id == "" {
+			continue
+		}
+		if first, ok := firstWithID[id]; ok {
+			repeats[i] = first
+			continue
+		}
+		firstWithID[id] = i
+		captureIDs = append(captureIDs, id)
+	}
+	if len(captureIDs) > 0 {
+		existing, err := findSnapshotsByCaptureID(supabaseURL, serviceKey, relay.ID, captureIDs)
+		if err != nil {
+			log.Printf("Duplicate lookup error: %v", err)
+		}
+		pending = filterBatch(pending, func(i int) bool {
+			switch {
+			case items[i].CaptureID == "":
+				// Nothing to look up, so a failed lookup doesn't matter.
+				return true
+			case err != nil:
+				results[i].Status, results[i].Error = batchStatusFailed, "could not check for duplicates"
+			case existing[items[i].CaptureID] != nil:
+				if _, repeat := repeats[i]; !repeat {
+					records[i] = existing[items[i].CaptureID]
+					discardDuplicateObject(supabaseURL, serviceKey, records[i], items[i].ImageFilename)
+					results[i] = duplicateBatchResult(i, supabaseURL, records[i])
+				}
+			default:
+				_, repeat := repeats[i]
+				return !repeat
+			}
+			return false
+		})
+	}
+
+	// 4. Insert the rest in one round trip
+	if len(pending) > 0 {
+		snaps := make([]SnapshotRequest, len(pending))
+		for n, i := range pending {
+			snaps[n] = items[i]
+		}
+		ids, err := insertSnapshots(supabaseURL, serviceKey, *relay.CoopID, snaps)
+		if errors.Is(err, errDuplicateSnapshot) {
+			// Lost a race with a concurrent resubmission, which fails the
+			// whole insert; go one by one to find the item.
+			ids, err = make([]string, len(pending)), nil
+			for n, i := range pending {
+				id, err := insertSnapshot(supabaseURL, serviceKey, *relay.CoopID, items[i])
+				if errors.Is(err, errDuplicateSnapshot) {
+					if e, _ := findSnapshotByCaptureID(supabaseURL, serviceKey, relay.ID, items[i].CaptureID); e != nil {
+						records[i] = e
+						discardDuplicateObject(supabaseURL, serviceKey, e, items[i].ImageFilename)
+						results[i] = duplicateBatchResult(i, supabaseURL, e)
+						continue
+					}
+				}
+				if err != nil {
+					log.Printf("Snapshot insert error: %v", err)
+					results[i].Status, results[i].Error = batchStatusFailed, "could not insert snapshot"
+					continue
+				}
+				ids[n] = id
+			}
+		}
+		if err != nil {
+			log.Printf("Snapshot batch insert error: %v", err)
+			for _, i := range pending {
+				results[i].Status, results[i].Error = batchStatusFailed, "could not insert snapshot"
+			}
+		} else {
+			for n, i := range pending {
+				if ids[n] != "" {
+					records[i] = &existingSnapshot{ID: ids[n], ImagePath: items[i].ImageFilename}
+					results[i] = SnapshotBatchResult{
+						Index:      i,
+						Status:     batchStatusCreated,
+						SnapshotID: ids[n],
+						ImageURL:   fmt.Sprintf("%s/storage/v1/object/public/snapshots/%s", supabaseURL, items[i].ImageFilename),
+					}
+				}
+			}
+		}
+	}
+
+	// 5. Repeats share the outcome of the item they repeat
+	for i, first := range repeats {
+		if results[i].Status != "" {
+			continue
+		}
+		if records[first] == nil {
+			results[i].Status = batchStatusFailed
+			results[i].Error = fmt.Sprintf("same frame as item %d, which was not registered", first)
+			continue
+		}
+		discardDuplicateObject(supabaseURL, serviceKey, records[first], items[i].ImageFilename)
+		results[i] = duplicateBatchResult(i, supabaseURL, records[first])
+	}
+
+	created := 0
+	for _, res := range results {
+		if res.Status == batchStatusCreated {
+			created++
+		}
+	}
+	log.Printf("Registered %d of %d snapshots from relay %s", created, len(items), relay.ID)
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"relay_id": relay.ID,
+		"results":  results,
+	})
+}
+
+// filterBatch keeps the item indexes keep accepts.
+func filterBatch(indexes []int, keep func(i int) bool) []int {
+	kept := indexes[:0]
+	for _, i := range indexes {
+		if keep(i) {
+			kept = append(kept, i)
+		}
+	}
+	return kept
+}
+
+func duplicateBatchResult(i int, supabaseURL string, existing *existingSnapshot) SnapshotBatchResult {
+	return SnapshotBatchResult{
+		Index:      i,
+		Status:     batchStatusDuplicate,
+		SnapshotID: existing.ID,
+		ImageURL:   fmt.Sprintf("%s/storage/v1/object/public/snapshots/%s", supabaseURL, existing.ImagePath),
+		Error:      "duplicate snapshot",
+	}
+}
+
+// findSnapshotsByCaptureID returns the relay's snapshots with these capture
+// IDs, keyed by capture ID.
+func findSnapshotsByCaptureID(supabaseURL, serviceKey, relayID string, captureIDs []string) (map[string]*existingSnapshot, error) {
+	q := fmt.Sprintf("%s/rest/v1/snapshots?relay_id=eq.%s&capture_id=in.(%s)&select=id,image_path,capture_id", supabaseURL, url.QueryEscape(relayID), strings.Join(captureIDs, ","))
+	req, err := http.NewRequest("GET", q, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("snapshot lookup failed: %s", resp.Status)
+	}
+	var rows []existingSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return nil, err
+	}
+	found := make(map[string]*existingSnapshot, len(rows))
+	for i := range rows {
+		found[rows[i].CaptureID] = &rows[i]
+	}
+	return found, nil
+}
+
+// insertSnapshots inserts snaps with one request and returns their IDs in
+// order. PostgREST wants the same keys in every row of a bulk insert, so
+// columns some rows leave unset are sent as null.
+func insertSnapshots(supabaseURL, serviceKey, coopID string, snaps []SnapshotRequest) ([]string, error) {
+	rows := make([]map[string]interface{}, len(snaps))
+	columns := map[string]bool{}
+	for i, snap := range snaps {
+		rows[i] = snapshotRow(coopID, snap)
+		for k := range rows[i] {
+			columns[k] = true
+		}
+	}
+	for _, row := range rows {
+		for k := range columns {
+			if _, ok := row[k]; !ok {
+				row[k] = nil
+			}
+		}
+	}
+	body, _ := json.Marshal(rows)
+	req, err := http.NewRequest("POST", supabaseURL+"/rest/v1/snapshots?select=id", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", "Bearer "+serviceKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=representation")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return nil, errDuplicateSnapshot
+	}
+	if resp.StatusCode != http.StatusCreated {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("insert failed: %s: %s", resp.Status, string(b))
+	}
+	var inserted []snapshotInsertResponse
+	if err := json.NewDecoder(resp.Body).Decode(&inserted); err != nil {
+		return nil, err
+	}
+	if len(inserted) != len(snaps) {
+		return nil, fmt.Errorf("inserted %d snapshots, want %d", len(inserted), len(snaps))
+	}
+	ids := make([]string, len(inserted))
+	for i, s := range inserted {
+		ids[i] = s.ID
+	}
+	return ids, nil
+}
@@ -4,12 +4,13 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"time"
 )
 
-// GET /api/relay/snapshots?relay_id=...&limit=10
+// GET /api/relay/snapshots?relay_id=...&limit=10[&camera_id=...]
 func GetRelaySnapshotsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -73,6 +74,9 @@ func GetRelaySnapshotsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Query snapshots for this relay
 	snapshotsURL := supabaseURL + "/rest/v1/snapshots?relay_id=eq." + relayID + "&order=created_at.desc&limit=" + strconv.Itoa(limit)
+	if cameraID := r.URL.Query().Get("camera_id"); cameraID != "" {
+		snapshotsURL += "&camera_id=eq." + url.QueryEscape(cameraID)
+	}
 	snapReq, err := http.NewRequest("GET", snapshotsURL, nil)
 	if err != nil {
 		log.Printf("Snapshot query error: %v", err)
@@ -91,6 +95,7 @@ func GetRelaySnapshotsHandler(w http.ResponseWriter, r *http.Request) {
 		ID        string  `json:"id"`
 		CreatedAt string  `json:"created_at"`
 		ImagePath *string `json:"image_path"`
+		CameraID  *string `json:"camera_id"`
 	}
 	if err := json.NewDecoder(snapResp.Body).Decode(&snaps); err != nil {
 		snapResp.Body.Close()
@@ -106,6 +111,7 @@ func GetRelaySnapshotsHandler(w http.ResponseWriter, r *http.Request) {
 			"id":         s.ID,
 			"created_at": s.CreatedAt,
 			"image_path": s.ImagePath,
+			"camera_id":  s.CameraID,
 		})
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// relayConfig mirrors the GET /api/relay/config?relay_id=... response.
+// Interval and RTSPUrl are the legacy single-camera fields and are null until
+// the relay is claimed and configured in the app; Cameras lists the relay's
+// cameras once any are set up. Clip and the embedded image settings apply to
+// the legacy camera.
+type relayConfig struct {
+	Interval *string        `json:"interval"`
+	RTSPUrl  *string        `json:"rtsp_url"`
+	Cameras  []cameraConfig `json:"cameras"`
+	// Schedule replaces Interval for the legacy camera when set.
+	Schedule *captureSchedule `json:"schedule"`
+	Clip     *clipSettings    `json:"clip"`
+	imageSettings
+}
+
+func (c relayConfig) equal(o relayConfig) bool {
+	if !strPtrEqual(c.Interval, o.Interval) || !strPtrEqual(c.RTSPUrl, o.RTSPUrl) || !c.Schedule.equal(o.Schedule) || !c.Clip.equal(o.Clip) || !c.imageSettings.equal(o.imageSettings) ||
+		len(c.Cameras) != len(o.Cameras) {
+		return false
+	}
+	for i := range c.Cameras {
+		if !c.Cameras[i].equal(o.Cameras[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func strPtrEqual(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// backendClient talks to the relay-facing endpoints of the Coop backend,
+// authenticating with the relay's device token.
+type backendClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func newBackendClient(baseURL, token string) *backendClient {
+	return &backendClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// fetchConfig polls GET /api/relay/config for the relay's current capture settings.
+func (b *backendClient) fetchConfig(relayID string) (*relayConfig, error) {
+	path := "/api/relay/config?relay_id=" + url.QueryEscape(relayID)
+	req, err := http.NewRequest(http.MethodGet, b.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRelayAuth(req, b.token)
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching relay config: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &backendStatusError{method: http.MethodGet, path: path, status: resp.Status, code: resp.StatusCode, body: string(body)}
+	}
+	var cfg relayConfig
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("decoding relay config: %w", err)
+	}
+	return &cfg, nil
+}
+
+// heartbeat is the POST /api/relay/status body. Besides liveness it carries
+// telemetry the app shows, so "relay up, camera unplugged" is visible.
+type heartbeat struct {
+	RelayID string `json:"relay_id"`
+	SeenAt  string `json:"seen_at"`
+	// SkippedCaptures counts frames dropped as unchanged since the previous
+	// heartbeat.
+	SkippedCaptures int64 `json:"skipped_captures"`
+
+	Version          string            `json:"version"`
+	OS               string            `json:"os"`
+	Arch             string            `json:"arch"`
+	UptimeSeconds    int64             `json:"uptime_seconds"`
+	DiskFreeBytes    *int64            `json:"disk_free_bytes,omitempty"`
+	QueueFrames      int               `json:"queue_frames"`
+	QueueBytes       int64             `json:"queue_bytes"`
+	LastCaptureError string            `json:"last_capture_error,omitempty"`
+	Cameras          []cameraHeartbeat `json:"cameras"`
+}
+
+// cameraHeartbeat is one camera's reachability and stream stats.
+type cameraHeartbeat struct {
+	CameraID      string     `json:"camera_id,omitempty"`
+	Name          string     `json:"name"`
+	Reachable     bool       `json:"reachable"`
+	LastCaptureAt *time.Time `json:"last_capture_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	Captures      int64      `json:"captures"`
+	Failures      int64      `json:"failures"`
+	Skipped       int64      `json:"skipped"`
+	Width         int        `json:"width,omitempty"`
+	Height        int        `json:"height,omitempty"`
+	CaptureMillis int64      `json:"capture_ms,omitempty"`
+}
+
+// postStatus sends a heartbeat to POST /api/relay/status.
+func (b *backendClient) postStatus(hb heartbeat) error {
+	return b.postJSON("/api/relay/status", hb)
+}
+
+// reportDiscoveredCameras replaces the relay's list of ONVIF cameras found
+// on its network, for the app's pick list.
+func (b *backendClient) reportDiscoveredCameras(cams []discoveredCamera) error {
+	return b.postJSON("/api/relay/discovered_cameras", map[string]interface{}{"cameras": cams})
+}
+
+// reportDoctor uploads a `relay doctor` report for the app and support.
+func (b *backendClient) reportDoctor(r doctorReport) error {
+	return b.postJSON("/api/relay/doctor", r)
+}
+
+// notifySnapshotCreated asks the backend to run egg detection on a freshly registered image,
+// the same call the Electron app makes after each upload.
+func (b *backendClient) notifySnapshotCreated(imagePath string) error {
+	return b.postJSON("/api/internal/snapshot-created", map[string]string{"image_path": imagePath})
+}
+
+// pairingCode mirrors the POST /api/relay/request_pairing_code response.
+type pairingCode struct {
+	RelayID       string `json:"relay_id"`
+	PairingCode   string `json:"pairing_code"`
+	Status        string `json:"status"`
+	PairingSecret string `json:"pairing_secret"`
+}
+
+// errPairingCodeNotFound means the backend no longer knows a pairing code,
+// usually because the relay was re-paired elsewhere.
+var errPairingCodeNotFound = errors.New("pairing code not found")
+
+// requestPairingCode asks for a new pairing code. relayID is empty for a new
+// relay; re-pairing an existing one needs its device token.
+func (b *backendClient) requestPairingCode(relayID string) (*pairingCode, error) {
+	payload := map[string]string{}
+	if relayID != "" {
+		payload["relay_id"] = relayID
+	}
+	var pc pairingCode
+	if err := b.doJSON(http.MethodPost, "/api/relay/request_pairing_code", payload, &pc); err != nil {
+		return nil, err
+	}
+	if pc.RelayID == "" || pc.PairingCode == "" || pc.PairingSecret == "" {
+		return nil, errors.New("pairing code response is incomplete")
+	}
+	return &pc, nil
+}
+
+// pairingStatus polls GET /api/relay/pairing and returns "pending" or "claimed".
+func (b *backendClient) pairingStatus(code string) (string, error) {
+	var status struct {
+		Status string `json:"status"`
+	}
+	err := b.doJSON(http.MethodGet, "/api/relay/pairing?code="+url.QueryEscape(code), nil, &status)
+	var se *backendStatusError
+	if errors.As(err, &se) && se.code == http.StatusNotFound {
+		return "", errPairingCodeNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return status.Status, nil
+}
+
+// collectDeviceToken trades the pairing secret for the relay's device token.
+// It returns an empty token while the claim is still pending.
+func (b *backendClient) collectDeviceToken(relayID, pairingSecret string) (string, error) {
+	var resp struct {
+		Status      string `json:"status"`
+		DeviceToken string `json:"device_token"`
+	}
+	payload := map[string]string{"relay_id": relayID, "pairing_secret": pairingSecret}
+	if err := b.doJSON(http.MethodPost, "/api/relay/token", payload, &resp); err != nil {
+		return "", err
+	}
+	return resp.DeviceToken, nil
+}
+
+// backendStatusError is a non-2xx response from the backend.
+type backendStatusError struct {
+	method, path, status string
+	code                 int
+	body                 string
+}
+
+func (e *backendStatusError) Error() string {
+	return fmt.Sprintf("%s %s. Status: %s, Body: %s", e.method, e.path, e.status, e.body)
+}
+
+// doJSON sends payload (if any) as JSON and decodes the response into out.
+func (b *backendClient) doJSON(method, path string, payload, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, b.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	setRelayAuth(req, b.token)
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &backendStatusError{method: method, path: path, status: resp.Status, code: resp.StatusCode, body: string(respBody)}
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("decoding %s response: %w", path, err)
+	}
+	return nil
+}
+
+func (b *backendClient) postJSON(path string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, b.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setRelayAuth(req, b.token)
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("POST %s. Status: %s, Body: %s", path, resp.Status, string(respBody))
+	}
+	return nil
+}
+
+// setRelayAuth adds the relay's device token to a backend request.
+func setRelayAuth(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// cameraConfig is one camera under the relay, as listed by GET /api/relay/config.
+type cameraConfig struct {
+	ID        string  `json:"id"`
+	Label     string  `json:"label"`
+	SourceURL string  `json:"source_url"`
+	Interval  *string `json:"interval"`
+	// Schedule, when set, replaces Interval.
+	Schedule *captureSchedule `json:"schedule"`
+	// Clip, when set, records video clips as well as frames.
+	Clip *clipSettings `json:"clip"`
+	imageSettings
+}
+
+// legacyCameraID keys the single camera of a relay that has no camera rows
+// yet. Its snapshots are uploaded without a camera_id.
+const legacyCameraID = ""
+
+func (c cameraConfig) equal(o cameraConfig) bool {
+	return c.ID == o.ID && c.Label == o.Label && c.SourceURL == o.SourceURL && strPtrEqual(c.Interval, o.Interval) &&
+		c.Schedule.equal(o.Schedule) && c.Clip.equal(o.Clip) && c.imageSettings.equal(o.imageSettings)
+}
+
+// name is how the camera appears in logs.
+func (c cameraConfig) name() string {
+	switch {
+	case c.Label != "":
+		return c.Label
+	case c.ID != legacyCameraID:
+		return c.ID
+	}
+	return "default"
+}
+
+// interval is the camera's capture interval, falling back to the default
+// when the backend sends none or an invalid one.
+func (c cameraConfig) interval() time.Duration {
+	if c.Interval == nil {
+		return defaultCaptureInterval
+	}
+	interval, err := parseInterval(*c.Interval)
+	if err != nil {
+		log.Printf("[%s] Invalid interval %q from backend, using %s: %v", c.name(), *c.Interval, defaultCaptureInterval, err)
+		return defaultCaptureInterval
+	}
+	return interval
+}
+
+// cameraList returns the cameras the relay should capture. A relay without
+// camera rows falls back to the legacy rtsp_url and interval fields.
+func (c relayConfig) cameraList() []cameraConfig {
+	if len(c.Cameras) > 0 {
+		var cams []cameraConfig
+		for _, cam := range c.Cameras {
+			if cam.SourceURL != "" {
+				cams = append(cams, cam)
+			}
+		}
+		return cams
+	}
+	if c.RTSPUrl == nil || *c.RTSPUrl == "" {
+		return nil
+	}
+	return []cameraConfig{{ID: legacyCameraID, SourceURL: *c.RTSPUrl, Interval: c.Interval, Schedule: c.Schedule, Clip: c.Clip, imageSettings: c.imageSettings}}
+}
+
+// camera looks up one camera of the relay by ID.
+func (c relayConfig) camera(id string) (cameraConfig, bool) {
+	for _, cam := range c.cameraList() {
+		if cam.ID == id {
+			return cam, true
+		}
+	}
+	return cameraConfig{}, false
+}
+
+// cameraNamed looks up a camera by ID or, ignoring case, by label. The
+// legacy camera answers to "default".
+func (c relayConfig) cameraNamed(name string) (cameraConfig, bool) {
+	for _, cam := range c.cameraList() {
+		if (cam.ID != legacyCameraID && cam.ID == name) || strings.EqualFold(cam.name(), name) {
+			return cam, true
+		}
+	}
+	return cameraConfig{}, false
+}
+
+// cameraWorker captures one camera on its own schedule, so a slow or dead
+// camera doesn't delay the others.
+type cameraWorker struct {
+	cancel  context.CancelFunc
+	done    chan struct{}
+	updates chan cameraConfig
+	// now asks for an immediate capture and receives its result.
+	now chan chan captureResult
+	// pushed carries images the camera sent to the ingest servers.
+	pushed chan pushedFrame
+}
+
+func (d *daemon) startCamera(ctx context.Context, cam cameraConfig) *cameraWorker {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &cameraWorker{cancel: cancel, done: make(chan struct{}), updates: make(chan cameraConfig, 1), now: make(chan chan captureResult), pushed: make(chan pushedFrame)}
+	go d.cameraLoop(ctx, w, cam)
+	return w
+}
+
+// update hands the worker a new config. Only the capture loop calls it, so
+// replacing an unread update can't race with another sender.
+func (w *cameraWorker) update(cam cameraConfig) {
+	select {
+	case <-w.updates:
+	default:
+	}
+	w.updates <- cam
+}
+
+// captureNow makes the worker capture and upload a frame right away.
+func (w *cameraWorker) captureNow(ctx context.Context) (captureResult, error) {
+	reply := make(chan captureResult, 1)
+	select {
+	case w.now <- reply:
+	case <-w.done:
+		return captureResult{}, errors.New("camera was removed")
+	case <-ctx.Done():
+		return captureResult{}, ctx.Err()
+	}
+	select {
+	case r := <-reply:
+		return r, nil
+	case <-ctx.Done():
+		return captureResult{}, ctx.Err()
+	}
+}
+
+// stop cancels the worker and waits for an in-flight capture to finish.
+func (w *cameraWorker) stop() {
+	w.cancel()
+	<-w.done
+}
+
+// cameraLoop fires a capture each time the camera's schedule comes due. A
+// config change reschedules relative to the last capture so shortening the
+// interval takes effect immediately. With a capture schedule the loop also
+// wakes every scheduleRecheck to notice windows opening and closing.
+// Scheduled clips (clip.every) follow the same windows. A push:// camera is
+// never polled; it only handles the images it pushes.
+func (d *daemon) cameraLoop(ctx context.Context, w *cameraWorker, cam cameraConfig) {
+	defer close(w.done)
+	var lastCapture, lastClip time.Time
+	changes := &changeDetector{threshold: d.changeThreshold, keepalive: d.keepalive}
+	sched := parseSchedule(cam.Schedule, cam.name())
+	wasActive := true
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case cam = <-w.updates:
+			sched = parseSchedule(cam.Schedule, cam.name())
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
+			now := time.Now()
+			interval, active := sched.intervalAt(now, cam.interval())
+			if every := cam.Clip.every(); active && every > 0 && !now.Before(nextCaptureAt(lastClip, every, now)) {
+				lastClip = now
+				d.startClip(ctx, cam, clipTriggerSchedule)
+			}
+			if active && !isPushSource(cam.SourceURL) && !now.Before(nextCaptureAt(lastCapture, interval, now)) {
+				lastCapture = now
+				d.captureOnce(ctx, cam, changes, false)
+			}
+		case reply := <-w.now:
+			reply <- d.captureOnce(ctx, cam, changes, true)
+		case p := <-w.pushed:
+			p.reply <- d.processPushed(ctx, cam, sched, changes, p)
+		}
+
+		now := time.Now()
+		interval, active := sched.intervalAt(now, cam.interval())
+		if active != wasActive {
+			if active {
+				log.Printf("[%s] Capture schedule active, every %s", cam.name(), interval)
+			} else {
+				log.Printf("[%s] Outside capture schedule, pausing", cam.name())
+			}
+			wasActive = active
+		}
+		wait := scheduleRecheck
+		if active && !isPushSource(cam.SourceURL) {
+			wait = nextCaptureAt(lastCapture, interval, now).Sub(now)
+			if every := cam.Clip.every(); every > 0 {
+				wait = min(wait, nextCaptureAt(lastClip, every, now).Sub(now))
+			}
+		}
+		if sched != nil {
+			wait = min(wait, scheduleRecheck)
+		}
+		timer.Reset(wait)
+	}
+}
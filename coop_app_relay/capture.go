@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAccessUnits bounds how many access units captureRTSP inspects before
+// giving up.
+const maxAccessUnits = 600
+
+// captureBurst grabs up to n frames from a camera source, stopping once n
+// are decoded or window has passed since the first. http(s) sources are
+// snapshot or MJPEG URLs, push:// cameras can't be captured, and the rest
+// must be rtsp:// or rtsps://. Callers crop, scale and encode the frames
+// themselves.
+func captureBurst(ctx context.Context, sourceURL string, n int, window time.Duration) ([]image.Image, error) {
+	if isHTTPSource(sourceURL) {
+		return captureHTTP(ctx, sourceURL, n, window)
+	}
+	if isPushSource(sourceURL) {
+		return nil, errPushSource
+	}
+	return captureRTSP(ctx, sourceURL, n, window)
+}
+
+// captureRTSP grabs up to n frames from an RTSP source. The stream is read
+// natively over TCP-interleaved RTP and intra-coded pictures are decoded in
+// memory, so nothing is executed and nothing touches the disk. Only keyframes
+// decode natively, though, so a burst from a camera with a keyframe every
+// few seconds would be one frame; bursts therefore go through ffmpeg when it
+// is installed, and natively only yield what keyframes the window holds. So
+// do streams the built-in decoder can't handle (CABAC, High profile) and
+// rtsps:// sources, which fail without ffmpeg. It fails only if no frame
+// decodes at all.
+func captureRTSP(ctx context.Context, rtspURL string, n int, window time.Duration) ([]image.Image, error) {
+	u, err := checkRTSPURL(rtspURL)
+	if err != nil {
+		return nil, err
+	}
+	_, lookErr := exec.LookPath("ffmpeg")
+	haveFFmpeg := lookErr == nil
+	if u.Scheme == "rtsps" {
+		if !haveFFmpeg {
+			return nil, errors.New("rtsps:// sources need ffmpeg; install it or use the camera's rtsp:// URL")
+		}
+		return captureFFmpeg(ctx, rtspURL, n, window)
+	}
+	if n > 1 && haveFFmpeg {
+		frames, err := captureFFmpeg(ctx, rtspURL, n, window)
+		if err == nil {
+			return frames, nil
+		}
+		log.Printf("ffmpeg burst failed, capturing keyframes instead: %v", err)
+	}
+	frames, err := captureRTSPNative(ctx, rtspURL, n, window)
+	if !errors.Is(err, errUnsupportedStream) {
+		return frames, err
+	}
+	if !haveFFmpeg {
+		return nil, fmt.Errorf("%w; install ffmpeg, switch the camera to Baseline profile or use a JPEG snapshot source", err)
+	}
+	frames, ffErr := captureFFmpeg(ctx, rtspURL, n, window)
+	if ffErr != nil {
+		return nil, fmt.Errorf("%v; ffmpeg fallback: %w", err, ffErr)
+	}
+	return frames, nil
+}
+
+// captureFFmpeg grabs n frames spread over window from an RTSP source with
+// ffmpeg, which decodes every frame rather than only keyframes. ffmpeg is
+// invoked with an argument list rather than through a shell, and writes the
+// frames to stdout as back-to-back JPEGs so nothing touches the disk. Only
+// RTSP URLs are passed on: ffmpeg's -i would as happily read a local file or
+// another protocol.
+func captureFFmpeg(ctx context.Context, rtspURL string, n int, window time.Duration) ([]image.Image, error) {
+	if _, err := checkRTSPURL(rtspURL); err != nil {
+		return nil, err
+	}
+	n = max(n, 1)
+	args := []string{
+		"-hide_banner", "-loglevel", "error",
+		"-rtsp_transport", "tcp",
+		"-i", rtspURL,
+		"-frames:v", strconv.Itoa(n),
+	}
+	if n > 1 && window > 0 {
+		// Space the frames evenly across the window instead of taking n
+		// consecutive ones a few milliseconds apart.
+		args = append(args, "-vf", "fps="+strconv.FormatFloat(float64(n)/window.Seconds(), 'f', 3, 64))
+	}
+	args = append(args, "-f", "image2pipe", "-c:v", "mjpeg", "pipe:1")
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	jpegs, err := splitJPEGs(stdout.Bytes())
+	if len(jpegs) == 0 {
+		if err == nil {
+			err = errors.New("ffmpeg produced no frame")
+		}
+		return nil, err
+	}
+	var frames []image.Image
+	for _, data := range jpegs {
+		img, err := decodeJPEG(data)
+		if err != nil {
+			return nil, fmt.Errorf("ffmpeg frame: %w", err)
+		}
+		frames = append(frames, img)
+	}
+	return frames, nil
+}
+
+// splitJPEGs splits back-to-back JPEG images at their end-of-image markers.
+// A truncated last image is dropped and reported with the ones before it.
+func splitJPEGs(data []byte) ([][]byte, error) {
+	var images [][]byte
+	for len(data) > 0 {
+		n, err := jpegLength(data)
+		if err != nil {
+			return images, err
+		}
+		images = append(images, data[:n])
+		data = data[n:]
+	}
+	return images, nil
+}
+
+// jpegLength walks the markers of the JPEG at the start of data and returns
+// its length through the end-of-image marker.
+func jpegLength(data []byte) (int, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return 0, errors.New("not a JPEG image")
+	}
+	i := 2
+	for {
+		if i+1 >= len(data) {
+			return 0, errors.New("truncated JPEG image")
+		}
+		if data[i] != 0xff {
+			return 0, fmt.Errorf("no JPEG marker at offset %d", i)
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xff:
+			// Fill byte before a marker.
+			i++
+			continue
+		case marker == 0xd9:
+			return i + 2, nil
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7:
+			// No length follows TEM and RSTn.
+			i += 2
+			continue
+		}
+		if i+3 >= len(data) {
+			return 0, errors.New("truncated JPEG image")
+		}
+		i += 2 + (int(data[i+2])<<8 | int(data[i+3]))
+		if marker != 0xda {
+			continue
+		}
+		// Entropy-coded data runs to the next marker that isn't a stuffed
+		// zero or a restart marker.
+		for ; i+1 < len(data); i++ {
+			if data[i] == 0xff && data[i+1] != 0 && (data[i+1] < 0xd0 || data[i+1] > 0xd7) {
+				break
+			}
+		}
+	}
+}
+
+// checkRTSPURL accepts only rtsp:// and rtsps:// URLs with a host.
+func checkRTSPURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid camera URL: %w", err)
+	}
+	if u.Scheme != "rtsp" && u.Scheme != "rtsps" {
+		return nil, fmt.Errorf("unsupported camera URL scheme %q: use rtsp://, rtsps://, http(s):// or push://", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("camera URL has no host")
+	}
+	return u, nil
+}
+
+// captureRTSPNative is captureRTSP without the ffmpeg fallback.
+func captureRTSPNative(ctx context.Context, rtspURL string, n int, window time.Duration) ([]image.Image, error) {
+	client, track, err := startRTSP(ctx, rtspURL)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	dec := newH264Decoder()
+	for _, ps := range track.paramSets {
+		// Bad out-of-band parameter sets are not fatal; most cameras repeat
+		// them in-band before each keyframe.
+		dec.addParameterSet(ps)
+	}
+
+	var depack h264Depacketizer
+	var lastErr error
+	var frames []image.Image
+	var deadline time.Time
+	for seen := 0; seen < maxAccessUnits; {
+		pkt, err := client.readRTP()
+		if err != nil {
+			if len(frames) > 0 {
+				return frames, nil
+			}
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			if lastErr != nil {
+				return nil, fmt.Errorf("%w (last decode error: %v)", err, lastErr)
+			}
+			return nil, err
+		}
+		au := depack.push(pkt)
+		if au == nil {
+			continue
+		}
+		seen++
+		if len(frames) > 0 && !time.Now().Before(deadline) {
+			return frames, nil
+		}
+		img, err := dec.decodeIntraPicture(au)
+		if errors.Is(err, errNotIntraPicture) {
+			continue
+		}
+		if errors.Is(err, errUnsupportedStream) && len(frames) == 0 {
+			// Every keyframe will fail the same way.
+			return nil, err
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		frames = append(frames, img)
+		if len(frames) == 1 {
+			deadline = time.Now().Add(window)
+			// Don't wait past the window for a keyframe that may never come.
+			if ctxDeadline, ok := ctx.Deadline(); n > 1 && (!ok || deadline.Before(ctxDeadline)) {
+				client.conn.SetReadDeadline(deadline)
+			}
+		}
+		if len(frames) >= n || !time.Now().Before(deadline) {
+			return frames, nil
+		}
+	}
+	if len(frames) > 0 {
+		return frames, nil
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("no decodable keyframe in stream: %w", lastErr)
+	}
+	return nil, errors.New("no keyframe received from stream")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// noisyJPEG encodes random pixels, so the entropy-coded data is full of
+// stuffed 0xFF bytes.
+func noisyJPEG(t *testing.T, seed int64) []byte {
+	t.Helper()
+	r := rand.New(rand.NewSource(seed))
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	r.Read(img.Pix)
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestSplitJPEGs(t *testing.T) {
+	images := [][]byte{noisyJPEG(t, 1), testJPEG(t, 200), noisyJPEG(t, 2)}
+	stream := bytes.Join(images, nil)
+
+	got, err := splitJPEGs(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(images) {
+		t.Fatalf("split into %d images, want %d", len(got), len(images))
+	}
+	for i := range images {
+		if !bytes.Equal(got[i], images[i]) {
+			t.Errorf("image %d: %d bytes, want %d", i, len(got[i]), len(images[i]))
+		}
+	}
+
+	// ffmpeg killed mid-frame leaves a truncated last image.
+	got, err = splitJPEGs(stream[:len(stream)-100])
+	if err == nil || len(got) != 2 {
+		t.Errorf("truncated stream: %d images, err %v; want 2 and an error", len(got), err)
+	}
+	if got, err := splitJPEGs([]byte("ffmpeg: error")); err == nil || len(got) != 0 {
+		t.Errorf("non-JPEG output: %d images, err %v", len(got), err)
+	}
+}
+
+// fakeFFmpeg puts an ffmpeg on PATH that records its arguments and writes
+// stdout to stdout.
+func fakeFFmpeg(t *testing.T, stdout []byte) (argsFile string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ffmpeg is a shell script")
+	}
+	dir := t.TempDir()
+	argsFile = filepath.Join(dir, "args")
+	out := filepath.Join(dir, "out")
+	if err := os.WriteFile(out, stdout, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\nfor a in \"$@\"; do echo \"$a\"; done > '" + argsFile + "'\ncat '" + out + "'\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return argsFile
+}
+
+func TestCaptureFFmpegBurst(t *testing.T) {
+	stream := bytes.Join([][]byte{testJPEG(t, 10), testJPEG(t, 120), testJPEG(t, 240)}, nil)
+	argsFile := fakeFFmpeg(t, stream)
+
+	frames, err := captureRTSP(context.Background(), "rtsp://cam.local/stream", 3, 6*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want 3", len(frames))
+	}
+	for i, want := range []uint8{10, 120, 240} {
+		if r, _, _, _ := frames[i].At(5, 5).RGBA(); uint8(r>>8) < want-3 || uint8(r>>8) > want+3 {
+			t.Errorf("frame %d is %d, want about %d", i, r>>8, want)
+		}
+	}
+	raw, _ := os.ReadFile(argsFile)
+	args := strings.Join(strings.Fields(string(raw)), " ")
+	for _, want := range []string{"-i rtsp://cam.local/stream", "-frames:v 3", "-vf fps=0.500", "-f image2pipe"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("ffmpeg args %q lack %q", args, want)
+		}
+	}
+
+	// A single frame needs no rate filter.
+	if _, err := captureFFmpeg(context.Background(), "rtsp://cam.local/stream", 1, 6*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ = os.ReadFile(argsFile)
+	if args := string(raw); !strings.Contains(args, "-frames:v\n1\n") || strings.Contains(args, "fps=") {
+		t.Errorf("single-frame ffmpeg args:\n%s", args)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"time"
+)
+
+const (
+	// Frames are compared as 32x24 grayscale thumbnails, which averages out
+	// sensor and JPEG noise while keeping a hen-sized change visible.
+	thumbW = 32
+	thumbH = 24
+
+	defaultChangeThreshold = 0.015
+	defaultKeepalive       = 6 * time.Hour
+)
+
+// frameThumb is a small grayscale copy of a frame.
+type frameThumb [thumbW * thumbH]uint8
+
+// thumbnail box-averages a frame's luma down to a thumbnail.
+func thumbnail(img image.Image) (*frameThumb, error) {
+	b := img.Bounds()
+	if b.Dx() < thumbW || b.Dy() < thumbH {
+		return nil, fmt.Errorf("frame %dx%d is smaller than the %dx%d thumbnail", b.Dx(), b.Dy(), thumbW, thumbH)
+	}
+	luma := func(x, y int) uint32 {
+		if ycc, ok := img.(*image.YCbCr); ok {
+			return uint32(ycc.Y[ycc.YOffset(x, y)])
+		}
+		r, g, bl, _ := img.At(x, y).RGBA()
+		return (19595*r + 38470*g + 7471*bl + 1<<15) >> 24
+	}
+
+	var t frameThumb
+	for ty := 0; ty < thumbH; ty++ {
+		y0, y1 := b.Min.Y+ty*b.Dy()/thumbH, b.Min.Y+(ty+1)*b.Dy()/thumbH
+		for tx := 0; tx < thumbW; tx++ {
+			x0, x1 := b.Min.X+tx*b.Dx()/thumbW, b.Min.X+(tx+1)*b.Dx()/thumbW
+			var sum uint32
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					sum += luma(x, y)
+				}
+			}
+			t[ty*thumbW+tx] = uint8(sum / uint32((y1-y0)*(x1-x0)))
+		}
+	}
+	return &t, nil
+}
+
+// diff is the mean absolute difference between two thumbnails, from 0
+// (identical) to 1 (black versus white).
+func (t *frameThumb) diff(o *frameThumb) float64 {
+	var sum int
+	for i := range t {
+		d := int(t[i]) - int(o[i])
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return float64(sum) / float64(len(t)*255)
+}
+
+// changeDetector decides, per camera, whether a frame differs enough from
+// the last uploaded one to be worth uploading.
+type changeDetector struct {
+	// threshold is the minimum diff to upload; 0 uploads every frame.
+	threshold float64
+	// keepalive forces an upload after this long without one; 0 never does.
+	keepalive time.Duration
+
+	last     *frameThumb
+	lastSent time.Time
+	// changed is set when the last frame accept passed was over the
+	// threshold, as opposed to forced, first or keepalive.
+	changed bool
+}
+
+// accept reports whether to upload the frame and why. Frames are compared
+// after cropping, so movement outside the region of interest is ignored. A
+// frame that can't be compared is uploaded rather than risk dropping a real
+// change. A forced frame, such as one the app asked for, is always uploaded
+// and becomes the new baseline.
+func (c *changeDetector) accept(img image.Image, now time.Time, force bool) (bool, string) {
+	c.changed = false
+	if c.threshold <= 0 {
+		return true, "change detection off"
+	}
+	thumb, err := thumbnail(img)
+	if err != nil {
+		c.last = nil
+		return true, fmt.Sprintf("could not compare frame: %v", err)
+	}
+
+	upload, reason := false, ""
+	switch {
+	case force:
+		upload, reason = true, "requested"
+	case c.last == nil:
+		upload, reason = true, "first frame"
+	case c.keepalive > 0 && now.Sub(c.lastSent) >= c.keepalive:
+		upload, reason = true, "keepalive"
+	default:
+		d := thumb.diff(c.last)
+		upload = d >= c.threshold
+		c.changed = upload
+		reason = fmt.Sprintf("%.1f%% different", d*100)
+	}
+	if upload {
+		c.last = thumb
+		c.lastSent = now
+	}
+	return upload, reason
+}
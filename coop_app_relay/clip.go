@@ -0,0 +1,559 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultClipLength   = 15 * time.Second
+	maxClipLength       = 60 * time.Second
+	defaultClipCooldown = 5 * time.Minute
+	// clipStartTimeout bounds the wait for the first keyframe of a clip.
+	clipStartTimeout = 20 * time.Second
+	// rtspKeepaliveEvery stays under the usual 60s RTSP session timeout.
+	rtspKeepaliveEvery = 30 * time.Second
+	// maxQueuedClips caps the clip queue; the oldest clip goes first.
+	maxQueuedClips = 50
+
+	clipTriggerChange   = "change"
+	clipTriggerSchedule = "schedule"
+	clipTriggerCommand  = "command"
+)
+
+// clipSettings says when a camera records clips. It mirrors ClipSettings in
+// the backend.
+type clipSettings struct {
+	Seconds  int    `json:"seconds"`
+	OnChange bool   `json:"on_change,omitempty"`
+	Every    string `json:"every,omitempty"`
+	Cooldown string `json:"cooldown,omitempty"`
+}
+
+func (c *clipSettings) equal(o *clipSettings) bool {
+	if c == nil || o == nil {
+		return c == o
+	}
+	return *c == *o
+}
+
+// length is how long each clip runs.
+func (c *clipSettings) length() time.Duration {
+	if c == nil || c.Seconds <= 0 {
+		return defaultClipLength
+	}
+	return min(time.Duration(c.Seconds)*time.Second, maxClipLength)
+}
+
+// every is the interval between scheduled clips, or 0 for none.
+func (c *clipSettings) every() time.Duration {
+	if c == nil || c.Every == "" {
+		return 0
+	}
+	d, err := parseInterval(c.Every)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// cooldown is the least time between two clips triggered by change.
+func (c *clipSettings) cooldown() time.Duration {
+	if c == nil || c.Cooldown == "" {
+		return defaultClipCooldown
+	}
+	d, err := parseInterval(c.Cooldown)
+	if err != nil {
+		return defaultClipCooldown
+	}
+	return d
+}
+
+// recordedClip is an MP4 file written by recordClip.
+type recordedClip struct {
+	Path          string
+	Duration      time.Duration
+	Width, Height int
+	Size          int64
+	SHA256        string
+}
+
+// recordClip records about length of video from an RTSP source into an MP4
+// file in dir, starting at the first keyframe. The H.264 stream is copied,
+// not re-encoded. If the camera drops out part way, what was recorded is
+// kept as long as it is at least a second.
+func recordClip(ctx context.Context, rtspURL string, length time.Duration, dir string) (*recordedClip, error) {
+	ctx, cancel := context.WithTimeout(ctx, clipStartTimeout+length)
+	defer cancel()
+	client, track, err := startRTSP(ctx, rtspURL)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	mux, err := newMP4Writer(dir)
+	if err != nil {
+		return nil, fmt.Errorf("creating clip: %w", err)
+	}
+	defer mux.close()
+	for _, ps := range track.paramSets {
+		mux.setParameterSet(ps)
+	}
+
+	var depack h264Depacketizer
+	var firstTS uint32
+	limit := uint64(length.Seconds() * mp4Timescale)
+	nextKeepalive := time.Now().Add(rtspKeepaliveEvery)
+	for {
+		pkt, err := client.readRTP()
+		if err != nil {
+			if mux.duration() >= mp4Timescale {
+				log.Printf("Clip cut short at %s: %v", time.Duration(mux.duration())*time.Second/mp4Timescale, err)
+				break
+			}
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			if mux.samples() == 0 {
+				return nil, fmt.Errorf("no keyframe received from stream: %w", err)
+			}
+			return nil, err
+		}
+		au := depack.push(pkt)
+		if au == nil {
+			continue
+		}
+		ts := depack.auTimestamp
+		if mux.samples() > 0 && uint64(ts-firstTS) >= limit {
+			break
+		}
+		wrote, err := mux.writeAccessUnit(au, ts)
+		if err != nil {
+			return nil, fmt.Errorf("writing clip: %w", err)
+		}
+		if wrote && mux.samples() == 1 {
+			firstTS = ts
+		}
+		if time.Now().After(nextKeepalive) {
+			if err := client.keepalive(); err != nil {
+				return nil, err
+			}
+			nextKeepalive = time.Now().Add(rtspKeepaliveEvery)
+		}
+	}
+
+	f, err := os.CreateTemp(dir, ".rec-*.mp4")
+	if err != nil {
+		return nil, fmt.Errorf("creating clip: %w", err)
+	}
+	h := sha256.New()
+	bw := io.MultiWriter(f, h)
+	if err := mux.finish(bw); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &recordedClip{
+		Path:     f.Name(),
+		Duration: time.Duration(mux.duration()) * time.Second / mp4Timescale,
+		Width:    mux.width,
+		Height:   mux.height,
+		Size:     fi.Size(),
+		SHA256:   hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// clipEntry is one recorded clip waiting to be uploaded.
+type clipEntry struct {
+	ID         string    `json:"id"`
+	CameraID   string    `json:"camera_id,omitempty"`
+	CapturedAt time.Time `json:"captured_at"`
+	Duration   float64   `json:"duration_seconds"`
+	Width      int       `json:"width,omitempty"`
+	Height     int       `json:"height,omitempty"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	Trigger    string    `json:"trigger"`
+	// UploadURL is the resumable upload once it has been created, kept so
+	// an upload interrupted by a restart carries on where it stopped.
+	UploadURL   string    `json:"upload_url,omitempty"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// clipQueue holds recorded clips until they are uploaded. Each clip is an
+// <id>.mp4 file with an <id>.json record next to it. It also tracks which
+// cameras are recording, so a camera records one clip at a time.
+type clipQueue struct {
+	dir string
+
+	mu         sync.Mutex
+	entries    []*clipEntry
+	recording  map[string]bool
+	lastChange map[string]time.Time
+
+	// notify is signalled whenever a clip is added.
+	notify chan struct{}
+}
+
+// clipDir is where clips are queued: next to the spool directory.
+func clipDir(spoolDir string) string {
+	return filepath.Join(filepath.Dir(filepath.Clean(spoolDir)), "clips")
+}
+
+// openClipQueue loads the queued clips in dir, creating it if needed.
+// Records without their MP4, MP4s without a record and half-written files
+// are deleted.
+func openClipQueue(dir string) (*clipQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating clip directory: %w", err)
+	}
+	q := &clipQueue{dir: dir, recording: make(map[string]bool), lastChange: make(map[string]time.Time), notify: make(chan struct{}, 1)}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing clip directory: %w", err)
+	}
+	known := make(map[string]bool)
+	for _, f := range files {
+		id, ok := strings.CutSuffix(f.Name(), ".json")
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		var e clipEntry
+		if err == nil {
+			err = json.Unmarshal(data, &e)
+		}
+		if err != nil || e.ID != id {
+			log.Printf("Clip record %s is unreadable, dropping it", f.Name())
+			continue
+		}
+		if _, err := os.Stat(q.clipPath(id)); err != nil {
+			log.Printf("Clip %s has no video file, dropping it", id)
+			continue
+		}
+		known[id+".json"], known[id+".mp4"] = true, true
+		q.entries = append(q.entries, &e)
+	}
+	for _, f := range files {
+		if !known[f.Name()] {
+			os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+	// IDs start with the capture time, so this is oldest first.
+	slices.SortFunc(q.entries, func(a, b *clipEntry) int { return strings.Compare(a.ID, b.ID) })
+	return q, nil
+}
+
+func (q *clipQueue) clipPath(id string) string {
+	return filepath.Join(q.dir, id+".mp4")
+}
+
+func (q *clipQueue) recordPath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+// begin marks cam as recording. It returns false if it already is.
+func (q *clipQueue) begin(cameraID string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.recording[cameraID] {
+		return false
+	}
+	q.recording[cameraID] = true
+	return true
+}
+
+func (q *clipQueue) end(cameraID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.recording, cameraID)
+}
+
+// changeAllowed reports whether a change-triggered clip of cam may start
+// now given its cooldown, and if so records that one did.
+func (q *clipQueue) changeAllowed(cameraID string, cooldown time.Duration, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if last, ok := q.lastChange[cameraID]; ok && now.Sub(last) < cooldown {
+		return false
+	}
+	q.lastChange[cameraID] = now
+	return true
+}
+
+// add moves a recorded clip into the queue.
+func (q *clipQueue) add(c *recordedClip, cameraID, trigger string, capturedAt time.Time) (*clipEntry, error) {
+	e := &clipEntry{
+		ID:         fmt.Sprintf("%d-%s", capturedAt.UnixNano(), c.SHA256[:8]),
+		CameraID:   cameraID,
+		CapturedAt: capturedAt.UTC(),
+		Duration:   c.Duration.Seconds(),
+		Width:      c.Width,
+		Height:     c.Height,
+		Size:       c.Size,
+		SHA256:     c.SHA256,
+		Trigger:    trigger,
+	}
+	if err := os.Rename(c.Path, q.clipPath(e.ID)); err != nil {
+		return nil, fmt.Errorf("queueing clip: %w", err)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.saveLocked(e); err != nil {
+		os.Remove(q.clipPath(e.ID))
+		return nil, err
+	}
+	q.entries = append(q.entries, e)
+	for len(q.entries) > maxQueuedClips {
+		log.Printf("Clip queue is full, dropping oldest clip %s", q.entries[0].ID)
+		q.removeLocked(q.entries[0].ID)
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	copied := *e
+	return &copied, nil
+}
+
+// head returns a copy of the oldest clip, or nil if the queue is empty.
+func (q *clipQueue) head() *clipEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) == 0 {
+		return nil
+	}
+	copied := *q.entries[0]
+	return &copied
+}
+
+// setUploadURL records the clip's resumable upload ("" to start over).
+func (q *clipQueue) setUploadURL(id, uploadURL string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if e := q.findLocked(id); e != nil {
+		e.UploadURL = uploadURL
+		return q.saveLocked(e)
+	}
+	return nil
+}
+
+// fail records a failed upload attempt and schedules the next one with the
+// spool's backoff. It returns the time of the next attempt.
+func (q *clipQueue) fail(id string, cause error, now time.Time) (time.Time, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e := q.findLocked(id)
+	if e == nil {
+		return now, nil
+	}
+	e.Attempts++
+	e.LastError = cause.Error()
+	e.NextAttempt = now.Add(spoolBackoff(e.Attempts))
+	return e.NextAttempt, q.saveLocked(e)
+}
+
+// complete removes a clip once the backend has registered it.
+func (q *clipQueue) complete(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.removeLocked(id)
+}
+
+func (q *clipQueue) findLocked(id string) *clipEntry {
+	for _, e := range q.entries {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+func (q *clipQueue) removeLocked(id string) {
+	for i, e := range q.entries {
+		if e.ID == id {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			break
+		}
+	}
+	os.Remove(q.clipPath(id))
+	os.Remove(q.recordPath(id))
+}
+
+func (q *clipQueue) saveLocked(e *clipEntry) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(q.recordPath(e.ID), data); err != nil {
+		return fmt.Errorf("writing clip record: %w", err)
+	}
+	return nil
+}
+
+// errClipBusy means the camera is already recording a clip.
+var errClipBusy = errors.New("camera is already recording a clip")
+
+// errClipNeedsRTSP means the camera is an HTTP or push source;
+// clips copy an H.264 stream, so only RTSP cameras record them.
+var errClipNeedsRTSP = errors.New("clips need an RTSP camera source")
+
+// errClipMasked means the camera has a privacy mask. Clips copy the camera's
+// H.264 without decoding it, so the mask can't be applied to them.
+var errClipMasked = errors.New("clips are not recorded from cameras with a privacy mask")
+
+// recordCameraClip records a clip from cam and queues it for upload.
+func (d *daemon) recordCameraClip(ctx context.Context, cam cameraConfig, trigger string, length time.Duration) (*clipEntry, error) {
+	if isHTTPSource(cam.SourceURL) || isPushSource(cam.SourceURL) {
+		return nil, errClipNeedsRTSP
+	}
+	if cam.PrivacyMask.active() {
+		return nil, errClipMasked
+	}
+	if !d.clips.begin(cam.ID) {
+		return nil, errClipBusy
+	}
+	defer d.clips.end(cam.ID)
+	log.Printf("[%s] Recording %s clip (%s)", cam.name(), length, trigger)
+	capturedAt := time.Now()
+	c, err := recordClip(ctx, cam.SourceURL, length, d.clips.dir)
+	if err != nil {
+		return nil, err
+	}
+	e, err := d.clips.add(c, cam.ID, trigger, capturedAt)
+	if err != nil {
+		os.Remove(c.Path)
+		return nil, err
+	}
+	log.Printf("[%s] Recorded clip %s (%.1fs, %dx%d, %d bytes)", cam.name(), e.ID, e.Duration, e.Width, e.Height, e.Size)
+	return e, nil
+}
+
+// startClip records a clip in the background for a change or schedule
+// trigger. Change triggers respect the camera's cooldown.
+func (d *daemon) startClip(ctx context.Context, cam cameraConfig, trigger string) {
+	if trigger == clipTriggerChange && !d.clips.changeAllowed(cam.ID, cam.Clip.cooldown(), time.Now()) {
+		return
+	}
+	go func() {
+		if _, err := d.recordCameraClip(ctx, cam, trigger, cam.Clip.length()); err != nil && ctx.Err() == nil {
+			log.Printf("[%s] Clip failed: %v", cam.name(), err)
+		}
+	}()
+}
+
+// clipNowResult is one camera's outcome of a record_clip command.
+type clipNowResult struct {
+	CameraID string  `json:"camera_id,omitempty"`
+	Name     string  `json:"name"`
+	Seconds  float64 `json:"seconds,omitempty"`
+	Bytes    int64   `json:"bytes,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// recordClipNow records a clip from one or all cameras right away and
+// queues it for upload. seconds overrides the camera's clip length.
+func (d *daemon) recordClipNow(ctx context.Context, cameraID *string, seconds int) ([]clipNowResult, error) {
+	d.mu.Lock()
+	cams := d.config.cameraList()
+	d.mu.Unlock()
+	var targets []cameraConfig
+	for _, cam := range cams {
+		if cameraID == nil || *cameraID == cam.ID {
+			targets = append(targets, cam)
+		}
+	}
+	if len(targets) == 0 {
+		if cameraID != nil {
+			return nil, fmt.Errorf("no camera %q on this relay", *cameraID)
+		}
+		return nil, errors.New("no cameras configured")
+	}
+
+	results := make([]clipNowResult, len(targets))
+	var wg sync.WaitGroup
+	for i, cam := range targets {
+		length := cam.Clip.length()
+		if seconds > 0 {
+			length = min(time.Duration(seconds)*time.Second, maxClipLength)
+		}
+		results[i] = clipNowResult{CameraID: cam.ID, Name: cam.name()}
+		wg.Add(1)
+		go func(r *clipNowResult, cam cameraConfig) {
+			defer wg.Done()
+			e, err := d.recordCameraClip(ctx, cam, clipTriggerCommand, length)
+			if err != nil {
+				r.Error = err.Error()
+				return
+			}
+			r.Seconds, r.Bytes = e.Duration, e.Size
+		}(&results[i], cam)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// clipUploadLoop uploads queued clips oldest first, retrying a failed one
+// with backoff before moving on, like the frame spool.
+func (d *daemon) clipUploadLoop(ctx context.Context) {
+	for {
+		e := d.clips.head()
+		var wait <-chan time.Time
+		switch {
+		case e == nil:
+		case time.Now().Before(e.NextAttempt):
+			wait = time.After(time.Until(e.NextAttempt))
+		default:
+			d.deliverClip(ctx, e)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.clips.notify:
+		case <-wait:
+		}
+	}
+}
+
+func (d *daemon) deliverClip(ctx context.Context, e *clipEntry) {
+	clipID, err := uploadClip(ctx, d.clipClient, d.backend.baseURL, d.backend.token, d.clips, e)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		next, saveErr := d.clips.fail(e.ID, err, time.Now())
+		if saveErr != nil {
+			log.Printf("Updating clip queue: %v", saveErr)
+		}
+		log.Printf("Upload of clip %s failed (attempt %d), retrying at %s: %v", e.ID, e.Attempts+1, next.Format(time.TimeOnly), err)
+		return
+	}
+	d.clips.complete(e.ID)
+	log.Printf("Uploaded clip %s as %s", e.ID, clipID)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Clips are uploaded with the backend's resumable (tus 1.0.0) endpoint in
+// chunks, so a dropped connection only costs the chunk in flight, then
+// registered with POST /api/clips.
+
+const (
+	tusVersion    = "1.0.0"
+	clipChunkSize = 1 << 20
+)
+
+// errClipUploadGone means the backend no longer has the resumable upload
+// (expired, or discarded after a failed check) and it must start over.
+var errClipUploadGone = errors.New("resumable upload no longer exists")
+
+// uploadClip sends a queued clip and registers it, resuming an upload
+// started by an earlier attempt. It returns the backend's clip ID.
+func uploadClip(ctx context.Context, client *http.Client, backendURL, deviceToken string, q *clipQueue, e *clipEntry) (string, error) {
+	f, err := os.Open(q.clipPath(e.ID))
+	if err != nil {
+		return "", fmt.Errorf("opening clip: %w", err)
+	}
+	defer f.Close()
+
+	if e.UploadURL == "" {
+		loc, err := createClipUpload(ctx, client, backendURL, deviceToken, e.Size)
+		if err != nil {
+			return "", err
+		}
+		e.UploadURL = loc
+		if err := q.setUploadURL(e.ID, loc); err != nil {
+			log.Printf("Recording upload of clip %s: %v", e.ID, err)
+		}
+	}
+	err = sendClipChunks(ctx, client, deviceToken, e, f)
+	if err == nil {
+		var clipID string
+		clipID, err = registerClip(ctx, client, backendURL, deviceToken, e)
+		if err == nil {
+			return clipID, nil
+		}
+	}
+	if errors.Is(err, errClipUploadGone) {
+		if resetErr := q.setUploadURL(e.ID, ""); resetErr != nil {
+			log.Printf("Recording upload of clip %s: %v", e.ID, resetErr)
+		}
+	}
+	return "", err
+}
+
+// createClipUpload starts a resumable upload of size bytes and returns its URL.
+func createClipUpload(ctx context.Context, client *http.Client, backendURL, deviceToken string, size int64) (string, error) {
+	base, err := url.Parse(strings.TrimSuffix(backendURL, "/") + "/api/clips/uploads")
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+	setRelayAuth(req, deviceToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("creating clip upload: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("creating clip upload. Status: %s, Body: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	loc, err := base.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return "", fmt.Errorf("clip upload response has no usable Location")
+	}
+	return loc.String(), nil
+}
+
+// clipUploadOffset asks how much of the upload the backend has.
+func clipUploadOffset(ctx context.Context, client *http.Client, uploadURL, deviceToken string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, uploadURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	setRelayAuth(req, deviceToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("checking clip upload: %w", err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+	case http.StatusNotFound, http.StatusGone:
+		return 0, errClipUploadGone
+	default:
+		return 0, fmt.Errorf("checking clip upload. Status: %s", resp.Status)
+	}
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("clip upload has no Upload-Offset")
+	}
+	return offset, nil
+}
+
+// sendClipChunks PATCHes the rest of the clip from wherever the backend's
+// copy ends.
+func sendClipChunks(ctx context.Context, client *http.Client, deviceToken string, e *clipEntry, f *os.File) error {
+	offset, err := clipUploadOffset(ctx, client, e.UploadURL, deviceToken)
+	if err != nil {
+		return err
+	}
+	for offset < e.Size {
+		n := min(clipChunkSize, e.Size-offset)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPatch, e.UploadURL, io.NewSectionReader(f, offset, n))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = n
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		setRelayAuth(req, deviceToken)
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("uploading clip at offset %d: %w", offset, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusNoContent, http.StatusOK:
+		case http.StatusConflict:
+			// Our idea of the offset is stale; carry on from the backend's.
+		case http.StatusNotFound, http.StatusGone:
+			return errClipUploadGone
+		default:
+			return fmt.Errorf("uploading clip. Status: %s, Body: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		next, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("clip upload response has no Upload-Offset")
+		}
+		if next == offset && resp.StatusCode != http.StatusConflict {
+			return fmt.Errorf("clip upload made no progress at offset %d", offset)
+		}
+		offset = next
+	}
+	return nil
+}
+
+// registerClip records a fully uploaded clip with POST /api/clips. A 409
+// for a duplicate means the backend already has it, which counts as
+// delivered.
+func registerClip(ctx context.Context, client *http.Client, backendURL, deviceToken string, e *clipEntry) (string, error) {
+	payload := map[string]interface{}{
+		"upload_id":        e.UploadURL[strings.LastIndex(e.UploadURL, "/")+1:],
+		"captured_at":      e.CapturedAt,
+		"duration_seconds": e.Duration,
+		"size":             e.Size,
+		"sha256":           e.SHA256,
+		"trigger":          e.Trigger,
+	}
+	if e.CameraID != legacyCameraID {
+		payload["camera_id"] = e.CameraID
+	}
+	if e.Width > 0 && e.Height > 0 {
+		payload["width"], payload["height"] = e.Width, e.Height
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("marshalling clip registration: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(backendURL, "/")+"/api/clips", bytes.NewReader(payloadBytes))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setRelayAuth(req, deviceToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("registering clip: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	var registered struct {
+		ClipID string `json:"clip_id"`
+	}
+	json.Unmarshal(body, &registered)
+	switch {
+	case resp.StatusCode == http.StatusCreated:
+		return registered.ClipID, nil
+	case resp.StatusCode == http.StatusConflict && registered.ClipID != "":
+		log.Printf("Backend already has clip %s as %s", e.ID, registered.ClipID)
+		return registered.ClipID, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnprocessableEntity:
+		// The backend discards an upload that fails its checks.
+		return "", fmt.Errorf("%w: %s", errClipUploadGone, strings.TrimSpace(string(body)))
+	}
+	return "", fmt.Errorf("registering clip. Status: %s, Body: %s", resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubTUSBackend is the backend's resumable clip upload endpoint and
+// POST /api/clips. Each upload keeps what it has received; PATCHes must
+// start at its current offset.
+type stubTUSBackend struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	uploads map[string][]byte
+	created int
+	patches []int64 // Upload-Offset of each PATCH
+	// cutPatch, when > 0, makes that PATCH (1-based) keep only its first
+	// cutKeep bytes and fail, as a connection dropped mid-chunk does.
+	cutPatch, cutKeep int
+	// staleHead makes the next HEAD report offset 0 regardless.
+	staleHead  bool
+	registered []map[string]interface{}
+	registerAs int // status for POST /api/clips
+}
+
+func newStubTUSBackend(t *testing.T) *stubTUSBackend {
+	b := &stubTUSBackend{uploads: make(map[string][]byte), registerAs: http.StatusCreated}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serve))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *stubTUSBackend) serve(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer tok" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/api/clips" {
+		var p map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&p)
+		b.registered = append(b.registered, p)
+		data, ok := b.uploads[fmt.Sprint(p["upload_id"])]
+		sum := sha256.Sum256(data)
+		if !ok || hex.EncodeToString(sum[:]) != p["sha256"] {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			io.WriteString(w, `{"error":"upload does not match"}`)
+			return
+		}
+		w.WriteHeader(b.registerAs)
+		io.WriteString(w, `{"clip_id":"clip-1"}`)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if r.URL.Path == "/api/clips/uploads" && r.Method == http.MethodPost {
+		if _, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b.created++
+		id := fmt.Sprintf("up%d", b.created)
+		b.uploads[id] = []byte{}
+		w.Header().Set("Location", "/api/clips/uploads/"+id)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	id, ok := strings.CutPrefix(r.URL.Path, "/api/clips/uploads/")
+	data, exists := b.uploads[id]
+	if !ok || !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	offset := int64(len(data))
+	switch r.Method {
+	case http.MethodHead:
+		if b.staleHead {
+			b.staleHead = false
+			offset = 0
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		at, _ := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		b.patches = append(b.patches, at)
+		if at != offset {
+			io.Copy(io.Discard, r.Body)
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		chunk, _ := io.ReadAll(r.Body)
+		if len(b.patches) == b.cutPatch {
+			b.uploads[id] = append(data, chunk[:b.cutKeep]...)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		b.uploads[id] = append(data, chunk...)
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(b.uploads[id])))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// queueTestClip queues a clip of size random bytes and returns it with its
+// contents.
+func queueTestClip(t *testing.T, q *clipQueue, size int) (*clipEntry, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+	path := filepath.Join(q.dir, ".rec-test.mp4")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	e, err := q.add(&recordedClip{Path: path, Duration: 10 * time.Second, Width: 640, Height: 360, Size: int64(size), SHA256: hex.EncodeToString(sum[:])},
+		"cam1", clipTriggerCommand, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, data
+}
+
+func TestUploadClipResumes(t *testing.T) {
+	backend := newStubTUSBackend(t)
+	backend.cutPatch, backend.cutKeep = 2, 300<<10
+	dir := t.TempDir()
+	q, err := openClipQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, data := queueTestClip(t, q, 2*clipChunkSize+12345)
+	ctx := context.Background()
+
+	if _, err := uploadClip(ctx, backend.Client(), backend.URL, "tok", q, e); err == nil {
+		t.Fatal("upload succeeded through a dropped chunk")
+	}
+	// The upload URL outlives the process, so a restart resumes it.
+	q, err = openClipQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = q.head()
+	if e.UploadURL != backend.URL+"/api/clips/uploads/up1" {
+		t.Fatalf("upload URL after the failure = %q", e.UploadURL)
+	}
+	clipID, err := uploadClip(ctx, backend.Client(), backend.URL, "tok", q, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clipID != "clip-1" {
+		t.Errorf("clip ID = %q", clipID)
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if backend.created != 1 {
+		t.Errorf("%d uploads created, want 1", backend.created)
+	}
+	resume := int64(clipChunkSize + 300<<10)
+	want := []int64{0, clipChunkSize, resume}
+	if fmt.Sprint(backend.patches) != fmt.Sprint(want) {
+		t.Errorf("PATCH offsets = %v, want %v", backend.patches, want)
+	}
+	if string(backend.uploads["up1"]) != string(data) {
+		t.Error("uploaded bytes differ from the clip")
+	}
+	if len(backend.registered) != 1 {
+		t.Fatalf("%d registrations", len(backend.registered))
+	}
+	reg := backend.registered[0]
+	if reg["upload_id"] != "up1" || reg["camera_id"] != "cam1" || reg["trigger"] != "command" ||
+		reg["size"] != float64(len(data)) || reg["width"] != float64(640) || reg["duration_seconds"] != float64(10) {
+		t.Errorf("registration = %v", reg)
+	}
+}
+
+func TestUploadClipStaleOffset(t *testing.T) {
+	backend := newStubTUSBackend(t)
+	q, err := openClipQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, data := queueTestClip(t, q, clipChunkSize+100)
+	loc, err := createClipUpload(context.Background(), backend.Client(), backend.URL, "tok", e.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.UploadURL = loc
+	backend.mu.Lock()
+	backend.uploads["up1"] = append([]byte{}, data[:clipChunkSize]...)
+	backend.staleHead = true
+	backend.mu.Unlock()
+
+	if _, err := uploadClip(context.Background(), backend.Client(), backend.URL, "tok", q, e); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{0, clipChunkSize}; fmt.Sprint(backend.patches) != fmt.Sprint(want) {
+		t.Errorf("PATCH offsets = %v, want %v: a 409 carries on from the backend's offset", backend.patches, want)
+	}
+	if string(backend.uploads["up1"]) != string(data) {
+		t.Error("uploaded bytes differ from the clip")
+	}
+}
+
+func TestUploadClipGone(t *testing.T) {
+	backend := newStubTUSBackend(t)
+	q, err := openClipQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := queueTestClip(t, q, 5000)
+	if err := q.setUploadURL(e.ID, backend.URL+"/api/clips/uploads/expired"); err != nil {
+		t.Fatal(err)
+	}
+	e = q.head()
+
+	_, err = uploadClip(context.Background(), backend.Client(), backend.URL, "tok", q, e)
+	if !errors.Is(err, errClipUploadGone) {
+		t.Fatalf("error = %v, want errClipUploadGone", err)
+	}
+	e = q.head()
+	if e.UploadURL != "" {
+		t.Fatalf("upload URL %q kept after the backend lost it", e.UploadURL)
+	}
+
+	// The next attempt starts over, and a duplicate registration counts.
+	backend.registerAs = http.StatusConflict
+	clipID, err := uploadClip(context.Background(), backend.Client(), backend.URL, "tok", q, e)
+	if err != nil || clipID != "clip-1" {
+		t.Fatalf("retry = %q, %v", clipID, err)
+	}
+	if backend.created != 1 {
+		t.Errorf("%d uploads created, want 1", backend.created)
+	}
+}
+
+func TestUploadClipRejected(t *testing.T) {
+	backend := newStubTUSBackend(t)
+	q, err := openClipQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, data := queueTestClip(t, q, 5000)
+	// Corrupt the queued file after it was hashed; the backend's check fails
+	// and discards the upload, so the clip must start over next time.
+	data[0] ^= 0xff
+	if err := os.WriteFile(q.clipPath(e.ID), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = uploadClip(context.Background(), backend.Client(), backend.URL, "tok", q, e)
+	if !errors.Is(err, errClipUploadGone) {
+		t.Fatalf("error = %v, want errClipUploadGone", err)
+	}
+	if q.head().UploadURL != "" {
+		t.Error("upload URL kept after the backend rejected the clip")
+	}
+}
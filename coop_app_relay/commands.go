@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// commandPollWait is how long the backend holds a command poll open. It
+	// stays under the backend client's 30s timeout.
+	commandPollWait = 20 * time.Second
+
+	commandRetryMin = 5 * time.Second
+	commandRetryMax = time.Minute
+
+	// restartExitCode is the daemon's exit status after a restart command.
+	// Run it under a supervisor (systemd Restart=always, launchd KeepAlive)
+	// that starts it again.
+	restartExitCode = 75
+)
+
+// remoteCommand is a command queued for this relay in the app.
+type remoteCommand struct {
+	ID      string          `json:"id"`
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args"`
+}
+
+// errCommandTaken means the backend refused an acknowledgement because the
+// command was already acknowledged or has expired; it must not run.
+var errCommandTaken = errors.New("command already acknowledged or expired")
+
+// pollCommands long-polls GET /api/relay/commands/poll.
+func (b *backendClient) pollCommands(ctx context.Context, wait time.Duration) ([]remoteCommand, error) {
+	path := "/api/relay/commands/poll?wait=" + strconv.Itoa(int(wait.Seconds()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRelayAuth(req, b.token)
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("polling commands: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &backendStatusError{method: http.MethodGet, path: path, status: resp.Status, code: resp.StatusCode, body: string(body)}
+	}
+	var cmds []remoteCommand
+	if err := json.NewDecoder(resp.Body).Decode(&cmds); err != nil {
+		return nil, fmt.Errorf("decoding commands: %w", err)
+	}
+	return cmds, nil
+}
+
+// ackCommand claims a command before it runs.
+func (b *backendClient) ackCommand(id string) error {
+	var ignored json.RawMessage
+	err := b.doJSON(http.MethodPost, "/api/relay/commands/ack", map[string]string{"command_id": id}, &ignored)
+	var statusErr *backendStatusError
+	if errors.As(err, &statusErr) && statusErr.code == http.StatusConflict {
+		return errCommandTaken
+	}
+	return err
+}
+
+// reportCommand sends a command's outcome to POST /api/relay/commands/result.
+func (b *backendClient) reportCommand(id string, result interface{}, cmdErr error) error {
+	payload := map[string]interface{}{
+		"command_id": id,
+		"status":     "succeeded",
+		"result":     result,
+	}
+	if cmdErr != nil {
+		payload["status"] = "failed"
+		payload["error"] = cmdErr.Error()
+	}
+	var ignored json.RawMessage
+	return b.doJSON(http.MethodPost, "/api/relay/commands/result", payload, &ignored)
+}
+
+// commandLoop waits for commands from the app and runs them one at a time.
+func (d *daemon) commandLoop(ctx context.Context) {
+	retry := commandRetryMin
+	for {
+		cmds, err := d.backend.pollCommands(ctx, commandPollWait)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Command poll failed, retrying in %s: %v", retry, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+			retry = min(retry*2, commandRetryMax)
+			continue
+		}
+		retry = commandRetryMin
+		for _, cmd := range cmds {
+			d.runCommand(ctx, cmd)
+		}
+	}
+}
+
+func (d *daemon) runCommand(ctx context.Context, cmd remoteCommand) {
+	if err := d.backend.ackCommand(cmd.ID); err != nil {
+		// A failed ack leaves the command pending, so it comes back with
+		// the next poll.
+		if !errors.Is(err, errCommandTaken) {
+			log.Printf("Acknowledging command %s failed: %v", cmd.Command, err)
+		}
+		return
+	}
+	log.Printf("Running remote command %s (%s)", cmd.Command, cmd.ID)
+	result, err := d.execCommand(ctx, cmd)
+	if err != nil {
+		log.Printf("Remote command %s failed: %v", cmd.Command, err)
+	}
+	if reportErr := d.backend.reportCommand(cmd.ID, result, err); reportErr != nil {
+		log.Printf("Reporting result of %s failed: %v", cmd.Command, reportErr)
+	}
+	if cmd.Command == "restart" && err == nil {
+		d.restartRequested.Store(true)
+		d.stop()
+	}
+}
+
+func (d *daemon) execCommand(ctx context.Context, cmd remoteCommand) (interface{}, error) {
+	var args struct {
+		CameraID *string `json:"camera_id"`
+		Username string  `json:"username"`
+		Password string  `json:"password"`
+		Seconds  int     `json:"seconds"`
+		Since    string  `json:"since"`
+	}
+	if len(cmd.Args) > 0 {
+		if err := json.Unmarshal(cmd.Args, &args); err != nil {
+			return nil, fmt.Errorf("invalid args: %w", err)
+		}
+	}
+
+	switch cmd.Command {
+	case "capture_now":
+		results, err := d.captureNow(ctx, args.CameraID)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range results {
+			if r.Error == "" {
+				return map[string]interface{}{"cameras": results}, nil
+			}
+		}
+		return map[string]interface{}{"cameras": results}, errors.New("no camera captured a frame")
+	case "record_clip":
+		results, err := d.recordClipNow(ctx, args.CameraID, args.Seconds)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range results {
+			if r.Error == "" {
+				return map[string]interface{}{"cameras": results}, nil
+			}
+		}
+		return map[string]interface{}{"cameras": results}, errors.New("no camera recorded a clip")
+	case "reload_config":
+		if err := d.refreshConfig(); err != nil {
+			return nil, err
+		}
+		d.mu.Lock()
+		n := len(d.config.cameraList())
+		d.mu.Unlock()
+		return map[string]int{"cameras": n}, nil
+	case "run_diagnostics":
+		return d.doctor(ctx), nil
+	case "upload_logs":
+		since, err := parseShipSince(args.Since)
+		if err != nil {
+			return nil, err
+		}
+		return d.shipLogs(since)
+	case "discover_cameras":
+		var creds *onvifCredentials
+		if args.Username != "" {
+			creds = &onvifCredentials{Username: args.Username, Password: args.Password}
+		}
+		found, err := d.discoverAndReport(ctx, creds)
+		if found == nil {
+			found = []discoveredCamera{}
+		}
+		return map[string]interface{}{"cameras": found}, err
+	case "restart":
+		return map[string]bool{"restarting": true}, nil
+	}
+	return nil, fmt.Errorf("unknown command %q", cmd.Command)
+}
+
+// captureNowResult is one camera's outcome of a capture_now command.
+type captureNowResult struct {
+	CameraID string `json:"camera_id,omitempty"`
+	Name     string `json:"name"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	Bytes    int    `json:"bytes,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// captureNowRequest asks the capture loop for an immediate capture. A nil
+// cameraID means every camera.
+type captureNowRequest struct {
+	cameraID *string
+	reply    chan []captureNowResult
+}
+
+// captureNow captures a frame from one or all cameras right away, outside
+// their schedule and regardless of change detection, and queues it for
+// upload.
+func (d *daemon) captureNow(ctx context.Context, cameraID *string) ([]captureNowResult, error) {
+	req := captureNowRequest{cameraID: cameraID, reply: make(chan []captureNowResult, 1)}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case d.captureRequests <- req:
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case results := <-req.reply:
+		if len(results) == 0 {
+			if cameraID != nil {
+				return nil, fmt.Errorf("no camera %q on this relay", *cameraID)
+			}
+			return nil, errors.New("no cameras configured")
+		}
+		return results, nil
+	}
+}
+
+// dispatchCaptureNow hands an immediate capture to the matching workers and
+// collects their results without blocking the capture loop.
+func dispatchCaptureNow(ctx context.Context, req captureNowRequest, workers map[string]*cameraWorker, names map[string]string) {
+	var results []captureNowResult
+	var targets []*cameraWorker
+	for id, w := range workers {
+		if req.cameraID == nil || *req.cameraID == id {
+			results = append(results, captureNowResult{CameraID: id, Name: names[id]})
+			targets = append(targets, w)
+		}
+	}
+	go func() {
+		var wg sync.WaitGroup
+		for i, w := range targets {
+			wg.Add(1)
+			go func(i int, w *cameraWorker) {
+				defer wg.Done()
+				r, err := w.captureNow(ctx)
+				if err == nil {
+					err = r.Err
+				}
+				if err != nil {
+					results[i].Error = err.Error()
+					return
+				}
+				results[i].Width, results[i].Height, results[i].Bytes = r.Width, r.Height, r.Bytes
+			}(i, w)
+		}
+		wg.Wait()
+		req.reply <- results
+	}()
+}
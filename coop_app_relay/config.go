@@ -0,0 +1,395 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Relay configuration
+//
+// Every setting can come from three places; later ones win:
+//
+//  1. the config file: --config, $RELAY_CONFIG, or relay.toml in the
+//     default config directory if it exists
+//  2. the environment: RELAY_<SETTING>, e.g. RELAY_HEARTBEAT=5m (plus
+//     COOP_BACKEND_URL for backend_url)
+//  3. command-line flags
+//
+// The file is TOML. Top-level keys (sharedSettings) apply to every command;
+// keys in a [daemon], [pair], [upload], [discover] or [doctor] table are that
+// command's flags with underscores, e.g. spool_max_mb for --spool-max-mb.
+// Several relays on one host each get their own file with its own
+// state_file, spool_dir and status_addr. See relay.example.toml.
+
+// sharedSettings are the top-level config file keys. Where a command has a
+// matching flag the key sets it; backend_url and device_token are read
+// through settings.get.
+var sharedSettings = []string{"state_file", "spool_dir", "relay_id", "backend_url", "device_token"}
+
+// settingEnvAliases are environment variables that predate RELAY_<SETTING>.
+var settingEnvAliases = map[string]string{
+	"backend_url": "COOP_BACKEND_URL",
+}
+
+// secretSettings are never printed by `relay config show`.
+var secretSettings = map[string]bool{"device_token": true, "password": true, "ingest_password": true}
+
+// configCommands are the commands that may have a table in the config file.
+var configCommands = []string{"daemon", "pair", "upload", "discover", "doctor"}
+
+// defaultConfigPath is the config file used when neither --config nor
+// RELAY_CONFIG names one. It is optional.
+func defaultConfigPath() string {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "coop-relay", "relay.toml")
+}
+
+// setting is a resolved value and where it came from: "default", "flag
+// --x", "env X", "<file>:<line>" or "state file".
+type setting struct {
+	Value  string
+	Source string
+}
+
+// settings is a command's effective configuration.
+type settings struct {
+	command string
+	path    string // config file in use, "" for none
+	fs      *flag.FlagSet
+	// values holds every setting that came from somewhere, by key.
+	values map[string]setting
+}
+
+// get returns a setting by key (underscored), whether or not the command has
+// a flag for it.
+func (s *settings) get(key string) string {
+	if f := s.fs.Lookup(flagName(key)); f != nil {
+		return f.Value.String()
+	}
+	return s.values[key].Value
+}
+
+// source says where a setting came from, for error messages.
+func (s *settings) source(key string) string {
+	if v, ok := s.values[key]; ok {
+		return v.Source
+	}
+	return "default"
+}
+
+// errorf reports a bad setting along with where it was set.
+func (s *settings) errorf(key, format string, args ...interface{}) error {
+	return fmt.Errorf("%s (%s): %s", key, s.source(key), fmt.Sprintf(format, args...))
+}
+
+func flagName(key string) string     { return strings.ReplaceAll(key, "_", "-") }
+func settingName(flag string) string { return strings.ReplaceAll(flag, "-", "_") }
+
+func settingEnv(key string) []string {
+	names := []string{"RELAY_" + strings.ToUpper(key)}
+	if alias, ok := settingEnvAliases[key]; ok {
+		names = append(names, alias)
+	}
+	return names
+}
+
+// parseLayered parses a command's flags, then fills in every flag not given
+// on the command line from the environment or, failing that, the config file.
+// It adds the --config flag itself.
+func parseLayered(fs *flag.FlagSet, command string, args []string) (*settings, error) {
+	configPath := fs.String("config", "", "Relay config file (default $RELAY_CONFIG or "+defaultConfigPath()+" if it exists)")
+	fs.Parse(args)
+
+	s := &settings{command: command, fs: fs, values: make(map[string]setting)}
+	fs.Visit(func(f *flag.Flag) {
+		s.values[settingName(f.Name)] = setting{f.Value.String(), "flag --" + f.Name}
+	})
+
+	s.path = *configPath
+	explicit := s.path != ""
+	if !explicit {
+		if s.path = os.Getenv("RELAY_CONFIG"); s.path != "" {
+			explicit = true
+		} else {
+			s.path = defaultConfigPath()
+		}
+	}
+	file, err := loadConfigFile(s.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && !explicit:
+		s.path = ""
+	case err != nil:
+		return nil, err
+	default:
+		if err := s.applyFile(file); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.applyEnv(); err != nil {
+		return nil, err
+	}
+	return s, s.validate()
+}
+
+// set stores a layered value, unless the command line already set the key.
+func (s *settings) set(key, value, source string) error {
+	if cur, ok := s.values[key]; ok && strings.HasPrefix(cur.Source, "flag ") {
+		return nil
+	}
+	if f := s.fs.Lookup(flagName(key)); f != nil {
+		if err := f.Value.Set(value); err != nil {
+			if g, ok := f.Value.(flag.Getter); ok {
+				if _, isDuration := g.Get().(time.Duration); isDuration {
+					err = errors.New(`want a duration such as "30s" or "5m"`)
+				}
+			}
+			return fmt.Errorf("%s (%s): invalid value %q: %v", key, source, value, err)
+		}
+		value = f.Value.String()
+	}
+	s.values[key] = setting{value, source}
+	return nil
+}
+
+func (s *settings) applyFile(file *configFile) error {
+	for key, e := range file.tables[""] {
+		if !slices.Contains(sharedSettings, key) {
+			return fmt.Errorf("%s:%d: unknown setting %q (command settings go in a [%s] table)", file.path, e.line, key, s.command)
+		}
+		if err := s.set(key, e.value, fmt.Sprintf("%s:%d", file.path, e.line)); err != nil {
+			return err
+		}
+	}
+	for key, e := range file.tables[s.command] {
+		if key == "config" || s.fs.Lookup(flagName(key)) == nil {
+			return fmt.Errorf("%s:%d: unknown [%s] setting %q", file.path, e.line, s.command, key)
+		}
+		if err := s.set(key, e.value, fmt.Sprintf("%s:%d", file.path, e.line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *settings) applyEnv() error {
+	keys := append([]string(nil), sharedSettings...)
+	s.fs.VisitAll(func(f *flag.Flag) {
+		if key := settingName(f.Name); f.Name != "config" && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	})
+	for _, key := range keys {
+		for _, env := range settingEnv(key) {
+			if v, ok := os.LookupEnv(env); ok && v != "" {
+				if err := s.set(key, v, "env "+env); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks the shared settings; commands check their own after.
+func (s *settings) validate() error {
+	if v := s.get("backend_url"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return s.errorf("backend_url", "must be an http:// or https:// URL, got %q", v)
+		}
+	}
+	for _, key := range []string{"state_file", "spool_dir"} {
+		if s.fs.Lookup(flagName(key)) != nil && s.get(key) == "" {
+			return s.errorf(key, "must not be empty")
+		}
+	}
+	return nil
+}
+
+// configFile is a parsed config file: key/value pairs by table, "" being the
+// top level.
+type configFile struct {
+	path   string
+	tables map[string]map[string]configEntry
+}
+
+type configEntry struct {
+	value string
+	line  int
+}
+
+var configKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// loadConfigFile reads the subset of TOML the relay needs: comments, [table]
+// headers and key = value pairs whose value is a string, number or boolean.
+// Values are kept as text and parsed by the flag they set.
+func loadConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	file := &configFile{path: path, tables: map[string]map[string]configEntry{"": {}}}
+	table := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		n := i + 1
+		line = strings.TrimSpace(strings.TrimSuffix(line, "\r"))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 || strings.TrimSpace(stripComment(line[end+1:])) != "" {
+				return nil, fmt.Errorf("%s:%d: malformed table header", path, n)
+			}
+			table = strings.TrimSpace(line[1:end])
+			if !slices.Contains(configCommands, table) {
+				return nil, fmt.Errorf("%s:%d: unknown table [%s] (want one of %s)", path, n, table, strings.Join(configCommands, ", "))
+			}
+			if _, dup := file.tables[table]; dup {
+				return nil, fmt.Errorf("%s:%d: table [%s] defined twice", path, n, table)
+			}
+			file.tables[table] = map[string]configEntry{}
+			continue
+		}
+		k, raw, ok := strings.Cut(line, "=")
+		key := settingName(strings.TrimSpace(k))
+		if !ok || !configKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		value, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %v", path, n, key, err)
+		}
+		if _, dup := file.tables[table][key]; dup {
+			return nil, fmt.Errorf("%s:%d: %s is set twice", path, n, key)
+		}
+		file.tables[table][key] = configEntry{value, n}
+	}
+	return file, nil
+}
+
+var configBarePattern = regexp.MustCompile(`^(true|false|[+-]?[0-9][0-9_]*(\.[0-9_]+)?([eE][+-]?[0-9]+)?)$`)
+
+// parseConfigValue decodes a "basic" or 'literal' string, a number or a
+// boolean, followed by an optional comment.
+func parseConfigValue(raw string) (string, error) {
+	var value, rest string
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		end := 1
+		for ; end < len(raw) && raw[end] != '"'; end++ {
+			if raw[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(raw) {
+			return "", errors.New("unterminated string")
+		}
+		s, err := strconv.Unquote(raw[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("bad string %s", raw[:end+1])
+		}
+		value, rest = s, raw[end+1:]
+	case strings.HasPrefix(raw, "'"):
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return "", errors.New("unterminated string")
+		}
+		value, rest = raw[1:end+1], raw[end+2:]
+	default:
+		value = strings.TrimSpace(stripComment(raw))
+		if !configBarePattern.MatchString(value) {
+			return "", fmt.Errorf("unsupported value %q (quote strings and durations, e.g. \"5m\")", value)
+		}
+		value = strings.ReplaceAll(value, "_", "")
+	}
+	if strings.TrimSpace(stripComment(rest)) != "" {
+		return "", errors.New("unexpected text after value")
+	}
+	return value, nil
+}
+
+func stripComment(s string) string {
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// runConfig is `relay config show`: print the daemon's effective settings,
+// with where each came from, as a config file with secrets redacted.
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "show" {
+		fmt.Fprintln(os.Stderr, "usage: relay config show [--config file] [daemon flags]")
+		os.Exit(2)
+	}
+	fs, opts := newDaemonFlags()
+	s, err := parseLayered(fs, "daemon", args[1:])
+	if err == nil {
+		err = opts.validate(s)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Fill the identity in from the state file the way loadIdentity does.
+	if st, err := loadState(s.get("state_file")); err == nil {
+		for key, v := range map[string]string{"relay_id": st.RelayID, "backend_url": st.BackendURL, "device_token": st.DeviceToken} {
+			if _, ok := s.values[key]; !ok && v != "" {
+				s.values[key] = setting{v, "state file"}
+				if f := fs.Lookup(flagName(key)); f != nil {
+					f.Value.Set(v)
+				}
+			}
+		}
+	}
+
+	fmt.Println("# Effective relay daemon configuration.")
+	fmt.Println("# Precedence: config file < environment (RELAY_*) < flags.")
+	if s.path != "" {
+		fmt.Printf("# Config file: %s\n", s.path)
+	} else {
+		fmt.Printf("# Config file: none (looked for %s)\n", defaultConfigPath())
+	}
+	fmt.Println()
+	for _, key := range sharedSettings {
+		s.printSetting(key)
+	}
+	fmt.Println()
+	fmt.Println("[daemon]")
+	var keys []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if key := settingName(f.Name); f.Name != "config" && !slices.Contains(sharedSettings, key) {
+			keys = append(keys, key)
+		}
+	})
+	slices.Sort(keys)
+	for _, key := range keys {
+		s.printSetting(key)
+	}
+}
+
+func (s *settings) printSetting(key string) {
+	v := s.get(key)
+	switch {
+	case v != "" && secretSettings[key]:
+		v = "<redacted>"
+	case strings.Contains(v, "://"):
+		v = redactURL(v)
+	}
+	fmt.Printf("%-20s = %-36s # %s\n", key, strconv.Quote(v), s.source(key))
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfigValue(t *testing.T) {
+	tests := []struct {
+		raw, want string
+		ok        bool
+	}{
+		{`"5m"`, "5m", true},
+		{`"rtsp://cam/stream" # the barn`, "rtsp://cam/stream", true},
+		{`"a # b"`, "a # b", true},
+		{`"say \"hi\"\tnow"`, "say \"hi\"\tnow", true},
+		{`"C:\\relay\\spool"`, `C:\relay\spool`, true},
+		{`'C:\relay\spool'`, `C:\relay\spool`, true},
+		{`'it # stays' # not this`, "it # stays", true},
+		{`""`, "", true},
+		{`42`, "42", true},
+		{`-3`, "-3", true},
+		{`1_000_000 # bytes`, "1000000", true},
+		{`0.5`, "0.5", true},
+		{`1e3`, "1e3", true},
+		{`true`, "true", true},
+		{`false#off`, "false", true},
+		{`5m`, "", false},
+		{`yes`, "", false},
+		{`"unterminated`, "", false},
+		{`"ends in a backslash\"`, "", false},
+		{`'unterminated`, "", false},
+		{`"a" "b"`, "", false},
+		{`'a' b`, "", false},
+		{`"\q"`, "", false},
+		{``, "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseConfigValue(tt.raw)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseConfigValue(%s) = %q, %v; want %q, ok %v", tt.raw, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func writeConfig(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "relay.toml")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfig(t, strings.Join([]string{
+		"# Barn relay",
+		"spool_dir = '/var/spool/relay'",
+		"",
+		"  [daemon]   # the long-running one",
+		"heartbeat = \"5m\"\r",
+		"spool-max-mb = 200",
+		"[doctor]",
+		"json = true",
+	}, "\n"))
+	file, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]configEntry{
+		"":       {"spool_dir": {"/var/spool/relay", 2}},
+		"daemon": {"heartbeat": {"5m", 5}, "spool_max_mb": {"200", 6}},
+		"doctor": {"json": {"true", 8}},
+	}
+	if len(file.tables) != len(want) {
+		t.Errorf("tables = %v", file.tables)
+	}
+	for table, entries := range want {
+		for key, e := range entries {
+			if got := file.tables[table][key]; got != e {
+				t.Errorf("[%s] %s = %+v, want %+v", table, key, got, e)
+			}
+		}
+		if len(file.tables[table]) != len(entries) {
+			t.Errorf("[%s] = %v", table, file.tables[table])
+		}
+	}
+
+	bad := []struct {
+		text, err string
+	}{
+		{"[daemon]\n[upload]\n[daemon]", ":3: table [daemon] defined twice"},
+		{"[cameras]", ":1: unknown table [cameras]"},
+		{"[daemon", ":1: malformed table header"},
+		{"[daemon] heartbeat = 1", ":1: malformed table header"},
+		{"spool_dir = 'a'\nspool_dir = 'b'", ":2: spool_dir is set twice"},
+		// Dashes and underscores name the same setting.
+		{"[daemon]\nspool_max_mb = 1\nspool-max-mb = 2", ":3: spool_max_mb is set twice"},
+		{"heartbeat", ":1: expected key = value"},
+		{"= 5", ":1: expected key = value"},
+		{"spool dir = 'a'", ":1: expected key = value"},
+		{"\n\nheartbeat = 5m", ":3: heartbeat: unsupported value"},
+		{"relay_id = \"abc", ":1: relay_id: unterminated string"},
+	}
+	for _, tt := range bad {
+		_, err := loadConfigFile(writeConfig(t, tt.text))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("loading %q: %v, want %q", tt.text, err, tt.err)
+		}
+	}
+
+	if _, err := loadConfigFile(filepath.Join(t.TempDir(), "missing.toml")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+// testFlags is a cut-down command with a flag of each kind.
+func testFlags(command string) (*flag.FlagSet, *string, *time.Duration, *int) {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.String("state-file", "relay-state.json", "")
+	spoolDir := fs.String("spool-dir", "spool", "")
+	heartbeat := fs.Duration("heartbeat", time.Minute, "")
+	spoolMax := fs.Int("spool-max-mb", 500, "")
+	return fs, spoolDir, heartbeat, spoolMax
+}
+
+// isolateConfig points the default config directory at an empty one and
+// clears the relay's environment.
+func isolateConfig(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("AppData", dir)
+	for _, kv := range os.Environ() {
+		if name, _, _ := strings.Cut(kv, "="); strings.HasPrefix(name, "RELAY_") || name == "COOP_BACKEND_URL" {
+			t.Setenv(name, "")
+		}
+	}
+}
+
+func TestParseLayeredPrecedence(t *testing.T) {
+	isolateConfig(t)
+	path := writeConfig(t, `
+spool_dir = "/file/spool"
+backend_url = "https://file.example.com"
+
+[daemon]
+heartbeat = "10m"
+spool_max_mb = 100
+
+[pair]
+# Other commands' tables are not the daemon's business.
+code = "123456"
+`)
+	t.Setenv("RELAY_HEARTBEAT", "2m")
+	t.Setenv("RELAY_SPOOL_MAX_MB", "200")
+	t.Setenv("COOP_BACKEND_URL", "https://alias.example.com")
+
+	fs, spoolDir, heartbeat, spoolMax := testFlags("daemon")
+	s, err := parseLayered(fs, "daemon", []string{"--config", path, "--spool-max-mb", "300"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key, value, source string
+	}{
+		{"state_file", "relay-state.json", "default"},
+		{"spool_dir", "/file/spool", path + ":2"},
+		{"backend_url", "https://alias.example.com", "env COOP_BACKEND_URL"},
+		{"heartbeat", "2m0s", "env RELAY_HEARTBEAT"},
+		{"spool_max_mb", "300", "flag --spool-max-mb"},
+	}
+	for _, tt := range tests {
+		if v, src := s.get(tt.key), s.source(tt.key); v != tt.value || src != tt.source {
+			t.Errorf("%s = %q from %s, want %q from %s", tt.key, v, src, tt.value, tt.source)
+		}
+	}
+	if *spoolDir != "/file/spool" || *heartbeat != 2*time.Minute || *spoolMax != 300 {
+		t.Errorf("flags = %q, %s, %d", *spoolDir, *heartbeat, *spoolMax)
+	}
+	if s.path != path {
+		t.Errorf("config file = %q, want %q", s.path, path)
+	}
+
+	// RELAY_<SETTING> wins over the older alias.
+	t.Setenv("RELAY_BACKEND_URL", "https://env.example.com")
+	t.Setenv("RELAY_CONFIG", path)
+	fs, _, _, _ = testFlags("daemon")
+	s, err = parseLayered(fs, "daemon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, src := s.get("backend_url"), s.source("backend_url"); v != "https://env.example.com" || src != "env RELAY_BACKEND_URL" {
+		t.Errorf("backend_url = %q from %s", v, src)
+	}
+	if s.path != path {
+		t.Errorf("RELAY_CONFIG not used: config file = %q", s.path)
+	}
+}
+
+func TestParseLayeredErrors(t *testing.T) {
+	isolateConfig(t)
+	tests := []struct {
+		name, file string
+		env        map[string]string
+		err        string
+	}{
+		{"unknown top-level key", "heartbeat = \"5m\"", nil, `:1: unknown setting "heartbeat" (command settings go in a [daemon] table)`},
+		{"unknown command key", "[daemon]\nverbose = true", nil, `:2: unknown [daemon] setting "verbose"`},
+		{"config in a table", "[daemon]\nconfig = 'other.toml'", nil, `:2: unknown [daemon] setting "config"`},
+		{"bad duration in the file", "[daemon]\nheartbeat = 5", nil, `heartbeat (PATH:2): invalid value "5": want a duration`},
+		{"bad number in the environment", "", map[string]string{"RELAY_SPOOL_MAX_MB": "lots"}, `spool_max_mb (env RELAY_SPOOL_MAX_MB): invalid value "lots"`},
+		{"bad backend URL", "backend_url = 'ftp://example.com'", nil, `backend_url (PATH:1): must be an http:// or https:// URL`},
+		{"empty spool dir", "spool_dir = ''", nil, `spool_dir (PATH:1): must not be empty`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, tt.file)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			fs, _, _, _ := testFlags("daemon")
+			_, err := parseLayered(fs, "daemon", []string{"--config", path})
+			want := strings.ReplaceAll(tt.err, "PATH", path)
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("err = %v, want %q", err, want)
+			}
+		})
+	}
+
+	t.Run("flag beats a bad file value", func(t *testing.T) {
+		path := writeConfig(t, "[daemon]\nheartbeat = 'soon'")
+		fs, _, heartbeat, _ := testFlags("daemon")
+		if _, err := parseLayered(fs, "daemon", []string{"--config", path, "--heartbeat", "3m"}); err != nil || *heartbeat != 3*time.Minute {
+			t.Errorf("heartbeat = %s, err %v", *heartbeat, err)
+		}
+	})
+	t.Run("named file missing", func(t *testing.T) {
+		fs, _, _, _ := testFlags("daemon")
+		if _, err := parseLayered(fs, "daemon", []string{"--config", filepath.Join(t.TempDir(), "none.toml")}); err == nil {
+			t.Error("no error for a missing --config file")
+		}
+	})
+	t.Run("default file missing", func(t *testing.T) {
+		fs, _, _, _ := testFlags("daemon")
+		s, err := parseLayered(fs, "daemon", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.path != "" {
+			t.Errorf("config file = %q, want none", s.path)
+		}
+	})
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultCaptureInterval matches defaultRelayInterval in the backend.
+	defaultCaptureInterval = 10 * time.Minute
+	minCaptureInterval     = 5 * time.Second
+	captureTimeout         = 20 * time.Second
+	// snapshotBatchSize is how many queued frames are registered at once
+	// when catching up.
+	snapshotBatchSize = 50
+	// batchRetryInterval is how long the upload loop sticks to single
+	// uploads after the backend turned a batch away, e.g. mid-deploy.
+	batchRetryInterval = 15 * time.Minute
+)
+
+// daemon owns the whole relay loop: config polling, scheduled capture,
+// upload and heartbeats.
+type daemon struct {
+	relayID string
+
+	backend      *backendClient
+	uploadClient *http.Client
+	spool        *spool
+	// batchRetryAt is set, by the upload loop only, when the backend turns
+	// out not to take batches; frames go up one at a time until then.
+	batchRetryAt time.Time
+	// clips queues recorded clips; clipClient uploads them in chunks.
+	clips      *clipQueue
+	clipClient *http.Client
+
+	configPoll time.Duration
+	heartbeat  time.Duration
+
+	changeThreshold float64
+	keepalive       time.Duration
+	// skipped counts captures dropped as unchanged since the last heartbeat.
+	skipped atomic.Int64
+
+	mu     sync.Mutex
+	config relayConfig
+
+	configChanged chan struct{}
+	// captureRequests carries capture_now commands to the capture loop.
+	captureRequests chan captureNowRequest
+
+	// stop ends the daemon; restartRequested makes it exit with
+	// restartExitCode so a supervisor starts it again.
+	stop             context.CancelFunc
+	restartRequested atomic.Bool
+
+	// updateCheck is how often to look for a new release (0 disables);
+	// heartbeatOK is signalled after each successful heartbeat so a new
+	// release can leave probation.
+	updateCheck     time.Duration
+	updateStatePath string
+	heartbeatOK     chan struct{}
+
+	// discoverEvery is how often to look for ONVIF cameras (0 disables),
+	// probing discoverAddr.
+	discoverEvery time.Duration
+	discoverAddr  string
+	// onvifCreds holds camera credentials from discover_cameras commands,
+	// by host, in memory only. Guarded by mu.
+	onvifCreds map[string]*onvifCredentials
+
+	stats relayStats
+	// statusListener, if set, serves the local status endpoint.
+	statusListener net.Listener
+
+	// pushRequests carries images pushed to the ingest servers to the
+	// capture loop; ingestPassword guards both servers.
+	pushRequests       chan pushedFrame
+	ingestPassword     string
+	ingestFTPListener  net.Listener
+	ingestHTTPListener net.Listener
+
+	// logs is the rotating log file, nil if it couldn't be opened.
+	logs *rotatingLog
+}
+
+// daemonOptions are the daemon's flags, shared with `relay config show`.
+type daemonOptions struct {
+	relayID, statePath, spoolDir          *string
+	configPoll, heartbeat, spoolMaxAge    *time.Duration
+	spoolMaxMB                            *int64
+	changeThreshold                       *float64
+	keepalive, updateCheck, discoverEvery *time.Duration
+	discoverAddr, statusAddr              *string
+	ingestFTPAddr, ingestHTTPAddr         *string
+	ingestPassword                        *string
+	logDir                                *string
+	logMaxMB                              *int64
+	logErrorBurst                         *int
+}
+
+func newDaemonFlags() (*flag.FlagSet, *daemonOptions) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	return fs, &daemonOptions{
+		relayID:         fs.String("relay-id", "", "Relay ID (UUID, default from the state file)"),
+		statePath:       fs.String("state-file", defaultStatePath(), "Relay identity written by `relay pair`"),
+		configPoll:      fs.Duration("config-poll", 45*time.Second, "Base interval between config polls (jittered up to +50%)"),
+		heartbeat:       fs.Duration("heartbeat", 2*time.Minute, "Interval between heartbeats to the backend"),
+		spoolDir:        fs.String("spool-dir", defaultSpoolDir(), "Directory where captured frames are queued until uploaded"),
+		spoolMaxMB:      fs.Int64("spool-max-mb", defaultSpoolMaxBytes>>20, "Drop the oldest queued frames beyond this many megabytes"),
+		spoolMaxAge:     fs.Duration("spool-max-age", defaultSpoolMaxAge, "Drop queued frames older than this"),
+		changeThreshold: fs.Float64("change-threshold", defaultChangeThreshold, "Skip frames whose mean pixel difference from the last uploaded one is below this fraction (0 uploads every frame)"),
+		keepalive:       fs.Duration("keepalive", defaultKeepalive, "Upload a frame at least this often even if nothing changed (0 disables)"),
+		updateCheck:     fs.Duration("update-check", defaultUpdateCheck, "Interval between checks for a signed relay release (0 disables self-update)"),
+		discoverEvery:   fs.Duration("discover-interval", time.Hour, "Interval between ONVIF camera discovery runs reported to the app (0 disables)"),
+		discoverAddr:    fs.String("discover-addr", wsDiscoveryAddr, "Where to send WS-Discovery probes: the multicast group, or a camera's address for a unicast probe"),
+		statusAddr:      fs.String("status-addr", "", "Serve local JSON status and Prometheus metrics on this address, e.g. 127.0.0.1:9797 (off by default)"),
+		ingestFTPAddr:   fs.String("ingest-ftp-addr", "", "Accept snapshots that cameras upload by FTP on this address, e.g. :2121 (off by default)"),
+		ingestHTTPAddr:  fs.String("ingest-http-addr", "", "Accept snapshots that cameras POST to /ingest/{camera} on this address, e.g. :8088 (off by default)"),
+		ingestPassword:  fs.String("ingest-password", "", "Password cameras use to push snapshots (required with an ingest address)"),
+		logDir:          fs.String("log-dir", "", "Directory for the rotating log file (default: logs next to the spool directory)"),
+		logMaxMB:        fs.Int64("log-max-mb", defaultLogMaxMB, "Keep at most this many megabytes of log files"),
+		logErrorBurst:   fs.Int("log-error-burst", 20, "Ship the recent log to the backend when this many error lines arrive within 5 minutes (0 disables)"),
+	}
+}
+
+// validate rejects settings the daemon can't run with, naming where each
+// bad value came from.
+func (o *daemonOptions) validate(s *settings) error {
+	for key, d := range map[string]time.Duration{"config_poll": *o.configPoll, "heartbeat": *o.heartbeat, "spool_max_age": *o.spoolMaxAge} {
+		if d <= 0 {
+			return s.errorf(key, "must be positive, got %s", d)
+		}
+	}
+	for key, d := range map[string]time.Duration{"keepalive": *o.keepalive, "update_check": *o.updateCheck, "discover_interval": *o.discoverEvery} {
+		if d < 0 {
+			return s.errorf(key, "must not be negative (0 disables), got %s", d)
+		}
+	}
+	if *o.spoolMaxMB <= 0 {
+		return s.errorf("spool_max_mb", "must be positive, got %d", *o.spoolMaxMB)
+	}
+	if *o.logMaxMB <= 0 {
+		return s.errorf("log_max_mb", "must be positive, got %d", *o.logMaxMB)
+	}
+	if *o.logErrorBurst < 0 {
+		return s.errorf("log_error_burst", "must not be negative (0 disables), got %d", *o.logErrorBurst)
+	}
+	if *o.changeThreshold < 0 || *o.changeThreshold >= 1 {
+		return s.errorf("change_threshold", "must be at least 0 and below 1, got %g", *o.changeThreshold)
+	}
+	for key, addr := range map[string]string{"status_addr": *o.statusAddr, "ingest_ftp_addr": *o.ingestFTPAddr, "ingest_http_addr": *o.ingestHTTPAddr} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return s.errorf(key, "must be host:port, got %q", addr)
+		}
+	}
+	if (*o.ingestFTPAddr != "" || *o.ingestHTTPAddr != "") && *o.ingestPassword == "" {
+		return s.errorf("ingest_password", "must be set to accept pushed snapshots")
+	}
+	return nil
+}
+
+func runDaemon(args []string) {
+	fs, opts := newDaemonFlags()
+	cfg, err := parseLayered(fs, "daemon", args)
+	if err == nil {
+		err = opts.validate(cfg)
+	}
+	if err != nil {
+		log.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+	if cfg.path != "" {
+		log.Printf("Using config file %s", cfg.path)
+	}
+
+	id, err := loadIdentity(cfg)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+
+	sp, err := openSpool(*opts.spoolDir, *opts.spoolMaxMB<<20, *opts.spoolMaxAge)
+	if err != nil {
+		log.Printf("Error opening spool: %v", err)
+		os.Exit(1)
+	}
+	if n, size := sp.stats(); n > 0 {
+		log.Printf("Resuming with %d queued frame(s) (%d bytes) in %s", n, size, *opts.spoolDir)
+	}
+	clips, err := openClipQueue(clipDir(*opts.spoolDir))
+	if err != nil {
+		log.Printf("Error opening clip queue: %v", err)
+		os.Exit(1)
+	}
+
+	// Without its own path the daemon can't update, and updateLoop says so.
+	exe, _ := relayExecutable()
+
+	d := &daemon{
+		relayID:       id.RelayID,
+		backend:       newBackendClient(id.BackendURL, id.DeviceToken),
+		uploadClient:  &http.Client{Timeout: 30 * time.Second},
+		spool:         sp,
+		clips:         clips,
+		clipClient:    &http.Client{Timeout: 2 * time.Minute},
+		configPoll:    *opts.configPoll,
+		heartbeat:     *opts.heartbeat,
+		configChanged: make(chan struct{}, 1),
+
+		captureRequests: make(chan captureNowRequest),
+		pushRequests:    make(chan pushedFrame),
+		ingestPassword:  *opts.ingestPassword,
+
+		updateCheck:     *opts.updateCheck,
+		updateStatePath: updateStatePath(exe),
+		heartbeatOK:     make(chan struct{}, 1),
+
+		discoverEvery: *opts.discoverEvery,
+		discoverAddr:  *opts.discoverAddr,
+		onvifCreds:    make(map[string]*onvifCredentials),
+
+		changeThreshold: *opts.changeThreshold,
+		keepalive:       *opts.keepalive,
+	}
+	d.stats.started = time.Now()
+	if *opts.statusAddr != "" {
+		// Listen up front so a taken port fails at startup, not silently.
+		d.statusListener, err = net.Listen("tcp", *opts.statusAddr)
+		if err != nil {
+			log.Printf("Error starting status server: %v", err)
+			os.Exit(1)
+		}
+	}
+	if err := d.listenIngest(*opts.ingestFTPAddr, *opts.ingestHTTPAddr); err != nil {
+		log.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+
+	// Keep the log on disk for the upload_logs command.
+	if *opts.logDir == "" {
+		*opts.logDir = logDir(*opts.spoolDir)
+	}
+	d.logs, err = openRotatingLog(*opts.logDir, *opts.logMaxMB<<20, *opts.logErrorBurst)
+	if err != nil {
+		log.Printf("Not keeping a log file: %v", err)
+	} else {
+		log.SetOutput(io.MultiWriter(os.Stderr, d.logs))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	d.stop = stop
+
+	log.Printf("Starting relay daemon for Relay ID: %s", d.relayID)
+	d.run(ctx)
+	if d.restartRequested.Load() {
+		log.Println("Relay daemon stopped for restart.")
+		stop()
+		os.Exit(restartExitCode)
+	}
+	log.Println("Relay daemon stopped.")
+}
+
+func (d *daemon) run(ctx context.Context) {
+	loops := []func(context.Context){d.configLoop, d.heartbeatLoop, d.captureLoop, d.uploadLoop, d.clipUploadLoop, d.commandLoop, d.updateLoop}
+	if d.discoverEvery > 0 {
+		loops = append(loops, d.discoveryLoop)
+	}
+	if d.logs != nil && d.logs.burstLimit > 0 {
+		loops = append(loops, d.logShipLoop)
+	}
+	if d.statusListener != nil {
+		loops = append(loops, func(ctx context.Context) { d.serveStatus(ctx, d.statusListener) })
+	}
+	if d.ingestFTPListener != nil {
+		loops = append(loops, func(ctx context.Context) { d.serveIngestFTP(ctx, d.ingestFTPListener) })
+	}
+	if d.ingestHTTPListener != nil {
+		loops = append(loops, func(ctx context.Context) { d.serveIngestHTTP(ctx, d.ingestHTTPListener) })
+	}
+	var wg sync.WaitGroup
+	for _, loop := range loops {
+		wg.Add(1)
+		go func(loop func(context.Context)) {
+			defer wg.Done()
+			loop(ctx)
+		}(loop)
+	}
+	wg.Wait()
+}
+
+// configLoop polls the backend for config, with jitter so a fleet of relays
+// doesn't hit the backend in lockstep.
+func (d *daemon) configLoop(ctx context.Context) {
+	for {
+		d.refreshConfig()
+		jitter := time.Duration(rand.Int63n(int64(d.configPoll)/2 + 1))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.configPoll + jitter):
+		}
+	}
+}
+
+func (d *daemon) refreshConfig() error {
+	cfg, err := d.backend.fetchConfig(d.relayID)
+	d.stats.configPolled(time.Now(), err)
+	if err != nil {
+		log.Printf("Config poll failed: %v", err)
+		return err
+	}
+	d.mu.Lock()
+	changed := !d.config.equal(*cfg)
+	d.config = *cfg
+	d.mu.Unlock()
+	if changed {
+		cams := cfg.cameraList()
+		log.Printf("Config updated: %d camera(s)", len(cams))
+		for _, cam := range cams {
+			log.Printf("  [%s] interval=%s source=%s", cam.name(), derefOr(cam.Interval, "-"), redactURL(cam.SourceURL))
+		}
+		select {
+		case d.configChanged <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (d *daemon) heartbeatLoop(ctx context.Context) {
+	ticker := time.NewTicker(d.heartbeat)
+	defer ticker.Stop()
+	for {
+		// Subtract only what was reported, so skips counted while the
+		// heartbeat was in flight go out with the next one.
+		skipped := d.skipped.Load()
+		err := d.backend.postStatus(d.heartbeatReport(time.Now(), skipped))
+		d.stats.heartbeatSent(time.Now(), err)
+		if err != nil {
+			log.Printf("Heartbeat failed: %v", err)
+		} else {
+			d.skipped.Add(-skipped)
+			select {
+			case d.heartbeatOK <- struct{}{}:
+			default:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// captureLoop runs one worker per configured camera, starting, updating and
+// stopping workers as the config changes.
+func (d *daemon) captureLoop(ctx context.Context) {
+	workers := make(map[string]*cameraWorker)
+	defer func() {
+		for _, w := range workers {
+			w.stop()
+		}
+	}()
+	for {
+		d.mu.Lock()
+		cams := d.config.cameraList()
+		d.mu.Unlock()
+
+		seen := make(map[string]bool)
+		names := make(map[string]string)
+		for _, cam := range cams {
+			seen[cam.ID] = true
+			names[cam.ID] = cam.name()
+			if w, ok := workers[cam.ID]; ok {
+				w.update(cam)
+				continue
+			}
+			log.Printf("[%s] Starting capture", cam.name())
+			workers[cam.ID] = d.startCamera(ctx, cam)
+		}
+		for id, w := range workers {
+			if !seen[id] {
+				log.Printf("Stopping capture for camera %q", id)
+				w.stop()
+				delete(workers, id)
+			}
+		}
+
+		// Serve capture requests until the config changes.
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-d.configChanged:
+				break wait
+			case req := <-d.captureRequests:
+				dispatchCaptureNow(ctx, req, workers, names)
+			case p := <-d.pushRequests:
+				dispatchPushed(ctx, p, workers)
+			}
+		}
+	}
+}
+
+// nextCaptureAt is the scheduling rule: one interval after the last capture,
+// or immediately if we have never captured or are overdue.
+func nextCaptureAt(last time.Time, interval time.Duration, now time.Time) time.Time {
+	if last.IsZero() {
+		return now
+	}
+	next := last.Add(interval)
+	if next.Before(now) {
+		return now
+	}
+	return next
+}
+
+var intervalPattern = regexp.MustCompile(`^(\d+)([smh])$`)
+
+// parseInterval accepts the same "30s" / "10m" / "1h" strings the app writes
+// to relays.interval.
+func parseInterval(s string) (time.Duration, error) {
+	m := intervalPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("expected <number><s|m|h>, got %q", s)
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, err
+	}
+	unit := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[m[2]]
+	interval := time.Duration(n) * unit
+	if interval < minCaptureInterval {
+		return 0, fmt.Errorf("interval %s is below the %s minimum", interval, minCaptureInterval)
+	}
+	return interval, nil
+}
+
+// captureOnce captures, prepares and queues one frame. force uploads it even
+// if it hasn't changed.
+func (d *daemon) captureOnce(ctx context.Context, cam cameraConfig, changes *changeDetector, force bool) captureResult {
+	n, window := cam.burst()
+	captureCtx, cancel := context.WithTimeout(ctx, captureTimeout+window)
+	defer cancel()
+	capturedAt := time.Now()
+	frames, err := captureBurst(captureCtx, cam.SourceURL, n, window)
+	result := captureResult{At: capturedAt, Took: time.Since(capturedAt), Err: err}
+	if err != nil {
+		d.stats.captured(cam.ID, result)
+		log.Printf("[%s] Capture failed: %v", cam.name(), err)
+		return result
+	}
+	return d.processFrames(ctx, cam, changes, frames, n > 1, force, result)
+}
+
+// processFrames prepares captured or pushed frames, keeps the best of a
+// burst, and queues it for upload unless change detection drops it. result
+// carries the capture's timing and is completed and recorded in the stats.
+func (d *daemon) processFrames(ctx context.Context, cam cameraConfig, changes *changeDetector, frames []image.Image, burst, force bool, result captureResult) captureResult {
+	capturedAt := result.At
+	result.Width, result.Height = frames[0].Bounds().Dx(), frames[0].Bounds().Dy()
+	for i, f := range frames {
+		prepared, err := cam.prepare(f)
+		if err != nil && i == 0 {
+			log.Printf("[%s] Ignoring image settings: %v", cam.name(), err)
+		}
+		frames[i] = prepared
+	}
+	frame := frames[0]
+	var quality *frameQuality
+	if burst {
+		best, q := pickBest(frames)
+		frame, quality = best, &q
+		log.Printf("[%s] Picked best of %d frames (sharpness %.1f, exposure %.3f)", cam.name(), q.BurstFrames, q.Sharpness, q.Exposure)
+	}
+	upload, reason := changes.accept(frame, capturedAt, force)
+	if !upload {
+		d.skipped.Add(1)
+		result.Skipped = true
+		d.stats.captured(cam.ID, result)
+		log.Printf("[%s] Skipped unchanged frame (%s)", cam.name(), reason)
+		return result
+	}
+	imageBytes, err := encodeJPEG(frame, cam.quality())
+	if err != nil {
+		result.Err = err
+		d.stats.captured(cam.ID, result)
+		log.Printf("[%s] %v", cam.name(), err)
+		return result
+	}
+	b := frame.Bounds()
+	log.Printf("[%s] Captured frame (%dx%d, %d bytes, %s)", cam.name(), b.Dx(), b.Dy(), len(imageBytes), reason)
+
+	objectKey := snapshotObjectKey(d.relayID, cam.ID, capturedAt)
+	_, err = d.spool.enqueue(d.relayID, cam.ID, objectKey, capturedAt, imageBytes, quality, cam.maskVersion())
+	result.Bytes, result.Err = len(imageBytes), err
+	d.stats.captured(cam.ID, result)
+	if err != nil {
+		log.Printf("[%s] Queueing frame failed: %v", cam.name(), err)
+	}
+	if changes.changed && cam.Clip != nil && cam.Clip.OnChange {
+		d.startClip(ctx, cam, clipTriggerChange)
+	}
+	return result
+}
+
+// uploadLoop drains the spool oldest-first. A failed delivery keeps the frame
+// in its place and retries it with backoff while the frames behind it go
+// ahead; after an outage, when all of them were failing, the backlog still
+// reaches the backend in capture order. Frames the backend refuses are
+// dropped.
+func (d *daemon) uploadLoop(ctx context.Context) {
+	for {
+		e := d.spool.next(time.Now())
+		var wait <-chan time.Time
+		switch {
+		case e == nil:
+			// Sleep until something is enqueued.
+		case time.Now().Before(e.NextAttempt):
+			wait = time.After(time.Until(e.NextAttempt))
+		default:
+			// After an outage, register the backlog in batches.
+			if backlog := d.spool.due(snapshotBatchSize, time.Now()); len(backlog) > 1 && !time.Now().Before(d.batchRetryAt) {
+				d.deliverBatch(backlog)
+			} else {
+				d.deliver(e)
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.spool.notify:
+		case <-wait:
+		}
+	}
+}
+
+func (d *daemon) deliver(e *spoolEntry) {
+	objectKey, _, duplicate, err := deliverSpooled(d.spool, e, d.uploadClient, d.backend.baseURL, d.backend.token)
+	if err != nil {
+		d.deliveryFailed(e, err)
+		return
+	}
+	d.delivered(objectKey, duplicate)
+}
+
+// deliverBatch uploads a backlog of frames and registers them with one
+// request. Frames that fail are retried on their own schedule, as they would
+// be one at a time.
+func (d *daemon) deliverBatch(entries []*spoolEntry) {
+	var uploaded []*spoolEntry
+	for _, e := range entries {
+		if err := uploadSpooled(d.spool, e, d.uploadClient, d.backend.baseURL, d.backend.token); err != nil {
+			d.deliveryFailed(e, err)
+			continue
+		}
+		uploaded = append(uploaded, e)
+	}
+	if len(uploaded) == 0 {
+		return
+	}
+	results, err := registerSnapshots(d.uploadClient, d.backend.baseURL, d.backend.token, uploaded)
+	if errors.Is(err, errBatchUnsupported) {
+		d.batchRetryAt = time.Now().Add(batchRetryInterval)
+		for _, e := range uploaded {
+			d.deliver(e)
+		}
+		return
+	}
+	// A refused batch may be down to one bad frame; one at a time, only
+	// that frame is dropped.
+	if errors.Is(err, errSnapshotRefused) {
+		for _, e := range uploaded {
+			d.deliver(e)
+		}
+		return
+	}
+	if err != nil {
+		for _, e := range uploaded {
+			d.deliveryFailed(e, err)
+		}
+		return
+	}
+	for i, e := range uploaded {
+		switch r := results[i]; r.Status {
+		case "created":
+			if err := d.spool.complete(e.ID); err != nil {
+				log.Printf("Removing %s from spool: %v", e.ObjectKey, err)
+			}
+			d.delivered(e.ObjectKey, false)
+		case "duplicate":
+			// The backend has discarded this object in favour of the
+			// snapshot it already had.
+			if err := d.spool.complete(e.ID); err != nil {
+				log.Printf("Removing %s from spool: %v", e.ObjectKey, err)
+			}
+			d.delivered(e.ObjectKey, true)
+		case "rejected":
+			if err := d.spool.resetUpload(e.ID); err != nil {
+				log.Printf("Recording rejection of %s: %v", e.ObjectKey, err)
+			}
+			d.deliveryFailed(e, fmt.Errorf("%w: %s", errSnapshotRejected, r.Error))
+		case "invalid":
+			// The registration itself is wrong, e.g. a camera the relay no
+			// longer has; sending it again gets the same answer.
+			log.Printf("Backend refused %s, dropping it: %s", e.ObjectKey, r.Error)
+			d.stats.uploaded(e.ObjectKey, time.Now(), fmt.Errorf("%w: %s", errSnapshotRefused, r.Error))
+			if err := d.spool.complete(e.ID); err != nil {
+				log.Printf("Removing %s from spool: %v", e.ObjectKey, err)
+			}
+		default:
+			d.deliveryFailed(e, fmt.Errorf("registering snapshot: %s: %s", r.Status, r.Error))
+		}
+	}
+}
+
+// delivered records a registered frame and asks for detection on it. A
+// duplicate's object has been discarded by the backend, which ran detection
+// on the original, so it is only recorded.
+func (d *daemon) delivered(objectKey string, duplicate bool) {
+	d.stats.uploaded(objectKey, time.Now(), nil)
+	if duplicate {
+		log.Printf("Snapshot %s was already registered", objectKey)
+		return
+	}
+	log.Printf("Uploaded snapshot %s", objectKey)
+
+	if err := d.backend.notifySnapshotCreated(objectKey); err != nil {
+		log.Printf("Snapshot-created notification failed (non-blocking): %v", err)
+	}
+}
+
+// deliveryFailed records a failed attempt and schedules the next, or drops
+// the frame if the backend refused it outright.
+func (d *daemon) deliveryFailed(e *spoolEntry, err error) {
+	d.stats.uploaded(e.ObjectKey, time.Now(), err)
+	if errors.Is(err, errSnapshotRefused) {
+		if err := d.spool.complete(e.ID); err != nil {
+			log.Printf("Removing %s from spool: %v", e.ObjectKey, err)
+		}
+		log.Printf("Upload of %s refused, dropping it: %v", e.ObjectKey, err)
+		return
+	}
+	next, saveErr := d.spool.fail(e.ID, err, time.Now())
+	if saveErr != nil {
+		log.Printf("Updating spool: %v", saveErr)
+	}
+	log.Printf("Upload of %s failed (attempt %d), retrying at %s: %v", e.ObjectKey, e.Attempts+1, next.Format(time.TimeOnly), err)
+}
+
+func derefOr(s *string, fallback string) string {
+	if s == nil || *s == "" {
+		return fallback
+	}
+	return *s
+}
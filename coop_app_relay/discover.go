@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// runDiscover is `relay discover`: list ONVIF cameras on the network with
+// their stream URLs, and optionally report them to the backend.
+func runDiscover(args []string) {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	wait := fs.Duration("timeout", defaultDiscoverFor, "How long to wait for cameras to answer the probe")
+	addr := fs.String("addr", wsDiscoveryAddr, "Where to send the probe: the multicast group, or a camera's address")
+	username := fs.String("username", "", "ONVIF username, needed by most cameras to list streams")
+	password := fs.String("password", "", "ONVIF password")
+	asJSON := fs.Bool("json", false, "Print the cameras as JSON")
+	report := fs.Bool("report", false, "Send the list to the backend for the app's camera pick list")
+	fs.String("state-file", defaultStatePath(), "Relay identity written by `relay pair` (for --report)")
+	cfg, err := parseLayered(fs, "discover", args)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+
+	var creds func(string) *onvifCredentials
+	if *username != "" {
+		c := &onvifCredentials{Username: *username, Password: *password}
+		creds = func(string) *onvifCredentials { return c }
+	}
+	found, err := discoverCameras(context.Background(), *addr, *wait, creds)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(found)
+	} else {
+		printDiscovered(found)
+	}
+
+	if *report {
+		id, err := loadIdentity(cfg)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			os.Exit(1)
+		}
+		if err := newBackendClient(id.BackendURL, id.DeviceToken).reportDiscoveredCameras(found); err != nil {
+			log.Printf("Error reporting cameras: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("Reported %d camera(s) to the backend", len(found))
+	}
+}
+
+func printDiscovered(found []discoveredCamera) {
+	if len(found) == 0 {
+		fmt.Println("No ONVIF cameras answered.")
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, cam := range found {
+		fmt.Fprintf(tw, "%s\t%s %s\t%s\n", cam.Address, cam.Manufacturer, cam.Model, firstNonEmpty(cam.Name, cam.Endpoint))
+		if cam.Error != "" {
+			fmt.Fprintf(tw, "\t  %s\t\n", cam.Error)
+		}
+		for _, p := range cam.Profiles {
+			fmt.Fprintf(tw, "\t  %s %s %dx%d\t%s\n", p.Name, p.Encoding, p.Width, p.Height, p.StreamURI)
+		}
+	}
+	tw.Flush()
+}
+
+// discoverAndReport runs discovery and reports the result. Each camera is
+// queried with override if given, else the credentials of a configured camera
+// on the same host, else ones that worked for an earlier discover_cameras
+// command, so scheduled runs don't lose what a credentialed scan found.
+func (d *daemon) discoverAndReport(ctx context.Context, override *onvifCredentials) ([]discoveredCamera, error) {
+	d.mu.Lock()
+	cams := d.config.cameraList()
+	d.mu.Unlock()
+	known := make(map[string]*onvifCredentials)
+	for _, cam := range cams {
+		u, err := url.Parse(cam.SourceURL)
+		if err != nil || u.User == nil {
+			continue
+		}
+		password, _ := u.User.Password()
+		known[u.Hostname()] = &onvifCredentials{Username: u.User.Username(), Password: password}
+	}
+	found, err := discoverCameras(ctx, d.discoverAddr, defaultDiscoverFor, func(host string) *onvifCredentials {
+		if override != nil {
+			return override
+		}
+		if c := known[host]; c != nil {
+			return c
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.onvifCreds[host]
+	})
+	if err != nil {
+		return nil, err
+	}
+	if override != nil {
+		d.mu.Lock()
+		for _, cam := range found {
+			if len(cam.Profiles) > 0 {
+				if u, err := url.Parse(cam.DeviceURL); err == nil {
+					d.onvifCreds[u.Hostname()] = override
+				}
+			}
+		}
+		d.mu.Unlock()
+	}
+	if err := d.backend.reportDiscoveredCameras(found); err != nil {
+		return found, err
+	}
+	return found, nil
+}
+
+// discoveryLoop looks for ONVIF cameras shortly after startup, once the
+// config (and the credentials of cameras already set up) has arrived, and
+// then every d.discoverEvery.
+func (d *daemon) discoveryLoop(ctx context.Context) {
+	wait := 15 * time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		found, err := d.discoverAndReport(ctx, nil)
+		if err != nil {
+			log.Printf("Camera discovery failed: %v", err)
+		} else {
+			log.Printf("Camera discovery found %d ONVIF camera(s)", len(found))
+		}
+		wait = d.discoverEvery
+	}
+}
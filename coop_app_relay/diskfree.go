@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// diskFree reports the bytes available to the relay on the filesystem
+// holding path. The relay is built as a plain file list, so platform syscalls
+// can't be split out by build tag; it asks POSIX df instead, and reports
+// nothing on Windows.
+func diskFree(path string) (int64, bool) {
+	if runtime.GOOS == "windows" {
+		return 0, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "df", "-Pk", path).Output()
+	if err != nil {
+		return 0, false
+	}
+	// Filesystem 1024-blocks Used Available Capacity Mounted-on
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(lines) < 2 || len(fields) < 4 {
+		return 0, false
+	}
+	kb, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return kb << 10, true
+}
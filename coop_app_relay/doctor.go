@@ -0,0 +1,575 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// `relay doctor` answers "why isn't my relay uploading?" with a pass/fail
+// report: DNS and TLS to the backend, reachability, the device token, the
+// config fetch, each camera's stream (codec, resolution, frame rate) and a
+// test capture, clock skew against the backend's Date header, and spool disk
+// space. The daemon runs the same checks for the run_diagnostics remote
+// command.
+
+const (
+	// doctorCameraTimeout bounds each camera's probe, long enough for a
+	// keyframe from a camera with a slow GOP.
+	doctorCameraTimeout = 15 * time.Second
+	// doctorFPSWindow is how long the doctor watches an RTSP stream to
+	// estimate its frame rate.
+	doctorFPSWindow = 2 * time.Second
+
+	doctorClockWarn = 10 * time.Second
+	doctorClockFail = 2 * time.Minute
+
+	doctorDiskWarn = 1 << 30
+	doctorDiskFail = 100 << 20
+
+	doctorCertWarn = 14 * 24 * time.Hour
+)
+
+// doctorCheck is one line of the report. Status is pass, warn, fail or skip.
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Millis int64  `json:"ms,omitempty"`
+}
+
+// doctorReport is the POST /api/relay/doctor body.
+type doctorReport struct {
+	Version string        `json:"version"`
+	OS      string        `json:"os"`
+	Arch    string        `json:"arch"`
+	RanAt   time.Time     `json:"ran_at"`
+	OK      bool          `json:"ok"`
+	Checks  []doctorCheck `json:"checks"`
+}
+
+// check runs one check and records its outcome and duration.
+func (r *doctorReport) check(name string, f func() (status, detail string)) string {
+	start := time.Now()
+	status, detail := f()
+	r.Checks = append(r.Checks, doctorCheck{Name: name, Status: status, Detail: detail, Millis: time.Since(start).Milliseconds()})
+	if status == "fail" {
+		r.OK = false
+	}
+	return status
+}
+
+func (r *doctorReport) skip(name, why string) {
+	r.Checks = append(r.Checks, doctorCheck{Name: name, Status: "skip", Detail: why})
+}
+
+// doctor holds what the checks need.
+type doctor struct {
+	relayID  string
+	backend  *backendClient
+	spoolDir string
+	// fallback is the config to check cameras against when the backend
+	// can't be asked for one: the daemon's current config, or nil.
+	fallback *relayConfig
+}
+
+func runDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	upload := fs.Bool("upload", false, "Send the report to the backend for the app and support")
+	fs.String("state-file", defaultStatePath(), "Relay identity written by `relay pair`")
+	spoolDir := fs.String("spool-dir", defaultSpoolDir(), "Directory where captured frames are queued until uploaded")
+	cfg, err := parseLayered(fs, "doctor", args)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+	id, err := loadIdentity(cfg)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+
+	dr := &doctor{relayID: id.RelayID, backend: newBackendClient(id.BackendURL, id.DeviceToken), spoolDir: *spoolDir}
+	report := dr.run(context.Background())
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		printDoctorReport(report)
+	}
+	if *upload {
+		if err := dr.backend.reportDoctor(report); err != nil {
+			log.Printf("Error uploading report: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("Uploaded report to the backend")
+	}
+	if !report.OK {
+		os.Exit(1)
+	}
+}
+
+func printDoctorReport(r doctorReport) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, c := range r.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", map[string]string{"pass": "PASS", "warn": "WARN", "fail": "FAIL", "skip": "SKIP"}[c.Status], c.Name, c.Detail)
+	}
+	tw.Flush()
+	if r.OK {
+		fmt.Println("\nNo problems found.")
+	} else {
+		fmt.Println("\nSome checks failed.")
+	}
+}
+
+// doctor runs the checks from the daemon, for the run_diagnostics remote
+// command, and uploads the report.
+func (d *daemon) doctor(ctx context.Context) doctorReport {
+	d.mu.Lock()
+	cfg := d.config
+	d.mu.Unlock()
+	dr := &doctor{relayID: d.relayID, backend: d.backend, spoolDir: d.spool.dir, fallback: &cfg}
+	report := dr.run(ctx)
+	if err := d.backend.reportDoctor(report); err != nil {
+		log.Printf("Uploading doctor report failed: %v", err)
+	}
+	return report
+}
+
+// run performs every check in order. A check whose prerequisite failed is
+// skipped rather than failing again for the same reason.
+func (dr *doctor) run(ctx context.Context) doctorReport {
+	r := doctorReport{Version: version, OS: runtime.GOOS, Arch: runtime.GOARCH, RanAt: time.Now().UTC(), OK: true}
+
+	u, err := url.Parse(dr.backend.baseURL)
+	if err != nil || u.Host == "" {
+		r.check("backend url", func() (string, string) { return "fail", fmt.Sprintf("%q is not a URL", dr.backend.baseURL) })
+		u = nil
+	}
+
+	reachable := false
+	var date time.Time
+	var rtt time.Duration
+	if u != nil && r.check("dns", func() (string, string) { return checkDNS(ctx, u.Hostname()) }) != "fail" {
+		tlsOK := true
+		if u.Scheme == "https" {
+			tlsOK = r.check("tls", func() (string, string) { return checkTLS(ctx, u) }) != "fail"
+		} else {
+			r.check("tls", func() (string, string) {
+				return "warn", "backend_url is not https; traffic to the backend is not encrypted"
+			})
+		}
+		if tlsOK {
+			reachable = r.check("backend", func() (string, string) {
+				var status, detail string
+				date, rtt, status, detail = dr.checkReachable(ctx)
+				return status, detail
+			}) != "fail"
+		} else {
+			r.skip("backend", "TLS failed")
+		}
+	} else {
+		r.skip("tls", "no address for the backend")
+		r.skip("backend", "no address for the backend")
+	}
+
+	if date.IsZero() {
+		r.skip("clock", "no Date header from the backend")
+	} else {
+		r.check("clock", func() (string, string) { return checkClock(date, rtt) })
+	}
+
+	var cfg *relayConfig
+	if reachable {
+		r.check("credentials", func() (string, string) {
+			var err error
+			cfg, err = dr.backend.fetchConfig(dr.relayID)
+			var statusErr *backendStatusError
+			switch {
+			case errors.As(err, &statusErr) && (statusErr.code == http.StatusUnauthorized || statusErr.code == http.StatusForbidden):
+				return "fail", fmt.Sprintf("device token rejected (%s); run `relay pair` again", statusErr.status)
+			case err != nil:
+				return "fail", err.Error()
+			}
+			return "pass", "device token accepted for relay " + dr.relayID
+		})
+	} else {
+		r.skip("credentials", "backend unreachable")
+	}
+	if cfg != nil {
+		r.check("config", func() (string, string) { return checkConfig(*cfg) })
+	} else if dr.fallback != nil {
+		r.skip("config", "couldn't fetch config; checking cameras from the running config")
+		cfg = dr.fallback
+	} else {
+		r.skip("config", "couldn't fetch config")
+	}
+
+	if cfg != nil {
+		for _, cam := range cfg.cameraList() {
+			dr.checkCamera(ctx, &r, cam)
+		}
+	}
+
+	r.check("disk", func() (string, string) { return checkDisk(dr.spoolDir) })
+	return r
+}
+
+func checkDNS(ctx context.Context, host string) (string, string) {
+	if net.ParseIP(host) != nil {
+		return "pass", host + " is an IP address"
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return "fail", err.Error()
+	}
+	return "pass", fmt.Sprintf("%s resolves to %v", host, addrs)
+}
+
+// checkTLS handshakes with the backend and looks at its certificate.
+func checkTLS(ctx context.Context, u *url.URL) (string, string) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	d := tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return "fail", err.Error()
+	}
+	defer conn.Close()
+	state := conn.(*tls.Conn).ConnectionState()
+	cert := state.PeerCertificates[0]
+	detail := fmt.Sprintf("%s, certificate issued by %s, expires %s", tls.VersionName(state.Version), cert.Issuer.CommonName, cert.NotAfter.Format("2006-01-02"))
+	if time.Until(cert.NotAfter) < doctorCertWarn {
+		return "warn", detail
+	}
+	return "pass", detail
+}
+
+// checkReachable makes an unauthenticated request to the backend. Any HTTP
+// answer counts; a 5xx is a warning since the backend itself is unwell.
+func (dr *doctor) checkReachable(ctx context.Context) (date time.Time, rtt time.Duration, status, detail string) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dr.backend.baseURL+"/", nil)
+	if err != nil {
+		return date, 0, "fail", err.Error()
+	}
+	start := time.Now()
+	resp, err := dr.backend.http.Do(req)
+	rtt = time.Since(start)
+	if err != nil {
+		return date, rtt, "fail", err.Error()
+	}
+	resp.Body.Close()
+	date, _ = http.ParseTime(resp.Header.Get("Date"))
+	if resp.StatusCode >= 500 {
+		return date, rtt, "warn", fmt.Sprintf("answered %s in %s", resp.Status, rtt.Round(time.Millisecond))
+	}
+	return date, rtt, "pass", fmt.Sprintf("answered in %s", rtt.Round(time.Millisecond))
+}
+
+// checkClock compares the local clock with the backend's Date header, taken
+// as the midpoint of the request. Date has one-second resolution.
+func checkClock(date time.Time, rtt time.Duration) (string, string) {
+	skew := time.Since(date.Add(rtt / 2)).Round(time.Second)
+	abs, dir := skew, "ahead of"
+	if skew < 0 {
+		abs, dir = -skew, "behind"
+	}
+	detail := fmt.Sprintf("local clock is %s %s the backend", abs, dir)
+	switch {
+	case abs <= time.Second:
+		return "pass", "local clock matches the backend"
+	case abs >= doctorClockFail:
+		return "fail", detail + "; enable NTP, snapshots get the wrong time"
+	case abs >= doctorClockWarn:
+		return "warn", detail
+	}
+	return "pass", detail
+}
+
+func checkConfig(cfg relayConfig) (string, string) {
+	cams := cfg.cameraList()
+	if len(cams) == 0 {
+		return "warn", "no cameras configured; add one in the app"
+	}
+	return "pass", fmt.Sprintf("%d camera(s) configured", len(cams))
+}
+
+// checkCamera adds a camera's stream check and test capture to the report.
+func (dr *doctor) checkCamera(ctx context.Context, r *doctorReport, cam cameraConfig) {
+	name := "camera " + cam.name()
+	if isPushSource(cam.SourceURL) {
+		r.skip(name, "camera pushes its images to the relay")
+		r.skip("capture "+cam.name(), "camera pushes its images to the relay")
+		return
+	}
+	var probe *streamProbe
+	var probeErr error
+	r.check(name, func() (string, string) {
+		probe, probeErr = probeStream(ctx, cam.SourceURL)
+		if probeErr != nil && probe == nil {
+			return "fail", fmt.Sprintf("%s: %v", redactURL(cam.SourceURL), probeErr)
+		}
+		return "pass", probe.String()
+	})
+	if probe == nil {
+		r.skip("capture "+cam.name(), "camera unreachable")
+		return
+	}
+	r.check("capture "+cam.name(), func() (string, string) {
+		if probe.frame == nil {
+			if probeErr != nil {
+				return "fail", "no frame decoded: " + probeErr.Error()
+			}
+			return "fail", "no frame decoded"
+		}
+		b := probe.frame.Bounds()
+		prepared, err := cam.prepare(probe.frame)
+		data, encErr := encodeJPEG(prepared, cam.quality())
+		if encErr != nil {
+			return "fail", encErr.Error()
+		}
+		pb := prepared.Bounds()
+		detail := fmt.Sprintf("%dx%d frame, uploads as %dx%d JPEG of %.1f KB", b.Dx(), b.Dy(), pb.Dx(), pb.Dy(), float64(len(data))/1024)
+		if err != nil {
+			return "warn", detail + "; image settings ignored: " + err.Error()
+		}
+		return "pass", detail
+	})
+}
+
+// streamProbe is what the doctor learned about a camera's stream.
+type streamProbe struct {
+	codec         string
+	width, height int
+	fps           float64
+	frame         image.Image // a decoded frame, if any
+}
+
+func (p *streamProbe) String() string {
+	s := p.codec
+	if p.width > 0 {
+		s += fmt.Sprintf(" %dx%d", p.width, p.height)
+	}
+	if p.fps > 0 {
+		s += fmt.Sprintf(" at %.1f fps", p.fps)
+	}
+	return s
+}
+
+// probeStream connects to a camera and reads enough of its stream to
+// describe it and decode one frame. A non-nil probe with an error means the
+// camera answered but no frame decoded.
+func probeStream(ctx context.Context, sourceURL string) (*streamProbe, error) {
+	ctx, cancel := context.WithTimeout(ctx, doctorCameraTimeout)
+	defer cancel()
+	if isHTTPSource(sourceURL) {
+		return probeHTTPStream(ctx, sourceURL)
+	}
+	if strings.HasPrefix(sourceURL, "rtsps://") {
+		// Only ffmpeg speaks RTSP over TLS, so that is what capture uses.
+		frames, err := captureRTSP(ctx, sourceURL, 1, 0)
+		if err != nil {
+			return nil, err
+		}
+		b := frames[0].Bounds()
+		return &streamProbe{codec: "decoded by ffmpeg", width: b.Dx(), height: b.Dy(), frame: frames[0]}, nil
+	}
+	p, err := probeRTSPStream(ctx, sourceURL)
+	if p != nil && p.frame == nil && errors.Is(err, errUnsupportedStream) {
+		// Capture would fall back to ffmpeg, so check that works too.
+		if _, lookErr := exec.LookPath("ffmpeg"); lookErr == nil {
+			frames, ffErr := captureFFmpeg(ctx, sourceURL, 1, 0)
+			if ffErr != nil {
+				return p, fmt.Errorf("%v; ffmpeg fallback: %w", err, ffErr)
+			}
+			p.frame = frames[0]
+			p.codec += " (decoded by ffmpeg)"
+			return p, nil
+		}
+	}
+	return p, err
+}
+
+func probeHTTPStream(ctx context.Context, sourceURL string) (*streamProbe, error) {
+	src, err := newHTTPSource(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := src.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	kind, err := sourceKind(resp)
+	if err != nil {
+		return nil, err
+	}
+	p := &streamProbe{codec: "JPEG snapshot"}
+	var img image.Image
+	if kind == "mjpeg" {
+		p.codec = "MJPEG"
+		var frames []image.Image
+		if frames, err = readMJPEG(ctx, resp, 1, 0); err == nil {
+			img = frames[0]
+		}
+	} else {
+		img, err = decodeSourceJPEG(resp.Body)
+	}
+	if err != nil {
+		return p, err
+	}
+	p.frame = img
+	p.width, p.height = img.Bounds().Dx(), img.Bounds().Dy()
+	return p, nil
+}
+
+// probeRTSPStream plays an RTSP stream until it has decoded a keyframe and
+// watched doctorFPSWindow of access units, timing them by RTP timestamp.
+func probeRTSPStream(ctx context.Context, rtspURL string) (*streamProbe, error) {
+	client, track, err := startRTSP(ctx, rtspURL)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	p := &streamProbe{codec: "H.264"}
+	dec := newH264Decoder()
+	sawSPS := func(nal []byte) {
+		if p.width != 0 || len(nal) == 0 || nal[0]&0x1f != 7 {
+			return
+		}
+		if sps, err := parseSPS(nal); err == nil {
+			p.codec = "H.264 " + h264ProfileName(sps.profileIdc)
+			p.width = sps.widthMbs*16 - sps.cropLeft - sps.cropRight
+			p.height = sps.heightMbs*16 - sps.cropTop - sps.cropBottom
+		}
+	}
+	for _, ps := range track.paramSets {
+		sawSPS(ps)
+		dec.addParameterSet(ps)
+	}
+
+	var depack h264Depacketizer
+	var lastErr error
+	var first, last uint32
+	var units int
+	var start time.Time
+	var unsupported bool
+	for seen := 0; seen < maxAccessUnits; seen++ {
+		pkt, err := client.readRTP()
+		if err != nil {
+			lastErr = err
+			break
+		}
+		au := depack.push(pkt)
+		if au == nil {
+			continue
+		}
+		for _, nal := range au {
+			sawSPS(nal)
+		}
+		if units == 0 {
+			first, start = depack.auTimestamp, time.Now()
+		}
+		if depack.auTimestamp != last || units == 0 {
+			units++
+			last = depack.auTimestamp
+		}
+		if p.frame == nil && !unsupported {
+			img, err := dec.decodeIntraPicture(au)
+			switch {
+			case err == nil:
+				p.frame = img
+				p.width, p.height = img.Bounds().Dx(), img.Bounds().Dy()
+			case errors.Is(err, errUnsupportedStream):
+				// No later keyframe will decode either; just time the stream.
+				lastErr, unsupported = err, true
+			case !errors.Is(err, errNotIntraPicture):
+				lastErr = err
+			}
+		}
+		if (p.frame != nil || unsupported) && time.Since(start) >= doctorFPSWindow {
+			break
+		}
+	}
+	if span := last - first; units > 1 && span > 0 {
+		p.fps = float64(units-1) * 90000 / float64(span)
+	}
+	if p.frame == nil {
+		if lastErr == nil {
+			lastErr = errors.New("no keyframe received from stream")
+		}
+		return p, lastErr
+	}
+	return p, nil
+}
+
+func h264ProfileName(idc uint32) string {
+	switch idc {
+	case 66:
+		return "Baseline"
+	case 77:
+		return "Main"
+	case 88:
+		return "Extended"
+	case 100:
+		return "High"
+	case 110:
+		return "High 10"
+	case 122:
+		return "High 4:2:2"
+	case 244:
+		return "High 4:4:4"
+	}
+	return fmt.Sprintf("profile %d", idc)
+}
+
+// checkDisk makes sure the spool directory is writable and has room.
+func checkDisk(dir string) (string, string) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "fail", err.Error()
+	}
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return "fail", fmt.Sprintf("%s is not writable: %v", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	free, ok := diskFree(dir)
+	if !ok {
+		return "pass", filepath.Clean(dir) + " is writable"
+	}
+	detail := fmt.Sprintf("%d MB free for %s", free>>20, filepath.Clean(dir))
+	switch {
+	case free < doctorDiskFail:
+		return "fail", detail
+	case free < doctorDiskWarn:
+		return "warn", detail
+	}
+	return "pass", detail
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal FTP server (RFC 959, with EPSV from RFC 2428) for cameras that
+// upload snapshots. It keeps no files: every upload is read into memory and,
+// if it is a .jpg, handed to the camera named by the login user. Directory
+// commands succeed against a virtual, always empty tree so cameras that
+// create dated folders before uploading are happy.
+
+const (
+	maxFTPSessions   = 16
+	ftpIdleTimeout   = 5 * time.Minute
+	ftpDataTimeout   = 30 * time.Second
+	maxFTPLineLength = 1024
+)
+
+// serveIngestFTP accepts FTP sessions until ctx ends.
+func (d *daemon) serveIngestFTP(ctx context.Context, ln net.Listener) {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	log.Printf("Accepting pushed images on ftp://%s", ln.Addr())
+	slots := make(chan struct{}, maxFTPSessions)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("FTP ingest server stopped: %v", err)
+			}
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			fmt.Fprintf(conn, "421 Too many connections, try again later\r\n")
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			s := &ftpSession{d: d, conn: conn, r: bufio.NewReaderSize(conn, maxFTPLineLength), cwd: "/"}
+			s.serve(ctx)
+		}()
+	}
+}
+
+// ftpSession is one control connection.
+type ftpSession struct {
+	d    *daemon
+	conn net.Conn
+	r    *bufio.Reader
+
+	user   string
+	camera string // set once logged in
+	cwd    string
+
+	// pasv is the listener of a pending passive data connection; port is
+	// the address of a pending active one.
+	pasv net.Listener
+	port string
+}
+
+func (s *ftpSession) serve(ctx context.Context) {
+	defer s.conn.Close()
+	defer s.closeData()
+	stop := context.AfterFunc(ctx, func() { s.conn.Close() })
+	defer stop()
+
+	s.reply(220, "Coop relay ready")
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+		line, err := s.r.ReadSlice('\n')
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				s.reply(500, "Line too long")
+			}
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+		cmd = strings.ToUpper(cmd)
+		if s.camera == "" && !ftpPreLogin[cmd] {
+			s.reply(530, "Please log in with USER and PASS")
+			continue
+		}
+		if quit := s.handle(ctx, cmd, arg); quit {
+			return
+		}
+	}
+}
+
+// ftpPreLogin are the commands allowed before logging in.
+var ftpPreLogin = map[string]bool{"USER": true, "PASS": true, "QUIT": true, "SYST": true, "FEAT": true, "NOOP": true, "OPTS": true, "AUTH": true}
+
+func (s *ftpSession) handle(ctx context.Context, cmd, arg string) (quit bool) {
+	switch cmd {
+	case "USER":
+		s.user, s.camera = arg, ""
+		s.reply(331, "Password required")
+	case "PASS":
+		s.login(arg)
+	case "QUIT":
+		s.reply(221, "Bye")
+		return true
+	case "SYST":
+		s.reply(215, "UNIX Type: L8")
+	case "FEAT":
+		s.conn.Write([]byte("211-Features:\r\n EPSV\r\n PASV\r\n SIZE\r\n UTF8\r\n211 End\r\n"))
+	case "NOOP":
+		s.reply(200, "OK")
+	case "OPTS":
+		s.reply(200, "OK")
+	case "AUTH":
+		s.reply(502, "TLS is not supported")
+	case "TYPE", "MODE", "STRU", "ALLO":
+		s.reply(200, "OK")
+	case "PWD", "XPWD":
+		s.reply(257, strconv.Quote(s.cwd)+" is the current directory")
+	case "CWD", "XCWD":
+		s.cwd = s.resolve(arg)
+		s.reply(250, "OK")
+	case "CDUP", "XCUP":
+		s.cwd = path.Dir(s.cwd)
+		s.reply(250, "OK")
+	case "MKD", "XMKD":
+		s.reply(257, strconv.Quote(s.resolve(arg))+" created")
+	case "RMD", "XRMD", "DELE":
+		// Nothing is kept, so there is nothing to remove.
+		s.reply(250, "OK")
+	case "SIZE", "MDTM":
+		s.reply(550, "No such file")
+	case "PASV", "EPSV":
+		s.passive(cmd)
+	case "PORT":
+		s.active(arg)
+	case "LIST", "NLST", "MLSD":
+		s.list()
+	case "STOR":
+		s.store(ctx, arg)
+	case "RETR", "APPE", "RNFR", "RNTO":
+		s.reply(502, "Not supported; this server only accepts uploads")
+	default:
+		s.reply(502, "Command not implemented")
+	}
+	return false
+}
+
+func (s *ftpSession) reply(code int, msg string) {
+	fmt.Fprintf(s.conn, "%d %s\r\n", code, msg)
+}
+
+// login checks the ingest password and that the user names a camera.
+func (s *ftpSession) login(password string) {
+	if s.user == "" {
+		s.reply(503, "Send USER first")
+		return
+	}
+	if !s.d.ingestPasswordOK(password) {
+		log.Printf("FTP login from %s as %q failed: wrong password", s.conn.RemoteAddr(), s.user)
+		time.Sleep(time.Second)
+		s.reply(530, "Login incorrect")
+		return
+	}
+	s.d.mu.Lock()
+	cam, ok := s.d.config.cameraNamed(s.user)
+	s.d.mu.Unlock()
+	if !ok {
+		log.Printf("FTP login from %s as %q failed: no such camera", s.conn.RemoteAddr(), s.user)
+		s.reply(530, "Log in as a camera ID or label")
+		return
+	}
+	s.camera = s.user
+	s.reply(230, "Logged in as "+cam.name())
+}
+
+func (s *ftpSession) resolve(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(s.cwd, p)
+	}
+	return path.Clean("/" + p)
+}
+
+// passive opens a data listener on the address the client reached us at.
+func (s *ftpSession) passive(cmd string) {
+	s.closeData()
+	host, _, _ := net.SplitHostPort(s.conn.LocalAddr().String())
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		s.reply(425, "Can't open data connection")
+		return
+	}
+	s.pasv = ln
+	port := ln.Addr().(*net.TCPAddr).Port
+	if cmd == "EPSV" {
+		s.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		return
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		s.closeData()
+		s.reply(425, "Use EPSV over IPv6")
+		return
+	}
+	s.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+}
+
+// active records a PORT address. It must be the client's own IP, so the
+// server can't be used to connect elsewhere.
+func (s *ftpSession) active(arg string) {
+	s.closeData()
+	f := strings.Split(arg, ",")
+	if len(f) != 6 {
+		s.reply(501, "Bad PORT")
+		return
+	}
+	var b [6]int
+	for i, v := range f {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 || n > 255 {
+			s.reply(501, "Bad PORT")
+			return
+		}
+		b[i] = n
+	}
+	ip := net.IPv4(byte(b[0]), byte(b[1]), byte(b[2]), byte(b[3]))
+	client, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if !ip.Equal(net.ParseIP(client)) {
+		s.reply(504, "PORT must name your own address")
+		return
+	}
+	s.port = net.JoinHostPort(ip.String(), strconv.Itoa(b[4]<<8|b[5]))
+	s.reply(200, "PORT OK")
+}
+
+// openData connects the pending data channel.
+func (s *ftpSession) openData() (net.Conn, error) {
+	defer s.closeData()
+	switch {
+	case s.pasv != nil:
+		s.pasv.(*net.TCPListener).SetDeadline(time.Now().Add(ftpDataTimeout))
+		conn, err := s.pasv.Accept()
+		if err != nil {
+			return nil, err
+		}
+		// Only the client may use the data port it asked for.
+		peer, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		client, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+		if peer != client {
+			conn.Close()
+			return nil, errors.New("data connection from another address")
+		}
+		return conn, nil
+	case s.port != "":
+		return net.DialTimeout("tcp", s.port, ftpDataTimeout)
+	}
+	return nil, errors.New("no data connection; send PASV or PORT first")
+}
+
+func (s *ftpSession) closeData() {
+	if s.pasv != nil {
+		s.pasv.Close()
+		s.pasv = nil
+	}
+	s.port = ""
+}
+
+// list answers directory listings with an empty list.
+func (s *ftpSession) list() {
+	data, err := s.openData()
+	if err != nil {
+		s.reply(425, err.Error())
+		return
+	}
+	s.reply(150, "Opening data connection")
+	data.Close()
+	s.reply(226, "Transfer complete")
+}
+
+// store receives an upload and pushes it if it is a JPEG.
+func (s *ftpSession) store(ctx context.Context, name string) {
+	data, err := s.openData()
+	if err != nil {
+		s.reply(425, err.Error())
+		return
+	}
+	s.reply(150, "Ready to receive")
+	data.SetReadDeadline(time.Now().Add(2 * time.Minute))
+	body, err := io.ReadAll(io.LimitReader(data, maxSourceImageBytes+1))
+	data.Close()
+	switch {
+	case err != nil:
+		s.reply(426, "Transfer aborted")
+		return
+	case len(body) > maxSourceImageBytes:
+		s.reply(552, "File too large")
+		return
+	}
+	ext := strings.ToLower(path.Ext(name))
+	if ext != ".jpg" && ext != ".jpeg" {
+		// Cameras upload test files and logs too; take them and move on.
+		s.reply(226, "Transfer complete")
+		return
+	}
+	_, _, err = s.d.pushImage(ctx, s.camera, body, "FTP from "+s.conn.RemoteAddr().String())
+	switch {
+	case errors.Is(err, errNotJPEG):
+		s.reply(550, "Not a JPEG image")
+	case errors.Is(err, errImageTooLarge):
+		s.reply(552, "Image frame too large")
+	case err != nil:
+		log.Printf("[%s] Pushed image not queued: %v", s.camera, err)
+		s.reply(451, "Could not queue image: "+err.Error())
+	default:
+		s.reply(226, "Transfer complete")
+	}
+}
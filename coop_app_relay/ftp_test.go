@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// startFTPIngest serves FTP ingest on a loopback port for a daemon with two
+// cameras, one of them push://, and returns the address and a channel of the
+// images pushed, which are collected instead of processed.
+func startFTPIngest(t *testing.T) (string, <-chan pushedFrame) {
+	t.Helper()
+	d := &daemon{relayID: "relay", pushRequests: make(chan pushedFrame), ingestPassword: "pw"}
+	d.config = relayConfig{Cameras: []cameraConfig{
+		{ID: "cam1", Label: "Barn Cam", SourceURL: "push://"},
+		{ID: "cam2", Label: "yard", SourceURL: "rtsp://127.0.0.1:1/x"},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	pushed := make(chan pushedFrame, 10)
+	go func() {
+		for {
+			select {
+			case p := <-d.pushRequests:
+				pushed <- p
+				p.reply <- captureResult{At: p.at, Bytes: 1}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.serveIngestFTP(ctx, ln)
+	return ln.Addr().String(), pushed
+}
+
+// ftpLogin opens a control connection and logs in.
+func ftpLogin(t *testing.T, addr, user, password string) (*textproto.Conn, error) {
+	t.Helper()
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ftpCmd(c, 331, "USER %s", user); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ftpCmd(c, 230, "PASS %s", password)
+	return c, err
+}
+
+func ftpCmd(c *textproto.Conn, code int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+	return c.ReadResponse(code)
+}
+
+// ftpStore uploads data as name over an EPSV or PASV data connection and
+// returns the final reply code.
+func ftpStore(t *testing.T, c *textproto.Conn, mode, name string, data []byte) int {
+	t.Helper()
+	_, msg, err := ftpCmd(c, 0, "%s", mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dataAddr string
+	switch mode {
+	case "EPSV":
+		var port int
+		if _, err := fmt.Sscanf(msg[strings.Index(msg, "(|||"):], "(|||%d|)", &port); err != nil {
+			t.Fatalf("EPSV reply %q: %v", msg, err)
+		}
+		dataAddr = fmt.Sprintf("127.0.0.1:%d", port)
+	default:
+		var h [4]int
+		var p1, p2 int
+		if _, err := fmt.Sscanf(msg[strings.Index(msg, "("):], "(%d,%d,%d,%d,%d,%d)", &h[0], &h[1], &h[2], &h[3], &p1, &p2); err != nil {
+			t.Fatalf("PASV reply %q: %v", msg, err)
+		}
+		dataAddr = fmt.Sprintf("%d.%d.%d.%d:%d", h[0], h[1], h[2], h[3], p1<<8|p2)
+	}
+	conn, err := net.Dial("tcp", dataAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ftpCmd(c, 150, "STOR %s", name); err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	conn.Write(data)
+	conn.Close()
+	code, _, _ := c.ReadResponse(0)
+	return code
+}
+
+// hugeFrameJPEG is a small JPEG whose SOF header claims a 60000x60000 frame.
+func hugeFrameJPEG(t *testing.T) []byte {
+	b := testJPEG(t, 128)
+	i := bytes.Index(b, []byte{0xff, 0xc0})
+	if i < 0 {
+		t.Fatal("no SOF0 marker")
+	}
+	// Length (2), precision (1), height (2), width (2).
+	copy(b[i+5:], []byte{0xea, 0x60, 0xea, 0x60})
+	return b
+}
+
+func TestFTPIngestStore(t *testing.T) {
+	addr, pushed := startFTPIngest(t)
+	c, err := ftpLogin(t, addr, "Barn Cam", "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"TYPE I", "MKD 2026", "CWD 2026"} {
+		if _, _, err := ftpCmd(c, 0, "%s", cmd); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		mode   string
+		data   []byte
+		code   int
+		pushed bool
+	}{
+		{name: "a.jpg", mode: "PASV", data: testJPEG(t, 200), code: 226, pushed: true},
+		{name: "b.JPEG", mode: "EPSV", data: testJPEG(t, 10), code: 226, pushed: true},
+		{name: "notes.txt", mode: "EPSV", data: []byte("hello"), code: 226},
+		{name: "c.jpg", mode: "EPSV", data: []byte("hello"), code: 550},
+		{name: "huge.jpg", mode: "PASV", data: hugeFrameJPEG(t), code: 552},
+	}
+	for _, tt := range tests {
+		if code := ftpStore(t, c, tt.mode, tt.name, tt.data); code != tt.code {
+			t.Errorf("STOR %s = %d, want %d", tt.name, code, tt.code)
+		}
+		select {
+		case p := <-pushed:
+			if !tt.pushed {
+				t.Errorf("STOR %s pushed an image", tt.name)
+			} else if p.cameraID != "cam1" || p.img.Bounds() != image.Rect(0, 0, 40, 30) {
+				t.Errorf("STOR %s pushed %v for %s", tt.name, p.img.Bounds(), p.cameraID)
+			}
+		default:
+			if tt.pushed {
+				t.Errorf("STOR %s pushed nothing", tt.name)
+			}
+		}
+	}
+	if _, _, err := ftpCmd(c, 221, "QUIT"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFTPIngestLogin(t *testing.T) {
+	addr, _ := startFTPIngest(t)
+	tests := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"cam2", "pw", true},
+		{"yard", "pw", true},
+		{"yard", "wrong", false},
+		{"nobody", "pw", false},
+	}
+	for _, tt := range tests {
+		_, err := ftpLogin(t, addr, tt.user, tt.password)
+		if (err == nil) != tt.ok {
+			t.Errorf("login as %s/%s: %v", tt.user, tt.password, err)
+		}
+	}
+
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.ReadResponse(220)
+	if _, _, err := ftpCmd(c, 530, "STOR x.jpg"); err != nil {
+		t.Errorf("STOR before login: %v", err)
+	}
+}
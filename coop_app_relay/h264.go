@@ -0,0 +1,656 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// H.264 NAL unit types the relay cares about.
+const (
+	nalSlice    = 1
+	nalIDRSlice = 5
+	nalSEI      = 6
+	nalSPS      = 7
+	nalPPS      = 8
+	nalAUD      = 9
+)
+
+var errBitstreamEnd = errors.New("h264: unexpected end of bitstream")
+
+// Frame size limits from the level tables (level 6.2 MaxFS), with no side
+// longer than 8192 pixels.
+const (
+	maxFrameSideMbs = 8192 / 16
+	maxFrameMbs     = 139264
+)
+
+// bitReader reads an RBSP (emulation prevention bytes already removed).
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+// unescapeRBSP strips the emulation_prevention_three_byte from a NAL payload.
+func unescapeRBSP(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func (r *bitReader) bitsLeft() int {
+	return len(r.data)*8 - r.pos
+}
+
+func (r *bitReader) u1() (uint32, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errBitstreamEnd
+	}
+	b := (r.data[r.pos>>3] >> (7 - uint(r.pos&7))) & 1
+	r.pos++
+	return uint32(b), nil
+}
+
+func (r *bitReader) u(n int) (uint32, error) {
+	if n > 32 {
+		return 0, fmt.Errorf("h264: read of %d bits", n)
+	}
+	if r.bitsLeft() < n {
+		return 0, errBitstreamEnd
+	}
+	var v uint32
+	for i := 0; i < n; i++ {
+		b := (r.data[r.pos>>3] >> (7 - uint(r.pos&7))) & 1
+		v = v<<1 | uint32(b)
+		r.pos++
+	}
+	return v, nil
+}
+
+func (r *bitReader) flag() (bool, error) {
+	b, err := r.u1()
+	return b == 1, err
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		b, err := r.u1()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("h264: invalid exp-golomb code")
+		}
+	}
+	if zeros == 0 {
+		return 0, nil
+	}
+	v, err := r.u(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1<<uint(zeros) - 1) + v, nil
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() (int32, error) {
+	v, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	if v&1 == 1 {
+		return int32((v + 1) / 2), nil
+	}
+	return -int32(v / 2), nil
+}
+
+func (r *bitReader) byteAligned() bool {
+	return r.pos&7 == 0
+}
+
+// moreRBSPData reports whether there is data before the rbsp_stop_one_bit.
+func (r *bitReader) moreRBSPData() bool {
+	last := len(r.data) - 1
+	for last >= 0 && r.data[last] == 0 {
+		last--
+	}
+	if last < 0 {
+		return false
+	}
+	stopBit := last*8 + 7
+	for b := r.data[last]; b&1 == 0; b >>= 1 {
+		stopBit--
+	}
+	return r.pos < stopBit
+}
+
+// seqParameterSet holds the SPS fields needed to decode intra pictures.
+type seqParameterSet struct {
+	id                      uint32
+	profileIdc              uint32
+	chromaFormatIdc         uint32
+	bitDepthLuma            uint32
+	bitDepthChroma          uint32
+	transformBypass         bool
+	scalingMatrixPresent    bool
+	scalingLists4x4         [6][16]int32 // zig-zag order
+	log2MaxFrameNum         uint32
+	picOrderCntType         uint32
+	log2MaxPocLsb           uint32
+	deltaPicOrderAlwaysZero bool
+	widthMbs                int
+	heightMbs               int
+	frameMbsOnly            bool
+	cropLeft, cropRight     int
+	cropTop, cropBottom     int
+}
+
+// picParameterSet holds the PPS fields needed to decode intra pictures.
+type picParameterSet struct {
+	id                         uint32
+	spsID                      uint32
+	entropyCodingMode          bool
+	bottomFieldPicOrderPresent bool
+	numSliceGroups             uint32
+	picInitQP                  int
+	chromaQPIndexOffset        int
+	secondChromaQPIndexOffset  int
+	deblockingControlPresent   bool
+	constrainedIntraPred       bool
+	redundantPicCntPresent     bool
+	transform8x8Mode           bool
+	scalingLists4x4            [6][16]int32
+}
+
+var (
+	flat4x4         = [16]int32{16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16}
+	defaultIntra4x4 = [16]int32{6, 13, 13, 20, 20, 20, 28, 28, 28, 28, 32, 32, 32, 37, 37, 42}
+	defaultInter4x4 = [16]int32{10, 14, 14, 20, 20, 20, 24, 24, 24, 24, 27, 27, 27, 30, 30, 34}
+	highProfileIdcs = map[uint32]bool{100: true, 110: true, 122: true, 244: true, 44: true, 83: true, 86: true, 118: true, 128: true, 138: true, 139: true, 134: true, 135: true}
+)
+
+// readScalingList parses scaling_list() into list and reports useDefaultScalingMatrixFlag.
+func readScalingList(r *bitReader, list []int32) (bool, error) {
+	last, next := int32(8), int32(8)
+	useDefault := false
+	for j := range list {
+		if next != 0 {
+			delta, err := r.se()
+			if err != nil {
+				return false, err
+			}
+			next = (last + delta + 256) % 256
+			useDefault = j == 0 && next == 0
+		}
+		if next == 0 {
+			list[j] = last
+		} else {
+			list[j] = next
+		}
+		last = list[j]
+	}
+	return useDefault, nil
+}
+
+// readScalingMatrix parses the 4x4 and 8x8 scaling lists of an SPS or PPS,
+// applying fall-back rule A (SPS) or B (PPS, with fallback = the SPS lists).
+// Only the 4x4 lists are kept; 8x8 lists are parsed and discarded.
+func readScalingMatrix(r *bitReader, count int, fallback *[6][16]int32) ([6][16]int32, error) {
+	var lists [6][16]int32
+	var scratch [64]int32
+	for i := 0; i < count; i++ {
+		present, err := r.flag()
+		if err != nil {
+			return lists, err
+		}
+		if i >= 6 {
+			if present {
+				if _, err := readScalingList(r, scratch[:]); err != nil {
+					return lists, err
+				}
+			}
+			continue
+		}
+		if present {
+			useDefault, err := readScalingList(r, lists[i][:])
+			if err != nil {
+				return lists, err
+			}
+			if useDefault {
+				if i < 3 {
+					lists[i] = defaultIntra4x4
+				} else {
+					lists[i] = defaultInter4x4
+				}
+			}
+			continue
+		}
+		switch {
+		case i == 0 && fallback == nil:
+			lists[i] = defaultIntra4x4
+		case i == 3 && fallback == nil:
+			lists[i] = defaultInter4x4
+		case i == 0 || i == 3:
+			lists[i] = fallback[i]
+		default:
+			lists[i] = lists[i-1]
+		}
+	}
+	return lists, nil
+}
+
+func parseSPS(nal []byte) (*seqParameterSet, error) {
+	r := &bitReader{data: unescapeRBSP(nal[1:])}
+	sps := &seqParameterSet{chromaFormatIdc: 1, bitDepthLuma: 8, bitDepthChroma: 8}
+	var err error
+	fail := func(e error) (*seqParameterSet, error) { return nil, fmt.Errorf("h264: parsing SPS: %w", e) }
+
+	if sps.profileIdc, err = r.u(8); err != nil {
+		return fail(err)
+	}
+	if _, err = r.u(16); err != nil { // constraint flags + level_idc
+		return fail(err)
+	}
+	if sps.id, err = r.ue(); err != nil {
+		return fail(err)
+	}
+	for i := range sps.scalingLists4x4 {
+		sps.scalingLists4x4[i] = flat4x4
+	}
+	if highProfileIdcs[sps.profileIdc] {
+		if sps.chromaFormatIdc, err = r.ue(); err != nil {
+			return fail(err)
+		}
+		if sps.chromaFormatIdc == 3 {
+			if _, err = r.u1(); err != nil { // separate_colour_plane_flag
+				return fail(err)
+			}
+		}
+		v, err := r.ue()
+		if err != nil {
+			return fail(err)
+		}
+		sps.bitDepthLuma = v + 8
+		if v, err = r.ue(); err != nil {
+			return fail(err)
+		}
+		sps.bitDepthChroma = v + 8
+		if sps.transformBypass, err = r.flag(); err != nil {
+			return fail(err)
+		}
+		if sps.scalingMatrixPresent, err = r.flag(); err != nil {
+			return fail(err)
+		}
+		if sps.scalingMatrixPresent {
+			count := 8
+			if sps.chromaFormatIdc == 3 {
+				count = 12
+			}
+			if sps.scalingLists4x4, err = readScalingMatrix(r, count, nil); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	v, err := r.ue()
+	if err != nil {
+		return fail(err)
+	}
+	sps.log2MaxFrameNum = v + 4
+	if sps.picOrderCntType, err = r.ue(); err != nil {
+		return fail(err)
+	}
+	switch sps.picOrderCntType {
+	case 0:
+		if v, err = r.ue(); err != nil {
+			return fail(err)
+		}
+		sps.log2MaxPocLsb = v + 4
+	case 1:
+		if sps.deltaPicOrderAlwaysZero, err = r.flag(); err != nil {
+			return fail(err)
+		}
+		if _, err = r.se(); err != nil { // offset_for_non_ref_pic
+			return fail(err)
+		}
+		if _, err = r.se(); err != nil { // offset_for_top_to_bottom_field
+			return fail(err)
+		}
+		n, err := r.ue()
+		if err != nil {
+			return fail(err)
+		}
+		for i := uint32(0); i < n; i++ {
+			if _, err = r.se(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if _, err = r.ue(); err != nil { // max_num_ref_frames
+		return fail(err)
+	}
+	if _, err = r.u1(); err != nil { // gaps_in_frame_num_value_allowed_flag
+		return fail(err)
+	}
+	if v, err = r.ue(); err != nil {
+		return fail(err)
+	}
+	sps.widthMbs = int(v) + 1
+	if v, err = r.ue(); err != nil {
+		return fail(err)
+	}
+	heightMapUnits := int(v) + 1
+	if sps.frameMbsOnly, err = r.flag(); err != nil {
+		return fail(err)
+	}
+	sps.heightMbs = heightMapUnits
+	if !sps.frameMbsOnly {
+		sps.heightMbs *= 2
+	}
+	// The picture buffers are sized from these, so a corrupt SPS must not
+	// get to ask for gigabytes.
+	if sps.widthMbs > maxFrameSideMbs || sps.heightMbs > maxFrameSideMbs || sps.widthMbs*sps.heightMbs > maxFrameMbs {
+		return fail(fmt.Errorf("frame size %dx%d macroblocks exceeds the level limit", sps.widthMbs, sps.heightMbs))
+	}
+	if !sps.frameMbsOnly {
+		if _, err = r.u1(); err != nil { // mb_adaptive_frame_field_flag
+			return fail(err)
+		}
+	}
+	if _, err = r.u1(); err != nil { // direct_8x8_inference_flag
+		return fail(err)
+	}
+	cropping, err := r.flag()
+	if err != nil {
+		return fail(err)
+	}
+	if cropping {
+		var c [4]uint32
+		for i := range c {
+			if c[i], err = r.ue(); err != nil {
+				return fail(err)
+			}
+		}
+		unitX, unitY := 1, 1
+		if sps.chromaFormatIdc == 1 || sps.chromaFormatIdc == 2 {
+			unitX = 2
+		}
+		if sps.chromaFormatIdc == 1 {
+			unitY = 2
+		}
+		if !sps.frameMbsOnly {
+			unitY *= 2
+		}
+		// Compare before multiplying so huge offsets can't overflow.
+		if uint64(c[0])+uint64(c[1]) >= uint64(sps.widthMbs*16/unitX) || uint64(c[2])+uint64(c[3]) >= uint64(sps.heightMbs*16/unitY) {
+			return fail(errors.New("frame cropping exceeds the frame size"))
+		}
+		sps.cropLeft, sps.cropRight = int(c[0])*unitX, int(c[1])*unitX
+		sps.cropTop, sps.cropBottom = int(c[2])*unitY, int(c[3])*unitY
+	}
+	// VUI is not needed for decoding and is ignored.
+	return sps, nil
+}
+
+func parsePPS(nal []byte, spss map[uint32]*seqParameterSet) (*picParameterSet, error) {
+	r := &bitReader{data: unescapeRBSP(nal[1:])}
+	pps := &picParameterSet{}
+	var err error
+	fail := func(e error) (*picParameterSet, error) { return nil, fmt.Errorf("h264: parsing PPS: %w", e) }
+
+	if pps.id, err = r.ue(); err != nil {
+		return fail(err)
+	}
+	if pps.spsID, err = r.ue(); err != nil {
+		return fail(err)
+	}
+	sps, ok := spss[pps.spsID]
+	if !ok {
+		return fail(fmt.Errorf("references unknown SPS %d", pps.spsID))
+	}
+	if pps.entropyCodingMode, err = r.flag(); err != nil {
+		return fail(err)
+	}
+	if pps.bottomFieldPicOrderPresent, err = r.flag(); err != nil {
+		return fail(err)
+	}
+	v, err := r.ue()
+	if err != nil {
+		return fail(err)
+	}
+	pps.numSliceGroups = v + 1
+	if pps.numSliceGroups > 1 {
+		// Slice groups (FMO) are a Baseline-only feature no camera we know of uses.
+		return fail(fmt.Errorf("%w: slice groups", errUnsupportedStream))
+	}
+	if _, err = r.ue(); err != nil { // num_ref_idx_l0_default_active_minus1
+		return fail(err)
+	}
+	if _, err = r.ue(); err != nil { // num_ref_idx_l1_default_active_minus1
+		return fail(err)
+	}
+	if _, err = r.u(3); err != nil { // weighted_pred_flag, weighted_bipred_idc
+		return fail(err)
+	}
+	qp, err := r.se()
+	if err != nil {
+		return fail(err)
+	}
+	pps.picInitQP = 26 + int(qp)
+	if _, err = r.se(); err != nil { // pic_init_qs_minus26
+		return fail(err)
+	}
+	off, err := r.se()
+	if err != nil {
+		return fail(err)
+	}
+	pps.chromaQPIndexOffset = int(off)
+	pps.secondChromaQPIndexOffset = int(off)
+	if pps.deblockingControlPresent, err = r.flag(); err != nil {
+		return fail(err)
+	}
+	if pps.constrainedIntraPred, err = r.flag(); err != nil {
+		return fail(err)
+	}
+	if pps.redundantPicCntPresent, err = r.flag(); err != nil {
+		return fail(err)
+	}
+	pps.scalingLists4x4 = sps.scalingLists4x4
+	if r.moreRBSPData() {
+		if pps.transform8x8Mode, err = r.flag(); err != nil {
+			return fail(err)
+		}
+		present, err := r.flag()
+		if err != nil {
+			return fail(err)
+		}
+		if present {
+			count := 6
+			if pps.transform8x8Mode {
+				if sps.chromaFormatIdc == 3 {
+					count += 6
+				} else {
+					count += 2
+				}
+			}
+			fallback := &sps.scalingLists4x4
+			if !sps.scalingMatrixPresent {
+				fallback = nil
+			}
+			if pps.scalingLists4x4, err = readScalingMatrix(r, count, fallback); err != nil {
+				return fail(err)
+			}
+		}
+		if off, err = r.se(); err != nil {
+			return fail(err)
+		}
+		pps.secondChromaQPIndexOffset = int(off)
+	}
+	return pps, nil
+}
+
+// sliceHeader holds the fields of slice_header() used by the intra decoder.
+type sliceHeader struct {
+	firstMb        int
+	sliceType      uint32
+	pps            *picParameterSet
+	sps            *seqParameterSet
+	qp             int
+	disableDeblock uint32
+	alphaOffset    int
+	betaOffset     int
+}
+
+func (h *sliceHeader) isIntra() bool {
+	return h.sliceType%5 == 2
+}
+
+func parseSliceHeader(r *bitReader, nalType, nalRefIdc byte, spss map[uint32]*seqParameterSet, ppss map[uint32]*picParameterSet) (*sliceHeader, error) {
+	h := &sliceHeader{}
+	fail := func(e error) (*sliceHeader, error) { return nil, fmt.Errorf("h264: parsing slice header: %w", e) }
+
+	v, err := r.ue()
+	if err != nil {
+		return fail(err)
+	}
+	h.firstMb = int(v)
+	if h.sliceType, err = r.ue(); err != nil {
+		return fail(err)
+	}
+	ppsID, err := r.ue()
+	if err != nil {
+		return fail(err)
+	}
+	pps, ok := ppss[ppsID]
+	if !ok {
+		return fail(fmt.Errorf("references unknown PPS %d", ppsID))
+	}
+	sps, ok := spss[pps.spsID]
+	if !ok {
+		return fail(fmt.Errorf("references unknown SPS %d", pps.spsID))
+	}
+	h.pps, h.sps = pps, sps
+	if !h.isIntra() {
+		// Callers only decode all-intra pictures; the rest of the header is inter-specific.
+		return h, nil
+	}
+	if _, err = r.u(int(sps.log2MaxFrameNum)); err != nil { // frame_num
+		return fail(err)
+	}
+	if !sps.frameMbsOnly {
+		return fail(fmt.Errorf("%w: interlaced pictures", errUnsupportedStream))
+	}
+	if nalType == nalIDRSlice {
+		if _, err = r.ue(); err != nil { // idr_pic_id
+			return fail(err)
+		}
+	}
+	if sps.picOrderCntType == 0 {
+		if _, err = r.u(int(sps.log2MaxPocLsb)); err != nil {
+			return fail(err)
+		}
+		if pps.bottomFieldPicOrderPresent {
+			if _, err = r.se(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if sps.picOrderCntType == 1 && !sps.deltaPicOrderAlwaysZero {
+		if _, err = r.se(); err != nil {
+			return fail(err)
+		}
+		if pps.bottomFieldPicOrderPresent {
+			if _, err = r.se(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if pps.redundantPicCntPresent {
+		if _, err = r.ue(); err != nil {
+			return fail(err)
+		}
+	}
+	if nalRefIdc != 0 {
+		if err := skipDecRefPicMarking(r, nalType == nalIDRSlice); err != nil {
+			return fail(err)
+		}
+	}
+	qpDelta, err := r.se()
+	if err != nil {
+		return fail(err)
+	}
+	h.qp = pps.picInitQP + int(qpDelta)
+	if pps.deblockingControlPresent {
+		if h.disableDeblock, err = r.ue(); err != nil {
+			return fail(err)
+		}
+		if h.disableDeblock != 1 {
+			a, err := r.se()
+			if err != nil {
+				return fail(err)
+			}
+			b, err := r.se()
+			if err != nil {
+				return fail(err)
+			}
+			h.alphaOffset, h.betaOffset = int(a)*2, int(b)*2
+		}
+	}
+	return h, nil
+}
+
+func skipDecRefPicMarking(r *bitReader, idr bool) error {
+	if idr {
+		_, err := r.u(2) // no_output_of_prior_pics_flag, long_term_reference_flag
+		return err
+	}
+	adaptive, err := r.flag()
+	if err != nil || !adaptive {
+		return err
+	}
+	for {
+		op, err := r.ue()
+		if err != nil {
+			return err
+		}
+		if op == 0 {
+			return nil
+		}
+		if op == 1 || op == 3 {
+			if _, err := r.ue(); err != nil {
+				return err
+			}
+		}
+		if op == 2 {
+			if _, err := r.ue(); err != nil {
+				return err
+			}
+		}
+		if op == 3 || op == 6 {
+			if _, err := r.ue(); err != nil {
+				return err
+			}
+		}
+		if op == 4 {
+			if _, err := r.ue(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+// deblock runs the in-loop deblocking filter (8.7) over a fully decoded
+// intra picture. Every edge of an intra macroblock has bS 3, or 4 on
+// macroblock boundaries, so no per-block motion state is needed.
+func (p *picture) deblock() {
+	for mby := 0; mby < p.heightMbs; mby++ {
+		for mbx := 0; mbx < p.widthMbs; mbx++ {
+			addr := mby*p.widthMbs + mbx
+			sh := p.slices[p.mbSlice[addr]]
+			if sh.disableDeblock == 1 {
+				continue
+			}
+			filterLeft := mbx > 0 && (sh.disableDeblock != 2 || p.mbSlice[addr-1] == p.mbSlice[addr])
+			filterTop := mby > 0 && (sh.disableDeblock != 2 || p.mbSlice[addr-p.widthMbs] == p.mbSlice[addr])
+
+			// Vertical edges, left to right, then horizontal edges, top to bottom.
+			for _, vertical := range []bool{true, false} {
+				for edge := 0; edge < 4; edge++ {
+					neighbour := addr
+					bS := 3
+					if edge == 0 {
+						if vertical && !filterLeft || !vertical && !filterTop {
+							continue
+						}
+						bS = 4
+						if vertical {
+							neighbour = addr - 1
+						} else {
+							neighbour = addr - p.widthMbs
+						}
+					}
+					p.filterLumaEdge(mbx, mby, edge, vertical, bS, p.mbQP[neighbour], p.mbQP[addr], sh)
+					if p.chroma && edge%2 == 0 {
+						p.filterChromaEdge(mbx, mby, edge/2, vertical, bS, p.mbQP[neighbour], p.mbQP[addr], sh)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (p *picture) filterLumaEdge(mbx, mby, edge int, vertical bool, bS, qpP, qpQ int, sh *sliceHeader) {
+	x0, y0 := mbx*16, mby*16
+	var start, step, across int
+	if vertical {
+		start, step, across = y0*p.strideY+x0+edge*4, 1, p.strideY
+	} else {
+		start, step, across = (y0+edge*4)*p.strideY+x0, p.strideY, 1
+	}
+	qpAv := (qpP + qpQ + 1) >> 1
+	for k := 0; k < 16; k++ {
+		filterSamples(p.y, start+k*across, step, bS, qpAv, sh, false)
+	}
+}
+
+func (p *picture) filterChromaEdge(mbx, mby, edge int, vertical bool, bS, qpP, qpQ int, sh *sliceHeader) {
+	x0, y0 := mbx*8, mby*8
+	var start, step, across int
+	if vertical {
+		start, step, across = y0*p.strideC+x0+edge*4, 1, p.strideC
+	} else {
+		start, step, across = (y0+edge*4)*p.strideC+x0, p.strideC, 1
+	}
+	for c, plane := range [2][]uint8{p.cb, p.cr} {
+		offset := p.pps.chromaQPIndexOffset
+		if c == 1 {
+			offset = p.pps.secondChromaQPIndexOffset
+		}
+		qpAv := (chromaQP(qpP, offset) + chromaQP(qpQ, offset) + 1) >> 1
+		for k := 0; k < 8; k++ {
+			filterSamples(plane, start+k*across, step, bS, qpAv, sh, true)
+		}
+	}
+}
+
+// filterSamples filters one line of samples across an edge; q0 is at
+// pix[off] and p0 at pix[off-step] (8.7.2.3, 8.7.2.4).
+func filterSamples(pix []uint8, off, step, bS, qpAv int, sh *sliceHeader, chroma bool) {
+	indexA := clip3(0, 51, qpAv+sh.alphaOffset)
+	indexB := clip3(0, 51, qpAv+sh.betaOffset)
+	alpha, beta := deblockAlpha[indexA], deblockBeta[indexB]
+
+	p0, q0 := int(pix[off-step]), int(pix[off])
+	p1, q1 := int(pix[off-2*step]), int(pix[off+step])
+	if abs(p0-q0) >= alpha || abs(p1-p0) >= beta || abs(q1-q0) >= beta {
+		return
+	}
+
+	if chroma {
+		if bS < 4 {
+			tc := deblockTC0[indexA][bS-1] + 1
+			delta := clip3(-tc, tc, ((q0-p0)<<2+(p1-q1)+4)>>3)
+			pix[off-step] = clip1(int32(p0 + delta))
+			pix[off] = clip1(int32(q0 - delta))
+		} else {
+			pix[off-step] = uint8((2*p1 + p0 + q1 + 2) >> 2)
+			pix[off] = uint8((2*q1 + q0 + p1 + 2) >> 2)
+		}
+		return
+	}
+
+	p2, q2 := int(pix[off-3*step]), int(pix[off+2*step])
+	ap, aq := abs(p2-p0), abs(q2-q0)
+	if bS < 4 {
+		tc0 := deblockTC0[indexA][bS-1]
+		tc := tc0
+		if ap < beta {
+			tc++
+		}
+		if aq < beta {
+			tc++
+		}
+		delta := clip3(-tc, tc, ((q0-p0)<<2+(p1-q1)+4)>>3)
+		pix[off-step] = clip1(int32(p0 + delta))
+		pix[off] = clip1(int32(q0 - delta))
+		if ap < beta {
+			pix[off-2*step] = uint8(p1 + clip3(-tc0, tc0, (p2+((p0+q0+1)>>1)-(p1<<1))>>1))
+		}
+		if aq < beta {
+			pix[off+step] = uint8(q1 + clip3(-tc0, tc0, (q2+((p0+q0+1)>>1)-(q1<<1))>>1))
+		}
+		return
+	}
+
+	p3, q3 := int(pix[off-4*step]), int(pix[off+3*step])
+	strong := abs(p0-q0) < (alpha>>2)+2
+	if ap < beta && strong {
+		pix[off-step] = uint8((p2 + 2*p1 + 2*p0 + 2*q0 + q1 + 4) >> 3)
+		pix[off-2*step] = uint8((p2 + p1 + p0 + q0 + 2) >> 2)
+		pix[off-3*step] = uint8((2*p3 + 3*p2 + p1 + p0 + q0 + 4) >> 3)
+	} else {
+		pix[off-step] = uint8((2*p1 + p0 + q1 + 2) >> 2)
+	}
+	if aq < beta && strong {
+		pix[off] = uint8((p1 + 2*p0 + 2*q0 + 2*q1 + q2 + 4) >> 3)
+		pix[off+step] = uint8((p0 + q0 + q1 + 2) >> 2)
+		pix[off+2*step] = uint8((2*q3 + 3*q2 + q1 + q0 + p0 + 4) >> 3)
+	} else {
+		pix[off] = uint8((2*q1 + q0 + p1 + 2) >> 2)
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,708 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+// errNotIntraPicture is returned for access units that reference other
+// pictures and so cannot be decoded on their own.
+var errNotIntraPicture = errors.New("h264: picture is not intra-only")
+
+// errUnsupportedStream wraps decode failures caused by coding tools the
+// built-in decoder doesn't implement, as opposed to a corrupt stream.
+var errUnsupportedStream = errors.New("h264: unsupported stream")
+
+// h264Decoder decodes intra-only H.264 pictures (IDR and all-I frames) into
+// YCbCr images. It supports what IP cameras emit for keyframes in the CAVLC
+// profiles: 8-bit 4:2:0 or monochrome, progressive, Intra 4x4/16x16/PCM
+// macroblocks, multiple slices, scaling matrices and the deblocking filter.
+// CABAC and the 8x8 transform (High profile) fail with errUnsupportedStream.
+type h264Decoder struct {
+	sps map[uint32]*seqParameterSet
+	pps map[uint32]*picParameterSet
+}
+
+func newH264Decoder() *h264Decoder {
+	return &h264Decoder{
+		sps: make(map[uint32]*seqParameterSet),
+		pps: make(map[uint32]*picParameterSet),
+	}
+}
+
+// addParameterSet records an SPS or PPS NAL unit; other NAL types are ignored.
+func (d *h264Decoder) addParameterSet(nal []byte) error {
+	if len(nal) == 0 {
+		return nil
+	}
+	switch nal[0] & 0x1f {
+	case nalSPS:
+		sps, err := parseSPS(nal)
+		if err != nil {
+			return err
+		}
+		d.sps[sps.id] = sps
+	case nalPPS:
+		pps, err := parsePPS(nal, d.sps)
+		if err != nil {
+			return err
+		}
+		d.pps[pps.id] = pps
+	}
+	return nil
+}
+
+// decodeIntraPicture decodes the slices of one access unit. Parameter sets
+// found in nals are applied first. It returns errNotIntraPicture if any slice
+// is not an I slice.
+func (d *h264Decoder) decodeIntraPicture(nals [][]byte) (*image.YCbCr, error) {
+	var slices [][]byte
+	for _, nal := range nals {
+		if len(nal) == 0 {
+			continue
+		}
+		switch nal[0] & 0x1f {
+		case nalSPS, nalPPS:
+			if err := d.addParameterSet(nal); err != nil {
+				return nil, err
+			}
+		case nalSlice, nalIDRSlice:
+			slices = append(slices, nal)
+		}
+	}
+	if len(slices) == 0 {
+		return nil, errors.New("h264: access unit has no slices")
+	}
+
+	var pic *picture
+	for i, nal := range slices {
+		r := &bitReader{data: unescapeRBSP(nal[1:])}
+		sh, err := parseSliceHeader(r, nal[0]&0x1f, (nal[0]>>5)&3, d.sps, d.pps)
+		if err != nil {
+			return nil, err
+		}
+		if !sh.isIntra() {
+			return nil, errNotIntraPicture
+		}
+		if pic == nil {
+			if pic, err = newPicture(sh.sps, sh.pps); err != nil {
+				return nil, err
+			}
+		} else if sh.sps != pic.sps {
+			return nil, errors.New("h264: slices reference different SPS")
+		}
+		pic.slices = append(pic.slices, sh)
+		if err := pic.decodeSlice(r, sh, i); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range pic.mbSlice {
+		if s < 0 {
+			return nil, errors.New("h264: picture is missing slices")
+		}
+	}
+	pic.deblock()
+	return pic.image(), nil
+}
+
+// picture is the reconstruction state of one frame.
+type picture struct {
+	sps       *seqParameterSet
+	pps       *picParameterSet
+	widthMbs  int
+	heightMbs int
+	chroma    bool // false for monochrome streams
+
+	y, cb, cr []uint8
+	strideY   int
+	strideC   int
+
+	slices  []*sliceHeader
+	mbSlice []int // slice index per macroblock, -1 until decoded
+	mbQP    []int // QPY per macroblock (0 for I_PCM) for deblocking
+
+	// Per 4x4 block state on frame-wide grids.
+	predModes []int8  // Intra4x4PredMode, 2 for non-Intra4x4 macroblocks
+	nzY       []uint8 // luma total_coeff
+	nzCb      []uint8 // chroma total_coeff, 2x2 per macroblock
+	nzCr      []uint8
+
+	// Current macroblock.
+	curMb    int
+	curSlice int
+	blkDone  [16]bool
+}
+
+func newPicture(sps *seqParameterSet, pps *picParameterSet) (*picture, error) {
+	switch {
+	case pps.entropyCodingMode:
+		return nil, fmt.Errorf("%w: CABAC entropy coding", errUnsupportedStream)
+	case sps.chromaFormatIdc > 1:
+		return nil, fmt.Errorf("%w: chroma_format_idc %d", errUnsupportedStream, sps.chromaFormatIdc)
+	case sps.bitDepthLuma != 8 || sps.bitDepthChroma != 8:
+		return nil, fmt.Errorf("%w: only 8-bit video is supported", errUnsupportedStream)
+	case sps.transformBypass:
+		return nil, fmt.Errorf("%w: lossless transform bypass", errUnsupportedStream)
+	case !sps.frameMbsOnly:
+		return nil, fmt.Errorf("%w: interlaced video", errUnsupportedStream)
+	}
+	mbs := sps.widthMbs * sps.heightMbs
+	p := &picture{
+		sps:       sps,
+		pps:       pps,
+		widthMbs:  sps.widthMbs,
+		heightMbs: sps.heightMbs,
+		chroma:    sps.chromaFormatIdc == 1,
+		strideY:   sps.widthMbs * 16,
+		strideC:   sps.widthMbs * 8,
+		mbSlice:   make([]int, mbs),
+		mbQP:      make([]int, mbs),
+		predModes: make([]int8, mbs*16),
+		nzY:       make([]uint8, mbs*16),
+		nzCb:      make([]uint8, mbs*4),
+		nzCr:      make([]uint8, mbs*4),
+	}
+	p.y = make([]uint8, mbs*256)
+	p.cb = make([]uint8, mbs*64)
+	p.cr = make([]uint8, mbs*64)
+	for i := range p.mbSlice {
+		p.mbSlice[i] = -1
+	}
+	if !p.chroma {
+		for i := range p.cb {
+			p.cb[i], p.cr[i] = 128, 128
+		}
+	}
+	return p, nil
+}
+
+// image returns the cropped frame.
+func (p *picture) image() *image.YCbCr {
+	img := &image.YCbCr{
+		Y:              p.y,
+		Cb:             p.cb,
+		Cr:             p.cr,
+		YStride:        p.strideY,
+		CStride:        p.strideC,
+		SubsampleRatio: image.YCbCrSubsampleRatio420,
+		Rect:           image.Rect(0, 0, p.widthMbs*16, p.heightMbs*16),
+	}
+	crop := image.Rect(p.sps.cropLeft, p.sps.cropTop, p.widthMbs*16-p.sps.cropRight, p.heightMbs*16-p.sps.cropBottom)
+	if crop.Empty() || crop == img.Rect {
+		return img
+	}
+	return img.SubImage(crop).(*image.YCbCr)
+}
+
+func (p *picture) decodeSlice(r *bitReader, sh *sliceHeader, sliceIdx int) error {
+	total := p.widthMbs * p.heightMbs
+	if sh.firstMb >= total {
+		return fmt.Errorf("h264: first_mb_in_slice %d out of range", sh.firstMb)
+	}
+	qp := sh.qp
+	p.curSlice = sliceIdx
+	for addr := sh.firstMb; ; addr++ {
+		if addr >= total {
+			return errors.New("h264: slice runs past the end of the picture")
+		}
+		if p.mbSlice[addr] >= 0 {
+			return fmt.Errorf("h264: macroblock %d decoded twice", addr)
+		}
+		p.curMb = addr
+		p.blkDone = [16]bool{}
+		var err error
+		if qp, err = p.decodeMacroblock(r, qp); err != nil {
+			return fmt.Errorf("h264: macroblock %d: %w", addr, err)
+		}
+		p.mbSlice[addr] = sliceIdx
+		if !r.moreRBSPData() {
+			return nil
+		}
+	}
+}
+
+// mbResidual holds the dequantisation inputs of one macroblock in raster order.
+type mbResidual struct {
+	lumaDC   [16]int32
+	luma     [16][16]int32 // per luma4x4BlkIdx
+	chromaDC [2][4]int32
+	chromaAC [2][4][16]int32
+}
+
+const (
+	mbTypeINxN = 0
+	mbTypeIPCM = 25
+)
+
+func (p *picture) decodeMacroblock(r *bitReader, qp int) (int, error) {
+	mbx, mby := p.curMb%p.widthMbs, p.curMb/p.widthMbs
+	mbType, err := r.ue()
+	if err != nil {
+		return qp, err
+	}
+	if mbType > mbTypeIPCM {
+		return qp, fmt.Errorf("invalid I-slice mb_type %d", mbType)
+	}
+	if mbType == mbTypeIPCM {
+		return qp, p.decodePCM(r, mbx, mby)
+	}
+
+	intra16x16 := mbType != mbTypeINxN
+	var i16Mode, cbpLuma, cbpChroma int
+	if intra16x16 {
+		i16Mode = int(mbType-1) % 4
+		cbpChroma = int(mbType-1) / 4 % 3
+		if mbType >= 13 {
+			cbpLuma = 15
+		}
+		for blk := 0; blk < 16; blk++ {
+			p.predModes[p.grid4x4(mbx*4+blk4x4X[blk]/4, mby*4+blk4x4Y[blk]/4)] = 2
+		}
+	} else {
+		if p.pps.transform8x8Mode {
+			t8x8, err := r.flag()
+			if err != nil {
+				return qp, err
+			}
+			if t8x8 {
+				return qp, fmt.Errorf("%w: 8x8 transform", errUnsupportedStream)
+			}
+		}
+		if err := p.readIntra4x4PredModes(r, mbx, mby); err != nil {
+			return qp, err
+		}
+	}
+
+	chromaMode := 0
+	if p.chroma {
+		v, err := r.ue()
+		if err != nil {
+			return qp, err
+		}
+		if v > 3 {
+			return qp, fmt.Errorf("invalid intra_chroma_pred_mode %d", v)
+		}
+		chromaMode = int(v)
+	}
+
+	if !intra16x16 {
+		codeNum, err := r.ue()
+		if err != nil {
+			return qp, err
+		}
+		var cbp int
+		if p.chroma {
+			if codeNum >= 48 {
+				return qp, fmt.Errorf("invalid coded_block_pattern %d", codeNum)
+			}
+			cbp = intraCBPFromCodeNum[codeNum]
+		} else {
+			if codeNum >= 16 {
+				return qp, fmt.Errorf("invalid coded_block_pattern %d", codeNum)
+			}
+			cbp = intraCBPFromCodeNumGray[codeNum]
+		}
+		cbpLuma, cbpChroma = cbp%16, cbp/16
+	}
+
+	var res mbResidual
+	if cbpLuma > 0 || cbpChroma > 0 || intra16x16 {
+		delta, err := r.se()
+		if err != nil {
+			return qp, err
+		}
+		if delta < -26 || delta > 25 {
+			return qp, fmt.Errorf("invalid mb_qp_delta %d", delta)
+		}
+		qp = (qp + int(delta) + 52) % 52
+		if err := p.readResidual(r, mbx, mby, intra16x16, cbpLuma, cbpChroma, &res); err != nil {
+			return qp, err
+		}
+	} else {
+		p.clearNonZero(mbx, mby)
+	}
+	p.mbQP[p.curMb] = qp
+
+	if intra16x16 {
+		if err := p.reconstructIntra16x16(mbx, mby, i16Mode, qp, &res); err != nil {
+			return qp, err
+		}
+	} else {
+		if err := p.reconstructIntra4x4(mbx, mby, qp, &res); err != nil {
+			return qp, err
+		}
+	}
+	if p.chroma {
+		if err := p.reconstructChroma(mbx, mby, chromaMode, qp, &res); err != nil {
+			return qp, err
+		}
+	}
+	return qp, nil
+}
+
+func (p *picture) decodePCM(r *bitReader, mbx, mby int) error {
+	for !r.byteAligned() {
+		if _, err := r.u1(); err != nil {
+			return err
+		}
+	}
+	need := 256
+	if p.chroma {
+		need += 128
+	}
+	if r.bitsLeft() < need*8 {
+		return errBitstreamEnd
+	}
+	data := r.data[r.pos/8:]
+	for y := 0; y < 16; y++ {
+		copy(p.y[(mby*16+y)*p.strideY+mbx*16:], data[y*16:y*16+16])
+	}
+	if p.chroma {
+		for y := 0; y < 8; y++ {
+			copy(p.cb[(mby*8+y)*p.strideC+mbx*8:], data[256+y*8:256+y*8+8])
+			copy(p.cr[(mby*8+y)*p.strideC+mbx*8:], data[320+y*8:320+y*8+8])
+		}
+	}
+	r.pos += need * 8
+	for i := 0; i < 16; i++ {
+		g := p.grid4x4(mbx*4+i%4, mby*4+i/4)
+		p.nzY[g] = 16
+		p.predModes[g] = 2
+	}
+	for i := 0; i < 4; i++ {
+		g := p.gridChroma(mbx*2+i%2, mby*2+i/2)
+		p.nzCb[g], p.nzCr[g] = 16, 16
+	}
+	p.mbQP[p.curMb] = 0
+	return nil
+}
+
+func (p *picture) grid4x4(bx, by int) int {
+	return by*p.widthMbs*4 + bx
+}
+
+func (p *picture) gridChroma(bx, by int) int {
+	return by*p.widthMbs*2 + bx
+}
+
+func (p *picture) clearNonZero(mbx, mby int) {
+	for i := 0; i < 16; i++ {
+		p.nzY[p.grid4x4(mbx*4+i%4, mby*4+i/4)] = 0
+	}
+	for i := 0; i < 4; i++ {
+		g := p.gridChroma(mbx*2+i%2, mby*2+i/2)
+		p.nzCb[g], p.nzCr[g] = 0, 0
+	}
+}
+
+// mbAvailable reports whether the macroblock containing luma sample (x, y) is
+// available for prediction from the current macroblock: inside the picture,
+// already decoded and in the same slice. The current macroblock counts as available.
+func (p *picture) mbAvailable(x, y int) bool {
+	if x < 0 || y < 0 || x >= p.widthMbs*16 || y >= p.heightMbs*16 {
+		return false
+	}
+	addr := (y/16)*p.widthMbs + x/16
+	if addr == p.curMb {
+		return true
+	}
+	return addr < p.curMb && p.mbSlice[addr] == p.curSlice
+}
+
+// sampleAvailable is mbAvailable plus, inside the current macroblock, whether
+// the 4x4 block holding the sample has been reconstructed yet.
+func (p *picture) sampleAvailable(x, y int) bool {
+	if !p.mbAvailable(x, y) {
+		return false
+	}
+	if (y/16)*p.widthMbs+x/16 == p.curMb {
+		return p.blkDone[blk4x4Index[(y%16)/4][(x%16)/4]]
+	}
+	return true
+}
+
+func (p *picture) readIntra4x4PredModes(r *bitReader, mbx, mby int) error {
+	for blk := 0; blk < 16; blk++ {
+		prevFlag, err := r.flag()
+		if err != nil {
+			return err
+		}
+		rem := -1
+		if !prevFlag {
+			v, err := r.u(3)
+			if err != nil {
+				return err
+			}
+			rem = int(v)
+		}
+		x, y := mbx*16+blk4x4X[blk], mby*16+blk4x4Y[blk]
+		predMode := 2
+		if p.mbAvailable(x-1, y) && p.mbAvailable(x, y-1) {
+			a := p.predModes[p.grid4x4(x/4-1, y/4)]
+			b := p.predModes[p.grid4x4(x/4, y/4-1)]
+			predMode = int(a)
+			if b < a {
+				predMode = int(b)
+			}
+		}
+		mode := predMode
+		if rem >= 0 {
+			if rem < predMode {
+				mode = rem
+			} else {
+				mode = rem + 1
+			}
+		}
+		p.predModes[p.grid4x4(x/4, y/4)] = int8(mode)
+	}
+	return nil
+}
+
+// lumaNC computes nC for the luma block at 4x4 grid position (bx, by).
+func (p *picture) lumaNC(bx, by int) int {
+	availA := p.mbAvailable(bx*4-1, by*4)
+	availB := p.mbAvailable(bx*4, by*4-1)
+	var nA, nB int
+	if availA {
+		nA = int(p.nzY[p.grid4x4(bx-1, by)])
+	}
+	if availB {
+		nB = int(p.nzY[p.grid4x4(bx, by-1)])
+	}
+	return combineNC(availA, availB, nA, nB)
+}
+
+// chromaNC computes nC for the chroma AC block at chroma 4x4 grid position (bx, by).
+func (p *picture) chromaNC(nz []uint8, bx, by int) int {
+	availA := p.mbAvailable(bx*8-1, by*8)
+	availB := p.mbAvailable(bx*8, by*8-1)
+	var nA, nB int
+	if availA {
+		nA = int(nz[p.gridChroma(bx-1, by)])
+	}
+	if availB {
+		nB = int(nz[p.gridChroma(bx, by-1)])
+	}
+	return combineNC(availA, availB, nA, nB)
+}
+
+func combineNC(availA, availB bool, nA, nB int) int {
+	switch {
+	case availA && availB:
+		return (nA + nB + 1) >> 1
+	case availA:
+		return nA
+	case availB:
+		return nB
+	}
+	return 0
+}
+
+func (p *picture) readResidual(r *bitReader, mbx, mby int, intra16x16 bool, cbpLuma, cbpChroma int, res *mbResidual) error {
+	var scan [16]int32
+	if intra16x16 {
+		if _, err := readResidualBlock(r, p.lumaNC(mbx*4, mby*4), 16, scan[:]); err != nil {
+			return err
+		}
+		for k := 0; k < 16; k++ {
+			res.lumaDC[zigzag4x4[k]] = scan[k]
+		}
+	}
+	for blk := 0; blk < 16; blk++ {
+		bx, by := mbx*4+blk4x4X[blk]/4, mby*4+blk4x4Y[blk]/4
+		g := p.grid4x4(bx, by)
+		if cbpLuma&(1<<uint(blk/4)) == 0 {
+			p.nzY[g] = 0
+			continue
+		}
+		nC := p.lumaNC(bx, by)
+		var n int
+		var err error
+		if intra16x16 {
+			n, err = readResidualBlock(r, nC, 15, scan[:15])
+			for k := 0; k < 15; k++ {
+				res.luma[blk][zigzag4x4[k+1]] = scan[k]
+			}
+		} else {
+			n, err = readResidualBlock(r, nC, 16, scan[:])
+			for k := 0; k < 16; k++ {
+				res.luma[blk][zigzag4x4[k]] = scan[k]
+			}
+		}
+		if err != nil {
+			return err
+		}
+		p.nzY[g] = uint8(n)
+	}
+	if !p.chroma {
+		return nil
+	}
+	if cbpChroma&3 != 0 {
+		for c := 0; c < 2; c++ {
+			if _, err := readResidualBlock(r, -1, 4, res.chromaDC[c][:]); err != nil {
+				return err
+			}
+		}
+	}
+	for c, nz := range [2][]uint8{p.nzCb, p.nzCr} {
+		for blk := 0; blk < 4; blk++ {
+			bx, by := mbx*2+blk%2, mby*2+blk/2
+			g := p.gridChroma(bx, by)
+			if cbpChroma&2 == 0 {
+				nz[g] = 0
+				continue
+			}
+			n, err := readResidualBlock(r, p.chromaNC(nz, bx, by), 15, scan[:15])
+			if err != nil {
+				return err
+			}
+			for k := 0; k < 15; k++ {
+				res.chromaAC[c][blk][zigzag4x4[k+1]] = scan[k]
+			}
+			nz[g] = uint8(n)
+		}
+	}
+	return nil
+}
+
+// readResidualBlock implements residual_block_cavlc() with startIdx 0 and
+// endIdx maxNumCoeff-1. nC == -1 selects the 4:2:0 chroma DC tables.
+// Coefficients are written to coeff in scan order.
+func readResidualBlock(r *bitReader, nC, maxNumCoeff int, coeff []int32) (int, error) {
+	for i := range coeff {
+		coeff[i] = 0
+	}
+	var tokenVLC *vlcTable
+	switch {
+	case nC == -1:
+		tokenVLC = chromaDCCoeffTokenVLC
+	case nC < 2:
+		tokenVLC = coeffTokenVLC[0]
+	case nC < 4:
+		tokenVLC = coeffTokenVLC[1]
+	case nC < 8:
+		tokenVLC = coeffTokenVLC[2]
+	default:
+		tokenVLC = coeffTokenVLC[3]
+	}
+	token, err := tokenVLC.read(r)
+	if err != nil {
+		return 0, err
+	}
+	totalCoeff, trailingOnes := token/4, token%4
+	if totalCoeff == 0 {
+		return 0, nil
+	}
+	if totalCoeff > maxNumCoeff {
+		return 0, fmt.Errorf("total_coeff %d exceeds %d", totalCoeff, maxNumCoeff)
+	}
+
+	var levels [16]int32
+	suffixLength := 0
+	if totalCoeff > 10 && trailingOnes < 3 {
+		suffixLength = 1
+	}
+	for i := 0; i < totalCoeff; i++ {
+		if i < trailingOnes {
+			sign, err := r.u1()
+			if err != nil {
+				return 0, err
+			}
+			levels[i] = 1 - 2*int32(sign)
+			continue
+		}
+		prefix := 0
+		for {
+			b, err := r.u1()
+			if err != nil {
+				return 0, err
+			}
+			if b == 1 {
+				break
+			}
+			prefix++
+			if prefix > 32 {
+				return 0, errors.New("invalid level_prefix")
+			}
+		}
+		levelCode := int32(min(15, prefix)) << uint(suffixLength)
+		if suffixLength > 0 || prefix >= 14 {
+			size := suffixLength
+			if prefix == 14 && suffixLength == 0 {
+				size = 4
+			} else if prefix >= 15 {
+				size = prefix - 3
+			}
+			if size > 0 {
+				suffix, err := r.u(size)
+				if err != nil {
+					return 0, err
+				}
+				levelCode += int32(suffix)
+			}
+		}
+		if prefix >= 15 && suffixLength == 0 {
+			levelCode += 15
+		}
+		if prefix >= 16 {
+			levelCode += (1 << uint(prefix-3)) - 4096
+		}
+		if i == trailingOnes && trailingOnes < 3 {
+			levelCode += 2
+		}
+		if levelCode%2 == 0 {
+			levels[i] = (levelCode + 2) >> 1
+		} else {
+			levels[i] = (-levelCode - 1) >> 1
+		}
+		if suffixLength == 0 {
+			suffixLength = 1
+		}
+		abs := levels[i]
+		if abs < 0 {
+			abs = -abs
+		}
+		if abs > (3<<uint(suffixLength-1)) && suffixLength < 6 {
+			suffixLength++
+		}
+	}
+
+	zerosLeft := 0
+	if totalCoeff < maxNumCoeff {
+		var tzVLC *vlcTable
+		if nC == -1 {
+			tzVLC = chromaDCTotalZerosVLC[totalCoeff-1]
+		} else {
+			tzVLC = totalZerosVLC[totalCoeff-1]
+		}
+		if zerosLeft, err = tzVLC.read(r); err != nil {
+			return 0, err
+		}
+	}
+	if totalCoeff+zerosLeft > maxNumCoeff {
+		return 0, errors.New("total_zeros out of range")
+	}
+	var runs [16]int
+	for i := 0; i < totalCoeff-1; i++ {
+		if zerosLeft > 0 {
+			run, err := runBeforeVLC[min(zerosLeft, 7)-1].read(r)
+			if err != nil {
+				return 0, err
+			}
+			if run > zerosLeft {
+				return 0, errors.New("run_before out of range")
+			}
+			runs[i] = run
+		}
+		zerosLeft -= runs[i]
+	}
+	runs[totalCoeff-1] = zerosLeft
+
+	pos := -1
+	for i := totalCoeff - 1; i >= 0; i-- {
+		pos += runs[i] + 1
+		coeff[pos] = levels[i]
+	}
+	return totalCoeff, nil
+}
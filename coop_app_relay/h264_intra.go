@@ -0,0 +1,569 @@
+package main
+
+import "fmt"
+
+// levelScale4x4 returns LevelScale4x4(m, i, j) for raster position pos,
+// given a scaling list in zig-zag order.
+func levelScale4x4(list *[16]int32, m, pos int) int32 {
+	var weight int32
+	for k, z := range zigzag4x4 {
+		if z == pos {
+			weight = list[k]
+			break
+		}
+	}
+	row, col := pos/4, pos%4
+	class := 2
+	if row%2 == 0 && col%2 == 0 {
+		class = 0
+	} else if row%2 == 1 && col%2 == 1 {
+		class = 1
+	}
+	return weight * normAdjust4x4[m][class]
+}
+
+// dequant4x4 scales a block of coefficient levels in place (8.5.12.1).
+// When skipDC is set, c[0] already holds a transformed DC value.
+func dequant4x4(c *[16]int32, list *[16]int32, qp int, skipDC bool) {
+	for i := range c {
+		if c[i] == 0 || (i == 0 && skipDC) {
+			continue
+		}
+		ls := levelScale4x4(list, qp%6, i)
+		if qp >= 24 {
+			c[i] = (c[i] * ls) << uint(qp/6-4)
+		} else {
+			c[i] = (c[i]*ls + (1 << uint(3-qp/6))) >> uint(4-qp/6)
+		}
+	}
+}
+
+// idct4x4 applies the 4x4 inverse transform (8.5.12.2) and returns the
+// residual samples in raster order.
+func idct4x4(c *[16]int32) [16]int32 {
+	var tmp, out [16]int32
+	for i := 0; i < 4; i++ {
+		d0, d1, d2, d3 := c[i*4], c[i*4+1], c[i*4+2], c[i*4+3]
+		e0, e1 := d0+d2, d0-d2
+		e2, e3 := (d1>>1)-d3, d1+(d3>>1)
+		tmp[i*4], tmp[i*4+1], tmp[i*4+2], tmp[i*4+3] = e0+e3, e1+e2, e1-e2, e0-e3
+	}
+	for j := 0; j < 4; j++ {
+		f0, f1, f2, f3 := tmp[j], tmp[4+j], tmp[8+j], tmp[12+j]
+		g0, g1 := f0+f2, f0-f2
+		g2, g3 := (f1>>1)-f3, f1+(f3>>1)
+		out[j], out[4+j], out[8+j], out[12+j] = (g0+g3+32)>>6, (g1+g2+32)>>6, (g1-g2+32)>>6, (g0-g3+32)>>6
+	}
+	return out
+}
+
+func allZero(c *[16]int32) bool {
+	for _, v := range c {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// addBlock writes pred + residual for a 4x4 block at (x, y) in plane.
+func addBlock(plane []uint8, stride, x, y int, pred *[16]int32, c *[16]int32) {
+	var res [16]int32
+	if !allZero(c) {
+		res = idct4x4(c)
+	}
+	for j := 0; j < 4; j++ {
+		for i := 0; i < 4; i++ {
+			plane[(y+j)*stride+x+i] = clip1(pred[j*4+i] + res[j*4+i])
+		}
+	}
+}
+
+func (p *picture) reconstructIntra4x4(mbx, mby, qp int, res *mbResidual) error {
+	list := &p.pps.scalingLists4x4[0]
+	for blk := 0; blk < 16; blk++ {
+		x, y := mbx*16+blk4x4X[blk], mby*16+blk4x4Y[blk]
+		mode := int(p.predModes[p.grid4x4(x/4, y/4)])
+		pred, err := p.predictIntra4x4(mode, x, y)
+		if err != nil {
+			return err
+		}
+		c := res.luma[blk]
+		dequant4x4(&c, list, qp, false)
+		addBlock(p.y, p.strideY, x, y, &pred, &c)
+		p.blkDone[blk] = true
+	}
+	return nil
+}
+
+// predictIntra4x4 implements the Intra_4x4 prediction modes (8.3.1.2).
+func (p *picture) predictIntra4x4(mode, x, y int) ([16]int32, error) {
+	var pred [16]int32
+	topAvail := p.sampleAvailable(x, y-1)
+	leftAvail := p.sampleAvailable(x-1, y)
+	cornerAvail := p.sampleAvailable(x-1, y-1)
+	var top [8]int32
+	var left [4]int32
+	var corner int32
+	if topAvail {
+		for i := 0; i < 4; i++ {
+			top[i] = int32(p.y[(y-1)*p.strideY+x+i])
+		}
+		if p.sampleAvailable(x+4, y-1) {
+			for i := 4; i < 8; i++ {
+				top[i] = int32(p.y[(y-1)*p.strideY+x+i])
+			}
+		} else {
+			for i := 4; i < 8; i++ {
+				top[i] = top[3]
+			}
+		}
+	}
+	if leftAvail {
+		for j := 0; j < 4; j++ {
+			left[j] = int32(p.y[(y+j)*p.strideY+x-1])
+		}
+	}
+	if cornerAvail {
+		corner = int32(p.y[(y-1)*p.strideY+x-1])
+	}
+	// s(i, j) is p[i, j] from the spec with i, j >= -1.
+	s := func(i, j int) int32 {
+		switch {
+		case j == -1 && i == -1:
+			return corner
+		case j == -1:
+			return top[i]
+		default:
+			return left[j]
+		}
+	}
+	need := func(ok bool) error {
+		if !ok {
+			return fmt.Errorf("intra 4x4 mode %d references unavailable samples", mode)
+		}
+		return nil
+	}
+
+	switch mode {
+	case 0: // Vertical
+		if err := need(topAvail); err != nil {
+			return pred, err
+		}
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				pred[j*4+i] = top[i]
+			}
+		}
+	case 1: // Horizontal
+		if err := need(leftAvail); err != nil {
+			return pred, err
+		}
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				pred[j*4+i] = left[j]
+			}
+		}
+	case 2: // DC
+		var dc int32 = 128
+		switch {
+		case topAvail && leftAvail:
+			dc = (top[0] + top[1] + top[2] + top[3] + left[0] + left[1] + left[2] + left[3] + 4) >> 3
+		case leftAvail:
+			dc = (left[0] + left[1] + left[2] + left[3] + 2) >> 2
+		case topAvail:
+			dc = (top[0] + top[1] + top[2] + top[3] + 2) >> 2
+		}
+		for i := range pred {
+			pred[i] = dc
+		}
+	case 3: // Diagonal_Down_Left
+		if err := need(topAvail); err != nil {
+			return pred, err
+		}
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				if i == 3 && j == 3 {
+					pred[j*4+i] = (top[6] + 3*top[7] + 2) >> 2
+				} else {
+					pred[j*4+i] = (top[i+j] + 2*top[i+j+1] + top[i+j+2] + 2) >> 2
+				}
+			}
+		}
+	case 4: // Diagonal_Down_Right
+		if err := need(topAvail && leftAvail && cornerAvail); err != nil {
+			return pred, err
+		}
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				switch {
+				case i > j:
+					pred[j*4+i] = (s(i-j-2, -1) + 2*s(i-j-1, -1) + s(i-j, -1) + 2) >> 2
+				case i < j:
+					pred[j*4+i] = (s(-1, j-i-2) + 2*s(-1, j-i-1) + s(-1, j-i) + 2) >> 2
+				default:
+					pred[j*4+i] = (s(0, -1) + 2*s(-1, -1) + s(-1, 0) + 2) >> 2
+				}
+			}
+		}
+	case 5: // Vertical_Right
+		if err := need(topAvail && leftAvail && cornerAvail); err != nil {
+			return pred, err
+		}
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				z := 2*i - j
+				switch {
+				case z >= 0 && z%2 == 0:
+					pred[j*4+i] = (s(i-(j>>1)-1, -1) + s(i-(j>>1), -1) + 1) >> 1
+				case z >= 0:
+					pred[j*4+i] = (s(i-(j>>1)-2, -1) + 2*s(i-(j>>1)-1, -1) + s(i-(j>>1), -1) + 2) >> 2
+				case z == -1:
+					pred[j*4+i] = (s(-1, 0) + 2*s(-1, -1) + s(0, -1) + 2) >> 2
+				default:
+					pred[j*4+i] = (s(-1, j-1) + 2*s(-1, j-2) + s(-1, j-3) + 2) >> 2
+				}
+			}
+		}
+	case 6: // Horizontal_Down
+		if err := need(topAvail && leftAvail && cornerAvail); err != nil {
+			return pred, err
+		}
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				z := 2*j - i
+				switch {
+				case z >= 0 && z%2 == 0:
+					pred[j*4+i] = (s(-1, j-(i>>1)-1) + s(-1, j-(i>>1)) + 1) >> 1
+				case z >= 0:
+					pred[j*4+i] = (s(-1, j-(i>>1)-2) + 2*s(-1, j-(i>>1)-1) + s(-1, j-(i>>1)) + 2) >> 2
+				case z == -1:
+					pred[j*4+i] = (s(-1, 0) + 2*s(-1, -1) + s(0, -1) + 2) >> 2
+				default:
+					pred[j*4+i] = (s(i-1, -1) + 2*s(i-2, -1) + s(i-3, -1) + 2) >> 2
+				}
+			}
+		}
+	case 7: // Vertical_Left
+		if err := need(topAvail); err != nil {
+			return pred, err
+		}
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				k := i + (j >> 1)
+				if j%2 == 0 {
+					pred[j*4+i] = (top[k] + top[k+1] + 1) >> 1
+				} else {
+					pred[j*4+i] = (top[k] + 2*top[k+1] + top[k+2] + 2) >> 2
+				}
+			}
+		}
+	case 8: // Horizontal_Up
+		if err := need(leftAvail); err != nil {
+			return pred, err
+		}
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				z := i + 2*j
+				k := j + (i >> 1)
+				switch {
+				case z > 5:
+					pred[j*4+i] = left[3]
+				case z == 5:
+					pred[j*4+i] = (left[2] + 3*left[3] + 2) >> 2
+				case z%2 == 0:
+					pred[j*4+i] = (left[k] + left[k+1] + 1) >> 1
+				default:
+					pred[j*4+i] = (left[k] + 2*left[k+1] + left[k+2] + 2) >> 2
+				}
+			}
+		}
+	default:
+		return pred, fmt.Errorf("invalid intra 4x4 mode %d", mode)
+	}
+	return pred, nil
+}
+
+func (p *picture) reconstructIntra16x16(mbx, mby, mode, qp int, res *mbResidual) error {
+	x0, y0 := mbx*16, mby*16
+	topAvail := p.mbAvailable(x0, y0-1)
+	leftAvail := p.mbAvailable(x0-1, y0)
+	cornerAvail := p.mbAvailable(x0-1, y0-1)
+	var top, left [16]int32
+	var corner int32
+	if topAvail {
+		for i := range top {
+			top[i] = int32(p.y[(y0-1)*p.strideY+x0+i])
+		}
+	}
+	if leftAvail {
+		for j := range left {
+			left[j] = int32(p.y[(y0+j)*p.strideY+x0-1])
+		}
+	}
+	if cornerAvail {
+		corner = int32(p.y[(y0-1)*p.strideY+x0-1])
+	}
+
+	var pred [256]int32
+	switch mode {
+	case 0: // Vertical
+		if !topAvail {
+			return fmt.Errorf("intra 16x16 vertical without top samples")
+		}
+		for j := 0; j < 16; j++ {
+			for i := 0; i < 16; i++ {
+				pred[j*16+i] = top[i]
+			}
+		}
+	case 1: // Horizontal
+		if !leftAvail {
+			return fmt.Errorf("intra 16x16 horizontal without left samples")
+		}
+		for j := 0; j < 16; j++ {
+			for i := 0; i < 16; i++ {
+				pred[j*16+i] = left[j]
+			}
+		}
+	case 2: // DC
+		var sumT, sumL int32
+		for i := 0; i < 16; i++ {
+			sumT += top[i]
+			sumL += left[i]
+		}
+		var dc int32 = 128
+		switch {
+		case topAvail && leftAvail:
+			dc = (sumT + sumL + 16) >> 5
+		case leftAvail:
+			dc = (sumL + 8) >> 4
+		case topAvail:
+			dc = (sumT + 8) >> 4
+		}
+		for i := range pred {
+			pred[i] = dc
+		}
+	case 3: // Plane
+		if !topAvail || !leftAvail || !cornerAvail {
+			return fmt.Errorf("intra 16x16 plane without neighbouring samples")
+		}
+		at := func(i int) int32 {
+			if i < 0 {
+				return corner
+			}
+			return top[i]
+		}
+		al := func(j int) int32 {
+			if j < 0 {
+				return corner
+			}
+			return left[j]
+		}
+		var h, v int32
+		for k := 0; k < 8; k++ {
+			h += int32(k+1) * (at(8+k) - at(6-k))
+			v += int32(k+1) * (al(8+k) - al(6-k))
+		}
+		a := 16 * (left[15] + top[15])
+		b := (5*h + 32) >> 6
+		c := (5*v + 32) >> 6
+		for j := 0; j < 16; j++ {
+			for i := 0; i < 16; i++ {
+				pred[j*16+i] = int32(clip1((a + b*int32(i-7) + c*int32(j-7) + 16) >> 5))
+			}
+		}
+	}
+
+	// Luma DC: inverse Hadamard then scale (8.5.10).
+	list := &p.pps.scalingLists4x4[0]
+	dc := hadamard4x4(&res.lumaDC)
+	ls := levelScale4x4(list, qp%6, 0)
+	for i := range dc {
+		if qp >= 36 {
+			dc[i] = (dc[i] * ls) << uint(qp/6-6)
+		} else {
+			dc[i] = (dc[i]*ls + (1 << uint(5-qp/6))) >> uint(6-qp/6)
+		}
+	}
+
+	for blk := 0; blk < 16; blk++ {
+		bx, by := blk4x4X[blk], blk4x4Y[blk]
+		c := res.luma[blk]
+		c[0] = dc[(by/4)*4+bx/4]
+		dequant4x4(&c, list, qp, true)
+		var bpred [16]int32
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				bpred[j*4+i] = pred[(by+j)*16+bx+i]
+			}
+		}
+		addBlock(p.y, p.strideY, x0+bx, y0+by, &bpred, &c)
+		p.blkDone[blk] = true
+	}
+	return nil
+}
+
+func hadamard4x4(c *[16]int32) [16]int32 {
+	var tmp, out [16]int32
+	for i := 0; i < 4; i++ {
+		a, b, cc, d := c[i*4], c[i*4+1], c[i*4+2], c[i*4+3]
+		tmp[i*4] = a + b + cc + d
+		tmp[i*4+1] = a + b - cc - d
+		tmp[i*4+2] = a - b - cc + d
+		tmp[i*4+3] = a - b + cc - d
+	}
+	for j := 0; j < 4; j++ {
+		a, b, cc, d := tmp[j], tmp[4+j], tmp[8+j], tmp[12+j]
+		out[j] = a + b + cc + d
+		out[4+j] = a + b - cc - d
+		out[8+j] = a - b - cc + d
+		out[12+j] = a - b + cc - d
+	}
+	return out
+}
+
+func (p *picture) reconstructChroma(mbx, mby, mode, qpY int, res *mbResidual) error {
+	x0, y0 := mbx*8, mby*8
+	topAvail := p.mbAvailable(mbx*16, mby*16-1)
+	leftAvail := p.mbAvailable(mbx*16-1, mby*16)
+	cornerAvail := p.mbAvailable(mbx*16-1, mby*16-1)
+
+	for c, plane := range [2][]uint8{p.cb, p.cr} {
+		offset := p.pps.chromaQPIndexOffset
+		if c == 1 {
+			offset = p.pps.secondChromaQPIndexOffset
+		}
+		qp := chromaQP(qpY, offset)
+		list := &p.pps.scalingLists4x4[1+c]
+
+		var top, left [8]int32
+		var corner int32
+		if topAvail {
+			for i := range top {
+				top[i] = int32(plane[(y0-1)*p.strideC+x0+i])
+			}
+		}
+		if leftAvail {
+			for j := range left {
+				left[j] = int32(plane[(y0+j)*p.strideC+x0-1])
+			}
+		}
+		if cornerAvail {
+			corner = int32(plane[(y0-1)*p.strideC+x0-1])
+		}
+
+		var pred [64]int32
+		switch mode {
+		case 0: // DC, per 4x4 chroma block
+			for blk := 0; blk < 4; blk++ {
+				xo, yo := (blk%2)*4, (blk/2)*4
+				var sumT, sumL int32
+				for k := 0; k < 4; k++ {
+					sumT += top[xo+k]
+					sumL += left[yo+k]
+				}
+				var dc int32 = 128
+				if xo > 0 && yo == 0 {
+					switch {
+					case topAvail:
+						dc = (sumT + 2) >> 2
+					case leftAvail:
+						dc = (sumL + 2) >> 2
+					}
+				} else if xo == 0 && yo > 0 {
+					switch {
+					case leftAvail:
+						dc = (sumL + 2) >> 2
+					case topAvail:
+						dc = (sumT + 2) >> 2
+					}
+				} else {
+					switch {
+					case topAvail && leftAvail:
+						dc = (sumT + sumL + 4) >> 3
+					case leftAvail:
+						dc = (sumL + 2) >> 2
+					case topAvail:
+						dc = (sumT + 2) >> 2
+					}
+				}
+				for j := 0; j < 4; j++ {
+					for i := 0; i < 4; i++ {
+						pred[(yo+j)*8+xo+i] = dc
+					}
+				}
+			}
+		case 1: // Horizontal
+			if !leftAvail {
+				return fmt.Errorf("chroma horizontal prediction without left samples")
+			}
+			for j := 0; j < 8; j++ {
+				for i := 0; i < 8; i++ {
+					pred[j*8+i] = left[j]
+				}
+			}
+		case 2: // Vertical
+			if !topAvail {
+				return fmt.Errorf("chroma vertical prediction without top samples")
+			}
+			for j := 0; j < 8; j++ {
+				for i := 0; i < 8; i++ {
+					pred[j*8+i] = top[i]
+				}
+			}
+		case 3: // Plane
+			if !topAvail || !leftAvail || !cornerAvail {
+				return fmt.Errorf("chroma plane prediction without neighbouring samples")
+			}
+			at := func(i int) int32 {
+				if i < 0 {
+					return corner
+				}
+				return top[i]
+			}
+			al := func(j int) int32 {
+				if j < 0 {
+					return corner
+				}
+				return left[j]
+			}
+			var h, v int32
+			for k := 0; k < 4; k++ {
+				h += int32(k+1) * (at(4+k) - at(2-k))
+				v += int32(k+1) * (al(4+k) - al(2-k))
+			}
+			a := 16 * (left[7] + top[7])
+			b := (34*h + 32) >> 6
+			cc := (34*v + 32) >> 6
+			for j := 0; j < 8; j++ {
+				for i := 0; i < 8; i++ {
+					pred[j*8+i] = int32(clip1((a + b*int32(i-3) + cc*int32(j-3) + 16) >> 5))
+				}
+			}
+		}
+
+		// Chroma DC: 2x2 transform then scale (8.5.11.2).
+		d := res.chromaDC[c]
+		f := [4]int32{
+			d[0] + d[1] + d[2] + d[3],
+			d[0] - d[1] + d[2] - d[3],
+			d[0] + d[1] - d[2] - d[3],
+			d[0] - d[1] - d[2] + d[3],
+		}
+		ls := levelScale4x4(list, qp%6, 0)
+		for blk := 0; blk < 4; blk++ {
+			xo, yo := (blk%2)*4, (blk/2)*4
+			coeffs := res.chromaAC[c][blk]
+			coeffs[0] = ((f[blk] * ls) << uint(qp/6)) >> 5
+			dequant4x4(&coeffs, list, qp, true)
+			var bpred [16]int32
+			for j := 0; j < 4; j++ {
+				for i := 0; i < 4; i++ {
+					bpred[j*4+i] = pred[(yo+j)*8+xo+i]
+				}
+			}
+			addBlock(plane, p.strideC, x0+xo, y0+yo, &bpred, &coeffs)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import "fmt"
+
+// vlcTable decodes a prefix code by reading one bit at a time and looking up
+// (length, code) pairs. Frame decoding happens once per capture, so clarity
+// wins over a multi-level lookup table here.
+type vlcTable struct {
+	maxLen int
+	codes  map[uint32]int // key: len<<16 | code
+}
+
+func newVLCTable(lens, bits []uint8, values []int) *vlcTable {
+	t := &vlcTable{codes: make(map[uint32]int)}
+	for i, l := range lens {
+		if l == 0 {
+			continue
+		}
+		t.codes[uint32(l)<<16|uint32(bits[i])] = values[i]
+		if int(l) > t.maxLen {
+			t.maxLen = int(l)
+		}
+	}
+	return t
+}
+
+func (t *vlcTable) read(r *bitReader) (int, error) {
+	var code uint32
+	for l := 1; l <= t.maxLen; l++ {
+		b, err := r.u1()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | b
+		if v, ok := t.codes[uint32(l)<<16|code]; ok {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("h264: invalid VLC code")
+}
+
+// coeff_token (Table 9-5), indexed [total_coeff*4 + trailing_ones] for the
+// nC ranges 0..1, 2..3, 4..7 and 8+.
+var coeffTokenLen = [4][4 * 17]uint8{
+	{
+		1, 0, 0, 0,
+		6, 2, 0, 0, 8, 6, 3, 0, 9, 8, 7, 5, 10, 9, 8, 6,
+		11, 10, 9, 7, 13, 11, 10, 8, 13, 13, 11, 9, 13, 13, 13, 10,
+		14, 14, 13, 11, 14, 14, 14, 13, 15, 15, 14, 14, 15, 15, 15, 14,
+		16, 15, 15, 15, 16, 16, 16, 15, 16, 16, 16, 16, 16, 16, 16, 16,
+	},
+	{
+		2, 0, 0, 0,
+		6, 2, 0, 0, 6, 5, 3, 0, 7, 6, 6, 4, 8, 6, 6, 4,
+		8, 7, 7, 5, 9, 8, 8, 6, 11, 9, 9, 6, 11, 11, 11, 7,
+		12, 11, 11, 9, 12, 12, 12, 11, 12, 12, 12, 11, 13, 13, 13, 12,
+		13, 13, 13, 13, 13, 14, 13, 13, 14, 14, 14, 13, 14, 14, 14, 14,
+	},
+	{
+		4, 0, 0, 0,
+		6, 4, 0, 0, 6, 5, 4, 0, 6, 5, 5, 4, 7, 5, 5, 4,
+		7, 5, 5, 4, 7, 6, 6, 4, 7, 6, 6, 4, 8, 7, 7, 5,
+		8, 8, 7, 6, 9, 8, 8, 7, 9, 9, 8, 8, 9, 9, 9, 8,
+		10, 9, 9, 9, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10,
+	},
+	{
+		6, 0, 0, 0,
+		6, 6, 0, 0, 6, 6, 6, 0, 6, 6, 6, 6, 6, 6, 6, 6,
+		6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6,
+		6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6,
+		6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6,
+	},
+}
+
+var coeffTokenBits = [4][4 * 17]uint8{
+	{
+		1, 0, 0, 0,
+		5, 1, 0, 0, 7, 4, 1, 0, 7, 6, 5, 3, 7, 6, 5, 3,
+		7, 6, 5, 4, 15, 6, 5, 4, 11, 14, 5, 4, 8, 10, 13, 4,
+		15, 14, 9, 4, 11, 10, 13, 12, 15, 14, 9, 12, 11, 10, 13, 8,
+		15, 1, 9, 12, 11, 14, 13, 8, 7, 10, 9, 12, 4, 6, 5, 8,
+	},
+	{
+		3, 0, 0, 0,
+		11, 2, 0, 0, 7, 7, 3, 0, 7, 10, 9, 5, 7, 6, 5, 4,
+		4, 6, 5, 6, 7, 6, 5, 8, 15, 6, 5, 4, 11, 14, 13, 4,
+		15, 10, 9, 4, 11, 14, 13, 12, 8, 10, 9, 8, 15, 14, 13, 12,
+		11, 10, 9, 12, 7, 11, 6, 8, 9, 8, 10, 1, 7, 6, 5, 4,
+	},
+	{
+		15, 0, 0, 0,
+		15, 14, 0, 0, 11, 15, 13, 0, 8, 12, 14, 12, 15, 10, 11, 11,
+		11, 8, 9, 10, 9, 14, 13, 9, 8, 10, 9, 8, 15, 14, 13, 13,
+		11, 14, 10, 12, 15, 10, 13, 12, 11, 14, 9, 12, 8, 10, 13, 8,
+		13, 7, 9, 12, 9, 12, 11, 10, 5, 8, 7, 6, 1, 4, 3, 2,
+	},
+	{
+		3, 0, 0, 0,
+		0, 1, 0, 0, 4, 5, 6, 0, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+		32, 33, 34, 35, 36, 37, 38, 39, 40, 41, 42, 43, 44, 45, 46, 47,
+		48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58, 59, 60, 61, 62, 63,
+	},
+}
+
+// coeff_token for 4:2:0 chroma DC (nC == -1).
+var chromaDCCoeffTokenLen = [4 * 5]uint8{
+	2, 0, 0, 0,
+	6, 1, 0, 0,
+	6, 6, 3, 0,
+	6, 7, 7, 6,
+	6, 8, 8, 7,
+}
+
+var chromaDCCoeffTokenBits = [4 * 5]uint8{
+	1, 0, 0, 0,
+	7, 1, 0, 0,
+	4, 6, 1, 0,
+	3, 3, 2, 5,
+	2, 3, 2, 0,
+}
+
+// total_zeros for 4x4 blocks (Tables 9-7, 9-8), indexed [total_coeff-1][total_zeros].
+var totalZerosLen = [15][16]uint8{
+	{1, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 9},
+	{3, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 6, 6, 6, 6},
+	{4, 3, 3, 3, 4, 4, 3, 3, 4, 5, 5, 6, 5, 6},
+	{5, 3, 4, 4, 3, 3, 3, 4, 3, 4, 5, 5, 5},
+	{4, 4, 4, 3, 3, 3, 3, 3, 4, 5, 4, 5},
+	{6, 5, 3, 3, 3, 3, 3, 3, 4, 3, 6},
+	{6, 5, 3, 3, 3, 2, 3, 4, 3, 6},
+	{6, 4, 5, 3, 2, 2, 3, 3, 6},
+	{6, 6, 4, 2, 2, 3, 2, 5},
+	{5, 5, 3, 2, 2, 2, 4},
+	{4, 4, 3, 3, 1, 3},
+	{4, 4, 2, 1, 3},
+	{3, 3, 1, 2},
+	{2, 2, 1},
+	{1, 1},
+}
+
+var totalZerosBits = [15][16]uint8{
+	{1, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 1},
+	{7, 6, 5, 4, 3, 5, 4, 3, 2, 3, 2, 3, 2, 1, 0},
+	{5, 7, 6, 5, 4, 3, 4, 3, 2, 3, 2, 1, 1, 0},
+	{3, 7, 5, 4, 6, 5, 4, 3, 3, 2, 2, 1, 0},
+	{5, 4, 3, 7, 6, 5, 4, 3, 2, 1, 1, 0},
+	{1, 1, 7, 6, 5, 4, 3, 2, 1, 1, 0},
+	{1, 1, 5, 4, 3, 3, 2, 1, 1, 0},
+	{1, 1, 1, 3, 3, 2, 2, 1, 0},
+	{1, 0, 1, 3, 2, 1, 1, 1},
+	{1, 0, 1, 3, 2, 1, 1},
+	{0, 1, 1, 2, 1, 3},
+	{0, 1, 1, 1, 1},
+	{0, 1, 1, 1},
+	{0, 1, 1},
+	{0, 1},
+}
+
+// total_zeros for 4:2:0 chroma DC (Table 9-9a), indexed [total_coeff-1][total_zeros].
+var chromaDCTotalZerosLen = [3][4]uint8{
+	{1, 2, 3, 3},
+	{1, 2, 2},
+	{1, 1},
+}
+
+var chromaDCTotalZerosBits = [3][4]uint8{
+	{1, 1, 1, 0},
+	{1, 1, 0},
+	{1, 0},
+}
+
+// run_before (Table 9-10), indexed [min(zerosLeft,7)-1][run_before].
+var runBeforeLen = [7][16]uint8{
+	{1, 1},
+	{1, 2, 2},
+	{2, 2, 2, 2},
+	{2, 2, 2, 3, 3},
+	{2, 2, 3, 3, 3, 3},
+	{2, 3, 3, 3, 3, 3, 3},
+	{3, 3, 3, 3, 3, 3, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+}
+
+var runBeforeBits = [7][16]uint8{
+	{1, 0},
+	{1, 1, 0},
+	{3, 2, 1, 0},
+	{3, 2, 1, 1, 0},
+	{3, 2, 3, 2, 1, 0},
+	{3, 0, 1, 3, 2, 5, 4},
+	{7, 6, 5, 4, 3, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+}
+
+var (
+	coeffTokenVLC         [4]*vlcTable
+	chromaDCCoeffTokenVLC *vlcTable
+	totalZerosVLC         [15]*vlcTable
+	chromaDCTotalZerosVLC [3]*vlcTable
+	runBeforeVLC          [7]*vlcTable
+)
+
+func init() {
+	tokenValues := make([]int, 4*17)
+	for i := range tokenValues {
+		tokenValues[i] = i // total_coeff*4 + trailing_ones
+	}
+	for n := range coeffTokenVLC {
+		coeffTokenVLC[n] = newVLCTable(coeffTokenLen[n][:], coeffTokenBits[n][:], tokenValues)
+	}
+	chromaDCCoeffTokenVLC = newVLCTable(chromaDCCoeffTokenLen[:], chromaDCCoeffTokenBits[:], tokenValues[:4*5])
+
+	// The first total_zeros row includes the code "1" for zero zeros, so unused
+	// trailing entries stay at length 0 and are skipped by newVLCTable.
+	indexValues := make([]int, 16)
+	for i := range indexValues {
+		indexValues[i] = i
+	}
+	for i := range totalZerosVLC {
+		totalZerosVLC[i] = newVLCTable(totalZerosLen[i][:], totalZerosBits[i][:], indexValues)
+	}
+	for i := range chromaDCTotalZerosVLC {
+		chromaDCTotalZerosVLC[i] = newVLCTable(chromaDCTotalZerosLen[i][:], chromaDCTotalZerosBits[i][:], indexValues[:4])
+	}
+	for i := range runBeforeVLC {
+		runBeforeVLC[i] = newVLCTable(runBeforeLen[i][:], runBeforeBits[i][:], indexValues)
+	}
+}
+
+// Intra coded_block_pattern mapping for me(v) (Table 9-4).
+var intraCBPFromCodeNum = [48]int{
+	47, 31, 15, 0, 23, 27, 29, 30, 7, 11, 13, 14, 39, 43, 45, 46,
+	16, 3, 5, 10, 12, 19, 21, 26, 28, 35, 37, 42, 44, 1, 2, 4,
+	8, 17, 18, 20, 24, 6, 9, 22, 25, 32, 33, 34, 36, 40, 38, 41,
+}
+
+// Intra coded_block_pattern mapping for monochrome streams.
+var intraCBPFromCodeNumGray = [16]int{15, 0, 7, 11, 13, 14, 3, 5, 10, 12, 1, 2, 4, 8, 6, 9}
+
+// zigzag4x4 maps scan position to raster index within a 4x4 block.
+var zigzag4x4 = [16]int{0, 1, 4, 8, 5, 2, 3, 6, 9, 12, 13, 10, 7, 11, 14, 15}
+
+// Position of each luma4x4BlkIdx within the macroblock.
+var (
+	blk4x4X = [16]int{0, 4, 0, 4, 8, 12, 8, 12, 0, 4, 0, 4, 8, 12, 8, 12}
+	blk4x4Y = [16]int{0, 0, 4, 4, 0, 0, 4, 4, 8, 8, 12, 12, 8, 8, 12, 12}
+)
+
+// blk4x4Index is the inverse of blk4x4X/blk4x4Y, indexed [y/4][x/4].
+var blk4x4Index = [4][4]int{
+	{0, 1, 4, 5},
+	{2, 3, 6, 7},
+	{8, 9, 12, 13},
+	{10, 11, 14, 15},
+}
+
+// normAdjust4x4 values v (8-315), indexed [qP%6][class].
+var normAdjust4x4 = [6][3]int32{
+	{10, 16, 13},
+	{11, 18, 14},
+	{13, 20, 16},
+	{14, 23, 18},
+	{16, 25, 20},
+	{18, 29, 23},
+}
+
+// chromaQPTable maps qPI (30..51) to QPC (Table 8-15); below 30 QPC == qPI.
+var chromaQPTable = [22]int{29, 30, 31, 32, 32, 33, 34, 34, 35, 35, 36, 36, 37, 37, 37, 38, 38, 38, 39, 39, 39, 39}
+
+func chromaQP(qpY, offset int) int {
+	qpi := clip3(0, 51, qpY+offset)
+	if qpi < 30 {
+		return qpi
+	}
+	return chromaQPTable[qpi-30]
+}
+
+// Deblocking thresholds (Tables 8-16, 8-17), indexed by indexA / indexB.
+var deblockAlpha = [52]int{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	4, 4, 5, 6, 7, 8, 9, 10, 12, 13, 15, 17, 20, 22, 25, 28,
+	32, 36, 40, 45, 50, 56, 63, 71, 80, 90, 101, 113, 127, 144, 162, 182,
+	203, 226, 255, 255,
+}
+
+var deblockBeta = [52]int{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 6, 6, 7, 7, 8, 8,
+	9, 9, 10, 10, 11, 11, 12, 12, 13, 13, 14, 14, 15, 15, 16, 16,
+	17, 17, 18, 18,
+}
+
+// deblockTC0 is tC0 for bS 1..3, indexed [indexA][bS-1].
+var deblockTC0 = [52][3]int{
+	{0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0},
+	{0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0}, {0, 0, 0},
+	{0, 0, 0}, {0, 0, 1}, {0, 0, 1}, {0, 0, 1}, {0, 0, 1}, {0, 1, 1}, {0, 1, 1}, {1, 1, 1},
+	{1, 1, 1}, {1, 1, 1}, {1, 1, 1}, {1, 1, 2}, {1, 1, 2}, {1, 1, 2}, {1, 1, 2}, {1, 2, 3},
+	{1, 2, 3}, {2, 2, 3}, {2, 2, 4}, {2, 3, 4}, {2, 3, 4}, {3, 3, 5}, {3, 4, 6}, {3, 4, 6},
+	{4, 5, 7}, {4, 5, 8}, {4, 6, 9}, {5, 7, 10}, {6, 8, 11}, {6, 8, 13}, {7, 10, 14}, {8, 11, 16},
+	{9, 12, 18}, {10, 13, 20}, {11, 15, 23}, {13, 17, 25},
+}
+
+func clip3(lo, hi, v int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func clip1(v int32) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
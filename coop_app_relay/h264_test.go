@@ -0,0 +1,419 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// bitWriter builds RBSPs for the parser tests.
+type bitWriter struct {
+	buf  []byte
+	nbit int
+}
+
+func (w *bitWriter) bit(b int) {
+	if w.nbit%8 == 0 {
+		w.buf = append(w.buf, 0)
+	}
+	if b != 0 {
+		w.buf[len(w.buf)-1] |= 0x80 >> uint(w.nbit%8)
+	}
+	w.nbit++
+}
+
+func (w *bitWriter) bits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.bit(int(v>>uint(i)) & 1)
+	}
+}
+
+func (w *bitWriter) flag(b bool) {
+	if b {
+		w.bit(1)
+	} else {
+		w.bit(0)
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	x := uint64(v) + 1
+	n := 0
+	for t := x; t > 1; t >>= 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(x, n+1)
+}
+
+func (w *bitWriter) se(v int) {
+	if v > 0 {
+		w.ue(uint32(2*v - 1))
+	} else {
+		w.ue(uint32(-2 * v))
+	}
+}
+
+func (w *bitWriter) align() {
+	for w.nbit%8 != 0 {
+		w.bit(0)
+	}
+}
+
+// nal adds the rbsp_trailing_bits and wraps the RBSP in a NAL unit with
+// emulation prevention bytes.
+func (w *bitWriter) nal(hdr byte) []byte {
+	w.bit(1)
+	w.align()
+	out := []byte{hdr}
+	zeros := 0
+	for _, b := range w.buf {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// testSPS describes an SPS to build; the zero value plus a size is a
+// Baseline 4:2:0 progressive stream.
+type testSPS struct {
+	profile             uint32
+	widthMbs, heightMbs uint32
+	interlaced          bool
+	crop                *[4]uint32
+}
+
+func (s testSPS) nal() []byte {
+	var w bitWriter
+	profile := s.profile
+	if profile == 0 {
+		profile = 66
+	}
+	w.bits(uint64(profile), 8)
+	w.bits(0x001e, 16) // constraint flags, level 3.0
+	w.ue(0)            // seq_parameter_set_id
+	if highProfileIdcs[profile] {
+		w.ue(1)  // chroma_format_idc
+		w.ue(0)  // bit_depth_luma_minus8
+		w.ue(0)  // bit_depth_chroma_minus8
+		w.bit(0) // qpprime_y_zero_transform_bypass_flag
+		w.bit(0) // seq_scaling_matrix_present_flag
+	}
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(2) // pic_order_cnt_type
+	w.ue(1) // max_num_ref_frames
+	w.bit(0)
+	w.ue(s.widthMbs - 1)
+	w.ue(s.heightMbs - 1)
+	w.flag(!s.interlaced)
+	if s.interlaced {
+		w.bit(0) // mb_adaptive_frame_field_flag
+	}
+	w.bit(1) // direct_8x8_inference_flag
+	w.flag(s.crop != nil)
+	if s.crop != nil {
+		for _, c := range s.crop {
+			w.ue(c)
+		}
+	}
+	w.bit(0) // vui_parameters_present_flag
+	return w.nal(0x67)
+}
+
+// testPPS describes a PPS referencing SPS 0.
+type testPPS struct {
+	cabac        bool
+	sliceGroups  uint32
+	transform8x8 bool
+}
+
+func (p testPPS) nal() []byte {
+	var w bitWriter
+	w.ue(0) // pic_parameter_set_id
+	w.ue(0) // seq_parameter_set_id
+	w.flag(p.cabac)
+	w.bit(0) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(max(p.sliceGroups, 1) - 1)
+	w.ue(0)
+	w.ue(0)
+	w.bits(0, 3)
+	w.se(0)  // pic_init_qp_minus26
+	w.se(0)  // pic_init_qs_minus26
+	w.se(0)  // chroma_qp_index_offset
+	w.bit(1) // deblocking_filter_control_present_flag
+	w.bit(0)
+	w.bit(0)
+	if p.transform8x8 {
+		w.bit(1)
+		w.bit(0) // pic_scaling_matrix_present_flag
+		w.se(0)  // second_chroma_qp_index_offset
+	}
+	return w.nal(0x68)
+}
+
+func sliceHeaderBits(w *bitWriter, sliceType, disableDeblock uint32) {
+	w.ue(0) // first_mb_in_slice
+	w.ue(sliceType)
+	w.ue(0)      // pic_parameter_set_id
+	w.bits(0, 4) // frame_num
+	w.ue(0)      // idr_pic_id
+	w.bits(0, 2) // dec_ref_pic_marking
+	w.se(0)      // slice_qp_delta
+	w.ue(disableDeblock)
+	if disableDeblock != 1 {
+		w.se(0)
+		w.se(0)
+	}
+}
+
+// testPicture is a 2x2 macroblock IDR picture: a PCM macroblock, then
+// Intra16x16 horizontal, vertical and DC predictions from it.
+func testPicture(disableDeblock uint32) ([]byte, [256]byte) {
+	var w bitWriter
+	sliceHeaderBits(&w, 7, disableDeblock)
+	var pcm [256]byte
+	for i := range pcm {
+		pcm[i] = byte((i*37 + i/16*11) % 251)
+	}
+	w.ue(25) // I_PCM
+	w.align()
+	for _, b := range pcm {
+		w.bits(uint64(b), 8)
+	}
+	for i := 0; i < 64; i++ {
+		w.bits(90, 8)
+	}
+	for i := 0; i < 64; i++ {
+		w.bits(200, 8)
+	}
+	for _, mode := range []uint32{1, 0, 2} {
+		w.ue(1 + mode) // I_16x16_<mode>_0_0
+		w.ue(0)        // intra_chroma_pred_mode
+		w.se(0)        // mb_qp_delta
+		switch mode {
+		case 2:
+			w.bit(1) // Intra16x16DCLevel, nC 0: no coefficients
+		default:
+			w.bits(0b000011, 6) // Intra16x16DCLevel, nC 1: no coefficients
+		}
+	}
+	return w.nal(0x65), pcm
+}
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		name       string
+		nal        []byte
+		w, h       int
+		cropRight  int
+		cropBottom int
+		err        string
+	}{
+		{name: "baseline", nal: testSPS{widthMbs: 120, heightMbs: 68}.nal(), w: 120, h: 68},
+		{name: "high", nal: testSPS{profile: 100, widthMbs: 80, heightMbs: 45}.nal(), w: 80, h: 45},
+		{name: "cropped 1080p", nal: testSPS{widthMbs: 120, heightMbs: 68, crop: &[4]uint32{0, 0, 0, 4}}.nal(), w: 120, h: 68, cropBottom: 8},
+		{name: "interlaced", nal: testSPS{widthMbs: 45, heightMbs: 18, interlaced: true}.nal(), w: 45, h: 36},
+		{name: "8192 wide", nal: testSPS{widthMbs: 512, heightMbs: 270}.nal(), w: 512, h: 270},
+		{name: "too wide", nal: testSPS{widthMbs: 513, heightMbs: 16}.nal(), err: "exceeds the level limit"},
+		{name: "too many macroblocks", nal: testSPS{widthMbs: 512, heightMbs: 512}.nal(), err: "exceeds the level limit"},
+		{name: "huge", nal: testSPS{widthMbs: 100000, heightMbs: 100000}.nal(), err: "exceeds the level limit"},
+		{name: "interlaced too tall", nal: testSPS{widthMbs: 16, heightMbs: 300, interlaced: true}.nal(), err: "exceeds the level limit"},
+		{name: "crop past width", nal: testSPS{widthMbs: 2, heightMbs: 2, crop: &[4]uint32{8, 8, 0, 0}}.nal(), err: "cropping exceeds"},
+		{name: "crop overflow", nal: testSPS{widthMbs: 2, heightMbs: 2, crop: &[4]uint32{0, 0, 1 << 31, 1 << 31}}.nal(), err: "cropping exceeds"},
+		{name: "truncated", nal: testSPS{widthMbs: 2, heightMbs: 2}.nal()[:4], err: "unexpected end"},
+		{name: "header only", nal: []byte{0x67}, err: "unexpected end"},
+		{name: "bad exp-golomb", nal: []byte{0x67, 66, 0, 0x1e, 0, 0, 0, 0, 0}, err: "exp-golomb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sps, err := parseSPS(tt.nal)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseSPS error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sps.widthMbs != tt.w || sps.heightMbs != tt.h {
+				t.Errorf("size = %dx%d MBs, want %dx%d", sps.widthMbs, sps.heightMbs, tt.w, tt.h)
+			}
+			if sps.cropRight != tt.cropRight || sps.cropBottom != tt.cropBottom {
+				t.Errorf("crop right/bottom = %d/%d, want %d/%d", sps.cropRight, sps.cropBottom, tt.cropRight, tt.cropBottom)
+			}
+		})
+	}
+}
+
+func TestParsePPS(t *testing.T) {
+	spss := map[uint32]*seqParameterSet{}
+	sps, err := parseSPS(testSPS{profile: 100, widthMbs: 2, heightMbs: 2}.nal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spss[0] = sps
+
+	tests := []struct {
+		name        string
+		nal         []byte
+		spss        map[uint32]*seqParameterSet
+		cabac       bool
+		unsupported bool
+		err         string
+	}{
+		{name: "cavlc", nal: testPPS{}.nal(), spss: spss},
+		{name: "cabac", nal: testPPS{cabac: true}.nal(), spss: spss, cabac: true},
+		{name: "high", nal: testPPS{cabac: true, transform8x8: true}.nal(), spss: spss, cabac: true},
+		{name: "slice groups", nal: testPPS{sliceGroups: 2}.nal(), spss: spss, unsupported: true, err: "slice groups"},
+		{name: "unknown SPS", nal: testPPS{}.nal(), spss: map[uint32]*seqParameterSet{}, err: "unknown SPS 0"},
+		{name: "truncated", nal: testPPS{}.nal()[:2], spss: spss, err: "unexpected end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pps, err := parsePPS(tt.nal, tt.spss)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parsePPS error = %v, want %q", err, tt.err)
+				}
+				if errors.Is(err, errUnsupportedStream) != tt.unsupported {
+					t.Errorf("errors.Is(%v, errUnsupportedStream) = %v", err, !tt.unsupported)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pps.entropyCodingMode != tt.cabac || pps.picInitQP != 26 || !pps.deblockingControlPresent {
+				t.Errorf("pps = %+v", pps)
+			}
+		})
+	}
+}
+
+func TestParseSliceHeader(t *testing.T) {
+	dec := newH264Decoder()
+	for _, ps := range [][]byte{testSPS{widthMbs: 2, heightMbs: 2}.nal(), testPPS{}.nal()} {
+		if err := dec.addParameterSet(ps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	slice := func(f func(w *bitWriter)) []byte {
+		var w bitWriter
+		f(&w)
+		return w.nal(0x65)
+	}
+
+	tests := []struct {
+		name  string
+		nal   []byte
+		intra bool
+		err   string
+	}{
+		{name: "I slice", nal: slice(func(w *bitWriter) { sliceHeaderBits(w, 7, 1) }), intra: true},
+		{name: "deblocked I slice", nal: slice(func(w *bitWriter) { sliceHeaderBits(w, 2, 0) }), intra: true},
+		{name: "P slice", nal: slice(func(w *bitWriter) { w.ue(0); w.ue(5); w.ue(0) })},
+		{name: "unknown PPS", nal: slice(func(w *bitWriter) { w.ue(0); w.ue(7); w.ue(3) }), err: "unknown PPS 3"},
+		{name: "truncated", nal: slice(func(w *bitWriter) { w.ue(0); w.ue(7); w.ue(0) }), err: "unexpected end"},
+		{name: "empty", nal: []byte{0x65}, err: "unexpected end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &bitReader{data: unescapeRBSP(tt.nal[1:])}
+			sh, err := parseSliceHeader(r, tt.nal[0]&0x1f, (tt.nal[0]>>5)&3, dec.sps, dec.pps)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseSliceHeader error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sh.isIntra() != tt.intra {
+				t.Errorf("isIntra = %v, want %v", sh.isIntra(), tt.intra)
+			}
+		})
+	}
+}
+
+func TestDecodeIntraPicture(t *testing.T) {
+	dec := newH264Decoder()
+	idr, pcm := testPicture(1)
+	img, err := dec.decodeIntraPicture([][]byte{testSPS{widthMbs: 2, heightMbs: 2}.nal(), testPPS{}.nal(), idr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(x, y int) byte { return img.Y[y*img.YStride+x] }
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			if got := at(x, y); got != pcm[y*16+x] {
+				t.Fatalf("PCM (%d,%d) = %d, want %d", x, y, got, pcm[y*16+x])
+			}
+			if got := at(16+x, y); got != pcm[y*16+15] {
+				t.Fatalf("horizontal (%d,%d) = %d, want %d", x, y, got, pcm[y*16+15])
+			}
+			if got := at(x, 16+y); got != pcm[15*16+x] {
+				t.Fatalf("vertical (%d,%d) = %d, want %d", x, y, got, pcm[15*16+x])
+			}
+		}
+	}
+	for i := range img.Cb {
+		if img.Cb[i] != 90 || img.Cr[i] != 200 {
+			t.Fatalf("chroma sample %d = %d,%d, want 90,200", i, img.Cb[i], img.Cr[i])
+		}
+	}
+
+	// Deblocked and cropped by one chroma unit on the right.
+	idr, _ = testPicture(0)
+	img, err = dec.decodeIntraPicture([][]byte{testSPS{widthMbs: 2, heightMbs: 2, crop: &[4]uint32{0, 1, 0, 0}}.nal(), testPPS{}.nal(), idr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Rect.Dx() != 30 || img.Rect.Dy() != 32 {
+		t.Errorf("cropped size = %v, want 30x32", img.Rect)
+	}
+}
+
+func TestDecodeIntraPictureMalformed(t *testing.T) {
+	sps, pps := testSPS{widthMbs: 2, heightMbs: 2}.nal(), testPPS{}.nal()
+	idr, _ := testPicture(0)
+	// Every truncation must fail cleanly rather than panic or succeed.
+	for n := 1; n < len(idr)-1; n++ {
+		if _, err := newH264Decoder().decodeIntraPicture([][]byte{sps, pps, idr[:n]}); err == nil {
+			t.Errorf("slice truncated to %d bytes decoded", n)
+		}
+	}
+	huge := testSPS{widthMbs: 100000, heightMbs: 100000}.nal()
+	if _, err := newH264Decoder().decodeIntraPicture([][]byte{huge, pps, idr}); err == nil {
+		t.Error("oversized SPS decoded")
+	}
+}
+
+func TestDecodeUnsupportedStream(t *testing.T) {
+	tests := []struct {
+		name string
+		sps  testSPS
+		pps  testPPS
+	}{
+		{name: "cabac", sps: testSPS{profile: 77, widthMbs: 2, heightMbs: 2}, pps: testPPS{cabac: true}},
+		{name: "interlaced", sps: testSPS{widthMbs: 2, heightMbs: 1, interlaced: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idr, _ := testPicture(1)
+			_, err := newH264Decoder().decodeIntraPicture([][]byte{tt.sps.nal(), tt.pps.nal(), idr})
+			if !errors.Is(err, errUnsupportedStream) {
+				t.Fatalf("decode error = %v, want errUnsupportedStream", err)
+			}
+		})
+	}
+}
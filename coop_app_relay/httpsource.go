@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTP camera sources come in two kinds behind the same source_url: a
+// snapshot URL that returns one JPEG per GET, and an MJPEG stream
+// (multipart/x-mixed-replace of JPEGs). Which one a URL is comes from the
+// response's Content-Type, so nothing else needs configuring. Credentials in
+// the URL are used for Basic or Digest auth when the camera asks for them.
+
+// maxSourceImageBytes bounds one JPEG read from an HTTP source.
+const maxSourceImageBytes = 20 << 20
+
+// maxSourceImagePixels bounds the frame size of a JPEG from any source. A
+// small file can declare a huge frame, so it is checked before decoding.
+const maxSourceImagePixels = 50_000_000
+
+// errImageTooLarge means a JPEG declares a frame over maxSourceImagePixels.
+var errImageTooLarge = errors.New("image frame is too large")
+
+// isHTTPSource reports whether a camera URL is an http(s) snapshot or MJPEG
+// source rather than RTSP.
+func isHTTPSource(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// httpSource fetches from one HTTP camera URL, answering its auth challenge.
+type httpSource struct {
+	client *http.Client
+	url    *url.URL // request URL without credentials
+	user   *url.Userinfo
+	auth   *rtspAuth // RTSP and HTTP share the Basic and Digest schemes
+}
+
+func newHTTPSource(rawURL string) (*httpSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("http source: invalid URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("http source: unsupported scheme %q", u.Scheme)
+	}
+	s := &httpSource{client: &http.Client{}, user: u.User}
+	stripped := *u
+	stripped.User = nil
+	s.url = &stripped
+	return s, nil
+}
+
+// get requests the source, retrying once with credentials if the camera
+// answers 401. The caller closes the body of a 200 response.
+func (s *httpSource) get(ctx context.Context) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", rtspUserAgent)
+		if s.auth != nil && s.user != nil {
+			password, _ := s.user.Password()
+			req.Header.Set("Authorization", s.auth.header(s.user.Username(), password, http.MethodGet, s.url.RequestURI()))
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("http source: %w", err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 && s.user != nil {
+			auth, err := parseRTSPAuth(resp.Header.Values("WWW-Authenticate"))
+			if err != nil {
+				return nil, fmt.Errorf("http source: %w", err)
+			}
+			s.auth = auth
+			continue
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			if s.user == nil {
+				return nil, errors.New("http source: camera requires a username and password (401)")
+			}
+			return nil, errors.New("http source: camera rejected the credentials (401)")
+		}
+		return nil, fmt.Errorf("http source: %s", resp.Status)
+	}
+}
+
+// sourceKind names what a response holds: "jpeg", "mjpeg" or an error for
+// anything else.
+func sourceKind(resp *http.Response) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil && resp.Header.Get("Content-Type") != "" {
+		return "", fmt.Errorf("http source: bad Content-Type %q", resp.Header.Get("Content-Type"))
+	}
+	switch {
+	case mediaType == "multipart/x-mixed-replace":
+		return "mjpeg", nil
+	case mediaType == "image/jpeg", mediaType == "image/jpg", mediaType == "", mediaType == "application/octet-stream":
+		// Some cameras label snapshots loosely; the JPEG decoder has the
+		// final say.
+		return "jpeg", nil
+	}
+	return "", fmt.Errorf("http source: got %s, want a JPEG snapshot or an MJPEG stream", mediaType)
+}
+
+// captureHTTP grabs up to n frames from an HTTP source within window of the
+// first. A snapshot URL is fetched again for each frame; an MJPEG stream is
+// read continuously and frames are taken at even spacing across the window.
+// Every frame decodes, unlike RTSP where only keyframes do.
+func captureHTTP(ctx context.Context, rawURL string, n int, window time.Duration) ([]image.Image, error) {
+	src, err := newHTTPSource(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := src.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	kind, err := sourceKind(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if kind == "mjpeg" {
+		defer resp.Body.Close()
+		return readMJPEG(ctx, resp, n, window)
+	}
+
+	img, err := decodeSourceJPEG(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	frames := []image.Image{img}
+	if n <= 1 {
+		return frames, nil
+	}
+	spacing := window / time.Duration(n)
+	deadline := time.Now().Add(window)
+	for len(frames) < n {
+		next := time.Now().Add(spacing)
+		if next.After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return frames, nil
+		case <-time.After(time.Until(next)):
+		}
+		resp, err := src.get(ctx)
+		if err != nil {
+			// Keep what we have; one failed fetch doesn't spoil the burst.
+			break
+		}
+		img, err := decodeSourceJPEG(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			break
+		}
+		frames = append(frames, img)
+	}
+	return frames, nil
+}
+
+// readMJPEG reads frames from an MJPEG response. The boundary is taken from
+// the first delimiter in the body rather than the Content-Type header, since
+// many cameras get the header's boundary parameter wrong (often adding or
+// dropping the leading dashes).
+func readMJPEG(ctx context.Context, resp *http.Response, n int, window time.Duration) ([]image.Image, error) {
+	br := bufio.NewReaderSize(resp.Body, 64*1024)
+	boundary, first, err := mjpegBoundary(br)
+	if err != nil {
+		return nil, err
+	}
+	parts := multipart.NewReader(io.MultiReader(bytes.NewReader(first), br), boundary)
+	var frames []image.Image
+	var deadline, nextAt time.Time
+	spacing := window / time.Duration(max(n, 1))
+	for len(frames) < n {
+		part, err := parts.NextPart()
+		if err != nil {
+			if len(frames) > 0 {
+				return frames, nil
+			}
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return nil, fmt.Errorf("mjpeg: %w", err)
+		}
+		now := time.Now()
+		if len(frames) > 0 && !now.Before(deadline) {
+			break
+		}
+		if len(frames) > 0 && now.Before(nextAt) {
+			// Skip frames between picks; the next part is read past this one.
+			continue
+		}
+		img, err := decodeSourceJPEG(part)
+		if err != nil {
+			if len(frames) > 0 {
+				continue
+			}
+			return nil, err
+		}
+		frames = append(frames, img)
+		if len(frames) == 1 {
+			deadline = now.Add(window)
+		}
+		nextAt = now.Add(spacing)
+		if !nextAt.Before(deadline) {
+			break
+		}
+	}
+	return frames, nil
+}
+
+// mjpegBoundary reads up to the first "--boundary" line of a multipart body
+// and returns the boundary and the line itself, which the multipart reader
+// still needs to see.
+func mjpegBoundary(br *bufio.Reader) (string, []byte, error) {
+	for read := 0; read < 4096; {
+		line, err := br.ReadSlice('\n')
+		read += len(line)
+		if trimmed := bytes.TrimSpace(line); bytes.HasPrefix(trimmed, []byte("--")) && len(trimmed) > 2 {
+			return string(trimmed[2:]), append([]byte(nil), line...), nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return "", nil, fmt.Errorf("mjpeg: %w", err)
+		}
+	}
+	return "", nil, errors.New("mjpeg: no multipart boundary in stream")
+}
+
+// decodeSourceJPEG decodes one JPEG from an HTTP source.
+func decodeSourceJPEG(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSourceImageBytes))
+	if err != nil {
+		return nil, fmt.Errorf("http source: reading image: %w", err)
+	}
+	img, err := decodeJPEG(data)
+	if err != nil && !errors.Is(err, errImageTooLarge) {
+		return nil, fmt.Errorf("http source: not a JPEG image: %w", err)
+	}
+	return img, err
+}
+
+// decodeJPEG decodes a JPEG from an untrusted source, refusing frames over
+// maxSourceImagePixels before allocating them.
+func decodeJPEG(data []byte) (image.Image, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxSourceImagePixels {
+		return nil, fmt.Errorf("%w: %dx%d", errImageTooLarge, cfg.Width, cfg.Height)
+	}
+	return jpeg.Decode(bytes.NewReader(data))
+}
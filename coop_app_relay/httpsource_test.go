@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// grayLevel is the colour of a testJPEG frame, give or take compression.
+func grayLevel(img image.Image) uint8 {
+	r, _, _, _ := img.At(img.Bounds().Min.X+5, img.Bounds().Min.Y+5).RGBA()
+	return uint8(r >> 8)
+}
+
+var digestParamPattern = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+// digestCamera is a snapshot camera behind RFC 2617 Digest auth, checked
+// independently of the relay's own implementation.
+type digestCamera struct {
+	t              *testing.T
+	user, password string
+	qop            bool
+
+	mu       sync.Mutex
+	requests int
+	ncs      []string
+}
+
+func (c *digestCamera) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	const realm, nonce, opaque = "Barn Cam", "dcd98b7102dd2f0e8b11d0f600bfb0c093", "5ccc069c403ebaf9f0171e9517f40e41"
+	challenge := func() {
+		h := fmt.Sprintf(`Digest realm="%s", nonce="%s", opaque="%s"`, realm, nonce, opaque)
+		if c.qop {
+			h += `, qop="auth,auth-int", algorithm=MD5`
+		}
+		// A Basic challenge first: the relay must still pick Digest.
+		w.Header().Add("WWW-Authenticate", `Basic realm="`+realm+`"`)
+		w.Header().Add("WWW-Authenticate", h)
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	scheme, params, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if scheme != "Digest" {
+		challenge()
+		return
+	}
+	p := map[string]string{}
+	for _, m := range digestParamPattern.FindAllStringSubmatch(params, -1) {
+		p[m[1]] = m[2] + m[3]
+	}
+	md5hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := md5hex(c.user + ":" + realm + ":" + c.password)
+	ha2 := md5hex(r.Method + ":" + r.URL.RequestURI())
+	want := md5hex(ha1 + ":" + nonce + ":" + ha2)
+	if c.qop {
+		if p["qop"] != "auth" || p["cnonce"] == "" {
+			c.t.Errorf("qop=%q cnonce=%q, want qop=auth and a cnonce", p["qop"], p["cnonce"])
+		}
+		want = md5hex(ha1 + ":" + nonce + ":" + p["nc"] + ":" + p["cnonce"] + ":auth:" + ha2)
+		c.ncs = append(c.ncs, p["nc"])
+	}
+	if p["username"] != c.user || p["realm"] != realm || p["nonce"] != nonce || p["uri"] != r.URL.RequestURI() || p["opaque"] != opaque || p["response"] != want {
+		challenge()
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(testJPEG(c.t, uint8(40*c.requests)))
+}
+
+func TestHTTPSourceDigest(t *testing.T) {
+	for _, qop := range []bool{false, true} {
+		t.Run(fmt.Sprintf("qop=%v", qop), func(t *testing.T) {
+			cam := &digestCamera{t: t, user: "admin", password: "p@ss:word", qop: qop}
+			srv := httptest.NewServer(cam)
+			defer srv.Close()
+			u, _ := url.Parse(srv.URL + "/cgi-bin/snapshot.cgi?channel=1")
+			u.User = url.UserPassword(cam.user, cam.password)
+
+			frames, err := captureHTTP(context.Background(), u.String(), 3, 150*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(frames) != 3 {
+				t.Fatalf("got %d frames, want 3", len(frames))
+			}
+			// One challenge, then the nonce is reused for the rest of the
+			// burst.
+			if cam.requests != 4 {
+				t.Errorf("%d requests, want a challenge and 3 authorised fetches", cam.requests)
+			}
+			if qop && strings.Join(cam.ncs, ",") != "00000001,00000002,00000003" {
+				t.Errorf("nonce counts %v, want 1 to 3", cam.ncs)
+			}
+		})
+	}
+
+	t.Run("wrong password", func(t *testing.T) {
+		cam := &digestCamera{t: t, user: "admin", password: "secret"}
+		srv := httptest.NewServer(cam)
+		defer srv.Close()
+		u, _ := url.Parse(srv.URL + "/snap.jpg")
+		u.User = url.UserPassword("admin", "guess")
+		if _, err := captureHTTP(context.Background(), u.String(), 1, 0); err == nil || !strings.Contains(err.Error(), "rejected the credentials") {
+			t.Errorf("err = %v", err)
+		}
+		if cam.requests != 2 {
+			t.Errorf("%d requests, want the challenge and one attempt", cam.requests)
+		}
+	})
+	t.Run("no credentials", func(t *testing.T) {
+		srv := httptest.NewServer(&digestCamera{t: t, user: "admin", password: "secret"})
+		defer srv.Close()
+		if _, err := captureHTTP(context.Background(), srv.URL+"/snap.jpg", 1, 0); err == nil || !strings.Contains(err.Error(), "requires a username and password") {
+			t.Errorf("err = %v", err)
+		}
+	})
+}
+
+func TestHTTPSourceBasic(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "viewer" || pass != "hunter2" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cam"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write(testJPEG(t, 90))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	u.User = url.UserPassword("viewer", "hunter2")
+	frames, err := captureHTTP(context.Background(), u.String(), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 {
+		t.Errorf("got %d frames", len(frames))
+	}
+}
+
+// mjpegPart is one part of a multipart/x-mixed-replace body.
+func mjpegPart(boundary string, jpeg []byte, withLength bool) string {
+	var b strings.Builder
+	b.WriteString("--" + boundary + "\r\nContent-Type: image/jpeg\r\n")
+	if withLength {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(jpeg))
+	}
+	b.WriteString("\r\n")
+	b.Write(jpeg)
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+func TestReadMJPEGBoundaries(t *testing.T) {
+	a, b := testJPEG(t, 30), testJPEG(t, 220)
+	tests := []struct {
+		name, contentType, body string
+		want                    uint8
+		err                     string
+	}{
+		{"boundary as declared", "multipart/x-mixed-replace; boundary=frame",
+			mjpegPart("frame", a, true) + mjpegPart("frame", b, true), 30, ""},
+		{"header boundary with the dashes", "multipart/x-mixed-replace; boundary=--myboundary",
+			mjpegPart("myboundary", a, true) + mjpegPart("myboundary", b, true), 30, ""},
+		{"header boundary missing", "multipart/x-mixed-replace",
+			mjpegPart("ipcamera", a, false) + mjpegPart("ipcamera", b, false), 30, ""},
+		{"header boundary wrong", "multipart/x-mixed-replace; boundary=other",
+			mjpegPart("BoundaryString", b, false) + mjpegPart("BoundaryString", a, false), 220, ""},
+		{"preamble before the first part", "multipart/x-mixed-replace; boundary=frame",
+			"\r\n\r\nstream starting\r\n" + mjpegPart("frame", b, true) + mjpegPart("frame", a, true), 220, ""},
+		{"LF line endings", "multipart/x-mixed-replace; boundary=frame",
+			"--frame\nContent-Type: image/jpeg\n\n" + string(a) + "\n--frame\n", 30, ""},
+		{"no boundary", "multipart/x-mixed-replace; boundary=frame",
+			strings.Repeat("not a multipart stream\r\n", 400), 0, "no multipart boundary"},
+		{"first part not a JPEG", "multipart/x-mixed-replace; boundary=frame",
+			mjpegPart("frame", []byte("<html>login</html>"), true) + mjpegPart("frame", a, true), 0, "not a JPEG"},
+		{"stream ends before a frame", "multipart/x-mixed-replace; boundary=frame",
+			"--frame\r\n", 0, "mjpeg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			frames, err := captureHTTP(context.Background(), srv.URL+"/video.mjpg", 1, time.Second)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(frames) != 1 {
+				t.Fatalf("got %d frames, want 1", len(frames))
+			}
+			if g := grayLevel(frames[0]); g < tt.want-3 || g > tt.want+3 {
+				t.Errorf("frame is %d, want the first part's %d", g, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadMJPEGBurstSpacing(t *testing.T) {
+	// Frames arrive at 0, 200, 700 and 800ms. A burst of 2 over 1s takes
+	// one at the start and the first at least 500ms later.
+	schedule := []struct {
+		at    time.Duration
+		level uint8
+	}{{0, 20}, {200 * time.Millisecond, 80}, {700 * time.Millisecond, 140}, {800 * time.Millisecond, 200}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+		start := time.Now()
+		for _, f := range schedule {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Until(start.Add(f.at))):
+			}
+			w.Write([]byte(mjpegPart("frame", testJPEG(t, f.level), true)))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	frames, err := captureHTTP(context.Background(), srv.URL, 2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []uint8
+	for _, f := range frames {
+		got = append(got, grayLevel(f))
+	}
+	if len(got) != 2 || got[0] > 23 || got[1] < 137 || got[1] > 143 {
+		t.Errorf("frame levels %v, want about [20 140]", got)
+	}
+}
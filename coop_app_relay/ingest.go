@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Push ingest
+//
+// Some cameras can't be polled reliably but can send a JPEG on motion or on a
+// timer, by FTP or HTTP POST. With --ingest-ftp-addr or --ingest-http-addr the
+// daemon accepts those images and feeds them to the camera's worker, where
+// they go through the same image settings, change detection and upload queue
+// as polled frames.
+//
+// The camera is named by its ID or label: the FTP login user, or the last
+// path segment of the HTTP upload (POST /ingest/{camera}). The legacy camera
+// answers to "default". Both servers require --ingest-password: as the FTP
+// password, or as the HTTP Basic auth password (any user name).
+//
+// A camera whose source_url is push:// is never polled, only fed by pushes;
+// any other camera may push as well.
+
+// isPushSource reports whether a camera only receives pushed images.
+func isPushSource(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme == "push"
+}
+
+// errPushSource means a push:// camera was asked for a frame.
+var errPushSource = errors.New("camera pushes its images to the relay and can't be captured on demand")
+
+var (
+	errUnknownCamera = errors.New("no such camera on this relay")
+	errNotJPEG       = errors.New("not a JPEG image")
+)
+
+// pushedFrame is one image a camera pushed, on its way to the camera's
+// worker. reply must be buffered.
+type pushedFrame struct {
+	cameraID string
+	img      image.Image
+	at       time.Time
+	reply    chan captureResult
+}
+
+// pushImage decodes a pushed JPEG and queues it for the named camera,
+// returning the outcome of processing it.
+func (d *daemon) pushImage(ctx context.Context, cameraName string, data []byte, via string) (cameraConfig, captureResult, error) {
+	d.mu.Lock()
+	cam, ok := d.config.cameraNamed(cameraName)
+	d.mu.Unlock()
+	if !ok {
+		return cam, captureResult{}, errUnknownCamera
+	}
+	img, err := decodeJPEG(data)
+	if errors.Is(err, errImageTooLarge) {
+		return cam, captureResult{}, err
+	}
+	if err != nil {
+		return cam, captureResult{}, fmt.Errorf("%w: %v", errNotJPEG, err)
+	}
+	log.Printf("[%s] Received %d-byte image by %s", cam.name(), len(data), via)
+	p := pushedFrame{cameraID: cam.ID, img: img, at: time.Now(), reply: make(chan captureResult, 1)}
+	select {
+	case d.pushRequests <- p:
+	case <-ctx.Done():
+		return cam, captureResult{}, ctx.Err()
+	}
+	select {
+	case r := <-p.reply:
+		return cam, r, r.Err
+	case <-ctx.Done():
+		return cam, captureResult{}, ctx.Err()
+	}
+}
+
+// dispatchPushed hands a pushed image to its camera's worker without
+// blocking the capture loop.
+func dispatchPushed(ctx context.Context, p pushedFrame, workers map[string]*cameraWorker) {
+	w, ok := workers[p.cameraID]
+	if !ok {
+		p.reply <- captureResult{At: p.at, Err: errUnknownCamera}
+		return
+	}
+	go func() {
+		select {
+		case w.pushed <- p:
+		case <-w.done:
+			p.reply <- captureResult{At: p.at, Err: errors.New("camera was removed")}
+		case <-ctx.Done():
+			p.reply <- captureResult{At: p.at, Err: ctx.Err()}
+		}
+	}()
+}
+
+// processPushed runs on the camera's worker. Pushed images outside the
+// camera's capture schedule are dropped.
+func (d *daemon) processPushed(ctx context.Context, cam cameraConfig, sched *schedule, changes *changeDetector, p pushedFrame) captureResult {
+	if _, active := sched.intervalAt(p.at, cam.interval()); !active {
+		log.Printf("[%s] Dropped pushed image outside capture schedule", cam.name())
+		return captureResult{At: p.at, Skipped: true}
+	}
+	return d.processFrames(ctx, cam, changes, []image.Image{p.img}, false, false, captureResult{At: p.at})
+}
+
+// ingestPasswordOK compares a pushed password with --ingest-password in
+// constant time.
+func (d *daemon) ingestPasswordOK(password string) bool {
+	return d.ingestPassword != "" && subtle.ConstantTimeCompare([]byte(password), []byte(d.ingestPassword)) == 1
+}
+
+// serveIngestHTTP accepts images at POST or PUT /ingest/{camera}, either as
+// the raw request body or as the first file of a multipart form.
+func (d *daemon) serveIngestHTTP(ctx context.Context, ln net.Listener) {
+	mux := http.NewServeMux()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if _, password, ok := r.BasicAuth(); !ok || !d.ingestPasswordOK(password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="coop relay"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		data, err := readPushedBody(w, r)
+		if err != nil {
+			status := http.StatusBadRequest
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		cam, result, err := d.pushImage(r.Context(), r.PathValue("camera"), data, "HTTP from "+r.RemoteAddr)
+		switch {
+		case errors.Is(err, errUnknownCamera):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, errNotJPEG):
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		case errors.Is(err, errImageTooLarge):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"camera_id": cam.ID,
+			"queued":    !result.Skipped,
+			"bytes":     result.Bytes,
+		})
+	}
+	mux.HandleFunc("POST /ingest/{camera}", handler)
+	mux.HandleFunc("PUT /ingest/{camera}", handler)
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second, ReadTimeout: 2 * time.Minute}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	log.Printf("Accepting pushed images on http://%s/ingest/{camera}", ln.Addr())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("HTTP ingest server stopped: %v", err)
+	}
+}
+
+// readPushedBody returns the uploaded image: the first file part of a
+// multipart form, or else the whole body.
+func readPushedBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSourceImageBytes)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return io.ReadAll(r.Body)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("form has no file")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" || strings.HasPrefix(part.Header.Get("Content-Type"), "image/") {
+			return io.ReadAll(part)
+		}
+	}
+}
+
+// listenIngest opens the ingest listeners up front so a taken port fails at
+// startup.
+func (d *daemon) listenIngest(ftpAddr, httpAddr string) error {
+	var err error
+	if ftpAddr != "" {
+		if d.ingestFTPListener, err = net.Listen("tcp", ftpAddr); err != nil {
+			return fmt.Errorf("starting FTP ingest server: %w", err)
+		}
+	}
+	if httpAddr != "" {
+		if d.ingestHTTPListener, err = net.Listen("tcp", httpAddr); err != nil {
+			return fmt.Errorf("starting HTTP ingest server: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log shipping
+//
+// The daemon keeps its log in a rotating file next to the spool directory
+// (relay.log plus a few older relay.log.N), so it survives the Electron app
+// that spawned the process. Bundles of it, gzipped with camera passwords
+// hidden, go to POST /api/relay/logs when the upload_logs command asks (the
+// last hour by default) or when errors come in a burst, so support can read
+// what happened without SSH.
+
+const (
+	logFileName = "relay.log"
+	// logFiles is how many files the log rotates through, current included.
+	logFiles = 5
+
+	defaultLogMaxMB = 20
+
+	// logTimeLayout is the date and time the log package prefixes each line
+	// with (log.LstdFlags), in local time.
+	logTimeLayout = "2006/01/02 15:04:05"
+
+	// errorBurstWindow is how far back error lines are counted; a burst
+	// ships errorBurstContext of log, at most once per errorBurstCooldown.
+	errorBurstWindow   = 5 * time.Minute
+	errorBurstContext  = 15 * time.Minute
+	errorBurstCooldown = time.Hour
+	logShipRetry       = 5 * time.Minute
+
+	defaultShipSince = time.Hour
+	maxShipSince     = 24 * time.Hour
+	// maxLogBundleBytes bounds a bundle before compression; the newest
+	// lines are kept.
+	maxLogBundleBytes = 16 << 20
+)
+
+// logDir is where the log is kept: next to the spool directory.
+func logDir(spoolDir string) string {
+	return filepath.Join(filepath.Dir(filepath.Clean(spoolDir)), "logs")
+}
+
+// rotatingLog is an io.Writer for the log package that appends to
+// relay.log, renaming it to relay.log.1 (and so on, dropping the oldest)
+// once it reaches maxBytes. It also counts error lines for burst shipping.
+type rotatingLog struct {
+	dir      string
+	maxBytes int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+
+	// burstLimit error lines within errorBurstWindow signal burst; 0
+	// disables it.
+	burstLimit int
+	errorTimes []time.Time
+	burst      chan struct{}
+}
+
+// openRotatingLog opens the log in dir. maxBytes is the budget for all of
+// its files together.
+func openRotatingLog(dir string, maxBytes int64, burstLimit int) (*rotatingLog, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating log directory: %w", err)
+	}
+	l := &rotatingLog{dir: dir, maxBytes: max(maxBytes/logFiles, 64<<10), burstLimit: burstLimit, burst: make(chan struct{}, 1)}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *rotatingLog) path(n int) string {
+	if n == 0 {
+		return filepath.Join(l.dir, logFileName)
+	}
+	return filepath.Join(l.dir, logFileName+"."+strconv.Itoa(n))
+}
+
+func (l *rotatingLog) open() error {
+	f, err := os.OpenFile(l.path(0), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil && l.size > 0 && l.size+int64(len(p)) > l.maxBytes {
+		l.rotate()
+	}
+	if l.f == nil {
+		// A failed rotation leaves no file; try again on the next line.
+		if err := l.open(); err != nil {
+			return len(p), nil
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	l.countErrors(p)
+	if err != nil {
+		// Never fail the log call; stderr still has the line.
+		return len(p), nil
+	}
+	return n, nil
+}
+
+// rotate shifts relay.log.N up by one, dropping the oldest.
+func (l *rotatingLog) rotate() {
+	l.f.Close()
+	l.f = nil
+	os.Remove(l.path(logFiles - 1))
+	for n := logFiles - 2; n >= 0; n-- {
+		os.Rename(l.path(n), l.path(n+1))
+	}
+	l.open()
+}
+
+// countErrors signals burst when enough error lines arrive close together.
+func (l *rotatingLog) countErrors(p []byte) {
+	if l.burstLimit <= 0 {
+		return
+	}
+	lower := bytes.ToLower(p)
+	if !bytes.Contains(lower, []byte("error")) && !bytes.Contains(lower, []byte("failed")) {
+		return
+	}
+	now := time.Now()
+	cutoff := now.Add(-errorBurstWindow)
+	kept := l.errorTimes[:0]
+	for _, t := range l.errorTimes {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	l.errorTimes = append(kept, now)
+	if len(l.errorTimes) >= l.burstLimit {
+		l.errorTimes = l.errorTimes[:0]
+		select {
+		case l.burst <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// logBundle is a gzipped excerpt of the log.
+type logBundle struct {
+	data     []byte
+	from, to time.Time
+	lines    int
+}
+
+// bundle gathers the lines logged since since, oldest first, with camera
+// passwords hidden. Lines without a timestamp of their own (a multi-line
+// message) go with the line before them.
+func (l *rotatingLog) bundle(since time.Time) (*logBundle, error) {
+	var lines []string
+	var size int
+	var from, to time.Time
+	include := false
+
+	l.mu.Lock()
+	for n := logFiles - 1; n >= 0; n-- {
+		info, err := os.Stat(l.path(n))
+		if err != nil || info.ModTime().Before(since) {
+			continue
+		}
+		f, err := os.Open(l.path(n))
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64<<10), 1<<20)
+		for sc.Scan() {
+			line := sc.Text()
+			if len(line) >= len(logTimeLayout) {
+				if t, err := time.ParseInLocation(logTimeLayout, line[:len(logTimeLayout)], time.Local); err == nil {
+					include = !t.Before(since)
+					if include {
+						if from.IsZero() {
+							from = t
+						}
+						to = t
+					}
+				}
+			}
+			if include {
+				lines = append(lines, line)
+				size += len(line) + 1
+			}
+		}
+		f.Close()
+	}
+	l.mu.Unlock()
+
+	if len(lines) == 0 {
+		return nil, errors.New("nothing logged in that time")
+	}
+	for size > maxLogBundleBytes && len(lines) > 1 {
+		size -= len(lines[0]) + 1
+		lines = lines[1:]
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for _, line := range lines {
+		zw.Write([]byte(redactURLsInLine(line)))
+		zw.Write([]byte{'\n'})
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return &logBundle{data: buf.Bytes(), from: from, to: to.Add(time.Second), lines: len(lines)}, nil
+}
+
+// uploadLogBundle sends a bundle to POST /api/relay/logs. reason is
+// "command" or "errors".
+func (b *backendClient) uploadLogBundle(lb *logBundle, reason string) error {
+	q := url.Values{}
+	q.Set("from", lb.from.UTC().Format(time.RFC3339))
+	q.Set("to", lb.to.UTC().Format(time.RFC3339))
+	q.Set("lines", strconv.Itoa(lb.lines))
+	q.Set("reason", reason)
+	path := "/api/relay/logs?" + q.Encode()
+	req, err := http.NewRequest(http.MethodPost, b.baseURL+path, bytes.NewReader(lb.data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	setRelayAuth(req, b.token)
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("POST /api/relay/logs: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return &backendStatusError{method: http.MethodPost, path: "/api/relay/logs", status: resp.Status, code: resp.StatusCode, body: string(body)}
+	}
+	return nil
+}
+
+// shipLogs uploads the log since since, for the upload_logs command.
+func (d *daemon) shipLogs(since time.Duration) (map[string]interface{}, error) {
+	if d.logs == nil {
+		return nil, errors.New("this relay has no log file")
+	}
+	if since <= 0 {
+		since = defaultShipSince
+	}
+	since = min(since, maxShipSince)
+	lb, err := d.logs.bundle(time.Now().Add(-since))
+	if err != nil {
+		return nil, err
+	}
+	if err := d.backend.uploadLogBundle(lb, "command"); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"from": lb.from.UTC(), "to": lb.to.UTC(), "lines": lb.lines, "bytes": len(lb.data)}, nil
+}
+
+// logShipLoop ships the recent log when errors come in a burst.
+func (d *daemon) logShipLoop(ctx context.Context) {
+	var lastShipped time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.logs.burst:
+		}
+		if time.Since(lastShipped) < errorBurstCooldown {
+			continue
+		}
+		lb, err := d.logs.bundle(time.Now().Add(-errorBurstContext))
+		if err == nil {
+			err = d.backend.uploadLogBundle(lb, "errors")
+		}
+		if err != nil {
+			log.Printf("Shipping logs after an error burst failed, retrying on the next burst: %v", err)
+			// Don't let the failure's own log line start another attempt
+			// straight away.
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(logShipRetry):
+			}
+			continue
+		}
+		lastShipped = time.Now()
+		log.Printf("Shipped %d log lines to the backend after an error burst", lb.lines)
+	}
+}
+
+// parseShipSince reads the upload_logs since argument, e.g. "30m".
+func parseShipSince(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultShipSince, nil
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid since %q, want a duration such as \"1h\"", s)
+	}
+	return d, nil
+}
+
+// redactURLsInLine hides passwords in any rtsp:// or http(s):// URL in a line.
+func redactURLsInLine(line string) string {
+	fields := strings.Fields(line)
+	for _, f := range fields {
+		f = strings.TrimPrefix(f, "source=")
+		if strings.Contains(f, "://") && strings.Contains(f, "@") {
+			line = strings.Replace(line, f, redactURL(f), 1)
+		}
+	}
+	return line
+}
@@ -1,129 +1,218 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 )
 
-func main() {
-	// 1. Define and parse CLI flags
-	relayID := flag.String("relay-id", "", "Relay ID (UUID)")
-	imagePath := flag.String("image-path", "", "Path to the .jpg image file")
-	flag.Parse()
-
-	if *relayID == "" {
-		log.Println("Error: --relay-id flag is required")
-		os.Exit(1)
-	}
-	if *imagePath == "" {
-		log.Println("Error: --image-path flag is required")
-		os.Exit(1)
-	}
-
-	log.Printf("Starting upload process for Relay ID: %s, Image: %s", *relayID, *imagePath)
-
-	// 2. Read environment variables
-	supabaseURL := os.Getenv("SUPABASE_URL")
-	supabaseServiceKey := os.Getenv("SUPABASE_SERVICE_KEY")
-	coopBackendURL := os.Getenv("COOP_BACKEND_URL")
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
 
-	if supabaseURL == "" || supabaseServiceKey == "" || coopBackendURL == "" {
-		log.Println("Error: SUPABASE_URL, SUPABASE_SERVICE_KEY, and COOP_BACKEND_URL environment variables must be set")
-		os.Exit(1)
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "version":
+			fmt.Println(version)
+			return
+		case "daemon":
+			// Before anything that a bad release could fail on.
+			if exe, err := relayExecutable(); err == nil && countProbationBoot(exe) {
+				os.Exit(restartExitCode)
+			}
+			runDaemon(os.Args[2:])
+			return
+		case "pair":
+			runPair(os.Args[2:])
+			return
+		case "discover":
+			runDiscover(os.Args[2:])
+			return
+		case "config":
+			runConfig(os.Args[2:])
+			return
+		case "doctor":
+			runDoctor(os.Args[2:])
+			return
+		}
 	}
+	runUpload(os.Args[1:])
+}
 
-	// Ensure Supabase URL does not end with a slash for proper joining later
-	supabaseURL = strings.TrimSuffix(supabaseURL, "/")
-	coopBackendURL = strings.TrimSuffix(coopBackendURL, "/")
-
-	// 3. Generate object key
-	timestamp := time.Now().UTC().Format("2006-01-02-15-04-05")
-	objectKey := fmt.Sprintf("%s/%s.jpg", *relayID, timestamp)
-	log.Printf("Generated Supabase object key: %s", objectKey)
-
-	// 4. Upload image to Supabase
-	log.Println("Reading image file...")
-	imageBytes, err := os.ReadFile(*imagePath)
+// runUpload is the original one-shot mode used by the Electron app:
+// upload a single image, read from disk or grabbed from a camera,
+// and register it with the backend.
+func runUpload(args []string) {
+	// 1. Define and parse CLI flags
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	relayID := fs.String("relay-id", "", "Relay ID (UUID, default from the state file)")
+	fs.String("state-file", defaultStatePath(), "Relay identity written by `relay pair`")
+	cameraID := fs.String("camera-id", "", "Tag the snapshot with this camera (default: the relay's legacy camera)")
+	imagePath := fs.String("image-path", "", "Path to the .jpg image file")
+	rtspURL := fs.String("rtsp-url", "", "Capture a frame from this camera (rtsp://, or an http(s):// snapshot or MJPEG URL) instead of reading --image-path")
+	spoolDir := fs.String("spool-dir", defaultUploadSpoolDir(), "Directory where frames are queued until uploaded (not the daemon's)")
+	cfg, err := parseLayered(fs, "upload", args)
 	if err != nil {
-		log.Printf("Error reading image file %s: %v", *imagePath, err)
+		log.Printf("Error: %v", err)
 		os.Exit(1)
 	}
 
-	supabaseUploadURL := fmt.Sprintf("%s/storage/v1/object/snapshots/%s", supabaseURL, objectKey)
-	log.Printf("Uploading to Supabase: %s", supabaseUploadURL)
-
-	req, err := http.NewRequest(http.MethodPut, supabaseUploadURL, bytes.NewReader(imageBytes))
-	if err != nil {
-		log.Printf("Error creating Supabase upload request: %v", err)
+	if (*imagePath == "") == (*rtspURL == "") {
+		log.Println("Error: exactly one of --image-path or --rtsp-url is required")
 		os.Exit(1)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+supabaseServiceKey)
-	req.Header.Set("Content-Type", "image/jpeg")
-	// Supabase might also require x-upsert for overwriting, though PUT usually implies it.
-	// req.Header.Set("x-upsert", "true") // Add if uploads fail for existing paths and you want to overwrite
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	// 2. Resolve the relay identity from the state file and settings.
+	// Storage uploads go through signed URLs from the backend, so the relay
+	// holds no storage credentials of its own.
+	id, err := loadIdentity(cfg)
 	if err != nil {
-		log.Printf("Error executing Supabase upload request: %v", err)
+		log.Printf("Error: %v", err)
 		os.Exit(1)
 	}
-	defer resp.Body.Close()
+	*relayID = id.RelayID
+	coopBackendURL, deviceToken := id.BackendURL, id.DeviceToken
 
-	bodyBytes, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		log.Printf("Error uploading to Supabase. Status: %s, Body: %s", resp.Status, string(bodyBytes))
-		os.Exit(1)
+	if *imagePath != "" {
+		log.Printf("Starting upload process for Relay ID: %s, Image: %s", *relayID, *imagePath)
+	} else {
+		log.Printf("Starting capture and upload for Relay ID: %s", *relayID)
 	}
-	log.Printf("Successfully uploaded image to Supabase. Status: %s", resp.Status)
 
-	// 5. Notify the backend
-	log.Println("Notifying Coop backend...")
-	notificationPayload := map[string]string{
-		"relay_id":       *relayID,
-		"image_filename": objectKey, // Send the full object key
-	}
-	payloadBytes, err := json.Marshal(notificationPayload)
+	// 3. Generate a provisional object key; the backend assigns the final one
+	capturedAt := time.Now()
+	objectKey := snapshotObjectKey(*relayID, *cameraID, capturedAt)
+	log.Printf("Generated object key: %s", objectKey)
+
+	// 4. Capture or read the image
+	var imageBytes []byte
+	var quality *frameQuality
+	// Without the config we don't know the camera's privacy mask, so
+	// nothing is uploaded rather than risk an unmasked image.
+	settings, err := oneShotImageSettings(newBackendClient(coopBackendURL, deviceToken), *relayID, *cameraID)
 	if err != nil {
-		log.Printf("Error marshalling notification payload: %v", err)
+		log.Printf("Error fetching image settings: %v", err)
 		os.Exit(1)
 	}
+	maskVersion := settings.maskVersion()
+	if *rtspURL != "" {
+		n, window := settings.burst()
+		log.Println("Capturing frame from camera...")
+		ctx, cancel := context.WithTimeout(context.Background(), captureTimeout+window)
+		frames, err := captureBurst(ctx, *rtspURL, n, window)
+		cancel()
+		if err != nil {
+			log.Printf("Error capturing frame: %v", err)
+			os.Exit(1)
+		}
+		for i, f := range frames {
+			prepared, err := settings.prepare(f)
+			if err != nil && i == 0 {
+				log.Printf("Ignoring image settings: %v", err)
+			}
+			frames[i] = prepared
+		}
+		frame := frames[0]
+		if n > 1 {
+			best, q := pickBest(frames)
+			frame, quality = best, &q
+			log.Printf("Picked best of %d frames (sharpness %.1f, exposure %.3f)", q.BurstFrames, q.Sharpness, q.Exposure)
+		}
+		imageBytes, err = encodeJPEG(frame, settings.quality())
+		if err != nil {
+			log.Printf("Error: %v", err)
+			os.Exit(1)
+		}
+	} else {
+		log.Println("Reading image file...")
+		imageBytes, err = os.ReadFile(*imagePath)
+		if err != nil {
+			log.Printf("Error reading image file %s: %v", *imagePath, err)
+			os.Exit(1)
+		}
+		// The file goes up as it is unless the camera has a mask to hide.
+		if settings.PrivacyMask.active() {
+			img, err := decodeJPEG(imageBytes)
+			if err != nil {
+				log.Printf("Error decoding %s to apply the privacy mask: %v", *imagePath, err)
+				os.Exit(1)
+			}
+			imageBytes, err = encodeJPEG(settings.PrivacyMask.apply(img), settings.quality())
+			if err != nil {
+				log.Printf("Error: %v", err)
+				os.Exit(1)
+			}
+		}
+	}
 
-	backendNotifyURL := fmt.Sprintf("%s/api/snapshots", coopBackendURL)
-	log.Printf("Sending notification to: %s", backendNotifyURL)
-
-	notifyReq, err := http.NewRequest(http.MethodPost, backendNotifyURL, bytes.NewReader(payloadBytes))
+	// Queue the frame on disk first so a failed upload is retried by the
+	// next run instead of being lost.
+	sp, err := openSpool(*spoolDir, defaultSpoolMaxBytes, defaultSpoolMaxAge)
 	if err != nil {
-		log.Printf("Error creating backend notification request: %v", err)
+		log.Printf("Error opening spool: %v", err)
 		os.Exit(1)
 	}
-	notifyReq.Header.Set("Content-Type", "application/json")
-
-	notifyResp, err := client.Do(notifyReq) // Reuse client
+	queued, err := sp.enqueue(*relayID, *cameraID, objectKey, capturedAt, imageBytes, quality, maskVersion)
 	if err != nil {
-		log.Printf("Error executing backend notification request: %v", err)
+		log.Printf("Error queueing image: %v", err)
 		os.Exit(1)
 	}
-	defer notifyResp.Body.Close()
 
-	notifyBodyBytes, _ := io.ReadAll(notifyResp.Body)
-	if notifyResp.StatusCode < 200 || notifyResp.StatusCode >= 300 {
-		log.Printf("Error notifying backend. Status: %s, Body: %s", notifyResp.Status, string(notifyBodyBytes))
-		os.Exit(1)
+	// 5. Upload queued frames, oldest first, and notify the backend for each
+	client := &http.Client{Timeout: 30 * time.Second}
+	var notifyBody []byte
+	for e := sp.head(); e != nil; e = sp.head() {
+		log.Printf("Uploading to storage: %s", e.ObjectKey)
+		key, body, _, err := deliverSpooled(sp, e, client, coopBackendURL, deviceToken)
+		if errors.Is(err, errSnapshotRefused) {
+			// Retrying can't help; drop the frame rather than let it block
+			// the queue on every run.
+			log.Printf("Dropping %s, the backend refused it: %v", e.ObjectKey, err)
+			sp.complete(e.ID)
+			if e.ID == queued.ID {
+				os.Exit(1)
+			}
+			continue
+		}
+		if err != nil {
+			sp.fail(e.ID, err, time.Now())
+			n, _ := sp.stats()
+			log.Printf("Error %v (%d frame(s) queued for the next run)", err, n)
+			os.Exit(1)
+		}
+		if e.ID == queued.ID {
+			objectKey = key
+			notifyBody = body
+		}
 	}
 
-	log.Printf("Successfully notified backend. Status: %s, Response: %s", notifyResp.Status, string(notifyBodyBytes))
-	
+	log.Printf("Successfully notified backend. Response: %s", string(notifyBody))
+
 	// Output the final image path for the React app to parse
 	fmt.Printf("UPLOADED_IMAGE_PATH:%s\n", objectKey)
 	log.Println("Process completed successfully.")
 }
+
+// oneShotImageSettings looks up the camera's image settings, privacy mask
+// included, for a one-shot capture. Without --camera-id the relay's own
+// settings apply; a camera the relay doesn't have is an error, not a frame
+// taken under no mask.
+func oneShotImageSettings(b *backendClient, relayID, cameraID string) (imageSettings, error) {
+	cfg, err := b.fetchConfig(relayID)
+	if err != nil {
+		return imageSettings{}, err
+	}
+	cam, ok := cfg.camera(cameraID)
+	if ok {
+		return cam.imageSettings, nil
+	}
+	if cameraID != legacyCameraID {
+		return imageSettings{}, fmt.Errorf("relay has no camera %q", cameraID)
+	}
+	return cfg.imageSettings, nil
+}
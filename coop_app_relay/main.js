@@ -46,11 +46,10 @@ function createWindow() {
 }
 
 
-// IPC handler to provide environment variables to the renderer process
+// IPC handler to provide environment variables to the renderer process.
+// Storage credentials stay on the backend; the uploader uses signed URLs.
 ipcMain.handle('get-env-vars', async (event) => {
   return {
-    SUPABASE_URL: process.env.SUPABASE_URL,
-    SUPABASE_SERVICE_KEY: process.env.SUPABASE_SERVICE_KEY,
     COOP_BACKEND_URL: process.env.COOP_BACKEND_URL,
   };
 });
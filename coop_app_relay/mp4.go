@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// mp4Timescale is the MP4 track timescale. It matches the H.264 RTP clock,
+// so sample durations are RTP timestamp deltas.
+const mp4Timescale = 90000
+
+// mp4Writer muxes H.264 access units into a progressive MP4 file with the
+// index (moov) ahead of the media data, so players can start streaming it
+// before the whole file has downloaded. Sample data is staged in a temp
+// file and only the per-sample index is kept in memory.
+type mp4Writer struct {
+	data    *os.File
+	written int64
+
+	sps, pps      []byte
+	width, height int
+
+	sizes     []uint32
+	durations []uint32
+	keyframes []uint32 // 1-based sample numbers
+	lastTS    uint32
+	lastDur   uint32
+}
+
+// defaultSampleDuration is used when timestamps give no better answer
+// (one frame at 30 fps).
+const defaultSampleDuration = mp4Timescale / 30
+
+func newMP4Writer(dir string) (*mp4Writer, error) {
+	f, err := os.CreateTemp(dir, ".clip-*.mdat")
+	if err != nil {
+		return nil, err
+	}
+	return &mp4Writer{data: f}, nil
+}
+
+// setParameterSet records the stream's SPS or PPS. The first of each is
+// the one written to the file.
+func (m *mp4Writer) setParameterSet(nal []byte) {
+	if len(nal) == 0 {
+		return
+	}
+	switch nal[0] & 0x1f {
+	case nalSPS:
+		if m.sps == nil {
+			sps, err := parseSPS(nal)
+			if err != nil {
+				return
+			}
+			m.sps = append([]byte(nil), nal...)
+			m.width = sps.widthMbs*16 - sps.cropLeft - sps.cropRight
+			m.height = sps.heightMbs*16 - sps.cropTop - sps.cropBottom
+		}
+	case nalPPS:
+		if m.pps == nil {
+			m.pps = append([]byte(nil), nal...)
+		}
+	}
+}
+
+// samples is how many access units have been written.
+func (m *mp4Writer) samples() int {
+	return len(m.sizes)
+}
+
+// duration is the length written so far in timescale units, counting the
+// last sample as lasting as long as the one before it.
+func (m *mp4Writer) duration() uint64 {
+	var total uint64
+	for _, d := range m.durations {
+		total += uint64(d)
+	}
+	if len(m.sizes) > len(m.durations) {
+		total += uint64(m.lastDur)
+	}
+	return total
+}
+
+// writeAccessUnit appends one access unit with RTP timestamp ts. Until the
+// first IDR picture with known parameter sets arrives it writes nothing and
+// returns false. Parameter sets and delimiters are left out of the samples
+// since they live in the avcC box.
+func (m *mp4Writer) writeAccessUnit(nals [][]byte, ts uint32) (bool, error) {
+	idr := false
+	for _, nal := range nals {
+		if len(nal) == 0 {
+			continue
+		}
+		switch nal[0] & 0x1f {
+		case nalSPS, nalPPS:
+			m.setParameterSet(nal)
+		case nalIDRSlice:
+			idr = true
+		}
+	}
+	if len(m.sizes) == 0 && (!idr || m.sps == nil || m.pps == nil) {
+		return false, nil
+	}
+
+	var size uint32
+	var hdr [4]byte
+	for _, nal := range nals {
+		if len(nal) == 0 {
+			continue
+		}
+		switch nal[0] & 0x1f {
+		case nalSPS, nalPPS, nalAUD:
+			continue
+		}
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(nal)))
+		if _, err := m.data.Write(hdr[:]); err != nil {
+			return false, err
+		}
+		if _, err := m.data.Write(nal); err != nil {
+			return false, err
+		}
+		size += 4 + uint32(len(nal))
+	}
+	if size == 0 {
+		return false, nil
+	}
+
+	if len(m.sizes) > 0 {
+		// Timestamps can go backwards with B-frames or jump after loss;
+		// reuse the last sane duration rather than corrupt the timeline.
+		dur := ts - m.lastTS
+		if int32(dur) <= 0 || dur > 10*mp4Timescale {
+			dur = m.lastDur
+		}
+		m.durations = append(m.durations, dur)
+		m.lastDur = dur
+	} else {
+		m.lastDur = defaultSampleDuration
+	}
+	m.lastTS = ts
+	m.sizes = append(m.sizes, size)
+	if idr {
+		m.keyframes = append(m.keyframes, uint32(len(m.sizes)))
+	}
+	m.written += int64(size)
+	return true, nil
+}
+
+// finish writes the MP4 to w: ftyp, moov, then the staged media data.
+func (m *mp4Writer) finish(w io.Writer) error {
+	if len(m.sizes) == 0 {
+		return errors.New("mp4: no video was recorded")
+	}
+	if m.written > 0xffffffff-8 {
+		return errors.New("mp4: clip is too large")
+	}
+	durations := append(m.durations, m.lastDur)
+	ftyp := mp4Box("ftyp", []byte("isom"), u32(0x200), []byte("isomiso2avc1mp41"))
+	// The chunk offset depends on the moov size, which doesn't depend on
+	// the offset's value, so build moov once to measure it.
+	moov := m.moov(durations, 0)
+	moov = m.moov(durations, uint32(len(ftyp)+len(moov)+8))
+	for _, b := range [][]byte{ftyp, moov, u32(uint32(m.written) + 8), []byte("mdat")} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	if _, err := m.data.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.Copy(w, m.data)
+	if err != nil {
+		return err
+	}
+	if n != m.written {
+		return fmt.Errorf("mp4: staged %d bytes of media, read back %d", m.written, n)
+	}
+	return nil
+}
+
+// close removes the staged media data.
+func (m *mp4Writer) close() {
+	m.data.Close()
+	os.Remove(m.data.Name())
+}
+
+func (m *mp4Writer) moov(durations []uint32, mdatOffset uint32) []byte {
+	var total uint32
+	for _, d := range durations {
+		total += d
+	}
+	matrix := []byte{
+		0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+	}
+
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(mp4Timescale), u32(total),
+		u32(0x00010000), u16(0x0100), make([]byte, 10), matrix, make([]byte, 24), u32(2))
+	tkhd := mp4FullBox("tkhd", 0, 3, // enabled, in movie
+		u32(0), u32(0), u32(1), u32(0), u32(total),
+		make([]byte, 8), u16(0), u16(0), u16(0), u16(0), matrix,
+		u32(uint32(m.width)<<16), u32(uint32(m.height)<<16))
+	mdhd := mp4FullBox("mdhd", 0, 0, u32(0), u32(0), u32(mp4Timescale), u32(total), u16(0x55c4), u16(0)) // "und"
+	hdlr := mp4FullBox("hdlr", 0, 0, u32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))
+	vmhd := mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, u32(1), mp4FullBox("url ", 0, 1)))
+
+	avcC := mp4Box("avcC",
+		[]byte{1, m.sps[1], m.sps[2], m.sps[3], 0xff, 0xe1}, u16(uint16(len(m.sps))), m.sps,
+		[]byte{1}, u16(uint16(len(m.pps))), m.pps)
+	compressor := make([]byte, 32)
+	avc1 := mp4Box("avc1",
+		make([]byte, 6), u16(1), // reserved, data_reference_index
+		make([]byte, 16), u16(uint16(m.width)), u16(uint16(m.height)),
+		u32(0x00480000), u32(0x00480000), u32(0), u16(1), compressor, u16(0x18), u16(0xffff),
+		avcC)
+	stsd := mp4FullBox("stsd", 0, 0, u32(1), avc1)
+
+	// stts run-length encodes the sample durations.
+	var stts []byte
+	var runs uint32
+	for i := 0; i < len(durations); {
+		j := i
+		for j < len(durations) && durations[j] == durations[i] {
+			j++
+		}
+		stts = append(stts, u32(uint32(j-i))...)
+		stts = append(stts, u32(durations[i])...)
+		runs++
+		i = j
+	}
+	stss := make([]byte, 0, 4*len(m.keyframes))
+	for _, k := range m.keyframes {
+		stss = append(stss, u32(k)...)
+	}
+	stsz := make([]byte, 0, 4*len(m.sizes))
+	for _, s := range m.sizes {
+		stsz = append(stsz, u32(s)...)
+	}
+	stbl := mp4Box("stbl",
+		stsd,
+		mp4FullBox("stts", 0, 0, u32(runs), stts),
+		mp4FullBox("stss", 0, 0, u32(uint32(len(m.keyframes))), stss),
+		mp4FullBox("stsc", 0, 0, u32(1), u32(1), u32(uint32(len(m.sizes))), u32(1)), // one chunk
+		mp4FullBox("stsz", 0, 0, u32(0), u32(uint32(len(m.sizes))), stsz),
+		mp4FullBox("stco", 0, 0, u32(1), u32(mdatOffset)))
+
+	minf := mp4Box("minf", vmhd, dinf, stbl)
+	mdia := mp4Box("mdia", mdhd, hdlr, minf)
+	trak := mp4Box("trak", tkhd, mdia)
+	return mp4Box("moov", mvhd, trak)
+}
+
+// mp4Box builds an ISO BMFF box from its type and payload parts.
+func mp4Box(typ string, parts ...[]byte) []byte {
+	size := 8
+	for _, p := range parts {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, typ...)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, parts ...[]byte) []byte {
+	header := u32(uint32(version)<<24 | flags&0xffffff)
+	return mp4Box(typ, append([][]byte{header}, parts...)...)
+}
+
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// mp4Boxes splits b into its top-level boxes' types and bodies.
+func mp4Boxes(t *testing.T, b []byte) (types []string, bodies [][]byte) {
+	t.Helper()
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("%d trailing bytes after the last box", len(b))
+		}
+		n := binary.BigEndian.Uint32(b)
+		if n < 8 || int64(n) > int64(len(b)) {
+			t.Fatalf("box %q has size %d with %d bytes left", b[4:8], n, len(b))
+		}
+		types = append(types, string(b[4:8]))
+		bodies = append(bodies, b[8:n])
+		b = b[n:]
+	}
+	return types, bodies
+}
+
+// mp4Find returns the body of the box at path, e.g. "moov", "trak".
+func mp4Find(t *testing.T, b []byte, path ...string) []byte {
+	t.Helper()
+	for _, typ := range path {
+		types, bodies := mp4Boxes(t, b)
+		found := false
+		for i := range types {
+			if types[i] == typ {
+				b, found = bodies[i], true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("no %s box in %v", typ, types)
+		}
+	}
+	return b
+}
+
+// fullBoxEntries returns the uint32 fields after a full box's version and
+// flags.
+func fullBoxEntries(b []byte) []uint32 {
+	var v []uint32
+	for i := 4; i+4 <= len(b); i += 4 {
+		v = append(v, binary.BigEndian.Uint32(b[i:]))
+	}
+	return v
+}
+
+func TestMP4Writer(t *testing.T) {
+	m, err := newMP4Writer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+
+	sps := testSPS{widthMbs: 2, heightMbs: 2, crop: &[4]uint32{0, 1, 0, 2}}.nal()
+	pps := testPPS{}.nal()
+	idr, _ := testPicture(1)
+	p := []byte{0x41, 0x9a, 0x01, 0x02}
+	aud := []byte{0x09, 0xf0}
+
+	if wrote, err := m.writeAccessUnit([][]byte{p}, 0); wrote || err != nil {
+		t.Fatalf("P slice before the first IDR: wrote = %v, err = %v", wrote, err)
+	}
+	if wrote, _ := m.writeAccessUnit([][]byte{idr}, 500); wrote {
+		t.Fatal("IDR written without parameter sets")
+	}
+	aus := []struct {
+		nals [][]byte
+		ts   uint32
+	}{
+		{[][]byte{aud, sps, pps, idr}, 1000},
+		{[][]byte{aud, p}, 4000},
+		{[][]byte{p}, 7000},
+		{[][]byte{aud, sps, pps, idr}, 13000},
+		{[][]byte{p}, 10000},                     // backwards: reuses 6000
+		{[][]byte{p}, 10000 + 20*mp4Timescale},   // jump: reuses 6000
+		{[][]byte{aud}, 10000 + 21*mp4Timescale}, // nothing to write
+	}
+	for i, au := range aus {
+		wrote, err := m.writeAccessUnit(au.nals, au.ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wrote != (i < 6) {
+			t.Errorf("access unit %d: wrote = %v", i, wrote)
+		}
+	}
+	if m.samples() != 6 || m.duration() != 30000 {
+		t.Fatalf("samples = %d, duration = %d, want 6 and 30000", m.samples(), m.duration())
+	}
+
+	var buf bytes.Buffer
+	if err := m.finish(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	types, bodies := mp4Boxes(t, data)
+	if len(types) != 3 || types[0] != "ftyp" || types[1] != "moov" || types[2] != "mdat" {
+		t.Fatalf("top-level boxes = %v, want ftyp moov mdat", types)
+	}
+	if !bytes.HasPrefix(bodies[0], []byte("isom")) {
+		t.Errorf("ftyp = %q", bodies[0])
+	}
+
+	moov := bodies[1]
+	mvhd := mp4Find(t, moov, "mvhd")
+	if ts, dur := binary.BigEndian.Uint32(mvhd[12:]), binary.BigEndian.Uint32(mvhd[16:]); ts != mp4Timescale || dur != 30000 {
+		t.Errorf("mvhd timescale/duration = %d/%d", ts, dur)
+	}
+	tkhd := mp4Find(t, moov, "trak", "tkhd")
+	if w, h := binary.BigEndian.Uint32(tkhd[76:]), binary.BigEndian.Uint32(tkhd[80:]); w != 30<<16 || h != 28<<16 {
+		t.Errorf("tkhd size = %gx%g, want the cropped 30x28", float64(w)/65536, float64(h)/65536)
+	}
+	mdhd := mp4Find(t, moov, "trak", "mdia", "mdhd")
+	if dur := binary.BigEndian.Uint32(mdhd[16:]); dur != 30000 {
+		t.Errorf("mdhd duration = %d", dur)
+	}
+	if hdlr := mp4Find(t, moov, "trak", "mdia", "hdlr"); string(hdlr[8:12]) != "vide" {
+		t.Errorf("handler = %q", hdlr[8:12])
+	}
+
+	stbl := mp4Find(t, moov, "trak", "mdia", "minf", "stbl")
+	stsd := mp4Find(t, stbl, "stsd")
+	avc1 := stsd[8:]
+	if string(avc1[4:8]) != "avc1" {
+		t.Fatalf("sample entry = %q", avc1[4:8])
+	}
+	if w, h := binary.BigEndian.Uint16(avc1[8+24:]), binary.BigEndian.Uint16(avc1[8+26:]); w != 30 || h != 28 {
+		t.Errorf("avc1 size = %dx%d", w, h)
+	}
+	avcC := mp4Find(t, avc1[8+78:binary.BigEndian.Uint32(avc1)], "avcC")
+	wantAvcC := append([]byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1}, u16(uint16(len(sps)))...)
+	wantAvcC = append(append(wantAvcC, sps...), 1)
+	wantAvcC = append(append(wantAvcC, u16(uint16(len(pps)))...), pps...)
+	if !bytes.Equal(avcC, wantAvcC) {
+		t.Errorf("avcC = %x\nwant %x", avcC, wantAvcC)
+	}
+
+	if got := fullBoxEntries(mp4Find(t, stbl, "stts")); !slices.Equal(got, []uint32{2, 2, 3000, 4, 6000}) {
+		t.Errorf("stts = %v, want 2 runs: 2x3000 4x6000", got)
+	}
+	if got := fullBoxEntries(mp4Find(t, stbl, "stss")); !slices.Equal(got, []uint32{2, 1, 4}) {
+		t.Errorf("stss = %v, want keyframes 1 and 4", got)
+	}
+	if got := fullBoxEntries(mp4Find(t, stbl, "stsc")); !slices.Equal(got, []uint32{1, 1, 6, 1}) {
+		t.Errorf("stsc = %v, want one chunk of 6 samples", got)
+	}
+	stsz := fullBoxEntries(mp4Find(t, stbl, "stsz"))
+	idrSize, pSize := uint32(4+len(idr)), uint32(4+len(p))
+	if !slices.Equal(stsz, []uint32{0, 6, idrSize, pSize, pSize, idrSize, pSize, pSize}) {
+		t.Errorf("stsz = %v", stsz)
+	}
+	stco := fullBoxEntries(mp4Find(t, stbl, "stco"))
+	mdatStart := uint32(len(data) - len(bodies[2]))
+	if len(stco) != 2 || stco[0] != 1 || stco[1] != mdatStart {
+		t.Fatalf("stco = %v, want one chunk at %d", stco, mdatStart)
+	}
+
+	// The samples are the slices alone, length-prefixed, back to back from
+	// the chunk offset; the first decodes on its own with the avcC's
+	// parameter sets.
+	off := stco[1]
+	for i, size := range stsz[2:] {
+		sample := data[off : off+size]
+		want := p
+		if i == 0 || i == 3 {
+			want = idr
+		}
+		if n := binary.BigEndian.Uint32(sample); n != uint32(len(want)) || !bytes.Equal(sample[4:], want) {
+			t.Errorf("sample %d is not the length-prefixed slice", i+1)
+		}
+		off += size
+	}
+	if off != uint32(len(data)) {
+		t.Errorf("samples end at %d, file at %d", off, len(data))
+	}
+	dec := newH264Decoder()
+	first := data[stco[1]+4 : stco[1]+idrSize]
+	if img, err := dec.decodeIntraPicture([][]byte{sps, pps, first}); err != nil || img.Rect.Dx() != 30 {
+		t.Errorf("first sample: %v", err)
+	}
+}
+
+func TestMP4WriterEmpty(t *testing.T) {
+	m, err := newMP4Writer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.setParameterSet(testSPS{widthMbs: 2, heightMbs: 2}.nal())
+	m.setParameterSet(testPPS{}.nal())
+	if err := m.finish(&bytes.Buffer{}); err == nil {
+		t.Error("finished an MP4 with no samples")
+	}
+	m.close()
+	if _, err := os.Stat(m.data.Name()); !os.IsNotExist(err) {
+		t.Errorf("staged media data left behind: %v", err)
+	}
+}
+
+func TestRecordClip(t *testing.T) {
+	idr, _ := testPicture(1)
+	stub := newStubRTSP(t, testSPS{widthMbs: 2, heightMbs: 2}.nal(), testPPS{}.nal(), idr, 45)
+
+	dir := t.TempDir()
+	c, err := recordClip(context.Background(), stub.url(), time.Second, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if c.Size != int64(len(data)) || c.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("clip size/hash = %d/%s, file is %d/%x", c.Size, c.SHA256, len(data), sum)
+	}
+	if c.Duration != time.Second || c.Width != 32 || c.Height != 32 {
+		t.Errorf("clip = %v %dx%d, want 1s 32x32", c.Duration, c.Width, c.Height)
+	}
+	// 30 fps for a second; the P slice ahead of the first keyframe is
+	// dropped.
+	stsz := fullBoxEntries(mp4Find(t, data, "moov", "trak", "mdia", "minf", "stbl", "stsz"))
+	if len(stsz) < 2 || stsz[1] != 30 {
+		t.Errorf("stsz = %v, want 30 samples", stsz)
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("recording left %d files behind", len(files)-1)
+	}
+}
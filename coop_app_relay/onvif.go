@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ONVIF discovery: WS-Discovery finds cameras on the LAN, then each camera's
+// device service is asked for its media profiles and their RTSP stream and
+// JPEG snapshot URIs.
+
+const (
+	wsDiscoveryAddr    = "239.255.255.250:3702"
+	defaultDiscoverFor = 3 * time.Second
+	onvifCallTimeout   = 5 * time.Second
+)
+
+// discoveredCamera is one ONVIF device found on the network.
+type discoveredCamera struct {
+	Endpoint     string         `json:"endpoint"` // WS-Discovery endpoint reference, stable per device
+	Address      string         `json:"address"`  // host the camera answered from
+	DeviceURL    string         `json:"device_url"`
+	Name         string         `json:"name,omitempty"`
+	Hardware     string         `json:"hardware,omitempty"`
+	Manufacturer string         `json:"manufacturer,omitempty"`
+	Model        string         `json:"model,omitempty"`
+	Firmware     string         `json:"firmware,omitempty"`
+	AuthRequired bool           `json:"auth_required,omitempty"`
+	Error        string         `json:"error,omitempty"`
+	Profiles     []onvifProfile `json:"profiles"`
+}
+
+// onvifProfile is a media profile: one encoding of the camera's video.
+type onvifProfile struct {
+	Token       string `json:"token"`
+	Name        string `json:"name"`
+	Encoding    string `json:"encoding,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	StreamURI   string `json:"stream_uri,omitempty"`
+	SnapshotURI string `json:"snapshot_uri,omitempty"`
+}
+
+// probeMatch is a WS-Discovery ProbeMatch.
+type probeMatch struct {
+	Endpoint string `xml:"EndpointReference>Address"`
+	Scopes   string `xml:"Scopes"`
+	XAddrs   string `xml:"XAddrs"`
+	from     net.Addr
+}
+
+// onvifCredentials authenticate ONVIF calls; cameras usually require them
+// for anything past device information.
+type onvifCredentials struct {
+	Username string
+	Password string
+}
+
+const probeTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<e:Envelope xmlns:e="http://www.w3.org/2003/05/soap-envelope" xmlns:w="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:dn="http://www.onvif.org/ver10/network/wsdl">
+<e:Header><w:MessageID>uuid:%s</w:MessageID><w:To e:mustUnderstand="true">urn:schemas-xmlsoap-org:ws:2005:04:discovery</w:To><w:Action e:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</w:Action></e:Header>
+<e:Body><d:Probe><d:Types>dn:NetworkVideoTransmitter</d:Types></d:Probe></e:Body>
+</e:Envelope>`
+
+// probeONVIF sends a WS-Discovery probe to addr (the multicast group, or one
+// camera's address for a unicast probe) and collects matches until ctx ends.
+func probeONVIF(ctx context.Context, addr string) ([]probeMatch, error) {
+	dst, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("ws-discovery: %w", err)
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("ws-discovery: %w", err)
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	msg := []byte(fmt.Sprintf(probeTemplate, newUUID()))
+	// UDP may drop a datagram; cameras ignore repeated message IDs.
+	for i := 0; i < 2; i++ {
+		if _, err := conn.WriteToUDP(msg, dst); err != nil {
+			return nil, fmt.Errorf("ws-discovery: %w", err)
+		}
+	}
+
+	var matches []probeMatch
+	seen := make(map[string]bool)
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return matches, nil
+			}
+			return matches, fmt.Errorf("ws-discovery: %w", err)
+		}
+		var env struct {
+			Matches []probeMatch `xml:"Body>ProbeMatches>ProbeMatch"`
+		}
+		if xml.Unmarshal(buf[:n], &env) != nil {
+			continue
+		}
+		for _, m := range env.Matches {
+			m.Endpoint = strings.TrimSpace(m.Endpoint)
+			if m.XAddrs == "" || seen[m.Endpoint] {
+				continue
+			}
+			seen[m.Endpoint] = true
+			m.from = from
+			matches = append(matches, m)
+		}
+	}
+}
+
+// discoverCameras probes for ONVIF cameras and queries each one. creds picks
+// the credentials to try for a camera's host, if any.
+func discoverCameras(ctx context.Context, probeAddr string, wait time.Duration, creds func(host string) *onvifCredentials) ([]discoveredCamera, error) {
+	probeCtx, cancel := context.WithTimeout(ctx, wait)
+	matches, err := probeONVIF(probeCtx, probeAddr)
+	cancel()
+	if err != nil && len(matches) == 0 {
+		return nil, err
+	}
+
+	cams := make([]discoveredCamera, len(matches))
+	var wg sync.WaitGroup
+	for i, m := range matches {
+		wg.Add(1)
+		go func(i int, m probeMatch) {
+			defer wg.Done()
+			cams[i] = describeCamera(ctx, m, creds)
+		}(i, m)
+	}
+	wg.Wait()
+	sort.Slice(cams, func(i, j int) bool { return cams[i].Address < cams[j].Address })
+	return cams, nil
+}
+
+func describeCamera(ctx context.Context, m probeMatch, creds func(host string) *onvifCredentials) discoveredCamera {
+	cam := discoveredCamera{Endpoint: m.Endpoint, Profiles: []onvifProfile{}}
+	if udp, ok := m.from.(*net.UDPAddr); ok {
+		cam.Address = udp.IP.String()
+	}
+	cam.DeviceURL = pickXAddr(m.XAddrs, cam.Address)
+	for _, scope := range strings.Fields(m.Scopes) {
+		if v, ok := strings.CutPrefix(scope, "onvif://www.onvif.org/name/"); ok {
+			cam.Name, _ = url.PathUnescape(v)
+		}
+		if v, ok := strings.CutPrefix(scope, "onvif://www.onvif.org/hardware/"); ok {
+			cam.Hardware, _ = url.PathUnescape(v)
+		}
+	}
+	if cam.DeviceURL == "" {
+		cam.Error = "no usable device service address"
+		return cam
+	}
+
+	c := &onvifClient{http: &http.Client{Timeout: onvifCallTimeout}}
+	if u, err := url.Parse(cam.DeviceURL); err == nil && creds != nil {
+		c.creds = creds(u.Hostname())
+	}
+	if info, err := c.deviceInformation(ctx, cam.DeviceURL); err == nil {
+		cam.Manufacturer, cam.Model, cam.Firmware = info.Manufacturer, info.Model, info.FirmwareVersion
+	}
+	profiles, err := c.mediaProfiles(ctx, cam.DeviceURL)
+	if err != nil {
+		cam.AuthRequired = errors.Is(err, errONVIFUnauthorized)
+		cam.Error = err.Error()
+		return cam
+	}
+	cam.Profiles = profiles
+	return cam
+}
+
+// pickXAddr chooses the device service URL, preferring one on the address
+// the camera answered from (cameras often list unreachable interfaces too).
+func pickXAddr(xaddrs, from string) string {
+	fields := strings.Fields(xaddrs)
+	for _, x := range fields {
+		if u, err := url.Parse(x); err == nil && u.Hostname() == from {
+			return x
+		}
+	}
+	for _, x := range fields {
+		if u, err := url.Parse(x); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			return x
+		}
+	}
+	return ""
+}
+
+var errONVIFUnauthorized = errors.New("onvif: camera requires a username and password")
+
+// onvifClient makes SOAP 1.2 calls to a camera's ONVIF services.
+type onvifClient struct {
+	http  *http.Client
+	creds *onvifCredentials
+}
+
+// call posts a SOAP body to a service and decodes the response body into out.
+func (c *onvifClient) call(ctx context.Context, serviceURL, body string, out interface{}) error {
+	var env bytes.Buffer
+	env.WriteString(`<?xml version="1.0" encoding="UTF-8"?><s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:tds="http://www.onvif.org/ver10/device/wsdl" xmlns:trt="http://www.onvif.org/ver10/media/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema">`)
+	if c.creds != nil {
+		env.WriteString(c.securityHeader(time.Now()))
+	}
+	env.WriteString("<s:Body>" + body + "</s:Body></s:Envelope>")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, serviceURL, &env)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml; charset=utf-8")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("onvif: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("onvif: %w", err)
+	}
+
+	var fault struct {
+		Code   string `xml:"Body>Fault>Code>Subcode>Value"`
+		Reason string `xml:"Body>Fault>Reason>Text"`
+	}
+	xml.Unmarshal(data, &fault)
+	if resp.StatusCode == http.StatusUnauthorized || strings.Contains(fault.Code, "NotAuthorized") {
+		return errONVIFUnauthorized
+	}
+	if fault.Code != "" || fault.Reason != "" {
+		return fmt.Errorf("onvif: %s %s", fault.Code, fault.Reason)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("onvif: %s", resp.Status)
+	}
+	if err := xml.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("onvif: decoding response: %w", err)
+	}
+	return nil
+}
+
+// securityHeader is a WS-Security UsernameToken with a password digest,
+// which every ONVIF camera accepts.
+func (c *onvifClient) securityHeader(now time.Time) string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	created := now.UTC().Format("2006-01-02T15:04:05.000Z")
+	h := sha1.New()
+	h.Write(nonce)
+	h.Write([]byte(created))
+	h.Write([]byte(c.creds.Password))
+	return `<s:Header><Security s:mustUnderstand="1" xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">` +
+		`<UsernameToken><Username>` + html.EscapeString(c.creds.Username) + `</Username>` +
+		`<Password Type="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordDigest">` + base64.StdEncoding.EncodeToString(h.Sum(nil)) + `</Password>` +
+		`<Nonce EncodingType="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary">` + base64.StdEncoding.EncodeToString(nonce) + `</Nonce>` +
+		`<Created xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd">` + created + `</Created>` +
+		`</UsernameToken></Security></s:Header>`
+}
+
+type onvifDeviceInfo struct {
+	Manufacturer    string `xml:"Body>GetDeviceInformationResponse>Manufacturer"`
+	Model           string `xml:"Body>GetDeviceInformationResponse>Model"`
+	FirmwareVersion string `xml:"Body>GetDeviceInformationResponse>FirmwareVersion"`
+}
+
+func (c *onvifClient) deviceInformation(ctx context.Context, deviceURL string) (*onvifDeviceInfo, error) {
+	var info onvifDeviceInfo
+	if err := c.call(ctx, deviceURL, `<tds:GetDeviceInformation/>`, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// mediaProfiles finds the media service and lists its profiles with their
+// stream and snapshot URIs.
+func (c *onvifClient) mediaProfiles(ctx context.Context, deviceURL string) ([]onvifProfile, error) {
+	var caps struct {
+		MediaURL string `xml:"Body>GetCapabilitiesResponse>Capabilities>Media>XAddr"`
+	}
+	if err := c.call(ctx, deviceURL, `<tds:GetCapabilities><tds:Category>Media</tds:Category></tds:GetCapabilities>`, &caps); err != nil {
+		return nil, err
+	}
+	mediaURL := strings.TrimSpace(caps.MediaURL)
+	if mediaURL == "" {
+		return nil, errors.New("onvif: camera has no media service")
+	}
+	mediaURL = sameHost(mediaURL, deviceURL)
+
+	var resp struct {
+		Profiles []struct {
+			Token    string `xml:"token,attr"`
+			Name     string `xml:"Name"`
+			Encoding string `xml:"VideoEncoderConfiguration>Encoding"`
+			Width    int    `xml:"VideoEncoderConfiguration>Resolution>Width"`
+			Height   int    `xml:"VideoEncoderConfiguration>Resolution>Height"`
+		} `xml:"Body>GetProfilesResponse>Profiles"`
+	}
+	if err := c.call(ctx, mediaURL, `<trt:GetProfiles/>`, &resp); err != nil {
+		return nil, err
+	}
+
+	profiles := make([]onvifProfile, 0, len(resp.Profiles))
+	for _, p := range resp.Profiles {
+		profile := onvifProfile{Token: p.Token, Name: p.Name, Encoding: p.Encoding, Width: p.Width, Height: p.Height}
+		token := html.EscapeString(p.Token)
+		var uri struct {
+			URI string `xml:"Body>GetStreamUriResponse>MediaUri>Uri"`
+		}
+		if c.call(ctx, mediaURL, `<trt:GetStreamUri><trt:StreamSetup><tt:Stream>RTP-Unicast</tt:Stream><tt:Transport><tt:Protocol>RTSP</tt:Protocol></tt:Transport></trt:StreamSetup><trt:ProfileToken>`+token+`</trt:ProfileToken></trt:GetStreamUri>`, &uri) == nil {
+			profile.StreamURI = sameHost(strings.TrimSpace(uri.URI), deviceURL)
+		}
+		var snap struct {
+			URI string `xml:"Body>GetSnapshotUriResponse>MediaUri>Uri"`
+		}
+		if c.call(ctx, mediaURL, `<trt:GetSnapshotUri><trt:ProfileToken>`+token+`</trt:ProfileToken></trt:GetSnapshotUri>`, &snap) == nil {
+			profile.SnapshotURI = sameHost(strings.TrimSpace(snap.URI), deviceURL)
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// sameHost rewrites a URI a camera returned to use the host we reached it
+// on. Cameras behind NAT or with several interfaces often report an address
+// the relay can't reach; the port and path are kept.
+func sameHost(uri, deviceURL string) string {
+	u, err := url.Parse(uri)
+	d, err2 := url.Parse(deviceURL)
+	if err != nil || err2 != nil || u.Host == "" || u.Hostname() == d.Hostname() {
+		return uri
+	}
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(d.Hostname(), port)
+	} else if strings.Contains(d.Hostname(), ":") {
+		u.Host = "[" + d.Hostname() + "]"
+	} else {
+		u.Host = d.Hostname()
+	}
+	return u.String()
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runPair pairs this machine as a relay without the desktop app: it requests
+// a pairing code, shows it (and a QR code) for the user to enter in the Coop
+// app, waits for the claim and stores the relay ID and device token in the
+// state file.
+func runPair(args []string) {
+	fs := flag.NewFlagSet("pair", flag.ExitOnError)
+	statePath := fs.String("state-file", defaultStatePath(), "Where the relay identity is stored")
+	backendURL := fs.String("backend-url", "", "Coop backend URL (default the previously paired backend, or "+defaultBackendURL+")")
+	poll := fs.Duration("poll", 3*time.Second, "Interval between pairing status checks")
+	timeout := fs.Duration("timeout", 30*time.Minute, "Give up if the code is not claimed within this long (0 waits forever)")
+	reset := fs.Bool("reset", false, "Pair again even if this relay is already paired")
+	if _, err := parseLayered(fs, "pair", args); err != nil {
+		log.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+
+	st, err := loadState(*statePath)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+	if st.DeviceToken != "" && !*reset {
+		log.Printf("Relay %s is already paired (%s). Use --reset to pair it again.", st.RelayID, *statePath)
+		return
+	}
+
+	base := firstNonEmpty(*backendURL, st.BackendURL, defaultBackendURL)
+	// The current token, if any, authorises re-pairing this relay.
+	b := newBackendClient(base, st.DeviceToken)
+
+	if st.PairingCode == "" || st.PairingSecret == "" || *reset || st.BackendURL != b.baseURL {
+		pc, err := b.requestPairingCode(st.RelayID)
+		if err != nil {
+			log.Printf("Error requesting pairing code: %v", err)
+			os.Exit(1)
+		}
+		// Re-pairing revokes the old token on the backend.
+		*st = relayState{
+			RelayID:       pc.RelayID,
+			BackendURL:    b.baseURL,
+			PairingCode:   pc.PairingCode,
+			PairingSecret: pc.PairingSecret,
+		}
+		if err := saveState(*statePath, st); err != nil {
+			log.Printf("Error: %v", err)
+			os.Exit(1)
+		}
+	} else {
+		log.Printf("Resuming pairing for relay %s", st.RelayID)
+	}
+	b.token = ""
+
+	fmt.Printf("\nEnter this pairing code in the Coop app:\n\n    %s\n\n", st.PairingCode)
+	if qr, err := encodeQR(st.PairingCode); err == nil {
+		fmt.Print(qr.terminal())
+		fmt.Println()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	token, err := waitForClaim(ctx, b, st, *poll)
+	if err != nil {
+		if errors.Is(err, errPairingCodeNotFound) {
+			log.Printf("Error: pairing code %s is no longer valid. Run `relay pair` again.", st.PairingCode)
+			// The code is dead; forget it so the next run asks for a new one.
+			st.PairingCode, st.PairingSecret = "", ""
+			saveState(*statePath, st)
+		} else {
+			log.Printf("Error: %v. Run `relay pair` again to resume.", err)
+		}
+		os.Exit(1)
+	}
+
+	now := time.Now().UTC()
+	st.DeviceToken = token
+	st.PairedAt = &now
+	st.PairingCode, st.PairingSecret = "", ""
+	if err := saveState(*statePath, st); err != nil {
+		log.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Paired. Relay ID: %s\n", st.RelayID)
+	log.Printf("Relay identity saved to %s", *statePath)
+}
+
+// waitForClaim polls the pairing status until the code is claimed, then
+// collects the device token.
+func waitForClaim(ctx context.Context, b *backendClient, st *relayState, poll time.Duration) (string, error) {
+	log.Printf("Waiting for code %s to be claimed...", st.PairingCode)
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	claimed := false
+	for {
+		if !claimed {
+			status, err := b.pairingStatus(st.PairingCode)
+			switch {
+			case errors.Is(err, errPairingCodeNotFound):
+				return "", err
+			case err != nil:
+				log.Printf("Pairing status check failed: %v", err)
+			case status == "claimed":
+				log.Println("Code claimed, collecting device credentials...")
+				claimed = true
+			}
+		}
+		if claimed {
+			token, err := b.collectDeviceToken(st.RelayID, st.PairingSecret)
+			if err != nil {
+				log.Printf("Collecting device token failed: %v", err)
+			} else if token != "" {
+				return token, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return "", errors.New("timed out waiting for the code to be claimed")
+			}
+			return "", errors.New("interrupted")
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+)
+
+// defaultJPEGQuality is used when the backend doesn't set jpeg_quality.
+const defaultJPEGQuality = 85
+
+// minCropSize is the smallest crop, in pixels per side, the relay will
+// produce; anything smaller is almost certainly a bad rectangle.
+const minCropSize = 16
+
+// cropRect is a region of interest as fractions of the frame.
+type cropRect struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// imageSettings is how the backend wants frames prepared before upload. Nil
+// fields leave the frame as captured.
+type imageSettings struct {
+	Crop         *cropRect `json:"crop"`
+	MaxDimension *int      `json:"max_dimension"`
+	JPEGQuality  *int      `json:"jpeg_quality"`
+	BurstFrames  *int      `json:"burst_frames"`
+	BurstSeconds *int      `json:"burst_seconds"`
+	// PrivacyMask regions are hidden before anything else looks at the
+	// frame; see privacy.go.
+	PrivacyMask *privacyMask `json:"privacy_mask"`
+}
+
+func (s imageSettings) equal(o imageSettings) bool {
+	return cropPtrEqual(s.Crop, o.Crop) && intPtrEqual(s.MaxDimension, o.MaxDimension) && intPtrEqual(s.JPEGQuality, o.JPEGQuality) &&
+		intPtrEqual(s.BurstFrames, o.BurstFrames) && intPtrEqual(s.BurstSeconds, o.BurstSeconds) && maskPtrEqual(s.PrivacyMask, o.PrivacyMask)
+}
+
+func cropPtrEqual(a, b *cropRect) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func intPtrEqual(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// quality is the JPEG quality to encode with, clamped to 1..100.
+func (s imageSettings) quality() int {
+	if s.JPEGQuality == nil || *s.JPEGQuality <= 0 {
+		return defaultJPEGQuality
+	}
+	return min(*s.JPEGQuality, 100)
+}
+
+// prepare hides the privacy mask, crops the frame to the region of interest
+// and scales it down so its longest side fits max_dimension. It never scales
+// up. If the crop doesn't fit the frame it returns the masked frame with the
+// error: the other settings may be skipped, the mask never is.
+func (s imageSettings) prepare(img image.Image) (image.Image, error) {
+	img = s.PrivacyMask.apply(img)
+	if s.Crop != nil {
+		r, err := s.Crop.pixels(img.Bounds())
+		if err != nil {
+			return img, err
+		}
+		img = subImage(img, r)
+	}
+	if s.MaxDimension != nil && *s.MaxDimension > 0 {
+		b := img.Bounds()
+		longest := max(b.Dx(), b.Dy())
+		if longest > *s.MaxDimension {
+			scale := float64(*s.MaxDimension) / float64(longest)
+			w := max(1, int(math.Round(float64(b.Dx())*scale)))
+			h := max(1, int(math.Round(float64(b.Dy())*scale)))
+			img = downscale(img, w, h)
+		}
+	}
+	return img, nil
+}
+
+// pixels maps the crop onto a frame, clamped to its bounds.
+func (c cropRect) pixels(b image.Rectangle) (image.Rectangle, error) {
+	x0 := b.Min.X + int(math.Round(c.X*float64(b.Dx())))
+	y0 := b.Min.Y + int(math.Round(c.Y*float64(b.Dy())))
+	x1 := b.Min.X + int(math.Round((c.X+c.Width)*float64(b.Dx())))
+	y1 := b.Min.Y + int(math.Round((c.Y+c.Height)*float64(b.Dy())))
+	r := image.Rect(x0, y0, x1, y1).Intersect(b)
+	if r.Dx() < minCropSize || r.Dy() < minCropSize {
+		return r, fmt.Errorf("crop %+v leaves %dx%d of a %dx%d frame", c, r.Dx(), r.Dy(), b.Dx(), b.Dy())
+	}
+	return r, nil
+}
+
+func subImage(img image.Image, r image.Rectangle) image.Image {
+	if s, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return s.SubImage(r)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			dst.Set(x-r.Min.X, y-r.Min.Y, img.At(x, y))
+		}
+	}
+	return dst
+}
+
+// downscale shrinks a frame to w x h by averaging each output pixel's source
+// area, which keeps fine detail like straw from aliasing. Frames from the
+// decoder are YCbCr and are resampled plane by plane; anything else is
+// converted first.
+func downscale(img image.Image, w, h int) *image.YCbCr {
+	src, ok := img.(*image.YCbCr)
+	if !ok {
+		src = toYCbCr(img)
+	}
+	b := src.Bounds()
+	dst := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio420)
+
+	boxAverage(b, w, h, 1, func(x, y int) uint8 { return src.Y[src.YOffset(x, y)] },
+		func(x, y int, v uint8) { dst.Y[dst.YOffset(x, y)] = v })
+	// Each chroma sample covers a 2x2 block of output pixels; it is averaged
+	// over that block's source area, read through the source's own
+	// subsampling.
+	boxAverage(b, w, h, 2, func(x, y int) uint8 { return src.Cb[src.COffset(x, y)] },
+		func(x, y int, v uint8) { dst.Cb[dst.COffset(2*x, 2*y)] = v })
+	boxAverage(b, w, h, 2, func(x, y int) uint8 { return src.Cr[src.COffset(x, y)] },
+		func(x, y int, v uint8) { dst.Cr[dst.COffset(2*x, 2*y)] = v })
+	return dst
+}
+
+// boxAverage resamples the area b of a plane to a w x h image, writing one
+// value per step x step block of output pixels.
+func boxAverage(b image.Rectangle, w, h, step int, at func(x, y int) uint8, set func(x, y int, v uint8)) {
+	for oy := 0; oy*step < h; oy++ {
+		y0 := b.Min.Y + oy*step*b.Dy()/h
+		y1 := max(b.Min.Y+min((oy+1)*step, h)*b.Dy()/h, y0+1)
+		for ox := 0; ox*step < w; ox++ {
+			x0 := b.Min.X + ox*step*b.Dx()/w
+			x1 := max(b.Min.X+min((ox+1)*step, w)*b.Dx()/w, x0+1)
+			var sum uint32
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					sum += uint32(at(x, y))
+				}
+			}
+			n := uint32((y1 - y0) * (x1 - x0))
+			set(ox, oy, uint8((sum+n/2)/n))
+		}
+	}
+}
+
+// toYCbCr copies a frame into a new 4:4:4 YCbCr image.
+func toYCbCr(img image.Image) *image.YCbCr {
+	b := img.Bounds()
+	dst := image.NewYCbCr(b, image.YCbCrSubsampleRatio444)
+	if src, ok := img.(*image.YCbCr); ok {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				i, c := dst.YOffset(x, y), src.COffset(x, y)
+				dst.Y[i], dst.Cb[i], dst.Cr[i] = src.Y[src.YOffset(x, y)], src.Cb[c], src.Cr[c]
+			}
+		}
+		return dst
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.YCbCrModel.Convert(img.At(x, y)).(color.YCbCr)
+			dst.Y[dst.YOffset(x, y)] = c.Y
+			dst.Cb[dst.COffset(x, y)] = c.Cb
+			dst.Cr[dst.COffset(x, y)] = c.Cr
+		}
+	}
+	return dst
+}
+
+func encodeJPEG(img image.Image, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, fmt.Errorf("encoding JPEG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
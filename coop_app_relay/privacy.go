@@ -0,0 +1,162 @@
+package main
+
+import (
+	"image"
+	"math"
+	"slices"
+)
+
+// privacyMask is a set of polygons to black out or blur before a frame is
+// used for anything, e.g. a neighbour's yard. Points are [x, y] fractions of
+// the full frame. The backend sets Version, a digest of the mask, and the
+// relay reports it with each snapshot taken under the mask.
+type privacyMask struct {
+	Version string         `json:"version"`
+	Mode    string         `json:"mode"` // "black" (default) or "blur"
+	Regions [][][2]float64 `json:"regions"`
+}
+
+func maskPtrEqual(a, b *privacyMask) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Version == b.Version && a.Mode == b.Mode &&
+		slices.EqualFunc(a.Regions, b.Regions, func(x, y [][2]float64) bool { return slices.Equal(x, y) })
+}
+
+// active reports whether the mask hides anything.
+func (m *privacyMask) active() bool {
+	return m != nil && len(m.Regions) > 0
+}
+
+// maskVersion is the version of the mask frames are taken under, or "" when
+// nothing is masked.
+func (s imageSettings) maskVersion() string {
+	if !s.PrivacyMask.active() {
+		return ""
+	}
+	return s.PrivacyMask.Version
+}
+
+// apply returns a copy of the frame with the mask's regions blacked out or
+// blurred. The frame itself is left alone.
+func (m *privacyMask) apply(img image.Image) image.Image {
+	if !m.active() {
+		return img
+	}
+	dst := toYCbCr(img)
+	b := dst.Bounds()
+	w, h := b.Dx(), b.Dy()
+	inside, area := m.rasterize(w, h)
+	if area.Empty() {
+		return dst
+	}
+	planes := [][]uint8{dst.Y, dst.Cb, dst.Cr}
+	if m.Mode == "blur" {
+		radius := max(8, max(w, h)/30)
+		around := area.Inset(-2 * radius).Intersect(image.Rect(0, 0, w, h))
+		for _, p := range planes {
+			blurred := boxBlur(p, w, around, radius)
+			for y := area.Min.Y; y < area.Max.Y; y++ {
+				for x := area.Min.X; x < area.Max.X; x++ {
+					if inside[y*w+x] {
+						p[y*w+x] = blurred[(y-around.Min.Y)*around.Dx()+x-around.Min.X]
+					}
+				}
+			}
+		}
+		return dst
+	}
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			if inside[y*w+x] {
+				dst.Y[y*w+x], dst.Cb[y*w+x], dst.Cr[y*w+x] = 0, 128, 128
+			}
+		}
+	}
+	return dst
+}
+
+// rasterize marks the pixels of a w x h frame whose centres fall inside any
+// region (even-odd rule), and returns the bounds of the marked pixels.
+func (m *privacyMask) rasterize(w, h int) ([]bool, image.Rectangle) {
+	inside := make([]bool, w*h)
+	var area image.Rectangle
+	var xs []float64
+	for _, region := range m.Regions {
+		if len(region) < 3 {
+			continue
+		}
+		minY, maxY := math.Inf(1), math.Inf(-1)
+		for _, p := range region {
+			minY, maxY = min(minY, p[1]*float64(h)), max(maxY, p[1]*float64(h))
+		}
+		y0 := max(0, int(math.Floor(minY)))
+		y1 := min(h, int(math.Ceil(maxY)))
+		for y := y0; y < y1; y++ {
+			cy := float64(y) + 0.5
+			xs = xs[:0]
+			for i, a := range region {
+				b := region[(i+1)%len(region)]
+				ay, by := a[1]*float64(h), b[1]*float64(h)
+				if (ay <= cy) == (by <= cy) {
+					continue
+				}
+				ax, bx := a[0]*float64(w), b[0]*float64(w)
+				xs = append(xs, ax+(cy-ay)*(bx-ax)/(by-ay))
+			}
+			slices.Sort(xs)
+			for i := 0; i+1 < len(xs); i += 2 {
+				x0 := max(0, int(math.Ceil(xs[i]-0.5)))
+				x1 := min(w, int(math.Ceil(xs[i+1]-0.5)))
+				if x0 >= x1 {
+					continue
+				}
+				for x := x0; x < x1; x++ {
+					inside[y*w+x] = true
+				}
+				area = area.Union(image.Rect(x0, y, x1, y+1))
+			}
+		}
+	}
+	return inside, area
+}
+
+// boxBlur blurs the part r of a plane with the given stride, returning the
+// result as an r.Dx() x r.Dy() buffer. Three passes of a box filter come
+// close to a Gaussian and leave nothing legible.
+func boxBlur(plane []uint8, stride int, r image.Rectangle, radius int) []uint8 {
+	w, h := r.Dx(), r.Dy()
+	buf := make([]uint8, w*h)
+	for y := 0; y < h; y++ {
+		copy(buf[y*w:(y+1)*w], plane[(r.Min.Y+y)*stride+r.Min.X:])
+	}
+	line := make([]uint8, max(w, h))
+	for pass := 0; pass < 3; pass++ {
+		for y := 0; y < h; y++ {
+			blurLine(buf[y*w:], 1, w, radius, line)
+		}
+		for x := 0; x < w; x++ {
+			blurLine(buf[x:], w, h, radius, line)
+		}
+	}
+	return buf
+}
+
+// blurLine box-filters n values spaced step apart in place, clamping at the
+// ends. line is scratch space of at least n.
+func blurLine(p []uint8, step, n, radius int, line []uint8) {
+	for i := 0; i < n; i++ {
+		line[i] = p[i*step]
+	}
+	at := func(i int) uint32 { return uint32(line[min(max(i, 0), n-1)]) }
+	var sum uint32
+	for i := -radius; i <= radius; i++ {
+		sum += at(i)
+	}
+	size := uint32(2*radius + 1)
+	for i := 0; i < n; i++ {
+		p[i*step] = uint8((sum + size/2) / size)
+		sum += at(i+radius+1) - at(i-radius)
+	}
+}
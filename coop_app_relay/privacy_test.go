@@ -0,0 +1,242 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// maskString draws rasterize's output as rows of '#' (inside) and '.'.
+func maskString(inside []bool, w int) string {
+	var sb strings.Builder
+	for i, in := range inside {
+		if i > 0 && i%w == 0 {
+			sb.WriteByte('\n')
+		}
+		if in {
+			sb.WriteByte('#')
+		} else {
+			sb.WriteByte('.')
+		}
+	}
+	return sb.String()
+}
+
+func TestPrivacyMaskRasterize(t *testing.T) {
+	tests := []struct {
+		name    string
+		regions [][][2]float64
+		w, h    int
+		want    string
+		area    image.Rectangle
+	}{
+		{
+			name:    "square",
+			regions: [][][2]float64{{{0.25, 0.25}, {0.75, 0.25}, {0.75, 0.75}, {0.25, 0.75}}},
+			w:       8, h: 8,
+			want: "........\n" +
+				"........\n" +
+				"..####..\n" +
+				"..####..\n" +
+				"..####..\n" +
+				"..####..\n" +
+				"........\n" +
+				"........",
+			area: image.Rect(2, 2, 6, 6),
+		},
+		{
+			// Pixels count when their centre is inside; centres on the
+			// diagonal are not.
+			name:    "triangle",
+			regions: [][][2]float64{{{0, 0}, {1, 0}, {0, 1}}},
+			w:       4, h: 4,
+			want: "###.\n" +
+				"##..\n" +
+				"#...\n" +
+				"....",
+			area: image.Rect(0, 0, 3, 3),
+		},
+		{
+			name:    "clipped to the frame",
+			regions: [][][2]float64{{{-1, -1}, {0.5, -1}, {0.5, 0.5}, {-1, 0.5}}},
+			w:       4, h: 4,
+			want: "##..\n" +
+				"##..\n" +
+				"....\n" +
+				"....",
+			area: image.Rect(0, 0, 2, 2),
+		},
+		{
+			name: "two regions, one degenerate",
+			regions: [][][2]float64{
+				{{0, 0}, {0.5, 0}, {0.5, 0.25}, {0, 0.25}},
+				{{0.5, 0.5}, {1, 1}},
+				{{0.75, 0.75}, {1, 0.75}, {1, 1}, {0.75, 1}},
+			},
+			w: 4, h: 4,
+			want: "##..\n" +
+				"....\n" +
+				"....\n" +
+				"...#",
+			area: image.Rect(0, 0, 4, 4),
+		},
+		{
+			// Even-odd: a polygon tracing a square and then, in reverse, a
+			// smaller one inside it leaves the inner square uncovered.
+			name: "hole",
+			regions: [][][2]float64{{
+				{0, 0}, {1, 0}, {1, 1}, {0, 1}, {0, 0},
+				{0.25, 0.25}, {0.25, 0.75}, {0.75, 0.75}, {0.75, 0.25}, {0.25, 0.25},
+			}},
+			w: 4, h: 4,
+			want: "####\n" +
+				"#..#\n" +
+				"#..#\n" +
+				"####",
+			area: image.Rect(0, 0, 4, 4),
+		},
+		{
+			name:    "thinner than a pixel",
+			regions: [][][2]float64{{{0, 0.3}, {1, 0.3}, {1, 0.35}, {0, 0.35}}},
+			w:       4, h: 4,
+			want: "....\n....\n....\n....",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &privacyMask{Regions: tt.regions}
+			inside, area := m.rasterize(tt.w, tt.h)
+			if got := maskString(inside, tt.w); got != tt.want {
+				t.Errorf("mask =\n%s\nwant\n%s", got, tt.want)
+			}
+			if area != tt.area && !(area.Empty() && tt.area.Empty()) {
+				t.Errorf("area = %v, want %v", area, tt.area)
+			}
+		})
+	}
+}
+
+// patternFrame is a w x h frame of hard-edged stripes, with a colour so the
+// chroma planes are checked too.
+func patternFrame(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{200, 120, 40, 255}
+			if (x/2)%2 == 0 {
+				c = color.RGBA{20, 40, 220, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestPrivacyMaskApplyBlack(t *testing.T) {
+	src := patternFrame(40, 30)
+	m := &privacyMask{Mode: "black", Regions: [][][2]float64{{{0.25, 0.2}, {0.75, 0.2}, {0.75, 0.8}, {0.25, 0.8}}}}
+	got, ok := m.apply(src).(*image.YCbCr)
+	if !ok {
+		t.Fatalf("apply returned %T", m.apply(src))
+	}
+	inside, _ := m.rasterize(40, 30)
+	masked := 0
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			c := got.YCbCrAt(x, y)
+			if inside[y*40+x] {
+				masked++
+				if c != (color.YCbCr{Y: 0, Cb: 128, Cr: 128}) {
+					t.Fatalf("masked pixel (%d,%d) = %v, want black", x, y, c)
+				}
+				continue
+			}
+			if want := color.YCbCrModel.Convert(src.At(x, y)).(color.YCbCr); c != want {
+				t.Fatalf("pixel (%d,%d) outside the mask = %v, want %v", x, y, c, want)
+			}
+		}
+	}
+	if masked != 20*18 {
+		t.Errorf("%d pixels masked, want 20x18", masked)
+	}
+	// The source frame is left alone.
+	if src.RGBAAt(20, 15) != (color.RGBA{20, 40, 220, 255}) {
+		t.Error("apply changed the source frame")
+	}
+}
+
+func TestPrivacyMaskApplyBlur(t *testing.T) {
+	src := patternFrame(60, 40)
+	m := &privacyMask{Mode: "blur", Regions: [][][2]float64{{{0.2, 0.2}, {0.8, 0.2}, {0.8, 0.8}, {0.2, 0.8}}}}
+	got := m.apply(src).(*image.YCbCr)
+	inside, _ := m.rasterize(60, 40)
+
+	// The stripes alternate every 2 pixels; after the blur nothing inside
+	// the mask should be left of that contrast.
+	lo, hi := uint8(255), uint8(0)
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 60; x++ {
+			c := got.YCbCrAt(x, y)
+			if !inside[y*60+x] {
+				if want := color.YCbCrModel.Convert(src.At(x, y)).(color.YCbCr); c != want {
+					t.Fatalf("pixel (%d,%d) outside the mask = %v, want %v", x, y, c, want)
+				}
+				continue
+			}
+			lo, hi = min(lo, c.Y), max(hi, c.Y)
+		}
+	}
+	a := color.YCbCrModel.Convert(color.RGBA{200, 120, 40, 255}).(color.YCbCr).Y
+	b := color.YCbCrModel.Convert(color.RGBA{20, 40, 220, 255}).(color.YCbCr).Y
+	contrast := int(max(a, b)) - int(min(a, b))
+	if int(hi)-int(lo) > contrast/10 {
+		t.Errorf("luma inside the blurred mask spans %d..%d, the stripes %d..%d", lo, hi, min(a, b), max(a, b))
+	}
+}
+
+func TestPrivacyMaskInactive(t *testing.T) {
+	src := patternFrame(8, 8)
+	for _, m := range []*privacyMask{nil, {Mode: "black"}} {
+		if got := m.apply(src); got != image.Image(src) {
+			t.Errorf("mask %+v changed the frame", m)
+		}
+		if (imageSettings{PrivacyMask: m}).maskVersion() != "" {
+			t.Errorf("mask %+v has a version", m)
+		}
+	}
+	m := &privacyMask{Version: "v1", Regions: [][][2]float64{{{0, 0}, {1, 0}, {1, 1}}}}
+	if v := (imageSettings{PrivacyMask: m}).maskVersion(); v != "v1" {
+		t.Errorf("maskVersion = %q", v)
+	}
+}
+
+func TestOneShotImageSettings(t *testing.T) {
+	status, config := http.StatusOK, `{
+		"privacy_mask": {"version": "relay", "regions": [[[0, 0], [1, 0], [1, 1]]]},
+		"cameras": [{"id": "cam1", "source_url": "rtsp://cam1/", "privacy_mask": {"version": "cam1", "regions": [[[0, 0], [1, 0], [1, 1]]]}}]
+	}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, config)
+	}))
+	defer srv.Close()
+	b := newBackendClient(srv.URL, "tok")
+
+	for cameraID, want := range map[string]string{"cam1": "cam1", "": "relay"} {
+		s, err := oneShotImageSettings(b, "relay-1", cameraID)
+		if err != nil || s.maskVersion() != want {
+			t.Errorf("camera %q: mask %q, %v; want %q", cameraID, s.maskVersion(), err, want)
+		}
+	}
+	if _, err := oneShotImageSettings(b, "relay-1", "cam2"); err == nil {
+		t.Error("settings for a camera the relay doesn't have")
+	}
+	status, config = http.StatusServiceUnavailable, `{"error":"Relay is not claimed by a coop yet."}`
+	if _, err := oneShotImageSettings(b, "relay-1", ""); err == nil {
+		t.Error("settings without a config")
+	}
+}
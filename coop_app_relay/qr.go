@@ -0,0 +1,418 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// A minimal QR code encoder, enough to show a pairing code in the terminal:
+// numeric or byte mode, error correction level M, versions 1-6.
+
+// qrVersionM holds the level-M block layout of one QR version.
+type qrVersionM struct {
+	ecPerBlock   int
+	blocks       int
+	dataPerBlock int
+	alignment    []int
+}
+
+var qrVersionsM = []qrVersionM{
+	1: {10, 1, 16, nil},
+	2: {16, 1, 28, []int{6, 18}},
+	3: {26, 1, 44, []int{6, 22}},
+	4: {18, 2, 32, []int{6, 26}},
+	5: {24, 2, 43, []int{6, 30}},
+	6: {16, 4, 27, []int{6, 34}},
+}
+
+// qrCode is a square grid of modules; true is dark.
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+var errQRTooLong = errors.New("text too long for a QR code")
+
+// encodeQR builds a QR code for text, picking the smallest version that fits
+// and the mask with the lowest penalty.
+func encodeQR(text string) (*qrCode, error) {
+	numeric := text != ""
+	for _, c := range text {
+		if c < '0' || c > '9' {
+			numeric = false
+			break
+		}
+	}
+
+	for version := 1; version < len(qrVersionsM); version++ {
+		v := qrVersionsM[version]
+		capacity := v.blocks * v.dataPerBlock * 8
+		var bits qrBits
+		if numeric {
+			bits.append(0b0001, 4)
+			bits.append(len(text), 10)
+			for i := 0; i < len(text); i += 3 {
+				chunk := text[i:min(i+3, len(text))]
+				n := 0
+				for _, c := range chunk {
+					n = n*10 + int(c-'0')
+				}
+				bits.append(n, []int{0, 4, 7, 10}[len(chunk)])
+			}
+		} else {
+			bits.append(0b0100, 4)
+			bits.append(len(text), 8)
+			for i := 0; i < len(text); i++ {
+				bits.append(int(text[i]), 8)
+			}
+		}
+		if len(bits) > capacity {
+			continue
+		}
+		bits.append(0, min(4, capacity-len(bits)))
+		bits.append(0, (8-len(bits)%8)%8)
+		data := bits.bytes()
+		for pad := byte(0xEC); len(data) < capacity/8; pad ^= 0xEC ^ 0x11 {
+			data = append(data, pad)
+		}
+
+		q := newQRCode(version)
+		q.drawCodewords(qrInterleave(data, v))
+		best, bestPenalty := 0, -1
+		for mask := 0; mask < 8; mask++ {
+			q.applyMask(mask)
+			q.drawFormatBits(mask)
+			if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+				best, bestPenalty = mask, p
+			}
+			q.applyMask(mask) // XOR again to undo
+		}
+		q.applyMask(best)
+		q.drawFormatBits(best)
+		return q, nil
+	}
+	return nil, errQRTooLong
+}
+
+type qrBits []bool
+
+func (b *qrBits) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (v>>i)&1 == 1)
+	}
+}
+
+func (b qrBits) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// qrInterleave splits data into blocks, appends each block's Reed-Solomon
+// codewords and interleaves the result.
+func qrInterleave(data []byte, v qrVersionM) []byte {
+	gen := rsGenerator(v.ecPerBlock)
+	var dataBlocks, ecBlocks [][]byte
+	for i := 0; i < v.blocks; i++ {
+		block := data[i*v.dataPerBlock : (i+1)*v.dataPerBlock]
+		dataBlocks = append(dataBlocks, block)
+		ecBlocks = append(ecBlocks, rsRemainder(block, gen))
+	}
+	var out []byte
+	for i := 0; i < v.dataPerBlock; i++ {
+		for _, b := range dataBlocks {
+			out = append(out, b[i])
+		}
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for _, b := range ecBlocks {
+			out = append(out, b[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8+x^4+x^3+x^2+1.
+func gfMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		hi := z & 0x80
+		z <<= 1
+		if hi != 0 {
+			z ^= 0x1D
+		}
+		if (y>>i)&1 == 1 {
+			z ^= x
+		}
+	}
+	return z
+}
+
+// rsGenerator returns the coefficients (highest degree first, leading 1
+// dropped) of the Reed-Solomon generator polynomial of the given degree.
+func rsGenerator(degree int) []byte {
+	gen := make([]byte, degree)
+	gen[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := 0; j < degree; j++ {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < degree {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return gen
+}
+
+func rsRemainder(data, gen []byte) []byte {
+	rem := make([]byte, len(gen))
+	for _, b := range data {
+		factor := b ^ rem[0]
+		copy(rem, rem[1:])
+		rem[len(rem)-1] = 0
+		for i, g := range gen {
+			rem[i] ^= gfMul(g, factor)
+		}
+	}
+	return rem
+}
+
+func newQRCode(version int) *qrCode {
+	size := version*4 + 17
+	q := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	q.drawFinder(3, 3)
+	q.drawFinder(size-4, 3)
+	q.drawFinder(3, size-4)
+
+	align := qrVersionsM[version].alignment
+	for i, ax := range align {
+		for j, ay := range align {
+			// Skip the three corners taken by finder patterns.
+			if (i == 0 && j == 0) || (i == 0 && j == len(align)-1) || (i == len(align)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(ax+dx, ay+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	// Reserve the format areas; the real bits are drawn after masking.
+	q.drawFormatBits(0)
+	return q
+}
+
+// set draws a function module at column x, row y.
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFinder draws a finder pattern centred on (x, y) with its separator.
+func (q *qrCode) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= q.size || yy < 0 || yy >= q.size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			q.set(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+// drawFormatBits writes both copies of the 15-bit format information for
+// level M and the given mask, plus the always-dark module.
+func (q *qrCode) drawFormatBits(mask int) {
+	const levelM = 0b00
+	data := levelM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// drawCodewords places the codewords in the zigzag order, two columns at a
+// time from the bottom-right, skipping function modules.
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = (data[i/8]>>(7-i%8))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the current modules with the four rules from the spec;
+// lower is easier to scan.
+func (q *qrCode) penalty() int {
+	p := 0
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+	line := make([]bool, q.size)
+	for pass := 0; pass < 2; pass++ {
+		for a := 0; a < q.size; a++ {
+			for b := 0; b < q.size; b++ {
+				if pass == 0 {
+					line[b] = q.modules[a][b]
+				} else {
+					line[b] = q.modules[b][a]
+				}
+			}
+			run := 1
+			for b := 1; b <= q.size; b++ {
+				if b < q.size && line[b] == line[b-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					p += 3 + run - 5
+				}
+				run = 1
+			}
+			for b := 0; b+11 <= q.size; b++ {
+				for _, pat := range finderLike {
+					match := true
+					for k, want := range pat {
+						if line[b+k] != want {
+							match = false
+							break
+						}
+					}
+					if match {
+						p += 40
+					}
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if q.modules[y][x+1] == c && q.modules[y+1][x] == c && q.modules[y+1][x+1] == c {
+					p += 3
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	p += abs(dark*20-total*10) / total * 10
+	return p
+}
+
+// terminal renders the code with half-block characters, two module rows per
+// text line. Light modules are drawn, so it reads on a dark background.
+func (q *qrCode) terminal() string {
+	const quiet = 2
+	light := func(x, y int) bool {
+		if x < 0 || y < 0 || x >= q.size || y >= q.size {
+			return true
+		}
+		return !q.modules[y][x]
+	}
+	var sb strings.Builder
+	for y := -quiet; y < q.size+quiet; y += 2 {
+		for x := -quiet; x < q.size+quiet; x++ {
+			top, bottom := light(x, y), y+1 < q.size+quiet && light(x, y+1)
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
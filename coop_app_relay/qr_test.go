@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The decoder below reads a code back the way a scanner does, from the
+// modules alone: it knows the symbol layout from the spec, not from the
+// encoder, and checks the error correction with its own Reed-Solomon
+// arithmetic.
+
+// qrTestBlocks is the level-M block layout of versions 1-6 (ISO/IEC 18004
+// table 9): codewords in all, blocks, EC codewords per block.
+var qrTestBlocks = [][3]int{1: {26, 1, 10}, 2: {44, 1, 16}, 3: {70, 1, 26}, 4: {100, 2, 18}, 5: {134, 2, 24}, 6: {172, 4, 16}}
+
+// qrTestAlignment is the alignment pattern centre row/column of versions
+// 2-6 (annex E); version 1 has none.
+var qrTestAlignment = []int{2: 18, 3: 22, 4: 26, 5: 30, 6: 34}
+
+// qrTestFormatM is the masked format information of level M with masks 0-7
+// (annex C, table C.1).
+var qrTestFormatM = []int{
+	0b101010000010010, 0b101000100100101, 0b101111001111100, 0b101101101001011,
+	0b100010111111001, 0b100000011001110, 0b100111110010111, 0b100101010100000,
+}
+
+var qrTestExp, qrTestLog = func() ([256]byte, [256]byte) {
+	var exp, lg [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i], lg[x] = byte(x), byte(i)
+		if x <<= 1; x > 0xff {
+			x ^= 0x11d
+		}
+	}
+	return exp, lg
+}()
+
+func qrTestMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return qrTestExp[(int(qrTestLog[a])+int(qrTestLog[b]))%255]
+}
+
+// readQRCodewords reads q's codewords in transmission order, checking its
+// function patterns and format information along the way.
+func readQRCodewords(q *qrCode) ([]byte, error) {
+	version := (q.size - 17) / 4
+	if version < 1 || version >= len(qrTestBlocks) || q.size != version*4+17 || len(q.modules) != q.size {
+		return nil, fmt.Errorf("bad size %d", q.size)
+	}
+	dark := func(x, y int) bool { return q.modules[y][x] }
+	size := q.size
+
+	// Finder patterns, timing patterns and the dark module.
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || y < 0 || x >= size || y >= size {
+					continue
+				}
+				d := max(abs(dx), abs(dy))
+				if want := d <= 1 || d == 3; dark(x, y) != want {
+					return nil, fmt.Errorf("finder pattern at %v is wrong at (%d, %d)", c, x, y)
+				}
+			}
+		}
+	}
+	for i := 8; i < size-8; i++ {
+		if dark(i, 6) != (i%2 == 0) || dark(6, i) != (i%2 == 0) {
+			return nil, fmt.Errorf("timing pattern is wrong at %d", i)
+		}
+	}
+	if !dark(8, size-8) {
+		return nil, errors.New("dark module is light")
+	}
+
+	var centres []int
+	if version > 1 {
+		centres = []int{6, qrTestAlignment[version]}
+	}
+	function := func(x, y int) bool {
+		switch {
+		case x < 9 && y < 9, x >= size-8 && y < 9, x < 9 && y >= size-8, x == 6, y == 6:
+			return true
+		}
+		for _, ax := range centres {
+			for _, ay := range centres {
+				if ax == 6 && ay == 6 || ax == 6 && ay == centres[len(centres)-1] || ay == 6 && ax == centres[len(centres)-1] {
+					continue
+				}
+				if abs(x-ax) <= 2 && abs(y-ay) <= 2 {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for _, ax := range centres[min(1, len(centres)):] {
+		for dy := -2; dy <= 2; dy++ {
+			for dx := -2; dx <= 2; dx++ {
+				if dark(ax+dx, ax+dy) != (max(abs(dx), abs(dy)) != 1) {
+					return nil, fmt.Errorf("alignment pattern at %d is wrong", ax)
+				}
+			}
+		}
+	}
+
+	// Format information: both copies, most significant bit first along
+	// the paths the spec gives.
+	var format1, format2 int
+	for _, p := range [][2]int{{0, 8}, {1, 8}, {2, 8}, {3, 8}, {4, 8}, {5, 8}, {7, 8}, {8, 8}, {8, 7}, {8, 5}, {8, 4}, {8, 3}, {8, 2}, {8, 1}, {8, 0}} {
+		format1 <<= 1
+		if dark(p[0], p[1]) {
+			format1 |= 1
+		}
+	}
+	for i := 0; i < 7; i++ {
+		format2 <<= 1
+		if dark(8, size-1-i) {
+			format2 |= 1
+		}
+	}
+	for i := 0; i < 8; i++ {
+		format2 <<= 1
+		if dark(size-8+i, 8) {
+			format2 |= 1
+		}
+	}
+	if format1 != format2 {
+		return nil, fmt.Errorf("format copies differ: %015b and %015b", format1, format2)
+	}
+	mask := -1
+	for m, f := range qrTestFormatM {
+		if f == format1 {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		return nil, fmt.Errorf("format %015b is not level M", format1)
+	}
+	masked := func(x, y int) bool {
+		i, j := y, x
+		switch mask {
+		case 0:
+			return (i+j)%2 == 0
+		case 1:
+			return i%2 == 0
+		case 2:
+			return j%3 == 0
+		case 3:
+			return (i+j)%3 == 0
+		case 4:
+			return (i/2+j/3)%2 == 0
+		case 5:
+			return (i*j)%2+(i*j)%3 == 0
+		case 6:
+			return ((i*j)%2+(i*j)%3)%2 == 0
+		default:
+			return ((i+j)%2+(i*j)%3)%2 == 0
+		}
+	}
+
+	// Codewords, read upward and downward in two-module columns from the
+	// bottom right, skipping the vertical timing pattern.
+	total := qrTestBlocks[version][0]
+	codewords := make([]byte, total)
+	n := 0
+	upward := true
+	for right := size - 1; right > 0; right -= 2 {
+		if right == 6 {
+			right--
+		}
+		for k := 0; k < size; k++ {
+			y := k
+			if upward {
+				y = size - 1 - k
+			}
+			for _, x := range []int{right, right - 1} {
+				if function(x, y) || n >= total*8 {
+					continue
+				}
+				if dark(x, y) != masked(x, y) {
+					codewords[n/8] |= 0x80 >> (n % 8)
+				}
+				n++
+			}
+		}
+		upward = !upward
+	}
+	if n != total*8 {
+		return nil, fmt.Errorf("read %d bits, want %d", n, total*8)
+	}
+	return codewords, nil
+}
+
+// decodeQRTest decodes q, checking every block's error correction and the
+// padding after the text.
+func decodeQRTest(q *qrCode) (string, error) {
+	codewords, err := readQRCodewords(q)
+	if err != nil {
+		return "", err
+	}
+	version := (q.size - 17) / 4
+	total, blocks, ecLen := qrTestBlocks[version][0], qrTestBlocks[version][1], qrTestBlocks[version][2]
+
+	// De-interleave and check each block's syndromes.
+	dataLen := total/blocks - ecLen
+	var data []byte
+	for b := 0; b < blocks; b++ {
+		var block []byte
+		for i := 0; i < dataLen; i++ {
+			block = append(block, codewords[i*blocks+b])
+		}
+		data = append(data, block...)
+		for i := 0; i < ecLen; i++ {
+			block = append(block, codewords[dataLen*blocks+i*blocks+b])
+		}
+		for j := 0; j < ecLen; j++ {
+			var s byte
+			for _, c := range block {
+				s = qrTestMul(s, qrTestExp[j]) ^ c
+			}
+			if s != 0 {
+				return "", fmt.Errorf("block %d: syndrome %d is %#x", b, j, s)
+			}
+		}
+	}
+
+	// The data: one segment, the terminator and padding.
+	pos := 0
+	read := func(bits int) int {
+		v := 0
+		for i := 0; i < bits; i++ {
+			v <<= 1
+			if pos < len(data)*8 && data[pos/8]&(0x80>>(pos%8)) != 0 {
+				v |= 1
+			}
+			pos++
+		}
+		return v
+	}
+	var text []byte
+	switch modeBits := read(4); modeBits {
+	case 0b0001:
+		count := read(10)
+		for ; count >= 3; count -= 3 {
+			text = fmt.Appendf(text, "%03d", read(10))
+		}
+		switch count {
+		case 2:
+			text = fmt.Appendf(text, "%02d", read(7))
+		case 1:
+			text = fmt.Appendf(text, "%d", read(4))
+		}
+	case 0b0100:
+		for count := read(8); count > 0; count-- {
+			text = append(text, byte(read(8)))
+		}
+	default:
+		return "", fmt.Errorf("unexpected mode %04b", modeBits)
+	}
+	if pos > len(data)*8 {
+		return "", errors.New("segment runs past the data")
+	}
+	for i := 0; pos < len(data)*8 && (i < 4 || pos%8 != 0); i++ {
+		if read(1) != 0 {
+			return "", errors.New("non-zero terminator or bit padding")
+		}
+	}
+	for pad := byte(0xec); pos < len(data)*8; pad ^= 0xec ^ 0x11 {
+		if b := byte(read(8)); b != pad {
+			return "", fmt.Errorf("pad codeword %#x, want %#x", b, pad)
+		}
+	}
+	return string(text), nil
+}
+
+func TestQRRoundTrip(t *testing.T) {
+	tests := []struct {
+		text    string
+		version int
+	}{
+		{"", 1},
+		{"7", 1},
+		{"01234567", 1},
+		{strings.Repeat("9", 34), 1},
+		{strings.Repeat("9", 35), 2},
+		{"ABC-123", 1},
+		{strings.Repeat("x", 14), 1},
+		{strings.Repeat("x", 15), 2},
+		{"https://coop.example.com/pair?code=123456", 3},
+		{strings.Repeat("y", 62), 4},
+		{strings.Repeat("z", 84), 5},
+		{strings.Repeat("\xff", 106), 6},
+		{strings.Repeat("1", 255), 6},
+	}
+	for _, tt := range tests {
+		q, err := encodeQR(tt.text)
+		if err != nil {
+			t.Errorf("encodeQR(%.20q): %v", tt.text, err)
+			continue
+		}
+		if got := (q.size - 17) / 4; got != tt.version {
+			t.Errorf("encodeQR(%.20q) is version %d, want %d", tt.text, got, tt.version)
+		}
+		got, err := decodeQRTest(q)
+		if err != nil {
+			t.Errorf("decoding %.20q: %v", tt.text, err)
+			continue
+		}
+		if got != tt.text {
+			t.Errorf("decoded %.20q, want %.20q", got, tt.text)
+		}
+	}
+
+	for _, text := range []string{strings.Repeat("a", 107), strings.Repeat("1", 256)} {
+		if _, err := encodeQR(text); !errors.Is(err, errQRTooLong) {
+			t.Errorf("encodeQR of %d characters = %v, want errQRTooLong", len(text), err)
+		}
+	}
+}
+
+// TestQRCodewords checks the encoder's data and Reed-Solomon codewords for
+// "01234567" at 1-M against the worked example in ISO/IEC 18004 annex I.
+func TestQRCodewords(t *testing.T) {
+	wantData := []byte{0x10, 0x20, 0x0c, 0x56, 0x61, 0x80, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11}
+	wantEC := []byte{0xa5, 0x24, 0xd4, 0xc1, 0xed, 0x36, 0xc7, 0x87, 0x2c, 0x55}
+
+	if got := rsRemainder(wantData, rsGenerator(10)); !bytes.Equal(got, wantEC) {
+		t.Errorf("EC codewords = % x, want % x", got, wantEC)
+	}
+	if got := qrInterleave(wantData, qrVersionsM[1]); !bytes.Equal(got, append(wantData, wantEC...)) {
+		t.Errorf("1-M codewords = % x", got)
+	}
+
+	q, err := encodeQR("01234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readQRCodewords(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(wantData, wantEC...); !bytes.Equal(got, want) {
+		t.Errorf("symbol carries % x, want % x", got, want)
+	}
+}
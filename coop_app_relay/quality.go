@@ -0,0 +1,106 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"time"
+)
+
+const (
+	// maxBurstFrames and maxBurstWindow bound a burst so it stays well
+	// inside a capture interval.
+	maxBurstFrames     = 10
+	defaultBurstWindow = 4 * time.Second
+	maxBurstWindow     = 15 * time.Second
+
+	// scoreSamples is roughly how many pixels scoreFrame looks at.
+	scoreSamples = 640 * 360
+)
+
+// frameQuality scores a frame for picking the best of a burst. It is sent
+// with the snapshot so the backend can record why a frame was chosen.
+type frameQuality struct {
+	// Sharpness is the variance of the luma Laplacian: higher is crisper.
+	// It only compares frames of the same scene.
+	Sharpness float64 `json:"sharpness"`
+	// Exposure is 1 for a well-exposed frame, falling towards 0 as the
+	// frame gets darker or brighter than mid-grey or clips.
+	Exposure float64 `json:"exposure"`
+	// Score is Sharpness weighted by Exposure.
+	Score float64 `json:"score"`
+	// BurstFrames is how many frames the winner was chosen from.
+	BurstFrames int `json:"burst_frames"`
+}
+
+// burst returns how many frames to grab and over how long. One frame means
+// no burst.
+func (s imageSettings) burst() (int, time.Duration) {
+	if s.BurstFrames == nil || *s.BurstFrames <= 1 {
+		return 1, 0
+	}
+	n := min(*s.BurstFrames, maxBurstFrames)
+	window := defaultBurstWindow
+	if s.BurstSeconds != nil && *s.BurstSeconds > 0 {
+		window = min(time.Duration(*s.BurstSeconds)*time.Second, maxBurstWindow)
+	}
+	return n, window
+}
+
+// scoreFrame measures sharpness and exposure on the luma channel, sampling a
+// grid of pixels so a 4K frame costs about as much as a small one. The
+// Laplacian uses immediate neighbours, so fine detail still counts.
+func scoreFrame(img image.Image) frameQuality {
+	b := img.Bounds()
+	luma := func(x, y int) float64 {
+		if ycc, ok := img.(*image.YCbCr); ok {
+			return float64(ycc.Y[ycc.YOffset(x, y)])
+		}
+		return float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+	}
+	step := max(1, int(math.Sqrt(float64(b.Dx()*b.Dy())/scoreSamples)))
+
+	var n, clipped int
+	var sum, lapSum, lapSq float64
+	for y := b.Min.Y + 1; y < b.Max.Y-1; y += step {
+		for x := b.Min.X + 1; x < b.Max.X-1; x += step {
+			c := luma(x, y)
+			lap := luma(x-1, y) + luma(x+1, y) + luma(x, y-1) + luma(x, y+1) - 4*c
+			n++
+			sum += c
+			lapSum += lap
+			lapSq += lap * lap
+			if c <= 5 || c >= 250 {
+				clipped++
+			}
+		}
+	}
+	if n == 0 {
+		return frameQuality{BurstFrames: 1}
+	}
+	mean := sum / float64(n)
+	sharpness := lapSq/float64(n) - (lapSum/float64(n))*(lapSum/float64(n))
+	off := (mean - 128) / 128
+	exposure := max(0, 1-off*off) * max(0, 1-2*float64(clipped)/float64(n))
+	return frameQuality{
+		Sharpness:   math.Round(sharpness*10) / 10,
+		Exposure:    math.Round(exposure*1000) / 1000,
+		Score:       math.Round(sharpness*exposure*10) / 10,
+		BurstFrames: 1,
+	}
+}
+
+// pickBest returns the frame with the highest score, breaking ties (such as
+// every frame scoring 0 in the dark) on sharpness.
+func pickBest(frames []image.Image) (image.Image, frameQuality) {
+	var best image.Image
+	var bestQ frameQuality
+	for i, f := range frames {
+		q := scoreFrame(f)
+		if i == 0 || q.Score > bestQ.Score || (q.Score == bestQ.Score && q.Sharpness > bestQ.Sharpness) {
+			best, bestQ = f, q
+		}
+	}
+	bestQ.BurstFrames = len(frames)
+	return best, bestQ
+}
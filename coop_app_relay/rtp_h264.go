@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// rtpPacket is the part of an RTP packet (RFC 3550) the depacketizer needs.
+type rtpPacket struct {
+	marker    bool
+	seq       uint16
+	timestamp uint32
+	payload   []byte
+}
+
+func parseRTP(b []byte) (*rtpPacket, error) {
+	if len(b) < 12 || b[0]>>6 != 2 {
+		return nil, errors.New("rtp: malformed packet")
+	}
+	pkt := &rtpPacket{
+		marker:    b[1]&0x80 != 0,
+		seq:       binary.BigEndian.Uint16(b[2:]),
+		timestamp: binary.BigEndian.Uint32(b[4:]),
+	}
+	off := 12 + int(b[0]&0x0f)*4
+	if b[0]&0x10 != 0 {
+		if len(b) < off+4 {
+			return nil, errors.New("rtp: truncated header extension")
+		}
+		off += 4 + int(binary.BigEndian.Uint16(b[off+2:]))*4
+	}
+	end := len(b)
+	if b[0]&0x20 != 0 && end > 0 {
+		end -= int(b[end-1])
+	}
+	if off > end {
+		return nil, errors.New("rtp: truncated packet")
+	}
+	pkt.payload = b[off:end]
+	return pkt, nil
+}
+
+// h264Depacketizer reassembles RTP payloads (RFC 6184 single NAL, STAP-A and
+// FU-A modes) into access units. An access unit that lost a packet is
+// dropped rather than handed to the decoder.
+type h264Depacketizer struct {
+	nals      [][]byte
+	fu        []byte
+	timestamp uint32
+	lastSeq   uint16
+	started   bool
+	broken    bool
+	// auTimestamp is the RTP timestamp of the last access unit push returned.
+	auTimestamp uint32
+}
+
+// push feeds one packet and returns a complete access unit, or nil.
+func (d *h264Depacketizer) push(pkt *rtpPacket) [][]byte {
+	var out [][]byte
+	if d.started && pkt.timestamp != d.timestamp {
+		// A new timestamp ends the previous access unit even if its marker
+		// bit was lost.
+		out = d.flush()
+	}
+	if d.started && pkt.seq != d.lastSeq+1 {
+		d.broken = true
+		d.fu = nil
+	}
+	d.started = true
+	d.lastSeq = pkt.seq
+	d.timestamp = pkt.timestamp
+	d.addPayload(pkt.payload)
+	if pkt.marker {
+		if au := d.flush(); au != nil {
+			out = au
+		}
+	}
+	return out
+}
+
+func (d *h264Depacketizer) flush() [][]byte {
+	nals, broken := d.nals, d.broken
+	d.nals, d.fu, d.broken = nil, nil, false
+	if broken || len(nals) == 0 {
+		return nil
+	}
+	d.auTimestamp = d.timestamp
+	return nals
+}
+
+func (d *h264Depacketizer) addPayload(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	switch typ := p[0] & 0x1f; {
+	case typ >= 1 && typ <= 23:
+		d.nals = append(d.nals, append([]byte(nil), p...))
+	case typ == 24: // STAP-A
+		p = p[1:]
+		for len(p) >= 2 {
+			n := int(binary.BigEndian.Uint16(p))
+			p = p[2:]
+			if n == 0 || n > len(p) {
+				d.broken = true
+				return
+			}
+			d.nals = append(d.nals, append([]byte(nil), p[:n]...))
+			p = p[n:]
+		}
+	case typ == 28: // FU-A
+		if len(p) < 2 {
+			d.broken = true
+			return
+		}
+		start, end := p[1]&0x80 != 0, p[1]&0x40 != 0
+		if start {
+			d.fu = []byte{p[0]&0xe0 | p[1]&0x1f}
+		} else if d.fu == nil {
+			// The start fragment was lost.
+			d.broken = true
+			return
+		}
+		d.fu = append(d.fu, p[2:]...)
+		if end {
+			d.nals = append(d.nals, d.fu)
+			d.fu = nil
+		}
+	default:
+		// STAP-B, MTAP and FU-B only occur in interleaved mode.
+		d.broken = true
+	}
+}
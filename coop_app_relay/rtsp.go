@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const rtspUserAgent = "coop-relay"
+
+// rtspResponse is a parsed RTSP reply.
+type rtspResponse struct {
+	StatusCode int
+	Status     string
+	Header     textproto.MIMEHeader
+	Body       []byte
+}
+
+// rtspClient is a minimal RTSP 1.0 client that plays a single H.264 video
+// track over TCP-interleaved RTP (RFC 2326, RFC 6184).
+type rtspClient struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	url     *url.URL // request URL without credentials
+	user    *url.Userinfo
+	cseq    int
+	session string
+	auth    *rtspAuth
+
+	rtpChannel byte
+}
+
+// rtspTrack describes the H.264 media section of the SDP.
+type rtspTrack struct {
+	controlURL  string
+	payloadType int
+	paramSets   [][]byte // from sprop-parameter-sets
+}
+
+// dialRTSP connects to the server named in rawURL. Credentials in the URL are
+// used for Basic or Digest auth when the server asks for them.
+func dialRTSP(ctx context.Context, rawURL string) (*rtspClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("rtsp: invalid URL: %w", err)
+	}
+	if u.Scheme != "rtsp" {
+		return nil, fmt.Errorf("rtsp: unsupported scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "554")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("rtsp: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c := &rtspClient{conn: conn, br: bufio.NewReaderSize(conn, 64*1024), user: u.User}
+	stripped := *u
+	stripped.User = nil
+	c.url = &stripped
+	// Unblock reads when the context is cancelled without a deadline.
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(time.Now())
+	}()
+	return c, nil
+}
+
+// startRTSP connects to rawURL and starts playing its H.264 track.
+func startRTSP(ctx context.Context, rawURL string) (*rtspClient, *rtspTrack, error) {
+	client, err := dialRTSP(ctx, rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := client.do("OPTIONS", client.url.String(), nil); err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	track, err := client.describe()
+	if err == nil {
+		err = client.setup(track)
+	}
+	if err == nil {
+		err = client.play()
+	}
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, track, nil
+}
+
+// keepalive tells the server the session is still in use. The reply is
+// skipped by readRTP.
+func (c *rtspClient) keepalive() error {
+	return c.writeRequest("OPTIONS", c.url.String(), nil)
+}
+
+func (c *rtspClient) Close() error {
+	if c.session != "" {
+		c.conn.SetDeadline(time.Now().Add(2 * time.Second))
+		c.writeRequest("TEARDOWN", c.url.String(), nil)
+	}
+	return c.conn.Close()
+}
+
+// do sends a request and waits for its response, retrying once with
+// credentials on 401.
+func (c *rtspClient) do(method, uri string, header map[string]string) (*rtspResponse, error) {
+	for attempt := 0; ; attempt++ {
+		if err := c.writeRequest(method, uri, header); err != nil {
+			return nil, err
+		}
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == 401 && attempt == 0 && c.user != nil {
+			auth, err := parseRTSPAuth(resp.Header.Values("Www-Authenticate"))
+			if err != nil {
+				return nil, err
+			}
+			c.auth = auth
+			continue
+		}
+		if resp.StatusCode != 200 {
+			return resp, fmt.Errorf("rtsp: %s %s: %d %s", method, uri, resp.StatusCode, resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+func (c *rtspClient) writeRequest(method, uri string, header map[string]string) error {
+	c.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\n", method, uri)
+	fmt.Fprintf(&b, "CSeq: %d\r\n", c.cseq)
+	fmt.Fprintf(&b, "User-Agent: %s\r\n", rtspUserAgent)
+	if c.session != "" {
+		fmt.Fprintf(&b, "Session: %s\r\n", c.session)
+	}
+	if c.auth != nil && c.user != nil {
+		password, _ := c.user.Password()
+		fmt.Fprintf(&b, "Authorization: %s\r\n", c.auth.header(c.user.Username(), password, method, uri))
+	}
+	for k, v := range header {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	b.WriteString("\r\n")
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+// readResponse reads the next RTSP response, discarding any interleaved
+// RTP packets that arrive before it.
+func (c *rtspClient) readResponse() (*rtspResponse, error) {
+	for {
+		first, err := c.br.Peek(1)
+		if err != nil {
+			return nil, fmt.Errorf("rtsp: reading response: %w", err)
+		}
+		if first[0] == '$' {
+			if _, _, err := c.readInterleaved(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		break
+	}
+	tp := textproto.NewReader(c.br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("rtsp: reading status line: %w", err)
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "RTSP/") {
+		return nil, fmt.Errorf("rtsp: malformed status line %q", line)
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("rtsp: malformed status line %q", line)
+	}
+	resp := &rtspResponse{StatusCode: code}
+	if len(parts) == 3 {
+		resp.Status = parts[2]
+	}
+	if resp.Header, err = tp.ReadMIMEHeader(); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("rtsp: reading headers: %w", err)
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 || n > 1<<20 {
+			return nil, fmt.Errorf("rtsp: bad Content-Length %q", cl)
+		}
+		resp.Body = make([]byte, n)
+		if _, err := io.ReadFull(c.br, resp.Body); err != nil {
+			return nil, fmt.Errorf("rtsp: reading body: %w", err)
+		}
+	}
+	return resp, nil
+}
+
+// readInterleaved reads one "$<channel><length><data>" frame.
+func (c *rtspClient) readInterleaved() (byte, []byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return 0, nil, fmt.Errorf("rtsp: reading interleaved frame: %w", err)
+	}
+	if hdr[0] != '$' {
+		return 0, nil, fmt.Errorf("rtsp: expected interleaved frame, got %q", hdr[0])
+	}
+	data := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(c.br, data); err != nil {
+		return 0, nil, fmt.Errorf("rtsp: reading interleaved frame: %w", err)
+	}
+	return hdr[1], data, nil
+}
+
+// describe fetches the SDP and returns the first H.264 video track.
+func (c *rtspClient) describe() (*rtspTrack, error) {
+	resp, err := c.do("DESCRIBE", c.url.String(), map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return nil, err
+	}
+	base := c.url.String()
+	if cb := resp.Header.Get("Content-Base"); cb != "" {
+		base = cb
+	} else if cl := resp.Header.Get("Content-Location"); cl != "" {
+		base = cl
+	}
+	return parseSDPH264Track(string(resp.Body), base)
+}
+
+// setup requests TCP-interleaved transport for the track.
+func (c *rtspClient) setup(track *rtspTrack) error {
+	resp, err := c.do("SETUP", track.controlURL, map[string]string{
+		"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1",
+	})
+	if err != nil {
+		return err
+	}
+	session := resp.Header.Get("Session")
+	if session == "" {
+		return errors.New("rtsp: SETUP response has no Session header")
+	}
+	c.session = strings.TrimSpace(strings.SplitN(session, ";", 2)[0])
+	c.rtpChannel = 0
+	for _, part := range strings.Split(resp.Header.Get("Transport"), ";") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(part), "interleaved="); ok {
+			if n, err := strconv.Atoi(strings.SplitN(v, "-", 2)[0]); err == nil {
+				c.rtpChannel = byte(n)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *rtspClient) play() error {
+	_, err := c.do("PLAY", c.url.String(), map[string]string{"Range": "npt=0.000-"})
+	return err
+}
+
+// readRTP returns the next RTP packet on the video channel.
+func (c *rtspClient) readRTP() (*rtpPacket, error) {
+	for {
+		first, err := c.br.Peek(1)
+		if err != nil {
+			return nil, fmt.Errorf("rtsp: %w", err)
+		}
+		if first[0] != '$' {
+			// Some servers send requests or keepalive replies mid-stream.
+			if _, err := c.readResponse(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		ch, data, err := c.readInterleaved()
+		if err != nil {
+			return nil, err
+		}
+		if ch != c.rtpChannel {
+			continue // RTCP
+		}
+		pkt, err := parseRTP(data)
+		if err != nil {
+			continue
+		}
+		return pkt, nil
+	}
+}
+
+// parseSDPH264Track picks the first H.264 video media section out of an SDP
+// document and resolves its control URL against base.
+func parseSDPH264Track(sdp, base string) (*rtspTrack, error) {
+	var (
+		inMedia  bool
+		track    *rtspTrack
+		found    *rtspTrack
+		codecs   = map[int]string{}
+		sessCtrl string
+	)
+	finish := func() {
+		if track != nil && found == nil && strings.EqualFold(codecs[track.payloadType], "H264") {
+			found = track
+		}
+	}
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "m="):
+			finish()
+			track, codecs = nil, map[int]string{}
+			inMedia = true
+			fields := strings.Fields(line[2:])
+			if len(fields) >= 4 && fields[0] == "video" {
+				pt, _ := strconv.Atoi(fields[3])
+				track = &rtspTrack{payloadType: pt}
+			}
+		case strings.HasPrefix(line, "a=control:"):
+			ctrl := strings.TrimPrefix(line, "a=control:")
+			if !inMedia {
+				sessCtrl = ctrl
+			} else if track != nil {
+				track.controlURL = ctrl
+			}
+		case strings.HasPrefix(line, "a=rtpmap:") && track != nil:
+			fields := strings.Fields(strings.TrimPrefix(line, "a=rtpmap:"))
+			if len(fields) == 2 {
+				pt, _ := strconv.Atoi(fields[0])
+				codecs[pt] = strings.SplitN(fields[1], "/", 2)[0]
+			}
+		case strings.HasPrefix(line, "a=fmtp:") && track != nil:
+			fields := strings.SplitN(strings.TrimPrefix(line, "a=fmtp:"), " ", 2)
+			if len(fields) != 2 {
+				continue
+			}
+			for _, param := range strings.Split(fields[1], ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if !ok || !strings.EqualFold(k, "sprop-parameter-sets") {
+					continue
+				}
+				for _, ps := range strings.Split(v, ",") {
+					if nal, err := base64.StdEncoding.DecodeString(ps); err == nil && len(nal) > 0 {
+						track.paramSets = append(track.paramSets, nal)
+					}
+				}
+			}
+		}
+	}
+	finish()
+	if found == nil {
+		return nil, errors.New("rtsp: stream has no H.264 video track")
+	}
+	found.controlURL = resolveControlURL(base, sessCtrl, found.controlURL)
+	return found, nil
+}
+
+func resolveControlURL(base, sessionControl, control string) string {
+	if sessionControl != "" && sessionControl != "*" {
+		base = resolveControlURL(base, "", sessionControl)
+	}
+	if control == "" || control == "*" {
+		return base
+	}
+	if strings.HasPrefix(strings.ToLower(control), "rtsp://") {
+		return control
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return control
+	}
+	if !strings.HasSuffix(b.Path, "/") {
+		b.Path += "/"
+	}
+	ref, err := url.Parse(control)
+	if err != nil {
+		return control
+	}
+	return b.ResolveReference(ref).String()
+}
+
+// rtspAuth holds a server's authentication challenge.
+type rtspAuth struct {
+	digest bool
+	realm  string
+	nonce  string
+	opaque string
+	qop    string
+	nc     int
+}
+
+func parseRTSPAuth(challenges []string) (*rtspAuth, error) {
+	var basic *rtspAuth
+	for _, ch := range challenges {
+		scheme, params, _ := strings.Cut(ch, " ")
+		fields := parseAuthParams(params)
+		switch strings.ToLower(scheme) {
+		case "digest":
+			a := &rtspAuth{digest: true, realm: fields["realm"], nonce: fields["nonce"], opaque: fields["opaque"]}
+			if alg := fields["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+				continue
+			}
+			for _, q := range strings.Split(fields["qop"], ",") {
+				if strings.TrimSpace(q) == "auth" {
+					a.qop = "auth"
+				}
+			}
+			return a, nil
+		case "basic":
+			basic = &rtspAuth{realm: fields["realm"]}
+		}
+	}
+	if basic != nil {
+		return basic, nil
+	}
+	return nil, errors.New("rtsp: server requires an unsupported authentication scheme")
+}
+
+func parseAuthParams(s string) map[string]string {
+	out := map[string]string{}
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		k, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		var v string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				v, s = rest[1:], ""
+			} else {
+				v, s = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			v, s, _ = strings.Cut(rest, ",")
+		}
+		out[k] = strings.TrimSpace(v)
+	}
+	return out
+}
+
+func (a *rtspAuth) header(user, password, method, uri string) string {
+	if !a.digest {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	}
+	ha1 := md5Hex(user + ":" + a.realm + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+	h := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, user, a.realm, a.nonce, uri)
+	if a.qop == "auth" {
+		a.nc++
+		nc := fmt.Sprintf("%08x", a.nc)
+		var raw [8]byte
+		rand.Read(raw[:])
+		cnonce := hex.EncodeToString(raw[:])
+		h += fmt.Sprintf(`, response="%s", qop=auth, nc=%s, cnonce="%s"`, md5Hex(ha1+":"+a.nonce+":"+nc+":"+cnonce+":auth:"+ha2), nc, cnonce)
+	} else {
+		h += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+a.nonce+":"+ha2))
+	}
+	if a.opaque != "" {
+		h += fmt.Sprintf(`, opaque="%s"`, a.opaque)
+	}
+	return h
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubRTSP is a camera stand-in that speaks just enough RTSP for
+// captureRTSP: Digest auth, an SDP with an audio and an H.264 track, and a
+// PLAY that sends RTCP noise, a P slice and then the IDR, frames times at
+// 30 fps, as FU-A fragments over interleaved TCP.
+type stubRTSP struct {
+	ln       net.Listener
+	sps, pps []byte
+	idr      []byte
+	frames   int
+
+	mu      sync.Mutex
+	methods []string
+	errs    []string
+}
+
+func newStubRTSP(t *testing.T, sps, pps, idr []byte, frames int) *stubRTSP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubRTSP{ln: ln, sps: sps, pps: pps, idr: idr, frames: frames}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *stubRTSP) url() string {
+	return "rtsp://admin:secret@" + s.ln.Addr().String() + "/stream1"
+}
+
+func (s *stubRTSP) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *stubRTSP) record(method, errMsg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if method != "" {
+		s.methods = append(s.methods, method)
+	}
+	if errMsg != "" {
+		s.errs = append(s.errs, errMsg)
+	}
+}
+
+func (s *stubRTSP) handle(conn net.Conn) {
+	defer conn.Close()
+	const nonce = "abc123"
+	buf := make([]byte, 4096)
+	pending := ""
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		pending += string(buf[:n])
+		for {
+			head, rest, ok := strings.Cut(pending, "\r\n\r\n")
+			if !ok {
+				break
+			}
+			pending = rest
+			lines := strings.Split(head, "\r\n")
+			parts := strings.Fields(lines[0])
+			if len(parts) < 2 {
+				s.record("", "bad request line "+lines[0])
+				return
+			}
+			method, uri := parts[0], parts[1]
+			hdr := map[string]string{}
+			for _, l := range lines[1:] {
+				k, v, _ := strings.Cut(l, ":")
+				hdr[strings.ToLower(k)] = strings.TrimSpace(v)
+			}
+			cseq := hdr["cseq"]
+			authorized := false
+			if auth, ok := strings.CutPrefix(hdr["authorization"], "Digest "); ok {
+				p := parseAuthParams(auth)
+				ha1 := md5Hex("admin:cam:secret")
+				ha2 := md5Hex(method + ":" + p["uri"])
+				authorized = p["response"] == md5Hex(ha1+":"+nonce+":"+p["nc"]+":"+p["cnonce"]+":auth:"+ha2)
+			}
+			if !authorized {
+				fmt.Fprintf(conn, "RTSP/1.0 401 Unauthorized\r\nCSeq: %s\r\nWWW-Authenticate: Basic realm=\"cam\"\r\nWWW-Authenticate: Digest realm=\"cam\", nonce=\"%s\", qop=\"auth\"\r\n\r\n", cseq, nonce)
+				continue
+			}
+			s.record(method, "")
+			switch method {
+			case "OPTIONS":
+				fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nPublic: DESCRIBE, SETUP, PLAY, TEARDOWN\r\n\r\n", cseq)
+			case "DESCRIBE":
+				sdp := "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=stub\r\nt=0 0\r\na=control:*\r\n" +
+					"m=audio 0 RTP/AVP 0\r\na=control:track0\r\n" +
+					"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\na=fmtp:96 packetization-mode=1;sprop-parameter-sets=" +
+					base64.StdEncoding.EncodeToString(s.sps) + "," + base64.StdEncoding.EncodeToString(s.pps) + "\r\na=control:track1\r\n"
+				fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nContent-Base: %s/\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\n\r\n%s", cseq, uri, len(sdp), sdp)
+			case "SETUP":
+				if !strings.HasSuffix(uri, "/stream1/track1") {
+					s.record("", "SETUP of "+uri)
+				}
+				fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nSession: 12345;timeout=60\r\nTransport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n\r\n", cseq)
+			case "PLAY":
+				fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nSession: 12345\r\n\r\n", cseq)
+				s.play(conn)
+			case "TEARDOWN":
+				fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\n\r\n", cseq)
+				return
+			}
+		}
+	}
+}
+
+func (s *stubRTSP) play(conn net.Conn) {
+	seq := uint16(100)
+	send := func(ch byte, payload []byte, ts uint32, marker bool) {
+		pkt := make([]byte, 12+len(payload))
+		pkt[0] = 0x80
+		pkt[1] = 96
+		if marker {
+			pkt[1] |= 0x80
+		}
+		binary.BigEndian.PutUint16(pkt[2:], seq)
+		binary.BigEndian.PutUint32(pkt[4:], ts)
+		copy(pkt[12:], payload)
+		seq++
+		frame := []byte{'$', ch, 0, 0}
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(pkt)))
+		conn.Write(append(frame, pkt...))
+	}
+	conn.Write([]byte{'$', 1, 0, 2, 0x80, 0xc8}) // truncated RTCP on channel 1
+	var w bitWriter
+	w.ue(0)
+	w.ue(5) // P slice
+	w.ue(0)
+	send(0, w.nal(0x41), 1000, true)
+	body := s.idr[1:]
+	for i := 0; i < s.frames; i++ {
+		ts := 4000 + uint32(i)*3000
+		for off := 0; off < len(body); off += 100 {
+			end := min(off+100, len(body))
+			fu := []byte{s.idr[0]&0xe0 | 28, s.idr[0] & 0x1f}
+			if off == 0 {
+				fu[1] |= 0x80
+			}
+			if end == len(body) {
+				fu[1] |= 0x40
+			}
+			send(0, append(fu, body[off:end]...), ts, end == len(body))
+		}
+	}
+}
+
+func TestCaptureRTSP(t *testing.T) {
+	idr, pcm := testPicture(1)
+	stub := newStubRTSP(t, testSPS{widthMbs: 2, heightMbs: 2}.nal(), testPPS{}.nal(), idr, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	frames, err := captureBurst(ctx, stub.url(), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || frames[0].Bounds().Dx() != 32 || frames[0].Bounds().Dy() != 32 {
+		t.Fatalf("frames = %d, first %v", len(frames), frames[0].Bounds())
+	}
+	if img, ok := frames[0].(*image.YCbCr); !ok || img.Y[5*img.YStride+3] != pcm[5*16+3] {
+		t.Errorf("frame is %T, not the decoded test picture", frames[0])
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if got := strings.Join(stub.methods, " "); !strings.HasPrefix(got, "OPTIONS DESCRIBE SETUP PLAY") {
+		t.Errorf("RTSP exchange = %q", got)
+	}
+	for _, e := range stub.errs {
+		t.Error(e)
+	}
+}
+
+func TestCaptureRTSPUnsupported(t *testing.T) {
+	idr, _ := testPicture(1)
+	stub := newStubRTSP(t, testSPS{profile: 77, widthMbs: 2, heightMbs: 2}.nal(), testPPS{cabac: true}.nal(), idr, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := captureRTSPNative(ctx, stub.url(), 1, 0)
+	if !errors.Is(err, errUnsupportedStream) {
+		t.Fatalf("captureRTSPNative error = %v, want errUnsupportedStream", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("unsupported stream was read until the deadline")
+	}
+}
+
+func TestCaptureRejectsOtherSchemes(t *testing.T) {
+	// None of these may reach ffmpeg's -i.
+	for _, u := range []string{
+		"file:///etc/passwd",
+		"/var/lib/coop-relay/state.json",
+		"-i",
+		"concat:a.ts|b.ts",
+		"tcp://10.0.0.5:554",
+		"rtsp:///stream1",
+		"rtsp://%zz",
+	} {
+		if _, err := captureBurst(context.Background(), u, 1, 0); err == nil {
+			t.Errorf("captured from %q", u)
+		}
+		if _, err := captureFFmpeg(context.Background(), u, 1, 0); err == nil || strings.HasPrefix(err.Error(), "ffmpeg") {
+			t.Errorf("captureFFmpeg(%q) = %v, want it refused before running ffmpeg", u, err)
+		}
+	}
+	for _, u := range []string{"rtsp://10.0.0.5/stream1", "rtsps://admin:pw@cam.local:322/live", "rtsp://[fe80::1]:554/"} {
+		if _, err := checkRTSPURL(u); err != nil {
+			t.Errorf("checkRTSPURL(%q) = %v", u, err)
+		}
+	}
+}
+
+func TestParseSDPH264Track(t *testing.T) {
+	sps, pps := testSPS{widthMbs: 2, heightMbs: 2}.nal(), testPPS{}.nal()
+	tests := []struct {
+		name    string
+		sdp     string
+		control string
+		params  int
+		err     bool
+	}{
+		{
+			name: "relative control",
+			sdp: "v=0\r\ns=x\r\na=control:*\r\nm=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\na=fmtp:96 sprop-parameter-sets=" +
+				base64.StdEncoding.EncodeToString(sps) + "," + base64.StdEncoding.EncodeToString(pps) + "\r\na=control:trackID=1\r\n",
+			control: "rtsp://cam/live/trackID=1",
+			params:  2,
+		},
+		{
+			name:    "absolute control",
+			sdp:     "v=0\r\nm=video 0 RTP/AVP 97\r\na=rtpmap:97 H264/90000\r\na=control:rtsp://cam/other/video\r\n",
+			control: "rtsp://cam/other/video",
+		},
+		{name: "no H.264 track", sdp: "v=0\r\nm=video 0 RTP/AVP 96\r\na=rtpmap:96 H265/90000\r\n", err: true},
+		{name: "empty", sdp: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			track, err := parseSDPH264Track(tt.sdp, "rtsp://cam/live/")
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parsed track %+v", track)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if track.controlURL != tt.control || len(track.paramSets) != tt.params {
+				t.Errorf("track = %q with %d parameter sets, want %q with %d", track.controlURL, len(track.paramSets), tt.control, tt.params)
+			}
+		})
+	}
+}
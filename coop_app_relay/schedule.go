@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // Windows relays have no system zoneinfo
+)
+
+// scheduleRecheck is how often a camera with a schedule re-evaluates it, so
+// windows opening or closing take effect within a minute.
+const scheduleRecheck = time.Minute
+
+// captureSchedule mirrors the schedule object in GET /api/relay/config. The
+// backend fills in the coop's location and time zone.
+type captureSchedule struct {
+	Timezone        string           `json:"timezone"`
+	Latitude        *float64         `json:"latitude"`
+	Longitude       *float64         `json:"longitude"`
+	DefaultInterval *string          `json:"default_interval"`
+	Windows         []scheduleWindow `json:"windows"`
+}
+
+type scheduleWindow struct {
+	Days     []string `json:"days"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Interval string   `json:"interval"`
+}
+
+func (s *captureSchedule) equal(o *captureSchedule) bool {
+	if s == nil || o == nil {
+		return s == o
+	}
+	if s.Timezone != o.Timezone || !floatPtrEqual(s.Latitude, o.Latitude) || !floatPtrEqual(s.Longitude, o.Longitude) ||
+		!strPtrEqual(s.DefaultInterval, o.DefaultInterval) || len(s.Windows) != len(o.Windows) {
+		return false
+	}
+	for i, w := range s.Windows {
+		ow := o.Windows[i]
+		if w.Start != ow.Start || w.End != ow.End || w.Interval != ow.Interval || strings.Join(w.Days, ",") != strings.Join(ow.Days, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+func floatPtrEqual(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// schedule is a captureSchedule parsed for evaluation. A nil *schedule means
+// the camera captures at its plain interval around the clock.
+type schedule struct {
+	loc             *time.Location
+	lat, lon        float64
+	hasLocation     bool
+	defaultInterval time.Duration // 0: don't capture outside windows
+	windows         []window
+}
+
+type window struct {
+	days       [7]bool // by time.Weekday
+	start, end timeOfDay
+	interval   time.Duration
+}
+
+// timeOfDay is "HH:MM" or a sun event plus an offset.
+type timeOfDay struct {
+	event  string // "", "sunrise" or "sunset"
+	clock  time.Duration
+	offset time.Duration
+}
+
+var (
+	clockPattern    = regexp.MustCompile(`^([01]\d|2[0-3]):([0-5]\d)$`)
+	sunEventPattern = regexp.MustCompile(`^(sunrise|sunset)(?:([+-])(\d+)([mh]))?$`)
+	weekdays        = map[string]time.Weekday{"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday}
+)
+
+func parseTimeOfDay(s string) (timeOfDay, error) {
+	if m := clockPattern.FindStringSubmatch(s); m != nil {
+		h, _ := strconv.Atoi(m[1])
+		mins, _ := strconv.Atoi(m[2])
+		return timeOfDay{clock: time.Duration(h)*time.Hour + time.Duration(mins)*time.Minute}, nil
+	}
+	m := sunEventPattern.FindStringSubmatch(s)
+	if m == nil {
+		return timeOfDay{}, fmt.Errorf("expected HH:MM, sunrise or sunset, got %q", s)
+	}
+	t := timeOfDay{event: m[1]}
+	if m[2] != "" {
+		n, _ := strconv.Atoi(m[3])
+		t.offset = time.Duration(n) * time.Minute
+		if m[4] == "h" {
+			t.offset = time.Duration(n) * time.Hour
+		}
+		if m[2] == "-" {
+			t.offset = -t.offset
+		}
+	}
+	return t, nil
+}
+
+// parseSchedule prepares a schedule from config. Bad windows are logged and
+// dropped rather than stopping capture, and an unknown time zone falls back
+// to UTC.
+func parseSchedule(s *captureSchedule, name string) *schedule {
+	if s == nil {
+		return nil
+	}
+	sched := &schedule{loc: time.UTC}
+	if s.Timezone != "" {
+		loc, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			log.Printf("[%s] Unknown schedule time zone %q, using UTC", name, s.Timezone)
+		} else {
+			sched.loc = loc
+		}
+	}
+	if s.Latitude != nil && s.Longitude != nil {
+		sched.lat, sched.lon, sched.hasLocation = *s.Latitude, *s.Longitude, true
+	}
+	if s.DefaultInterval != nil {
+		interval, err := parseInterval(*s.DefaultInterval)
+		if err != nil {
+			log.Printf("[%s] Ignoring schedule default_interval: %v", name, err)
+		} else {
+			sched.defaultInterval = interval
+		}
+	}
+	for i, sw := range s.Windows {
+		w, err := parseWindow(sw)
+		if err == nil && !sched.hasLocation && (w.start.event != "" || w.end.event != "") {
+			err = errors.New("sunrise/sunset needs the coop's location")
+		}
+		if err != nil {
+			log.Printf("[%s] Ignoring schedule window %d: %v", name, i+1, err)
+			continue
+		}
+		sched.windows = append(sched.windows, w)
+	}
+	return sched
+}
+
+func parseWindow(sw scheduleWindow) (window, error) {
+	var w window
+	var err error
+	if w.start, err = parseTimeOfDay(sw.Start); err != nil {
+		return w, err
+	}
+	if w.end, err = parseTimeOfDay(sw.End); err != nil {
+		return w, err
+	}
+	if w.interval, err = parseInterval(sw.Interval); err != nil {
+		return w, err
+	}
+	for _, d := range sw.Days {
+		day, ok := weekdays[d]
+		if !ok {
+			return w, fmt.Errorf("unknown day %q", d)
+		}
+		w.days[day] = true
+	}
+	if len(sw.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	return w, nil
+}
+
+// intervalAt returns the capture interval in force at t, or false when the
+// schedule says not to capture. The first matching window wins.
+func (s *schedule) intervalAt(t time.Time, fallback time.Duration) (time.Duration, bool) {
+	if s == nil {
+		return fallback, true
+	}
+	local := t.In(s.loc)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, s.loc)
+	for _, w := range s.windows {
+		// A window that runs past midnight may have started yesterday.
+		for _, day := range []time.Time{today, today.AddDate(0, 0, -1)} {
+			if !w.days[day.Weekday()] {
+				continue
+			}
+			start, ok1 := s.resolve(day, w.start)
+			end, ok2 := s.resolve(day, w.end)
+			if !ok1 || !ok2 {
+				continue
+			}
+			if !end.After(start) {
+				if end, ok2 = s.resolve(day.AddDate(0, 0, 1), w.end); !ok2 {
+					continue
+				}
+			}
+			if !t.Before(start) && t.Before(end) {
+				return w.interval, true
+			}
+		}
+	}
+	return s.defaultInterval, s.defaultInterval > 0
+}
+
+// resolve turns a time of day into an instant on the given local date. Sun
+// events fail on days the sun doesn't rise or set.
+func (s *schedule) resolve(day time.Time, t timeOfDay) (time.Time, bool) {
+	if t.event == "" {
+		// Built from wall-clock fields so DST days keep "07:00" at 07:00.
+		h, m := int(t.clock/time.Hour), int(t.clock%time.Hour/time.Minute)
+		return time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, s.loc), true
+	}
+	rise, set, ok := sunTimes(day.Year(), day.Month(), day.Day(), s.lat, s.lon)
+	if !ok {
+		return time.Time{}, false
+	}
+	if t.event == "sunrise" {
+		return rise.Add(t.offset), true
+	}
+	return set.Add(t.offset), true
+}
+
+// sunTimes computes sunrise and sunset for a calendar date at a location
+// (degrees, east and north positive) with the standard sunrise equation,
+// accurate to a minute or two. ok is false during polar day or night.
+func sunTimes(year int, month time.Month, day int, lat, lon float64) (rise, set time.Time, ok bool) {
+	const j2000 = 2451545.0
+	rad := math.Pi / 180
+	// Julian day number of the date at noon UTC, less J2000.
+	noon := time.Date(year, month, day, 12, 0, 0, 0, time.UTC)
+	n := float64(noon.Unix())/86400 + 2440587.5 - j2000
+
+	meanNoon := n - lon/360
+	m := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	c := 1.9148*math.Sin(m*rad) + 0.0200*math.Sin(2*m*rad) + 0.0003*math.Sin(3*m*rad)
+	lambda := math.Mod(m+c+180+102.9372, 360)
+	transit := j2000 + meanNoon + 0.0053*math.Sin(m*rad) - 0.0069*math.Sin(2*lambda*rad)
+	sinDecl := math.Sin(lambda*rad) * math.Sin(23.4397*rad)
+	cosDecl := math.Cos(math.Asin(sinDecl))
+	cosHour := (math.Sin(-0.833*rad) - math.Sin(lat*rad)*sinDecl) / (math.Cos(lat*rad) * cosDecl)
+	if cosHour < -1 || cosHour > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hour := math.Acos(cosHour) / rad
+	fromJulian := func(j float64) time.Time {
+		return time.Unix(0, int64((j-2440587.5)*86400*float64(time.Second))).UTC()
+	}
+	return fromJulian(transit - hour/360), fromJulian(transit + hour/360), true
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func ptr[T any](v T) *T { return &v }
+
+func TestSunTimes(t *testing.T) {
+	// Reference times are the published (NOAA) sunrise and sunset, in UTC.
+	tests := []struct {
+		name      string
+		lat, lon  float64
+		date      string
+		rise, set string
+	}{
+		{"London, summer solstice", 51.5074, -0.1278, "2024-06-21", "2024-06-21T03:43:00Z", "2024-06-21T20:21:00Z"},
+		{"London, winter solstice", 51.5074, -0.1278, "2024-12-21", "2024-12-21T08:04:00Z", "2024-12-21T15:53:00Z"},
+		{"New York, equinox", 40.7128, -74.0060, "2024-03-20", "2024-03-20T10:59:00Z", "2024-03-20T23:08:00Z"},
+		// Sunrise in Sydney is the previous evening in UTC.
+		{"Sydney, winter solstice", -33.8688, 151.2093, "2024-06-21", "2024-06-20T21:00:00Z", "2024-06-21T06:54:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := time.Parse(time.DateOnly, tt.date)
+			rise, set, ok := sunTimes(d.Year(), d.Month(), d.Day(), tt.lat, tt.lon)
+			if !ok {
+				t.Fatal("no sunrise or sunset")
+			}
+			for _, c := range []struct {
+				got  time.Time
+				want string
+			}{{rise, tt.rise}, {set, tt.set}} {
+				want, _ := time.Parse(time.RFC3339, c.want)
+				if diff := c.got.Sub(want).Abs(); diff > 2*time.Minute {
+					t.Errorf("got %s, want %s (off by %s)", c.got.Format(time.RFC3339), c.want, diff.Round(time.Second))
+				}
+			}
+		})
+	}
+
+	polar := []struct {
+		name     string
+		lat, lon float64
+		date     string
+	}{
+		{"Tromsø, midnight sun", 69.6492, 18.9553, "2024-06-21"},
+		{"Tromsø, polar night", 69.6492, 18.9553, "2024-12-21"},
+		{"McMurdo, polar night", -77.846, 166.676, "2024-06-21"},
+		{"McMurdo, midnight sun", -77.846, 166.676, "2024-12-21"},
+	}
+	for _, tt := range polar {
+		d, _ := time.Parse(time.DateOnly, tt.date)
+		if rise, set, ok := sunTimes(d.Year(), d.Month(), d.Day(), tt.lat, tt.lon); ok {
+			t.Errorf("%s: sunrise %s, sunset %s; want neither", tt.name, rise, set)
+		}
+	}
+	// Outside the polar season Tromsø has a sunrise and sunset again.
+	if _, _, ok := sunTimes(2024, time.May, 10, 69.6492, 18.9553); !ok {
+		t.Error("Tromsø, 10 May: no sunrise or sunset")
+	}
+}
+
+func TestParseTimeOfDay(t *testing.T) {
+	tests := []struct {
+		in   string
+		want timeOfDay
+		ok   bool
+	}{
+		{"00:00", timeOfDay{}, true},
+		{"07:30", timeOfDay{clock: 7*time.Hour + 30*time.Minute}, true},
+		{"23:59", timeOfDay{clock: 23*time.Hour + 59*time.Minute}, true},
+		{"sunrise", timeOfDay{event: "sunrise"}, true},
+		{"sunset+30m", timeOfDay{event: "sunset", offset: 30 * time.Minute}, true},
+		{"sunrise-1h", timeOfDay{event: "sunrise", offset: -time.Hour}, true},
+		{"24:00", timeOfDay{}, false},
+		{"7:30", timeOfDay{}, false},
+		{"12:60", timeOfDay{}, false},
+		{"noon", timeOfDay{}, false},
+		{"sunset+30", timeOfDay{}, false},
+		{"sunset 30m", timeOfDay{}, false},
+		{"", timeOfDay{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeOfDay(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseTimeOfDay(%q) = %+v, %v; want %+v, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestScheduleIntervalAt(t *testing.T) {
+	london := &captureSchedule{
+		Timezone:        "Europe/London",
+		Latitude:        ptr(51.5074),
+		Longitude:       ptr(-0.1278),
+		DefaultInterval: ptr("30m"),
+		Windows: []scheduleWindow{
+			// Overnight on Friday and Saturday, running into the next day.
+			{Days: []string{"fri", "sat"}, Start: "22:00", End: "02:00", Interval: "10m"},
+			{Start: "sunrise-30m", End: "sunset+1h", Interval: "1m"},
+			// Shadowed by the window above whenever both match.
+			{Start: "12:00", End: "13:00", Interval: "5m"},
+		},
+	}
+	tromso := &captureSchedule{
+		Timezone:  "Europe/Oslo",
+		Latitude:  ptr(69.6492),
+		Longitude: ptr(18.9553),
+		Windows:   []scheduleWindow{{Start: "sunrise", End: "sunset", Interval: "1m"}},
+	}
+	midnight := &captureSchedule{
+		Timezone: "America/New_York",
+		Windows:  []scheduleWindow{{Start: "23:00", End: "01:00", Interval: "2m"}},
+	}
+	allDay := &captureSchedule{
+		Timezone: "America/New_York",
+		Windows:  []scheduleWindow{{Start: "07:00", End: "07:00", Interval: "3m"}},
+	}
+
+	tests := []struct {
+		name  string
+		sched *captureSchedule
+		at    string
+		want  time.Duration
+		ok    bool
+	}{
+		// London sunrise on 21 June 2024 is 04:43 BST and sunset 21:21.
+		{"before sunrise-30m", london, "2024-06-21T04:12:00+01:00", 30 * time.Minute, true},
+		{"at sunrise-30m", london, "2024-06-21T04:14:00+01:00", time.Minute, true},
+		{"midday, first window wins", london, "2024-06-21T12:30:00+01:00", time.Minute, true},
+		{"before sunset+1h", london, "2024-06-20T22:20:00+01:00", time.Minute, true},
+		{"after sunset+1h", london, "2024-06-20T22:23:00+01:00", 30 * time.Minute, true},
+		{"Friday night, first window wins", london, "2024-06-21T22:20:00+01:00", 10 * time.Minute, true},
+		{"Saturday, past midnight", london, "2024-06-22T01:59:00+01:00", 10 * time.Minute, true},
+		{"Saturday, window closed", london, "2024-06-22T02:00:00+01:00", 30 * time.Minute, true},
+		{"Sunday, past midnight", london, "2024-06-23T01:00:00+01:00", 10 * time.Minute, true},
+		{"Monday, past midnight", london, "2024-06-24T01:00:00+01:00", 30 * time.Minute, true},
+		// In winter the sun window is short and in GMT.
+		{"December, after sunset+1h", london, "2024-12-18T17:00:00Z", 30 * time.Minute, true},
+		{"December, before sunset+1h", london, "2024-12-18T16:45:00Z", time.Minute, true},
+
+		{"polar day has no sunrise", tromso, "2024-06-21T12:00:00+02:00", 0, false},
+		{"polar night has no sunset", tromso, "2024-12-21T12:00:00+01:00", 0, false},
+		{"spring day", tromso, "2024-04-10T12:00:00+02:00", time.Minute, true},
+
+		{"before midnight", midnight, "2024-03-09T23:30:00-05:00", 2 * time.Minute, true},
+		{"after midnight", midnight, "2024-03-10T00:59:00-05:00", 2 * time.Minute, true},
+		{"window closed", midnight, "2024-03-10T01:00:00-05:00", 0, false},
+		{"across the DST change", midnight, "2024-03-10T23:30:00-04:00", 2 * time.Minute, true},
+		// 07:00 to 07:00 is a whole day, even the 23-hour one DST starts on.
+		{"whole day, early", allDay, "2024-03-10T05:00:00-04:00", 3 * time.Minute, true},
+		{"whole day, at 07:00", allDay, "2024-03-10T07:00:00-04:00", 3 * time.Minute, true},
+		{"whole day, DST start", allDay, "2024-03-10T01:30:00-05:00", 3 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at, err := time.Parse(time.RFC3339, tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := parseSchedule(tt.sched, "test").intervalAt(at, time.Hour)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("intervalAt(%s) = %s, %v; want %s, %v", tt.at, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+
+	if got, ok := (*schedule)(nil).intervalAt(time.Now(), time.Hour); got != time.Hour || !ok {
+		t.Errorf("no schedule: %s, %v; want the camera's own interval", got, ok)
+	}
+}
+
+func TestParseScheduleDropsBadWindows(t *testing.T) {
+	s := parseSchedule(&captureSchedule{
+		Timezone:        "Mars/Olympus_Mons",
+		DefaultInterval: ptr("1s"),
+		Windows: []scheduleWindow{
+			{Start: "sunrise", End: "18:00", Interval: "1m"},
+			{Start: "08:00", End: "18:00", Interval: "1m", Days: []string{"funday"}},
+			{Start: "08:00", End: "18:00", Interval: "often"},
+			{Start: "08:00", End: "18:00", Interval: "5m", Days: []string{"mon"}},
+		},
+	}, "test")
+	if s.loc != time.UTC {
+		t.Errorf("unknown time zone gave %s, want UTC", s.loc)
+	}
+	if s.defaultInterval != 0 {
+		t.Errorf("default interval below the minimum kept as %s", s.defaultInterval)
+	}
+	if len(s.windows) != 1 || s.windows[0].interval != 5*time.Minute || !s.windows[0].days[time.Monday] || s.windows[0].days[time.Tuesday] {
+		t.Errorf("windows = %+v, want only the Monday one", s.windows)
+	}
+}
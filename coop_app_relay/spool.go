@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolManifestName = "manifest.json"
+
+	defaultSpoolMaxBytes = 500 << 20
+	defaultSpoolMaxAge   = 7 * 24 * time.Hour
+
+	spoolBackoffMin = 5 * time.Second
+	spoolBackoffMax = 10 * time.Minute
+)
+
+// spoolEntry is one captured frame waiting to be uploaded.
+type spoolEntry struct {
+	ID         string    `json:"id"`
+	RelayID    string    `json:"relay_id"`
+	CameraID   string    `json:"camera_id,omitempty"`
+	ObjectKey  string    `json:"object_key"`
+	CapturedAt time.Time `json:"captured_at"`
+	Size       int64     `json:"size"`
+	// SHA256 is the hex digest of the frame as captured. The backend checks
+	// the stored object against it.
+	SHA256 string `json:"sha256,omitempty"`
+	// CaptureID names the frame to the backend, the same on every attempt,
+	// so a replay registers once while identical frames (a camera in the
+	// dark) still register separately.
+	CaptureID string `json:"capture_id,omitempty"`
+	// Quality is the frame's burst score, sent with the snapshot.
+	Quality *frameQuality `json:"quality,omitempty"`
+	// MaskVersion is the privacy mask the frame was taken under, if any.
+	MaskVersion string `json:"privacy_mask_version,omitempty"`
+	// Uploaded is set once the storage PUT succeeded, so a retry after a
+	// failed backend notify doesn't upload the bytes again. ObjectKey is then
+	// the key the backend assigned.
+	Uploaded    bool      `json:"uploaded"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// spool is a durable FIFO of captured frames. Each frame is a file in dir and
+// manifest.json records the queue order and retry state. Both are written
+// via rename so a crash or power cut leaves either the old or the new state.
+type spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu      sync.Mutex
+	entries []*spoolEntry
+	seq     int
+
+	// notify is signalled whenever an entry is added.
+	notify chan struct{}
+}
+
+// defaultSpoolDir is where frames are queued when --spool-dir is not given.
+func defaultSpoolDir() string {
+	return filepath.Join(relayCacheDir(), "spool")
+}
+
+// defaultUploadSpoolDir is the one-shot upload's queue. It is kept apart
+// from the daemon's so the Electron app can upload while the daemon runs.
+func defaultUploadSpoolDir() string {
+	return filepath.Join(relayCacheDir(), "upload-spool")
+}
+
+func relayCacheDir() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "coop-relay")
+}
+
+// openSpool loads the queue from dir, creating it if needed. Entries whose
+// frame file is missing are dropped and stray frame files are deleted. Only
+// one process may use a spool directory at a time.
+func openSpool(dir string, maxBytes int64, maxAge time.Duration) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating spool directory: %w", err)
+	}
+	s := &spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge, notify: make(chan struct{}, 1)}
+
+	data, err := os.ReadFile(filepath.Join(dir, spoolManifestName))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("reading spool manifest: %w", err)
+	default:
+		if err := json.Unmarshal(data, &s.entries); err != nil {
+			// A corrupt manifest shouldn't wedge the relay; start over.
+			log.Printf("Spool manifest is corrupt, discarding queue: %v", err)
+			s.entries = nil
+		}
+	}
+
+	known := make(map[string]bool)
+	kept := s.entries[:0]
+	for _, e := range s.entries {
+		if _, err := os.Stat(s.framePath(e.ID)); err != nil {
+			log.Printf("Spool entry %s has no frame file, dropping", e.ObjectKey)
+			continue
+		}
+		if e.CaptureID == "" {
+			// Queued by a relay that didn't send capture IDs yet.
+			e.CaptureID = newUUID()
+		}
+		known[e.ID+".jpg"] = true
+		kept = append(kept, e)
+		if n, err := strconv.Atoi(strings.SplitN(e.ID, "-", 2)[0]); err == nil && n > s.seq {
+			s.seq = n
+		}
+	}
+	s.entries = kept
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing spool directory: %w", err)
+	}
+	for _, f := range files {
+		if f.Name() != spoolManifestName && !known[f.Name()] {
+			os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(time.Now())
+	if err := s.saveLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *spool) framePath(id string) string {
+	return filepath.Join(s.dir, id+".jpg")
+}
+
+// enqueue writes a frame to disk and appends it to the queue.
+func (s *spool) enqueue(relayID, cameraID, objectKey string, capturedAt time.Time, data []byte, quality *frameQuality, maskVersion string) (*spoolEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	e := &spoolEntry{
+		ID:          fmt.Sprintf("%010d-%d", s.seq, capturedAt.UnixNano()),
+		RelayID:     relayID,
+		CameraID:    cameraID,
+		ObjectKey:   objectKey,
+		CaptureID:   newUUID(),
+		CapturedAt:  capturedAt.UTC(),
+		Size:        int64(len(data)),
+		SHA256:      sha256Hex(data),
+		Quality:     quality,
+		MaskVersion: maskVersion,
+	}
+	if err := writeFileAtomic(s.framePath(e.ID), data); err != nil {
+		return nil, fmt.Errorf("writing spooled frame: %w", err)
+	}
+	s.entries = append(s.entries, e)
+	s.pruneLocked(time.Now())
+	if err := s.saveLocked(); err != nil {
+		return nil, err
+	}
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	copied := *e
+	return &copied, nil
+}
+
+// head returns a copy of the oldest entry, or nil if the queue is empty.
+func (s *spool) head() *spoolEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.entries) == 0 {
+		return nil
+	}
+	copied := *s.entries[0]
+	return &copied
+}
+
+// next returns a copy of the oldest entry that is due or, if none is, of the
+// one due soonest, so a frame backing off doesn't hold up the rest. It
+// returns nil if the queue is empty.
+func (s *spool) next(now time.Time) *spoolEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var soonest *spoolEntry
+	for _, e := range s.entries {
+		if !now.Before(e.NextAttempt) {
+			soonest = e
+			break
+		}
+		if soonest == nil || e.NextAttempt.Before(soonest.NextAttempt) {
+			soonest = e
+		}
+	}
+	if soonest == nil {
+		return nil
+	}
+	copied := *soonest
+	return &copied
+}
+
+// due returns copies of up to n entries whose next attempt is due, oldest
+// first.
+func (s *spool) due(n int, now time.Time) []*spoolEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []*spoolEntry
+	for _, e := range s.entries {
+		if len(entries) == n {
+			break
+		}
+		if !now.Before(e.NextAttempt) {
+			copied := *e
+			entries = append(entries, &copied)
+		}
+	}
+	return entries
+}
+
+func (s *spool) readFrame(e *spoolEntry) ([]byte, error) {
+	return os.ReadFile(s.framePath(e.ID))
+}
+
+// markUploaded records that the storage PUT for id succeeded under objectKey.
+func (s *spool) markUploaded(id, objectKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.findLocked(id); e != nil {
+		e.Uploaded = true
+		e.ObjectKey = objectKey
+		return s.saveLocked()
+	}
+	return nil
+}
+
+// resetUpload forgets that an entry was uploaded, so the next attempt puts
+// the frame in storage again.
+func (s *spool) resetUpload(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.findLocked(id); e != nil {
+		e.Uploaded = false
+		return s.saveLocked()
+	}
+	return nil
+}
+
+// complete removes an entry once the backend has accepted it.
+func (s *spool) complete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.entries {
+		if e.ID == id {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			os.Remove(s.framePath(id))
+			return s.saveLocked()
+		}
+	}
+	return nil
+}
+
+// fail records a failed attempt and schedules the next one with exponential
+// backoff and jitter. It returns the time of the next attempt.
+func (s *spool) fail(id string, cause error, now time.Time) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.findLocked(id)
+	if e == nil {
+		return now, nil
+	}
+	e.Attempts++
+	e.LastError = cause.Error()
+	e.NextAttempt = now.Add(spoolBackoff(e.Attempts))
+	return e.NextAttempt, s.saveLocked()
+}
+
+// stats reports the queue depth and bytes on disk.
+func (s *spool) stats() (count int, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		bytes += e.Size
+	}
+	return len(s.entries), bytes
+}
+
+func (s *spool) findLocked(id string) *spoolEntry {
+	for _, e := range s.entries {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// pruneLocked drops the oldest frames until the queue is within its age and
+// size caps, so a long outage costs the oldest frames rather than the disk.
+func (s *spool) pruneLocked(now time.Time) {
+	var total int64
+	for _, e := range s.entries {
+		total += e.Size
+	}
+	dropped := 0
+	for len(s.entries) > 0 {
+		e := s.entries[0]
+		tooOld := s.maxAge > 0 && now.Sub(e.CapturedAt) > s.maxAge
+		tooBig := s.maxBytes > 0 && total > s.maxBytes
+		if !tooOld && !tooBig {
+			break
+		}
+		os.Remove(s.framePath(e.ID))
+		total -= e.Size
+		s.entries = s.entries[1:]
+		dropped++
+	}
+	if dropped > 0 {
+		log.Printf("Spool over its size/age cap, dropped %d oldest frame(s)", dropped)
+	}
+}
+
+func (s *spool) saveLocked() error {
+	entries := s.entries
+	if entries == nil {
+		entries = []*spoolEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, spoolManifestName), data); err != nil {
+		return fmt.Errorf("writing spool manifest: %w", err)
+	}
+	return nil
+}
+
+// spoolBackoff is 5s doubling per attempt up to 10m, with ±20% jitter.
+func spoolBackoff(attempts int) time.Duration {
+	d := spoolBackoffMin
+	for i := 1; i < attempts && d < spoolBackoffMax; i++ {
+		d *= 2
+	}
+	if d > spoolBackoffMax {
+		d = spoolBackoffMax
+	}
+	jitter := time.Duration(rand.Int63n(int64(d)/5*2+1)) - d/5
+	return d + jitter
+}
+
+// writeFileAtomic writes data to a temp file in the same directory, syncs it
+// and renames it over path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// spoolIDs lists the queued entries' IDs in order.
+func spoolIDs(s *spool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for _, e := range s.entries {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func enqueueN(t *testing.T, s *spool, n int, base time.Time) []*spoolEntry {
+	t.Helper()
+	var entries []*spoolEntry
+	for i := 0; i < n; i++ {
+		e, err := s.enqueue("relay", legacyCameraID, "", base.Add(time.Duration(i)*time.Second), []byte{byte(i), 1, 2, 3, 4, 5, 6, 7, 8, 9}, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestSpoolRecovery(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := enqueueN(t, s, 3, time.Now())
+	if _, err := s.fail(entries[0].ID, errors.New("offline"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash can leave a frame written but not in the manifest, a temp file
+	// from an interrupted write, or a manifest entry whose frame is gone.
+	os.WriteFile(filepath.Join(dir, "0000000099-1.jpg"), []byte("orphan"), 0o600)
+	os.WriteFile(filepath.Join(dir, ".tmp-123"), []byte("partial"), 0o600)
+	os.Remove(s.framePath(entries[1].ID))
+
+	s, err = openSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := spoolIDs(s), []string{entries[0].ID, entries[2].ID}; !slices.Equal(got, want) {
+		t.Fatalf("queue after reopening = %v, want %v", got, want)
+	}
+	if h := s.head(); h.Attempts != 1 || h.LastError != "offline" || h.NextAttempt.IsZero() || h.CaptureID != entries[0].CaptureID {
+		t.Errorf("retry state lost: %+v", h)
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 3 {
+		t.Errorf("%d files in the spool, want the manifest and 2 frames", len(files))
+	}
+	// New frames still queue behind the recovered ones.
+	e := enqueueN(t, s, 1, time.Now())[0]
+	if ids := spoolIDs(s); !slices.IsSorted(ids) || ids[len(ids)-1] != e.ID {
+		t.Errorf("queue after enqueueing = %v", ids)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, spoolManifestName), []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err = openSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.stats(); n != 0 {
+		t.Errorf("%d entries from a corrupt manifest", n)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left after discarding a corrupt manifest", len(files))
+	}
+}
+
+func TestSpoolPrune(t *testing.T) {
+	t.Run("size", func(t *testing.T) {
+		s, err := openSpool(t.TempDir(), 25, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := enqueueN(t, s, 4, time.Now())
+		if got, want := spoolIDs(s), []string{entries[2].ID, entries[3].ID}; !slices.Equal(got, want) {
+			t.Errorf("queue = %v, want the newest 2 of 10-byte frames under a 25-byte cap", got)
+		}
+		if _, err := os.Stat(s.framePath(entries[0].ID)); !os.IsNotExist(err) {
+			t.Error("pruned frame left on disk")
+		}
+	})
+	t.Run("age", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := openSpool(dir, 0, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := enqueueN(t, s, 2, time.Now().Add(-2*time.Hour))
+		if n, _ := s.stats(); n != 0 {
+			t.Errorf("%d frames older than the cap kept", n)
+		}
+		fresh := enqueueN(t, s, 1, time.Now().Add(-30*time.Minute))
+		if got := spoolIDs(s); !slices.Equal(got, []string{fresh[0].ID}) {
+			t.Errorf("queue = %v, want only the fresh frame", got)
+		}
+		if _, err := os.Stat(s.framePath(old[0].ID)); !os.IsNotExist(err) {
+			t.Error("pruned frame left on disk")
+		}
+		// The cap also applies to what a restart finds on disk.
+		s, err = openSpool(dir, 0, 20*time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := s.stats(); n != 0 {
+			t.Errorf("%d frames older than the cap kept across a restart", n)
+		}
+	})
+}
+
+func TestSpoolBackoff(t *testing.T) {
+	for attempts := 1; attempts <= 12; attempts++ {
+		base := min(spoolBackoffMin<<(attempts-1), spoolBackoffMax)
+		lo, hi := base-base/5, base+base/5
+		for i := 0; i < 50; i++ {
+			if d := spoolBackoff(attempts); d < lo || d > hi {
+				t.Fatalf("backoff after %d attempts = %v, want %v..%v", attempts, d, lo, hi)
+			}
+		}
+	}
+}
+
+func TestSpoolOrder(t *testing.T) {
+	s, err := openSpool(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	entries := enqueueN(t, s, 4, now.Add(-time.Minute))
+
+	due := s.due(3, now)
+	if len(due) != 3 || due[0].ID != entries[0].ID || due[1].ID != entries[1].ID || due[2].ID != entries[2].ID {
+		t.Fatalf("due = %v, want the oldest 3", due)
+	}
+
+	// A failing head backs off while the frames behind it go ahead.
+	s.fail(entries[0].ID, errors.New("refused"), now)
+	if e := s.next(now); e.ID != entries[1].ID {
+		t.Errorf("next = %s, want %s behind the backing-off head", e.ID, entries[1].ID)
+	}
+	if due := s.due(4, now); len(due) != 3 || due[0].ID != entries[1].ID {
+		t.Errorf("due = %v, want entries 2-4", due)
+	}
+
+	// With everything backing off, next is whichever is due soonest. One
+	// failure backs off 4-6s and two 8-12s, so entries 1 and 3 come after
+	// entry 2 and entry 0, whose second failure is dated 5s back.
+	s.fail(entries[1].ID, errors.New("offline"), now)
+	s.fail(entries[1].ID, errors.New("offline"), now)
+	at0, _ := s.fail(entries[0].ID, errors.New("refused"), now.Add(-5*time.Second))
+	at2, _ := s.fail(entries[2].ID, errors.New("offline"), now)
+	s.fail(entries[3].ID, errors.New("offline"), now)
+	s.fail(entries[3].ID, errors.New("offline"), now)
+	want := entries[0].ID
+	if at2.Before(at0) {
+		want = entries[2].ID
+	}
+	if e := s.next(now); e.ID != want {
+		t.Errorf("next = %s, want %s, the soonest due", e.ID, want)
+	}
+	if len(s.due(4, now)) != 0 {
+		t.Error("entries due while all are backing off")
+	}
+
+	// Once the backoff passes, delivery order is capture order again.
+	later := now.Add(spoolBackoffMax * 2)
+	if e := s.next(later); e.ID != entries[0].ID {
+		t.Errorf("next after the backoff = %s, want the head", e.ID)
+	}
+	s.complete(entries[0].ID)
+	if e := s.head(); e.ID != entries[1].ID {
+		t.Errorf("head after completing = %s", e.ID)
+	}
+	for _, e := range entries[1:] {
+		s.complete(e.ID)
+	}
+	if s.next(later) != nil || s.head() != nil {
+		t.Error("empty spool has a next entry")
+	}
+}
@@ -1,23 +1,43 @@
 import React, { useState, useEffect, useCallback } from 'react';
 
 // Node.js modules
-const { exec } = require('child_process');
-const fs = require('fs');
-const path = require('path');
+const { execFile } = require('child_process');
 const { ipcRenderer } = require('electron');
 
 console.log('[App.jsx Top Level] import.meta.env:', import.meta.env);
 
 const PAIRING_CODE_KEY = 'coop_pairing_code';
 const RELAY_ID_KEY = 'coop_relay_id';
+const PAIRING_SECRET_KEY = 'coop_pairing_secret';
+const DEVICE_TOKEN_KEY = 'coop_device_token';
 // Removed DEFAULT_PAIRING_CODE: now pairing code is fetched from backend
 
 // API_BASE_URL will be set from fetched env vars
-const SNAPSHOT_DIR = 'tmp';
-const SNAPSHOT_FILENAME = 'snapshot.jpg';
-const SNAPSHOT_FULL_PATH = path.join(SNAPSHOT_DIR, SNAPSHOT_FILENAME);
 const UPLOADER_COMMAND = `./coop_relay_uploader`;
 
+// Headers for relay-authenticated backend calls (config, status, snapshots).
+const relayAuthHeaders = (extra = {}) => {
+  const token = localStorage.getItem(DEVICE_TOKEN_KEY);
+  return token ? { ...extra, Authorization: `Bearer ${token}` } : extra;
+};
+
+// Once claimed, trade the one-time pairing secret for this relay's device token.
+const collectDeviceToken = async (relayId) => {
+  const pairingSecret = localStorage.getItem(PAIRING_SECRET_KEY);
+  if (!pairingSecret) return false;
+  const response = await fetch('https://coop-app-backend.fly.dev/api/relay/token', {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ relay_id: relayId, pairing_secret: pairingSecret }),
+  });
+  if (!response.ok) throw new Error(`Device token request failed: ${response.status}`);
+  const data = await response.json();
+  if (!data.device_token) return false;
+  localStorage.setItem(DEVICE_TOKEN_KEY, data.device_token);
+  localStorage.removeItem(PAIRING_SECRET_KEY);
+  return true;
+};
+
 const parseIntervalToMs = (intervalStr) => {
   if (!intervalStr || typeof intervalStr !== 'string') return 0;
   const match = intervalStr.match(/^(\d+)([msh])$/);
@@ -70,8 +90,8 @@ function App() {
       console.log('Using VITE_COOP_BACKEND_URL for API calls:', apiBaseUrl);
     }
 
-    // This IPC call is still important to ensure SUPABASE_URL and SUPABASE_SERVICE_KEY 
-    // are loaded in the main process and available for the uploader child process.
+    // This IPC call is still important to ensure COOP_BACKEND_URL
+    // is loaded in the main process and available for the uploader child process.
     // We don't need to use its return value here for apiBaseUrl anymore.
     const verifyMainProcessEnv = async () => {
       try {
@@ -95,7 +115,7 @@ function App() {
         const body = existingRelayId ? { relay_id: existingRelayId } : {};
         const response = await fetch('https://coop-app-backend.fly.dev/api/relay/request_pairing_code', {
           method: 'POST',
-          headers: { 'Content-Type': 'application/json' },
+          headers: relayAuthHeaders({ 'Content-Type': 'application/json' }),
           body: JSON.stringify(body),
         });
         if (!response.ok) throw new Error(`Pairing code request failed: ${response.status}`);
@@ -103,6 +123,8 @@ function App() {
         if (data && data.pairing_code && data.relay_id) {
           localStorage.setItem(PAIRING_CODE_KEY, data.pairing_code);
           localStorage.setItem(RELAY_ID_KEY, data.relay_id);
+          localStorage.setItem(PAIRING_SECRET_KEY, data.pairing_secret);
+          localStorage.removeItem(DEVICE_TOKEN_KEY);
           setPairingCode(data.pairing_code);
           setRelayId(data.relay_id);
           setPairingStatusMessage('Ready to pair. Enter this code in your Coop App.');
@@ -129,6 +151,7 @@ function App() {
             if (!response.ok) throw new Error(`HTTP ${response.status}`);
             const data = await response.json();
             if (data.status === 'claimed') {
+              await collectDeviceToken(storedRelayId);
               localStorage.removeItem(PAIRING_CODE_KEY);
               setPairingCode('');
               setAppState('PAIRED');
@@ -178,14 +201,17 @@ function App() {
         const data = await response.json();
         console.log("[Relay] Polled relay config:", data);
         if (data.status === 'claimed' && data.relay_id) {
+          if (!(await collectDeviceToken(data.relay_id))) {
+            setPairingStatusMessage('Claimed. Waiting for device credentials...');
+            return;
+          }
           localStorage.setItem(RELAY_ID_KEY, data.relay_id);
-          if (data.coop_id) localStorage.setItem('coop_coop_id', data.coop_id);
           setRelayId(data.relay_id);
           setAppState('PAIRED');
           setPairingStatusMessage(`Successfully paired! Relay ID: ${data.relay_id}`);
           localStorage.removeItem(PAIRING_CODE_KEY); // Clean up pairing code
           clearInterval(pairingInterval);
-          console.log(`[Relay] Transitioned to PAIRING COMPLETE. relay_id=${data.relay_id}, coop_id=${data.coop_id}`);
+          console.log(`[Relay] Transitioned to PAIRING COMPLETE. relay_id=${data.relay_id}`);
         } else if (data.status === 'pending') {
           setPairingStatusMessage(`Status: Pending. Waiting for code ${pairingCode} to be claimed...`);
           console.log('[Relay] Still waiting to be claimed...');
@@ -210,7 +236,8 @@ function App() {
     const fetchConfig = async () => {
       setPollingError(null);
       try {
-        const response = await fetch(`${apiBaseUrl}/api/relay/config?relay_id=${relayId}`);
+        const response = await fetch(`${apiBaseUrl}/api/relay/config`, { headers: relayAuthHeaders() });
+        if (response.status === 401) throw new Error('Relay credentials missing or revoked. Reset pairing to re-pair this relay.');
         if (!response.ok) throw new Error(`HTTP error! status: ${response.status}`);
         const data = await response.json();
         setConfig({ interval: data.interval || "-", rtsp_url: data.rtsp_url || null });
@@ -248,7 +275,7 @@ function App() {
     let envVars = {};
     try {
       envVars = await ipcRenderer.invoke('get-env-vars');
-      if (!envVars || !envVars.SUPABASE_URL || !envVars.SUPABASE_SERVICE_KEY || !envVars.COOP_BACKEND_URL) {
+      if (!envVars || !envVars.COOP_BACKEND_URL) {
         throw new Error('Required environment variables not received from main process.');
       }
     } catch (error) {
@@ -261,42 +288,22 @@ function App() {
       statusCallback("Error: RTSP URL is not available for capture.");
       return;
     }
-    statusCallback(`Preparing to capture from ${rtspUrlToUse}...`);
-    try {
-      if (!fs.existsSync(SNAPSHOT_DIR)) fs.mkdirSync(SNAPSHOT_DIR, { recursive: true });
-    } catch (err) {
-      statusCallback(`Error creating snapshot directory: ${err.message}`);
-      return;
-    }
+    statusCallback(`Capturing and uploading from camera...`);
 
-    const ffmpegCmd = `ffmpeg -y -rtsp_transport tcp -i "${rtspUrlToUse}" -frames:v 1 ${SNAPSHOT_FULL_PATH}`;
-    statusCallback(`Executing: ${ffmpegCmd.split(' ')[0]}...`);
-    
     try {
-      await new Promise((resolve, reject) => {
-        exec(ffmpegCmd, (err, stdout, stderr) => {
-          if (err) {
-            console.error(`ffmpeg error: ${err.message}`, `Stderr: ${stderr}`, `Stdout: ${stdout}`);
-            reject(new Error(`ffmpeg: ${err.message}. ${stderr ? 'Stderr: ' + stderr : ''}`)); return;
-          }
-          console.log(`Snapshot captured: ${SNAPSHOT_FULL_PATH}`, `Stdout: ${stdout}`);
-          resolve(stdout);
-        });
-      });
-      statusCallback(`Snapshot captured. Uploading...`);
-
-      const command = `${UPLOADER_COMMAND} --relay-id="${currentRelayId}" --image-path="${SNAPSHOT_FULL_PATH}"`;
-    console.log('[Uploader Command]', command);
+      // The uploader grabs the frame itself over RTSP. execFile passes the URL
+      // as a single argument, so nothing is interpreted by a shell.
+      const args = ['--relay-id', currentRelayId, '--rtsp-url', rtspUrlToUse];
+      console.log('[Uploader Command]', UPLOADER_COMMAND, '--relay-id', currentRelayId);
       statusCallback(`Executing: ${UPLOADER_COMMAND.split('/').pop()}...`);
       
       const uploadOutput = await new Promise((resolve, reject) => {
-        exec(command, { 
+        execFile(UPLOADER_COMMAND, args, { 
           env: {
             // Explicitly pass only necessary vars, ensure they are defined
-            SUPABASE_URL: envVars.SUPABASE_URL || '',
-            SUPABASE_SERVICE_KEY: envVars.SUPABASE_SERVICE_KEY || '',
             COOP_BACKEND_URL: envVars.COOP_BACKEND_URL || '',
-            PATH: process.env.PATH // Important for ffmpeg and uploader to be found
+            RELAY_DEVICE_TOKEN: localStorage.getItem(DEVICE_TOKEN_KEY) || '',
+            PATH: process.env.PATH
           }
         }, (err, stdout, stderr) => {
           if (err) {
@@ -389,7 +396,7 @@ function App() {
     const interval = setInterval(() => {
       fetch(`${apiBaseUrl}/api/relay/status`, {
         method: 'POST',
-        headers: { 'Content-Type': 'application/json' },
+        headers: relayAuthHeaders({ 'Content-Type': 'application/json' }),
         body: JSON.stringify({ relay_id: relayId }),
         cache: 'no-store',
       })
@@ -403,7 +410,7 @@ function App() {
     // Initial ping immediately
     fetch(`${apiBaseUrl}/api/relay/status`, {
       method: 'POST',
-      headers: { 'Content-Type': 'application/json' },
+      headers: relayAuthHeaders({ 'Content-Type': 'application/json' }),
       body: JSON.stringify({ relay_id: relayId }),
       cache: 'no-store',
     })
@@ -514,13 +521,15 @@ function App() {
       try {
         const response = await fetch('https://coop-app-backend.fly.dev/api/relay/request_pairing_code', {
           method: 'POST',
-          headers: { 'Content-Type': 'application/json' },
+          headers: relayAuthHeaders({ 'Content-Type': 'application/json' }),
           body: JSON.stringify({ relay_id: storedRelayId }),
         });
         if (!response.ok) throw new Error(`Request failed: ${response.status}`);
         const data = await response.json();
         if (data.pairing_code) {
           localStorage.setItem(PAIRING_CODE_KEY, data.pairing_code);
+          localStorage.setItem(PAIRING_SECRET_KEY, data.pairing_secret);
+          localStorage.removeItem(DEVICE_TOKEN_KEY);
           setPairingCode(data.pairing_code);
           setAppState('UNPAIRED'); // Go back to pairing screen
           setPairingStatusMessage('Ready to pair. Enter this code in your Coop App.');
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultBackendURL is used by `relay pair` when nothing else names a backend.
+const defaultBackendURL = "https://coop-app-backend.fly.dev"
+
+// relayState is this machine's relay identity. `relay pair` writes it and
+// every other command reads it, so a paired relay needs no flags or env.
+type relayState struct {
+	RelayID     string     `json:"relay_id,omitempty"`
+	BackendURL  string     `json:"backend_url,omitempty"`
+	DeviceToken string     `json:"device_token,omitempty"`
+	PairedAt    *time.Time `json:"paired_at,omitempty"`
+
+	// PairingCode and PairingSecret are only set while a pairing is in
+	// progress, so an interrupted `relay pair` resumes with the same code.
+	PairingCode   string `json:"pairing_code,omitempty"`
+	PairingSecret string `json:"pairing_secret,omitempty"`
+}
+
+// defaultStatePath is where the state file lives unless the state_file
+// setting says otherwise.
+func defaultStatePath() string {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "coop-relay", "state.json")
+}
+
+// loadState reads the state file. A missing file is an unpaired relay.
+func loadState(path string) (*relayState, error) {
+	var st relayState
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading relay state: %w", err)
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("parsing relay state %s: %w", path, err)
+	}
+	return &st, nil
+}
+
+// saveState writes the state file atomically. It holds the device token,
+// so it is only readable by the owner.
+func saveState(path string, st *relayState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("creating state directory: %w", err)
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("writing relay state: %w", err)
+	}
+	return nil
+}
+
+// relayIdentity is what a command needs to act as this relay.
+type relayIdentity struct {
+	RelayID     string
+	BackendURL  string
+	DeviceToken string
+}
+
+// loadIdentity fills in the relay identity from the state file. relay_id,
+// backend_url and device_token settings (config file, env or flags)
+// override it.
+func loadIdentity(cfg *settings) (relayIdentity, error) {
+	st, err := loadState(cfg.get("state_file"))
+	if err != nil {
+		return relayIdentity{}, err
+	}
+	id := relayIdentity{
+		RelayID:     firstNonEmpty(cfg.get("relay_id"), st.RelayID),
+		BackendURL:  firstNonEmpty(cfg.get("backend_url"), st.BackendURL),
+		DeviceToken: firstNonEmpty(cfg.get("device_token"), st.DeviceToken),
+	}
+	id.BackendURL = strings.TrimSuffix(id.BackendURL, "/")
+	switch {
+	case id.RelayID == "":
+		return id, errors.New("no relay ID: run `relay pair` or set relay_id")
+	case id.BackendURL == "" || id.DeviceToken == "":
+		return id, errors.New("no backend credentials: run `relay pair` or set backend_url and device_token (COOP_BACKEND_URL and RELAY_DEVICE_TOKEN)")
+	}
+	return id, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
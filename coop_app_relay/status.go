@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// relayStats records what the daemon has been doing, for the local status
+// endpoint. The zero value is ready to use.
+type relayStats struct {
+	mu      sync.Mutex
+	started time.Time
+	cameras map[string]*cameraStats
+
+	configPolledAt time.Time
+	configError    string
+	heartbeatAt    time.Time
+	heartbeatError string
+
+	uploads, uploadFailures int64
+	lastUpload              uploadStatus
+}
+
+// cameraStats is one camera's capture history since the daemon started.
+type cameraStats struct {
+	LastAttemptAt time.Time `json:"last_attempt_at,omitzero"`
+	LastSuccessAt time.Time `json:"last_success_at,omitzero"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastBytes     int       `json:"last_bytes,omitempty"`
+	Captures      int64     `json:"captures"`
+	Failures      int64     `json:"failures"`
+	Skipped       int64     `json:"skipped"`
+
+	// Stream stats from the last successful capture: the resolution the
+	// camera sends, before any crop, and how long grabbing a frame took.
+	Width         int   `json:"width,omitempty"`
+	Height        int   `json:"height,omitempty"`
+	CaptureMillis int64 `json:"capture_ms,omitempty"`
+}
+
+// captureResult is the outcome of one capture attempt.
+type captureResult struct {
+	At            time.Time
+	Took          time.Duration
+	Width, Height int
+	// Bytes is the encoded size of a queued frame.
+	Bytes   int
+	Skipped bool
+	Err     error
+}
+
+// reachable reports whether the camera's most recent capture worked.
+func (c *cameraStats) reachable() bool {
+	return !c.LastSuccessAt.IsZero() && c.LastError == ""
+}
+
+type uploadStatus struct {
+	At        time.Time `json:"at,omitzero"`
+	ObjectKey string    `json:"object_key,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func (s *relayStats) cameraLocked(id string) *cameraStats {
+	if s.cameras == nil {
+		s.cameras = make(map[string]*cameraStats)
+	}
+	c, ok := s.cameras[id]
+	if !ok {
+		c = &cameraStats{}
+		s.cameras[id] = c
+	}
+	return c
+}
+
+// captured records a capture attempt.
+func (s *relayStats) captured(cameraID string, r captureResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.cameraLocked(cameraID)
+	c.LastAttemptAt = r.At
+	if r.Err != nil {
+		c.Failures++
+		c.LastError = r.Err.Error()
+		return
+	}
+	c.LastSuccessAt, c.LastError = r.At, ""
+	c.Width, c.Height, c.CaptureMillis = r.Width, r.Height, r.Took.Milliseconds()
+	if r.Skipped {
+		c.Skipped++
+		return
+	}
+	c.Captures++
+	c.LastBytes = r.Bytes
+}
+
+func (s *relayStats) uploaded(objectKey string, at time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUpload = uploadStatus{At: at, ObjectKey: objectKey}
+	if err != nil {
+		s.uploadFailures++
+		s.lastUpload.Error = err.Error()
+		return
+	}
+	s.uploads++
+}
+
+func (s *relayStats) configPolled(at time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.configPolledAt, s.configError = at, errString(err)
+}
+
+func (s *relayStats) heartbeatSent(at time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heartbeatAt, s.heartbeatError = at, errString(err)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// redactURL hides the password in a camera URL; status output may end up
+// pasted into a support thread.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	return u.Redacted()
+}
+
+// cameraStatus is one camera in the status document.
+type cameraStatus struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	SourceURL string `json:"source_url"`
+	Interval  string `json:"interval"`
+	Reachable bool   `json:"reachable"`
+	cameraStats
+}
+
+// relayStatus is the JSON served at /status.
+type relayStatus struct {
+	RelayID        string         `json:"relay_id"`
+	BackendURL     string         `json:"backend_url"`
+	StartedAt      time.Time      `json:"started_at"`
+	UptimeSeconds  int64          `json:"uptime_seconds"`
+	ConfigPolledAt time.Time      `json:"config_polled_at,omitzero"`
+	ConfigError    string         `json:"config_error,omitempty"`
+	HeartbeatAt    time.Time      `json:"heartbeat_at,omitzero"`
+	HeartbeatError string         `json:"heartbeat_error,omitempty"`
+	SkippedPending int64          `json:"skipped_pending"`
+	Cameras        []cameraStatus `json:"cameras"`
+	Queue          queueStatus    `json:"queue"`
+	Uploads        int64          `json:"uploads"`
+	UploadFailures int64          `json:"upload_failures"`
+	LastUpload     *uploadStatus  `json:"last_upload,omitempty"`
+}
+
+type queueStatus struct {
+	Frames         int       `json:"frames"`
+	Bytes          int64     `json:"bytes"`
+	OldestCaptured time.Time `json:"oldest_captured_at,omitzero"`
+	HeadAttempts   int       `json:"head_attempts,omitempty"`
+	HeadLastError  string    `json:"head_last_error,omitempty"`
+}
+
+// status snapshots the daemon for /status and /metrics. Only cameras in the
+// current config are listed.
+func (d *daemon) status(now time.Time) relayStatus {
+	d.mu.Lock()
+	cams := d.config.cameraList()
+	d.mu.Unlock()
+
+	st := relayStatus{
+		RelayID:        d.relayID,
+		BackendURL:     d.backend.baseURL,
+		SkippedPending: d.skipped.Load(),
+		Cameras:        []cameraStatus{},
+	}
+	st.Queue.Frames, st.Queue.Bytes = d.spool.stats()
+	if head := d.spool.head(); head != nil {
+		st.Queue.OldestCaptured = head.CapturedAt
+		st.Queue.HeadAttempts = head.Attempts
+		st.Queue.HeadLastError = head.LastError
+	}
+
+	s := &d.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st.StartedAt = s.started
+	if !s.started.IsZero() {
+		st.UptimeSeconds = int64(now.Sub(s.started).Seconds())
+	}
+	st.ConfigPolledAt, st.ConfigError = s.configPolledAt, s.configError
+	st.HeartbeatAt, st.HeartbeatError = s.heartbeatAt, s.heartbeatError
+	st.Uploads, st.UploadFailures = s.uploads, s.uploadFailures
+	if !s.lastUpload.At.IsZero() {
+		last := s.lastUpload
+		st.LastUpload = &last
+	}
+	for _, cam := range cams {
+		c := s.cameraLocked(cam.ID)
+		st.Cameras = append(st.Cameras, cameraStatus{
+			ID:          cam.ID,
+			Name:        cam.name(),
+			SourceURL:   redactURL(cam.SourceURL),
+			Interval:    cam.interval().String(),
+			Reachable:   c.reachable(),
+			cameraStats: *c,
+		})
+	}
+	return st
+}
+
+// heartbeatReport builds the heartbeat telemetry from the current status.
+func (d *daemon) heartbeatReport(now time.Time, skipped int64) heartbeat {
+	st := d.status(now)
+	hb := heartbeat{
+		RelayID:         d.relayID,
+		SeenAt:          now.UTC().Format(time.RFC3339Nano),
+		SkippedCaptures: skipped,
+		Version:         version,
+		OS:              runtime.GOOS,
+		Arch:            runtime.GOARCH,
+		UptimeSeconds:   st.UptimeSeconds,
+		QueueFrames:     st.Queue.Frames,
+		QueueBytes:      st.Queue.Bytes,
+		Cameras:         []cameraHeartbeat{},
+	}
+	if free, ok := diskFree(d.spool.dir); ok {
+		hb.DiskFreeBytes = &free
+	}
+	var lastErrorAt time.Time
+	for _, c := range st.Cameras {
+		ch := cameraHeartbeat{
+			CameraID:      c.ID,
+			Name:          c.Name,
+			Reachable:     c.Reachable,
+			LastError:     c.LastError,
+			Captures:      c.Captures,
+			Failures:      c.Failures,
+			Skipped:       c.Skipped,
+			Width:         c.Width,
+			Height:        c.Height,
+			CaptureMillis: c.CaptureMillis,
+		}
+		if !c.LastSuccessAt.IsZero() {
+			at := c.LastSuccessAt
+			ch.LastCaptureAt = &at
+		}
+		if c.LastError != "" && c.LastAttemptAt.After(lastErrorAt) {
+			hb.LastCaptureError, lastErrorAt = fmt.Sprintf("[%s] %s", c.Name, c.LastError), c.LastAttemptAt
+		}
+		hb.Cameras = append(hb.Cameras, ch)
+	}
+	return hb
+}
+
+// serveStatus serves the local status endpoint until ctx is done:
+//
+//	GET /status   JSON summary of cameras, queue, uploads and config
+//	GET /metrics  the same in Prometheus text format
+//
+// It needs no backend, so it keeps working while the relay is offline.
+func (d *daemon) serveStatus(ctx context.Context, ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(d.status(time.Now()))
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, d.status(time.Now()))
+	})
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/status", http.StatusFound)
+	})
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	log.Printf("Serving status on http://%s/status", ln.Addr())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Status server stopped: %v", err)
+	}
+}
+
+// writeMetrics renders the status in the Prometheus text exposition format.
+func writeMetrics(w io.Writer, st relayStatus) {
+	var b strings.Builder
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	sample := func(name string, labels map[string]string, v float64) {
+		b.WriteString(name)
+		if len(labels) > 0 {
+			keys := make([]string, 0, len(labels))
+			for k := range labels {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			b.WriteByte('{')
+			for i, k := range keys {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(&b, `%s="%s"`, k, labelEscaper.Replace(labels[k]))
+			}
+			b.WriteByte('}')
+		}
+		fmt.Fprintf(&b, " %g\n", v)
+	}
+	ts := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.UnixMilli()) / 1000
+	}
+	boolValue := func(ok bool) float64 {
+		if ok {
+			return 1
+		}
+		return 0
+	}
+
+	metric("coop_relay_start_time_seconds", "gauge", "Unix time the daemon started.")
+	sample("coop_relay_start_time_seconds", nil, ts(st.StartedAt))
+
+	metric("coop_relay_camera_up", "gauge", "Whether the camera's last capture succeeded.")
+	for _, c := range st.Cameras {
+		sample("coop_relay_camera_up", cameraLabels(c, nil), boolValue(c.Reachable))
+	}
+	metric("coop_relay_captures_total", "counter", "Capture attempts by result.")
+	for _, c := range st.Cameras {
+		sample("coop_relay_captures_total", cameraLabels(c, map[string]string{"result": "queued"}), float64(c.Captures))
+		sample("coop_relay_captures_total", cameraLabels(c, map[string]string{"result": "skipped"}), float64(c.Skipped))
+		sample("coop_relay_captures_total", cameraLabels(c, map[string]string{"result": "failed"}), float64(c.Failures))
+	}
+	metric("coop_relay_last_capture_timestamp_seconds", "gauge", "Unix time of the camera's last successful capture.")
+	for _, c := range st.Cameras {
+		sample("coop_relay_last_capture_timestamp_seconds", cameraLabels(c, nil), ts(c.LastSuccessAt))
+	}
+
+	metric("coop_relay_uploads_total", "counter", "Snapshot upload attempts by result.")
+	sample("coop_relay_uploads_total", map[string]string{"result": "ok"}, float64(st.Uploads))
+	sample("coop_relay_uploads_total", map[string]string{"result": "failed"}, float64(st.UploadFailures))
+	if st.LastUpload != nil {
+		metric("coop_relay_last_upload_timestamp_seconds", "gauge", "Unix time of the last upload attempt.")
+		sample("coop_relay_last_upload_timestamp_seconds", nil, ts(st.LastUpload.At))
+	}
+
+	metric("coop_relay_queue_frames", "gauge", "Frames waiting to be uploaded.")
+	sample("coop_relay_queue_frames", nil, float64(st.Queue.Frames))
+	metric("coop_relay_queue_bytes", "gauge", "Bytes of frames waiting to be uploaded.")
+	sample("coop_relay_queue_bytes", nil, float64(st.Queue.Bytes))
+
+	metric("coop_relay_config_ok", "gauge", "Whether the last config poll succeeded.")
+	sample("coop_relay_config_ok", nil, boolValue(!st.ConfigPolledAt.IsZero() && st.ConfigError == ""))
+	metric("coop_relay_heartbeat_ok", "gauge", "Whether the last heartbeat succeeded.")
+	sample("coop_relay_heartbeat_ok", nil, boolValue(!st.HeartbeatAt.IsZero() && st.HeartbeatError == ""))
+
+	io.WriteString(w, b.String())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// cameraLabels identifies a camera in metrics. The legacy camera has no ID.
+func cameraLabels(c cameraStatus, extra map[string]string) map[string]string {
+	labels := map[string]string{"camera": c.ID, "name": c.Name}
+	if c.ID == legacyCameraID {
+		labels["camera"] = "default"
+	}
+	for k, v := range extra {
+		labels[k] = v
+	}
+	return labels
+}
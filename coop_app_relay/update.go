@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// releasePublicKey is the base64 Ed25519 key release manifests must be signed
+// with, set at build time with -ldflags "-X main.releasePublicKey=...". A
+// build without it never updates itself.
+var releasePublicKey = ""
+
+const (
+	defaultUpdateCheck = 6 * time.Hour
+
+	// updateProbation is how long a freshly installed version has to get a
+	// heartbeat through before it is rolled back.
+	updateProbation = 10 * time.Minute
+	// maxProbationBoots rolls back a new version that keeps crashing before
+	// its first heartbeat.
+	maxProbationBoots = 3
+
+	maxReleaseSize = 200 << 20
+)
+
+// releaseOffer is the response of GET /api/relay/update.
+type releaseOffer struct {
+	UpdateAvailable bool   `json:"update_available"`
+	Version         string `json:"version"`
+	Manifest        string `json:"manifest"`
+	Signature       string `json:"signature"`
+}
+
+// releaseManifest is the signed description of a release.
+type releaseManifest struct {
+	Version   string            `json:"version"`
+	Artifacts []releaseArtifact `json:"artifacts"`
+}
+
+type releaseArtifact struct {
+	OS     string `json:"os"`
+	Arch   string `json:"arch"`
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// checkUpdate asks the backend whether this relay should move to a newer
+// release.
+func (b *backendClient) checkUpdate(current string) (*releaseOffer, error) {
+	q := url.Values{"version": {current}, "os": {runtime.GOOS}, "arch": {runtime.GOARCH}}
+	var offer releaseOffer
+	if err := b.doJSON(http.MethodGet, "/api/relay/update?"+q.Encode(), nil, &offer); err != nil {
+		return nil, err
+	}
+	return &offer, nil
+}
+
+// verifyRelease checks the offer's signature with the built-in key and
+// returns the artifact for this platform. Nothing in an offer is trusted
+// before this.
+func verifyRelease(offer *releaseOffer, publicKey string) (*releaseArtifact, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("built-in release key is invalid")
+	}
+	sig, err := base64.StdEncoding.DecodeString(offer.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), []byte(offer.Manifest), sig) {
+		return nil, errors.New("release signature is invalid")
+	}
+	var m releaseManifest
+	if err := json.Unmarshal([]byte(offer.Manifest), &m); err != nil {
+		return nil, fmt.Errorf("parsing release manifest: %w", err)
+	}
+	if m.Version != offer.Version {
+		return nil, fmt.Errorf("manifest is for %s, not the offered %s", m.Version, offer.Version)
+	}
+	for _, a := range m.Artifacts {
+		if a.OS == runtime.GOOS && a.Arch == runtime.GOARCH {
+			return &a, nil
+		}
+	}
+	return nil, fmt.Errorf("release %s has no build for %s/%s", m.Version, runtime.GOOS, runtime.GOARCH)
+}
+
+// downloadRelease fetches an artifact into a new file in dir, checking its
+// size and SHA-256, and returns the file's path.
+func downloadRelease(ctx context.Context, client *http.Client, a *releaseArtifact, dir string) (string, error) {
+	if a.Size <= 0 || a.Size > maxReleaseSize {
+		return "", fmt.Errorf("release size %d is out of range", a.Size)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("downloading release: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading release: %s", resp.Status)
+	}
+
+	f, err := os.CreateTemp(dir, ".relay-update-*")
+	if err != nil {
+		return "", err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(resp.Body, a.Size+1))
+	if err != nil {
+		return "", fmt.Errorf("downloading release: %w", err)
+	}
+	if n != a.Size {
+		return "", fmt.Errorf("release is %d bytes, manifest says %d", n, a.Size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != a.SHA256 {
+		return "", fmt.Errorf("release SHA-256 is %s, manifest says %s", sum, a.SHA256)
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(f.Name(), 0o755); err != nil {
+		return "", err
+	}
+	ok = true
+	return f.Name(), nil
+}
+
+// installRelease swaps the new binary in place of exe, keeping the running
+// one as exe.old for rollback. Both renames stay in one directory, so each
+// is atomic; a running executable can be renamed on every platform.
+func installRelease(exe, newPath string) error {
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return fmt.Errorf("keeping current binary: %w", err)
+	}
+	if err := os.Rename(newPath, exe); err != nil {
+		if restoreErr := os.Rename(old, exe); restoreErr != nil {
+			return fmt.Errorf("installing release: %v (and restoring failed: %v)", err, restoreErr)
+		}
+		return fmt.Errorf("installing release: %w", err)
+	}
+	return nil
+}
+
+// rollbackRelease puts exe.old back in place of exe.
+func rollbackRelease(exe string) error {
+	return os.Rename(exe+".old", exe)
+}
+
+// updateState tracks an installed release through its probation. It lives
+// next to the binary, where countProbationBoot finds it before any flag or
+// config file is read.
+type updateState struct {
+	// PendingVersion is on probation until it sends a heartbeat.
+	PendingVersion  string    `json:"pending_version,omitempty"`
+	PreviousVersion string    `json:"previous_version,omitempty"`
+	InstalledAt     time.Time `json:"installed_at,omitzero"`
+	Boots           int       `json:"boots,omitempty"`
+	// BadVersions were rolled back and are never installed again.
+	BadVersions []string `json:"bad_versions,omitempty"`
+}
+
+// relayExecutable is the path of the running binary, symlinks resolved.
+func relayExecutable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// updateStatePath is where the update state of the binary exe is kept.
+func updateStatePath(exe string) string {
+	return exe + ".update.json"
+}
+
+func loadUpdateState(path string) (*updateState, error) {
+	var st updateState
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &st, nil
+}
+
+func saveUpdateState(path string, st *updateState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// newerVersion reports whether a is a later "1.4.0"-style version than b. A
+// pre-release sorts before its release; anything unparseable is never newer.
+func newerVersion(a, b string) bool {
+	pa, prea, ok1 := parseVersion(a)
+	pb, preb, ok2 := parseVersion(b)
+	if !ok1 || !ok2 {
+		return false
+	}
+	if c := slices.Compare(pa, pb); c != 0 {
+		return c > 0
+	}
+	if prea == "" || preb == "" {
+		return prea == "" && preb != ""
+	}
+	return prea > preb
+}
+
+func parseVersion(v string) ([]int, string, bool) {
+	core, pre, _ := strings.Cut(strings.TrimPrefix(v, "v"), "-")
+	fields := strings.Split(core, ".")
+	if len(fields) != 3 {
+		return nil, "", false
+	}
+	parts := make([]int, 3)
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return nil, "", false
+		}
+		parts[i] = n
+	}
+	return parts, pre, true
+}
+
+// countProbationBoot counts a start of a release on probation, rolling it
+// back once it has restarted maxProbationBoots times without a heartbeat.
+// The daemon calls it before anything else, so a release that fails even
+// on its own flags or config file is rolled back too. It reports whether
+// it rolled back, in which case the daemon should exit for its supervisor
+// to start the previous binary.
+func countProbationBoot(exe string) bool {
+	path := updateStatePath(exe)
+	st, err := loadUpdateState(path)
+	if err != nil {
+		log.Printf("Reading update state: %v", err)
+		return false
+	}
+	if st.PendingVersion == "" {
+		return false
+	}
+	if st.PendingVersion != version {
+		// The swap didn't take or someone put another binary in place.
+		log.Printf("Expected to be running %s after an update, found %s", st.PendingVersion, version)
+		st.PendingVersion, st.Boots = "", 0
+		saveUpdateStateLogged(path, st)
+		return false
+	}
+	st.Boots++
+	saveUpdateStateLogged(path, st)
+	if st.Boots <= maxProbationBoots {
+		return false
+	}
+	return rollbackUpdate(exe, path, st, fmt.Sprintf("restarted %d times without a heartbeat", st.Boots-1))
+}
+
+// rollbackUpdate puts the previous binary back and marks the pending
+// version bad. It reports whether the previous binary is in place.
+func rollbackUpdate(exe, path string, st *updateState, reason string) bool {
+	log.Printf("Rolling back %s to %s: %s", st.PendingVersion, st.PreviousVersion, reason)
+	if err := rollbackRelease(exe); err != nil {
+		// Without the old binary there is nothing to go back to; stay up.
+		log.Printf("Rollback failed, staying on %s: %v", version, err)
+		st.PendingVersion, st.Boots = "", 0
+		saveUpdateStateLogged(path, st)
+		return false
+	}
+	st.BadVersions = append(st.BadVersions, st.PendingVersion)
+	st.PendingVersion, st.Boots = "", 0
+	saveUpdateStateLogged(path, st)
+	return true
+}
+
+// updateLoop first sees a just-installed release through probation, then
+// checks for new releases every d.updateCheck. Installing one restarts the
+// daemon, which relies on a supervisor to start the new binary.
+func (d *daemon) updateLoop(ctx context.Context) {
+	exe, err := relayExecutable()
+	if err != nil {
+		log.Printf("Self-update disabled: can't locate the relay binary: %v", err)
+		return
+	}
+
+	if !d.probation(ctx, exe) {
+		return
+	}
+
+	switch {
+	case d.updateCheck <= 0:
+		return
+	case releasePublicKey == "":
+		log.Println("Self-update disabled: this build has no release key")
+		return
+	case version == "dev":
+		log.Println("Self-update disabled for development builds")
+		return
+	}
+	for {
+		// Stagger checks so a fleet doesn't download a release at once.
+		jitter := time.Duration(rand.Int63n(int64(d.updateCheck)/4 + 1))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.updateCheck/4 + jitter):
+		}
+		if installed := d.checkAndInstall(ctx, exe); installed {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.updateCheck - d.updateCheck/4 - jitter):
+		}
+	}
+}
+
+// probation confirms or rolls back a release installed by the previous run;
+// countProbationBoot has already counted this start. It returns false if
+// the daemon is restarting.
+func (d *daemon) probation(ctx context.Context, exe string) bool {
+	st, err := loadUpdateState(d.updateStatePath)
+	if err != nil {
+		log.Printf("Reading update state: %v", err)
+		return true
+	}
+	if st.PendingVersion != version {
+		return true
+	}
+	log.Printf("Running %s on probation, waiting for a heartbeat (previous %s)", version, st.PreviousVersion)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-d.heartbeatOK:
+		log.Printf("Update to %s confirmed", version)
+		st.PendingVersion, st.Boots = "", 0
+		d.saveUpdateState(st)
+		os.Remove(exe + ".old")
+		return true
+	case <-time.After(updateProbation):
+		d.rollback(exe, st, fmt.Sprintf("no heartbeat within %s", updateProbation))
+		return false
+	}
+}
+
+func (d *daemon) rollback(exe string, st *updateState, reason string) {
+	if !rollbackUpdate(exe, d.updateStatePath, st, reason) {
+		return
+	}
+	d.restartRequested.Store(true)
+	d.stop()
+}
+
+// checkAndInstall installs an offered release and restarts. It reports
+// whether it did.
+func (d *daemon) checkAndInstall(ctx context.Context, exe string) bool {
+	offer, err := d.backend.checkUpdate(version)
+	if err != nil {
+		log.Printf("Update check failed: %v", err)
+		return false
+	}
+	if !offer.UpdateAvailable || !newerVersion(offer.Version, version) {
+		return false
+	}
+	st, err := loadUpdateState(d.updateStatePath)
+	if err != nil {
+		log.Printf("Reading update state: %v", err)
+		return false
+	}
+	if slices.Contains(st.BadVersions, offer.Version) {
+		return false
+	}
+	artifact, err := verifyRelease(offer, releasePublicKey)
+	if err != nil {
+		log.Printf("Rejecting release %s: %v", offer.Version, err)
+		return false
+	}
+
+	log.Printf("Downloading relay %s", offer.Version)
+	dlCtx, cancel := context.WithTimeout(ctx, 15*time.Minute)
+	defer cancel()
+	// No client timeout: a slow link may need minutes; dlCtx bounds it.
+	newPath, err := downloadRelease(dlCtx, &http.Client{}, artifact, filepath.Dir(exe))
+	if err != nil {
+		log.Printf("Update to %s failed: %v", offer.Version, err)
+		return false
+	}
+	// Record the probation before swapping, so a crash right after the
+	// swap still rolls back.
+	st.PendingVersion, st.PreviousVersion, st.InstalledAt, st.Boots = offer.Version, version, time.Now().UTC(), 0
+	if err := saveUpdateState(d.updateStatePath, st); err != nil {
+		os.Remove(newPath)
+		log.Printf("Update to %s failed: saving update state: %v", offer.Version, err)
+		return false
+	}
+	if err := installRelease(exe, newPath); err != nil {
+		os.Remove(newPath)
+		st.PendingVersion = ""
+		d.saveUpdateState(st)
+		log.Printf("Update to %s failed: %v", offer.Version, err)
+		return false
+	}
+	log.Printf("Installed relay %s, restarting", offer.Version)
+	d.restartRequested.Store(true)
+	d.stop()
+	return true
+}
+
+func (d *daemon) saveUpdateState(st *updateState) {
+	saveUpdateStateLogged(d.updateStatePath, st)
+}
+
+func saveUpdateStateLogged(path string, st *updateState) {
+	if err := saveUpdateState(path, st); err != nil {
+		log.Printf("Saving update state: %v", err)
+	}
+}
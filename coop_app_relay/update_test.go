@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// signedOffer signs a manifest for version with artifacts and returns the
+// offer and the base64 public key to check it with.
+func signedOffer(t *testing.T, version string, artifacts ...releaseArtifact) (*releaseOffer, string, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := json.Marshal(releaseManifest{Version: version, Artifacts: artifacts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &releaseOffer{
+		UpdateAvailable: true,
+		Version:         version,
+		Manifest:        string(manifest),
+		Signature:       base64.StdEncoding.EncodeToString(ed25519.Sign(priv, manifest)),
+	}, base64.StdEncoding.EncodeToString(pub), priv
+}
+
+func TestVerifyRelease(t *testing.T) {
+	here := releaseArtifact{OS: runtime.GOOS, Arch: runtime.GOARCH, URL: "https://example.com/relay", SHA256: strings.Repeat("ab", 32), Size: 10}
+	other := releaseArtifact{OS: runtime.GOOS, Arch: "other-arch", URL: "https://example.com/relay-other", Size: 10}
+
+	offer, key, priv := signedOffer(t, "1.2.0", other, here)
+	a, err := verifyRelease(offer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *a != here {
+		t.Errorf("artifact = %+v, want this platform's", a)
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(o *releaseOffer, key *string)
+	}{
+		{"manifest changed after signing", func(o *releaseOffer, _ *string) {
+			o.Manifest = strings.Replace(o.Manifest, "example.com", "evil.example", 1)
+		}},
+		{"signed with another key", func(o *releaseOffer, key *string) {
+			_, *key, _ = signedOffer(t, "1.2.0", here)
+		}},
+		{"garbled signature", func(o *releaseOffer, _ *string) { o.Signature = "not base64!" }},
+		{"no signature", func(o *releaseOffer, _ *string) { o.Signature = "" }},
+		{"offer claims another version", func(o *releaseOffer, _ *string) { o.Version = "9.9.9" }},
+		{"no built-in key", func(_ *releaseOffer, key *string) { *key = "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, k := *offer, key
+			tt.mutate(&o, &k)
+			if a, err := verifyRelease(&o, k); err == nil {
+				t.Errorf("verified %+v", a)
+			}
+		})
+	}
+
+	t.Run("no build for this platform", func(t *testing.T) {
+		o, k, _ := signedOffer(t, "1.2.0", other)
+		if a, err := verifyRelease(o, k); err == nil {
+			t.Errorf("verified %+v", a)
+		}
+	})
+	t.Run("manifest is not JSON", func(t *testing.T) {
+		o := *offer
+		o.Manifest = "1.2.0"
+		o.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(o.Manifest)))
+		if a, err := verifyRelease(&o, key); err == nil {
+			t.Errorf("verified %+v", a)
+		}
+	})
+}
+
+func TestDownloadRelease(t *testing.T) {
+	body := []byte("new relay binary")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer srv.Close()
+	sum := sha256.Sum256(body)
+	good := releaseArtifact{URL: srv.URL, SHA256: hex.EncodeToString(sum[:]), Size: int64(len(body))}
+
+	dir := t.TempDir()
+	path, err := downloadRelease(context.Background(), srv.Client(), &good, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != string(body) {
+		t.Errorf("downloaded %q", got)
+	}
+	os.Remove(path)
+
+	bad := map[string]releaseArtifact{
+		"SHA-256 mismatch": {URL: srv.URL, SHA256: strings.Repeat("00", 32), Size: good.Size},
+		"short":            {URL: srv.URL, SHA256: good.SHA256, Size: good.Size + 1},
+		"long":             {URL: srv.URL, SHA256: good.SHA256, Size: good.Size - 1},
+		"no size":          {URL: srv.URL, SHA256: good.SHA256},
+		"too large":        {URL: srv.URL, SHA256: good.SHA256, Size: maxReleaseSize + 1},
+	}
+	for name, a := range bad {
+		if _, err := downloadRelease(context.Background(), srv.Client(), &a, dir); err == nil {
+			t.Errorf("%s: downloaded", name)
+		}
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("failed downloads left %d files behind", len(files))
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"1.4.0", "1.3.9", true},
+		{"1.3.9", "1.4.0", false},
+		{"1.10.0", "1.9.0", true},
+		{"2.0.0", "1.99.99", true},
+		{"1.4.0", "1.4.0", false},
+		{"v1.4.1", "1.4.0", true},
+		{"1.4.0", "1.4.0-rc.1", true},
+		{"1.4.0-rc.1", "1.4.0", false},
+		{"1.4.0-rc.2", "1.4.0-rc.1", true},
+		{"1.4.0-rc.1", "1.3.0", true},
+		{"1.4", "1.3.0", false},
+		{"1.4.0.1", "1.3.0", false},
+		{"1.x.0", "1.3.0", false},
+		{"1.4.0", "dev", false},
+		{"-1.0.0", "0.0.1", false},
+		{"", "1.0.0", false},
+	}
+	for _, tt := range tests {
+		if got := newerVersion(tt.a, tt.b); got != tt.want {
+			t.Errorf("newerVersion(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCountProbationBoot(t *testing.T) {
+	defer func(v string) { version = v }(version)
+	version = "1.4.0"
+
+	exe := filepath.Join(t.TempDir(), "relay")
+	os.WriteFile(exe, []byte("new"), 0o755)
+	os.WriteFile(exe+".old", []byte("old"), 0o755)
+	path := updateStatePath(exe)
+	if err := saveUpdateState(path, &updateState{PendingVersion: "1.4.0", PreviousVersion: "1.3.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for boot := 1; boot <= maxProbationBoots; boot++ {
+		if countProbationBoot(exe) {
+			t.Fatalf("rolled back on boot %d", boot)
+		}
+		st, _ := loadUpdateState(path)
+		if st.Boots != boot || st.PendingVersion != "1.4.0" {
+			t.Fatalf("state after boot %d = %+v", boot, st)
+		}
+	}
+	if !countProbationBoot(exe) {
+		t.Fatal("no rollback after restarting without a heartbeat")
+	}
+	if got, _ := os.ReadFile(exe); string(got) != "old" {
+		t.Errorf("binary after the rollback is %q, want the old one", got)
+	}
+	st, _ := loadUpdateState(path)
+	if st.PendingVersion != "" || st.Boots != 0 || !slices.Equal(st.BadVersions, []string{"1.4.0"}) {
+		t.Errorf("state after the rollback = %+v", st)
+	}
+	// The previous binary starts normally.
+	version = "1.3.0"
+	if countProbationBoot(exe) {
+		t.Error("rolled back again")
+	}
+}
+
+func TestCountProbationBootOtherBinary(t *testing.T) {
+	defer func(v string) { version = v }(version)
+	version = "1.3.0"
+
+	exe := filepath.Join(t.TempDir(), "relay")
+	path := updateStatePath(exe)
+	saveUpdateState(path, &updateState{PendingVersion: "1.4.0", Boots: maxProbationBoots})
+	if countProbationBoot(exe) {
+		t.Error("rolled back a binary that isn't the pending release")
+	}
+	if st, _ := loadUpdateState(path); st.PendingVersion != "" || st.Boots != 0 {
+		t.Errorf("state = %+v, want the probation cleared", st)
+	}
+}
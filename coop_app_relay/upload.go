@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// snapshotObjectKey builds the storage object key for a snapshot captured at
+// t. Cameras other than the legacy one get their own folder.
+func snapshotObjectKey(relayID, cameraID string, t time.Time) string {
+	timestamp := t.UTC().Format("2006-01-02-15-04-05")
+	if cameraID != legacyCameraID {
+		return fmt.Sprintf("%s/%s/%s.jpg", relayID, cameraID, timestamp)
+	}
+	return fmt.Sprintf("%s/%s.jpg", relayID, timestamp)
+}
+
+// uploadTarget is where the backend told the relay to put a snapshot.
+type uploadTarget struct {
+	ObjectKey string `json:"object_key"`
+	UploadURL string `json:"upload_url"`
+}
+
+// requestUploadURL asks the backend for a signed storage URL for a frame
+// captured at capturedAt. The backend picks the object key.
+func requestUploadURL(client *http.Client, coopBackendURL, deviceToken, cameraID string, capturedAt time.Time) (*uploadTarget, error) {
+	payload := map[string]interface{}{"captured_at": capturedAt.UTC()}
+	if cameraID != legacyCameraID {
+		payload["camera_id"] = cameraID
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling upload URL request: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(coopBackendURL, "/")+"/api/snapshots/upload-url", bytes.NewReader(payloadBytes))
+	if err != nil {
+		return nil, fmt.Errorf("creating upload URL request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setRelayAuth(req, deviceToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting upload URL: %w", err)
+	}
+	defer resp.Body.Close()
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	if refusedStatus(resp.StatusCode) {
+		return nil, fmt.Errorf("%w: requesting upload URL. Status: %s, Body: %s", errSnapshotRefused, resp.Status, string(bodyBytes))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("requesting upload URL. Status: %s, Body: %s", resp.Status, string(bodyBytes))
+	}
+	var target uploadTarget
+	if err := json.Unmarshal(bodyBytes, &target); err != nil {
+		return nil, fmt.Errorf("decoding upload URL response: %w", err)
+	}
+	if target.ObjectKey == "" || target.UploadURL == "" {
+		return nil, fmt.Errorf("upload URL response is incomplete: %s", string(bodyBytes))
+	}
+	return &target, nil
+}
+
+// uploadToSignedURL PUTs the JPEG bytes to a signed storage URL. The URL
+// carries its own authorisation, so no storage key is needed.
+func uploadToSignedURL(client *http.Client, uploadURL string, imageBytes []byte) error {
+	req, err := http.NewRequest(http.MethodPut, uploadURL, bytes.NewReader(imageBytes))
+	if err != nil {
+		return fmt.Errorf("creating storage upload request: %w", err)
+	}
+	req.Header.Set("Content-Type", "image/jpeg")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("executing storage upload request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("uploading to storage. Status: %s, Body: %s", resp.Status, string(bodyBytes))
+	}
+	return nil
+}
+
+// snapshotPayload is the registration of an uploaded frame, as POST
+// /api/snapshots and POST /api/snapshots/batch take it.
+func snapshotPayload(e *spoolEntry, objectKey string) map[string]interface{} {
+	payload := map[string]interface{}{
+		"relay_id":       e.RelayID,
+		"image_filename": objectKey, // Send the full object key
+		"capture_id":     e.CaptureID,
+		"size":           e.Size,
+		"captured_at":    e.CapturedAt.UTC(),
+	}
+	if e.CameraID != legacyCameraID {
+		payload["camera_id"] = e.CameraID
+	}
+	if e.SHA256 != "" {
+		payload["sha256"] = e.SHA256
+	}
+	if e.Quality != nil {
+		payload["quality"] = e.Quality
+	}
+	if e.MaskVersion != "" {
+		payload["privacy_mask_version"] = e.MaskVersion
+	}
+	return payload
+}
+
+// errSnapshotRejected means the backend found the stored object unusable,
+// e.g. missing or not matching the frame's checksum, so it must be uploaded
+// again.
+var errSnapshotRejected = errors.New("backend rejected the uploaded object")
+
+// errSnapshotRefused means the backend refused the frame itself, e.g. a
+// payload it won't accept or a camera that no longer exists. Retrying can't
+// change that, so the frame is dropped.
+var errSnapshotRefused = errors.New("backend refused the snapshot")
+
+// refusedStatus reports whether a 4xx response is about the request itself
+// rather than the relay's credentials or the backend's load.
+func refusedStatus(code int) bool {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return code >= 400 && code < 500
+}
+
+// notifyBackend registers an uploaded object with POST /api/snapshots and returns the raw response body.
+// A 409 means the backend already has this frame, which counts as delivered
+// but is reported as a duplicate: the backend has discarded objectKey.
+func notifyBackend(client *http.Client, coopBackendURL, deviceToken string, e *spoolEntry, objectKey string) (body []byte, duplicate bool, err error) {
+	payloadBytes, err := json.Marshal(snapshotPayload(e, objectKey))
+	if err != nil {
+		return nil, false, fmt.Errorf("marshalling notification payload: %w", err)
+	}
+
+	backendNotifyURL := fmt.Sprintf("%s/api/snapshots", strings.TrimSuffix(coopBackendURL, "/"))
+	notifyReq, err := http.NewRequest(http.MethodPost, backendNotifyURL, bytes.NewReader(payloadBytes))
+	if err != nil {
+		return nil, false, fmt.Errorf("creating backend notification request: %w", err)
+	}
+	notifyReq.Header.Set("Content-Type", "application/json")
+	setRelayAuth(notifyReq, deviceToken)
+
+	notifyResp, err := client.Do(notifyReq)
+	if err != nil {
+		return nil, false, fmt.Errorf("executing backend notification request: %w", err)
+	}
+	defer notifyResp.Body.Close()
+
+	notifyBodyBytes, _ := io.ReadAll(notifyResp.Body)
+	switch notifyResp.StatusCode {
+	case http.StatusConflict:
+		log.Printf("Backend already has %s: %s", objectKey, strings.TrimSpace(string(notifyBodyBytes)))
+		return notifyBodyBytes, true, nil
+	case http.StatusUnprocessableEntity:
+		return nil, false, fmt.Errorf("%w: %s", errSnapshotRejected, strings.TrimSpace(string(notifyBodyBytes)))
+	}
+	if refusedStatus(notifyResp.StatusCode) {
+		return nil, false, fmt.Errorf("%w: notifying backend. Status: %s, Body: %s", errSnapshotRefused, notifyResp.Status, string(notifyBodyBytes))
+	}
+	if notifyResp.StatusCode < 200 || notifyResp.StatusCode >= 300 {
+		return nil, false, fmt.Errorf("notifying backend. Status: %s, Body: %s", notifyResp.Status, string(notifyBodyBytes))
+	}
+	return notifyBodyBytes, false, nil
+}
+
+// deliverSpooled uploads a queued frame and registers it with the backend,
+// recording progress in the spool so a retry resumes where it failed. It
+// returns the object key the backend assigned and the notify response body,
+// and whether the backend already had the frame.
+func deliverSpooled(sp *spool, e *spoolEntry, client *http.Client, coopBackendURL, deviceToken string) (objectKey string, body []byte, duplicate bool, err error) {
+	if err := uploadSpooled(sp, e, client, coopBackendURL, deviceToken); err != nil {
+		return "", nil, false, err
+	}
+	objectKey = e.ObjectKey
+	body, duplicate, err = notifyBackend(client, coopBackendURL, deviceToken, e, objectKey)
+	if errors.Is(err, errSnapshotRejected) {
+		if resetErr := sp.resetUpload(e.ID); resetErr != nil {
+			log.Printf("Recording rejection of %s: %v", objectKey, resetErr)
+		}
+	}
+	if err != nil {
+		return "", nil, false, err
+	}
+	if err := sp.complete(e.ID); err != nil {
+		log.Printf("Removing %s from spool: %v", objectKey, err)
+	}
+	return objectKey, body, duplicate, nil
+}
+
+// uploadSpooled puts a queued frame in storage unless that already happened,
+// recording it in the spool and in e, whose ObjectKey is then the key the
+// backend assigned.
+func uploadSpooled(sp *spool, e *spoolEntry, client *http.Client, coopBackendURL, deviceToken string) error {
+	if e.Uploaded {
+		return nil
+	}
+	imageBytes, err := sp.readFrame(e)
+	if err != nil {
+		return fmt.Errorf("reading spooled frame: %w", err)
+	}
+	if e.SHA256 != "" && sha256Hex(imageBytes) != e.SHA256 {
+		// Retrying can't fix a frame damaged on disk.
+		if err := sp.complete(e.ID); err != nil {
+			log.Printf("Removing %s from spool: %v", e.ID, err)
+		}
+		return fmt.Errorf("spooled frame %s is corrupt and was dropped", e.ID)
+	}
+	// Signed URLs are short-lived, so each attempt asks for a fresh one.
+	target, err := requestUploadURL(client, coopBackendURL, deviceToken, e.CameraID, e.CapturedAt)
+	if err != nil {
+		return err
+	}
+	if err := uploadToSignedURL(client, target.UploadURL, imageBytes); err != nil {
+		return err
+	}
+	e.Uploaded, e.ObjectKey = true, target.ObjectKey
+	if err := sp.markUploaded(e.ID, e.ObjectKey); err != nil {
+		log.Printf("Recording upload of %s: %v", e.ObjectKey, err)
+	}
+	return nil
+}
+
+// batchResult is the backend's verdict on one frame of a batch: created or
+// duplicate (delivered), rejected (upload it again), invalid (dropped) or
+// failed (retried).
+type batchResult struct {
+	Index      int    `json:"index"`
+	Status     string `json:"status"`
+	SnapshotID string `json:"snapshot_id"`
+	Error      string `json:"error"`
+}
+
+// errBatchUnsupported means the backend predates POST /api/snapshots/batch.
+var errBatchUnsupported = errors.New("backend has no batch snapshot endpoint")
+
+// registerSnapshots registers uploaded frames with one POST
+// /api/snapshots/batch and returns a result per entry, in order.
+func registerSnapshots(client *http.Client, coopBackendURL, deviceToken string, entries []*spoolEntry) ([]batchResult, error) {
+	items := make([]map[string]interface{}, len(entries))
+	for i, e := range entries {
+		items[i] = snapshotPayload(e, e.ObjectKey)
+	}
+	payloadBytes, err := json.Marshal(map[string]interface{}{"snapshots": items})
+	if err != nil {
+		return nil, fmt.Errorf("marshalling batch payload: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(coopBackendURL, "/")+"/api/snapshots/batch", bytes.NewReader(payloadBytes))
+	if err != nil {
+		return nil, fmt.Errorf("creating batch request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setRelayAuth(req, deviceToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("executing batch request: %w", err)
+	}
+	defer resp.Body.Close()
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return nil, errBatchUnsupported
+	}
+	if refusedStatus(resp.StatusCode) {
+		return nil, fmt.Errorf("%w: registering batch. Status: %s, Body: %s", errSnapshotRefused, resp.Status, string(bodyBytes))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("registering batch. Status: %s, Body: %s", resp.Status, string(bodyBytes))
+	}
+	var out struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.Unmarshal(bodyBytes, &out); err != nil {
+		return nil, fmt.Errorf("decoding batch response: %w", err)
+	}
+	if len(out.Results) != len(entries) {
+		return nil, fmt.Errorf("batch response has %d results for %d snapshots", len(out.Results), len(entries))
+	}
+	results := make([]batchResult, len(entries))
+	for _, r := range out.Results {
+		if r.Index < 0 || r.Index >= len(entries) {
+			return nil, fmt.Errorf("batch response has result for snapshot %d of %d", r.Index, len(entries))
+		}
+		results[r.Index] = r
+	}
+	return results, nil
+}
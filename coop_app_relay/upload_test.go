@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testJPEG(t *testing.T, v uint8) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 40, 30))
+	for i := range img.Pix {
+		img.Pix[i] = v
+	}
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// stubSnapshotBackend answers the relay's snapshot endpoints. Batch
+// registrations get the statuses in results, in order, or a 404 while
+// batchGone is set; single registrations get singleStatus.
+type stubSnapshotBackend struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	results      []string
+	batchGone    bool
+	singleStatus int
+	batches      int
+	singles      int
+	detections   []string
+	// captureIDs are the capture IDs of single registrations, in order.
+	captureIDs []string
+}
+
+func newStubSnapshotBackend(t *testing.T) *stubSnapshotBackend {
+	b := &stubSnapshotBackend{singleStatus: http.StatusCreated}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serve))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *stubSnapshotBackend) serve(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case r.URL.Path == "/api/snapshots/upload-url":
+		var p map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&p)
+		key := "relay/" + p["captured_at"].(string) + ".jpg"
+		json.NewEncoder(w).Encode(map[string]string{"object_key": key, "upload_url": b.URL + "/put/" + key})
+	case strings.HasPrefix(r.URL.Path, "/put/"):
+		io.Copy(io.Discard, r.Body)
+	case r.URL.Path == "/api/snapshots/batch":
+		b.batches++
+		if b.batchGone {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var body struct {
+			Snapshots []json.RawMessage `json:"snapshots"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		results := make([]map[string]interface{}, len(body.Snapshots))
+		for i := range body.Snapshots {
+			results[i] = map[string]interface{}{"index": i, "status": b.results[i]}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	case r.URL.Path == "/api/snapshots":
+		b.singles++
+		var p map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&p)
+		id, _ := p["capture_id"].(string)
+		b.captureIDs = append(b.captureIDs, id)
+		w.WriteHeader(b.singleStatus)
+		io.WriteString(w, `{}`)
+	case r.URL.Path == "/api/internal/snapshot-created":
+		var p map[string]string
+		json.NewDecoder(r.Body).Decode(&p)
+		b.detections = append(b.detections, p["image_path"])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestDaemon(t *testing.T, backend *stubSnapshotBackend, frames int) *daemon {
+	t.Helper()
+	sp, err := openSpool(t.TempDir(), 1<<30, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Now().Add(-10 * time.Minute)
+	for i := 0; i < frames; i++ {
+		if _, err := sp.enqueue("relay", legacyCameraID, "", base.Add(time.Duration(i)*time.Second), testJPEG(t, uint8(i*40)), nil, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := backend.Client()
+	return &daemon{spool: sp, backend: &backendClient{baseURL: backend.URL, http: client, token: "t"}, uploadClient: client}
+}
+
+func TestDeliverDuplicateSkipsDetection(t *testing.T) {
+	backend := newStubSnapshotBackend(t)
+	backend.singleStatus = http.StatusConflict
+	d := newTestDaemon(t, backend, 1)
+
+	d.deliver(d.spool.head())
+	if n, _ := d.spool.stats(); n != 0 {
+		t.Errorf("%d frames still queued after a 409", n)
+	}
+	if len(backend.detections) != 0 {
+		t.Errorf("detection requested for discarded objects %v", backend.detections)
+	}
+}
+
+func TestDeliverKeepsCaptureID(t *testing.T) {
+	backend := newStubSnapshotBackend(t)
+	backend.singleStatus = http.StatusServiceUnavailable
+	d := newTestDaemon(t, backend, 0)
+	// Identical frames, as a camera in the dark captures them.
+	for i := 0; i < 2; i++ {
+		if _, err := d.spool.enqueue("relay", legacyCameraID, "", time.Now().Add(time.Duration(i-10)*time.Second), testJPEG(t, 0), nil, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d.deliver(d.spool.head())
+	backend.singleStatus = http.StatusCreated
+	d.deliver(d.spool.head())
+	d.deliver(d.spool.head())
+	if n, _ := d.spool.stats(); n != 0 {
+		t.Fatalf("%d frames still queued", n)
+	}
+	ids := backend.captureIDs
+	if len(ids) != 3 || ids[0] == "" || ids[1] != ids[0] || ids[2] == ids[0] {
+		t.Errorf("capture IDs sent = %q, want the retry to repeat the first and the identical frame to get its own", ids)
+	}
+}
+
+func TestDeliverBatchDuplicates(t *testing.T) {
+	backend := newStubSnapshotBackend(t)
+	backend.results = []string{"created", "duplicate", "created"}
+	d := newTestDaemon(t, backend, 3)
+
+	d.deliverBatch(d.spool.due(snapshotBatchSize, time.Now()))
+	if n, _ := d.spool.stats(); n != 0 {
+		t.Errorf("%d frames still queued", n)
+	}
+	if len(backend.detections) != 2 {
+		t.Errorf("detection requested for %v, want the 2 created frames", backend.detections)
+	}
+}
+
+func TestDeliverBatchInvalid(t *testing.T) {
+	backend := newStubSnapshotBackend(t)
+	backend.results = []string{"invalid", "failed", "created"}
+	d := newTestDaemon(t, backend, 3)
+	entries := d.spool.due(snapshotBatchSize, time.Now())
+
+	d.deliverBatch(entries)
+	// The invalid frame is dropped; only the failed one waits for a retry.
+	if got := d.spool.head(); got == nil || got.ID != entries[1].ID {
+		t.Fatalf("head = %+v, want the failed frame", got)
+	}
+	if n, _ := d.spool.stats(); n != 1 {
+		t.Errorf("%d frames still queued, want 1", n)
+	}
+}
+
+func TestDeliverBatchRetriesEndpoint(t *testing.T) {
+	backend := newStubSnapshotBackend(t)
+	backend.batchGone = true
+	d := newTestDaemon(t, backend, 2)
+
+	d.deliverBatch(d.spool.due(snapshotBatchSize, time.Now()))
+	if backend.singles != 2 {
+		t.Fatalf("%d single registrations after a 404 from the batch endpoint, want 2", backend.singles)
+	}
+	if !time.Now().Before(d.batchRetryAt) {
+		t.Fatal("batching not paused after a 404")
+	}
+	if d.batchRetryAt.After(time.Now().Add(batchRetryInterval)) {
+		t.Errorf("batching paused until %v", d.batchRetryAt)
+	}
+}
+
+func TestDeliverRefusedDropsFrame(t *testing.T) {
+	backend := newStubSnapshotBackend(t)
+	backend.singleStatus = http.StatusServiceUnavailable
+	d := newTestDaemon(t, backend, 2)
+
+	// A 5xx is retried later; the frame keeps its place.
+	head := d.spool.head()
+	d.deliver(head)
+	if n, _ := d.spool.stats(); n != 2 {
+		t.Fatalf("%d frames queued after a 503, want 2", n)
+	}
+	if e := d.spool.next(time.Now()); e == nil || e.ID == head.ID {
+		t.Fatalf("next = %+v, want the frame behind the failing head", e)
+	}
+
+	// A 400 can't be fixed by retrying, so the frame is dropped.
+	backend.mu.Lock()
+	backend.singleStatus = http.StatusBadRequest
+	backend.mu.Unlock()
+	d.deliver(d.spool.next(time.Now()))
+	if got := d.spool.head(); got == nil || got.ID != head.ID {
+		t.Fatalf("head = %+v, want only the frame that got the 503", got)
+	}
+	if n, _ := d.spool.stats(); n != 1 {
+		t.Errorf("%d frames queued, want 1", n)
+	}
+}